@@ -1,19 +1,13 @@
 package model
 
 import (
-	"context"
 	"encoding/hex"
 	"time"
 
-	"github.com/Logiase/MiraiGo-Template/utils"
 	"github.com/Mrs4s/MiraiGo/message"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-var logger = utils.GetModuleLogger("mongo.model")
-
 type ObjectID struct {
 	ObjectID primitive.ObjectID `bson:"_id"`
 }
@@ -27,6 +21,17 @@ func (o ObjectID) ShortHexID() string {
 	return hex.EncodeToString(o.ObjectID[len(o.ObjectID)-3 : len(o.ObjectID)])
 }
 
+// RollStatus is the state of a roll event
+type RollStatus string
+
+const (
+	RollNew        RollStatus = "new"        // written by the web site, waiting to be announced
+	RollAnnouncing RollStatus = "announcing" // claimed by the bot to announce
+	RollPending    RollStatus = "pending"    // announced and waiting to be drawn, also for events saved without status
+	RollCancelled  RollStatus = "cancelled"
+	RollDrawn      RollStatus = "drawn"
+)
+
 // The Mongo DB mirror of event
 // the object ID is a 12 byte array, that is 24 hex digits
 // the `bson:",inline"` is for letting ObjectID's fields get unmarshaled
@@ -34,63 +39,221 @@ type MongoEvent struct {
 	ObjectID       `bson:",inline"`
 	SenderID       int64            `bson:"sender_id" json:"qqUIN"`
 	SenderNickname string           `bson:"sender_nickname"`
-	SkinName       string           `bson:"skin_name" json:"skinName"`
+	SkinName       string           `bson:"skin_name" json:"skinName"` // all prizes in one line
+	Prizes         []Prize          `bson:"prizes"`
 	DrawTime       time.Time        `bson:"draw_time" json:"drawDate"`
 	Source         string           `bson:"source"`
+	Status         RollStatus       `bson:"status" json:"status"`
 	MsgID          int32            `bson:"msg_id"`
 	GroupCode      int64            `bson:"group_code"`
 	GroupName      string           `bson:"group_name"`
+	Groups         []RollGroup      `bson:"groups" json:"groups"` // other groups the roll is announced in
 	WinnerCount    int              `bson:"winner_count"`
+	Rules          RollRules        `bson:"rules"`
+	SeedHash       string           `bson:"seed_hash" json:"seedHash"` // published when announced
+	Seed           string           `bson:"seed" json:"-"`             // kept secret until drawn
+	Draw           *DrawRecord      `bson:"draw,omitempty" json:"draw,omitempty"`
+	Claims         []Claim          `bson:"claims" json:"claims"`
 	Participants   []message.Sender `bson:"participants"`
+	Joins          []Join           `bson:"joins,omitempty" json:"joins,omitempty"`             // when the participants joined
+	Subscribers    []int64          `bson:"subscribers,omitempty" json:"subscribers,omitempty"` // participants reminded privately before the draw
+	Winners        []message.Sender `bson:"winner"`
 }
 
-func (r *MongoEvent) identity() bson.M {
-	return bson.M{"group_code": r.GroupCode, "msg_id": r.MsgID}
+// Join records when a member joined a roll, participants added by nickname
+// when the roll is created have no join
+type Join struct {
+	Uin  int64     `bson:"uin" json:"uin"`
+	Time time.Time `bson:"time" json:"time"`
 }
 
-func (r *MongoEvent) Insert(ctx context.Context, c *mongo.Collection) {
-	_, err := c.InsertOne(ctx, r)
-	if err != nil {
-		logger.Errorf("failed to persist roll event: %v", err)
+// JoinedAt returns when the participant joined, or the creation time of the
+// roll if not recorded
+func (r *MongoEvent) JoinedAt(uin int64) time.Time {
+	for _, j := range r.Joins {
+		if j.Uin == uin {
+			return j.Time
+		}
 	}
+	return r.ObjectID.ObjectID.Timestamp()
 }
 
-func (r *MongoEvent) Find(ctx context.Context, c *mongo.Collection, groupCode int64, msgID int32) (error, bool) {
-	result := c.FindOne(ctx, bson.M{
-		"group_code": groupCode,
-		"msg_id":     msgID,
-	})
-	switch result.Err() {
-	case nil:
-	case mongo.ErrNoDocuments:
-		return nil, false
-	default:
-		logger.Errorf("failed to get roll event: %v", result.Err())
-		return nil, false
+// RollGroup is another group a roll is announced in, members join by replying
+// to the announcement there
+type RollGroup struct {
+	GroupCode int64  `bson:"group_code" json:"groupCode"`
+	GroupName string `bson:"group_name" json:"groupName"`
+	MsgID     int32  `bson:"msg_id" json:"msgID"`
+}
+
+// InGroup reports whether the roll is announced in the group
+func (r *MongoEvent) InGroup(groupCode int64) bool {
+	if r.GroupCode == groupCode {
+		return true
 	}
-	err := result.Decode(r)
-	if err != nil {
-		logger.Errorf("failed to decode roll event: %v", err)
-		return err, false
+	for _, g := range r.Groups {
+		if g.GroupCode == groupCode {
+			return true
+		}
 	}
-	return nil, true
+	return false
+}
+
+// Prize is a kind of item given in a roll
+type Prize struct {
+	Name     string `bson:"name" json:"name"`
+	Quantity int    `bson:"quantity" json:"quantity"`
+	// copied from the catalogue when the prize references an item
+	ItemID   string  `bson:"item_id,omitempty" json:"itemID,omitempty"`
+	ImageURL string  `bson:"image_url,omitempty" json:"imageURL,omitempty"`
+	Value    float64 `bson:"value,omitempty" json:"value,omitempty"` // of one item
+}
+
+// CatalogItem is an item in the prize catalogue, organisers write its ID as
+// the prize name to use the metadata
+type CatalogItem struct {
+	ID       string  `bson:"_id" json:"id"` // lower case, e.g. ak-redline
+	Name     string  `bson:"name" json:"name"`
+	Rarity   string  `bson:"rarity" json:"rarity"`
+	Wear     string  `bson:"wear" json:"wear"`
+	ImageURL string  `bson:"image_url" json:"imageURL"`
+	Value    float64 `bson:"value" json:"value"` // estimated market value in CNY
 }
 
-func (r *MongoEvent) AddWinner(ctx context.Context, c *mongo.Collection, winner message.Sender) {
-	_, err := c.UpdateOne(ctx,
-		r.identity(),
-		bson.M{"$push": bson.D{{"winner", winner}}})
-	if err != nil {
-		logger.Error(err)
+// State returns the status, events saved without status are pending
+func (r *MongoEvent) State() RollStatus {
+	if r.Status == "" {
+		return RollPending
 	}
+	return r.Status
 }
 
-func (r *MongoEvent) AddParticipant(ctx context.Context, c *mongo.Collection, p message.Sender) {
-	_, err := c.UpdateOne(ctx,
-		r.identity(),
-		bson.M{"$push": bson.M{"participants": p}},
-	)
-	if err != nil {
-		logger.Errorf("failed to append participants: %v", err)
+// RollRules are the conditions a member must meet to join a roll, zero values
+// mean no restriction
+type RollRules struct {
+	AllowOrganiser  bool   `bson:"allow_organiser" json:"allowOrganiser"`
+	MinMemberDays   int    `bson:"min_member_days" json:"minMemberDays"`
+	MinLevel        int    `bson:"min_level" json:"minLevel"`
+	MinMessages     int64  `bson:"min_messages" json:"minMessages"`
+	Keyword         string `bson:"keyword" json:"keyword"`
+	MaxParticipants int    `bson:"max_participants" json:"maxParticipants"`
+
+	// weighting, every participant has one ticket by default
+	MessagesPerTicket int64         `bson:"messages_per_ticket" json:"messagesPerTicket"` // one extra ticket per this many messages in stat
+	BonusTickets      []BonusTicket `bson:"bonus_tickets" json:"bonusTickets"`
+	MaxTickets        int64         `bson:"max_tickets" json:"maxTickets"`
+}
+
+// Weighted reports whether participants may have more than one ticket
+func (r RollRules) Weighted() bool {
+	return r.MessagesPerTicket > 0 || len(r.BonusTickets) > 0
+}
+
+// BonusTicket gives a member extra tickets, e.g. the organiser's friends or
+// tickets bought with points
+type BonusTicket struct {
+	Uin     int64 `bson:"uin" json:"uin"`
+	Tickets int64 `bson:"tickets" json:"tickets"`
+}
+
+// DrawRecord is published when a roll is drawn, so that anyone can recompute
+// the winners from the seed and the order of participants
+type DrawRecord struct {
+	Seed    string    `bson:"seed" json:"seed"`
+	Order   []int64   `bson:"order" json:"order"`                         // participant uins in the order used to draw
+	Weights []int64   `bson:"weights,omitempty" json:"weights,omitempty"` // tickets of each participant in Order, empty means one each
+	Winners []int64   `bson:"winners" json:"winners"`
+	DrawnAt time.Time `bson:"drawn_at" json:"drawnAt"`
+}
+
+// ClaimStatus is the state of a winner's claim of the prize
+type ClaimStatus string
+
+const (
+	ClaimWaiting   ClaimStatus = "waiting"
+	ClaimConfirmed ClaimStatus = "confirmed"
+	ClaimExpired   ClaimStatus = "expired" // not confirmed in time, the prize was drawn again
+)
+
+// Claim is a winner's claim of the prize, the winner confirms by replying to
+// the winner message or sending a private message, e.g. with a trade URL
+type Claim struct {
+	Uin         int64       `bson:"uin" json:"uin"`
+	Nickname    string      `bson:"nickname" json:"nickname"`
+	Prize       string      `bson:"prize" json:"prize"`
+	Status      ClaimStatus `bson:"status" json:"status"`
+	Detail      string      `bson:"detail" json:"detail"`
+	MsgID       int32       `bson:"msg_id" json:"msgID"` // the winner message
+	Deadline    time.Time   `bson:"deadline" json:"deadline"`
+	ConfirmedAt time.Time   `bson:"confirmed_at" json:"confirmedAt"`
+}
+
+// MessageCount is the number of messages a member sent in a group
+type MessageCount struct {
+	Uin       int64  `bson:"uin"`
+	GroupCode int64  `bson:"group_code"`
+	UserName  string `bson:"user_name"`
+	Count     int64  `bson:"count"`
+}
+
+// PerfectWorldAccount is a shared 完美世界 game account
+type PerfectWorldAccount struct {
+	Account       string `bson:"account"`
+	Password      string `bson:"password"`
+	Email         string `bson:"email"`
+	EmailPassword string `bson:"emailPassword"`
+	EmailSite     string `bson:"emailSite"`
+	Mobile        string `bson:"mobile"`
+	FriendCode    string `bson:"friendCode"`
+	Nickname      string `bson:"nickname"`
+}
+
+// GroupPolicy is the module switches and module settings overrides of a group
+type GroupPolicy struct {
+	GroupCode int64                             `bson:"group_code"`
+	Modules   map[string]bool                   `bson:"modules"`  // 模块ID -> 是否启用，未出现的模块默认启用
+	Settings  map[string]map[string]interface{} `bson:"settings"` // modules下的配置名 -> 覆盖的配置项
+}
+
+// Offence is the anti-spam record of a member in a group, the level drops by
+// one for every decay period without offences
+type Offence struct {
+	GroupCode int64     `bson:"group_code" json:"groupCode"`
+	Uin       int64     `bson:"uin" json:"uin"`
+	Level     int       `bson:"level" json:"level"`                         // number of offences punished so far
+	Last      time.Time `bson:"last" json:"last"`                           // time of the last offence
+	Until     time.Time `bson:"until,omitempty" json:"until,omitempty"`     // end of the grace of the last offence, offences before it are not counted
+	Trusted   bool      `bson:"trusted,omitempty" json:"trusted,omitempty"` // whitelisted by a group admin
+}
+
+// DecayedLevel is the level at now, reduced by one for every decay since the
+// last offence, decay 0 never reduces it
+func (o *Offence) DecayedLevel(decay time.Duration, now time.Time) int {
+	level := o.Level
+	if decay > 0 {
+		level -= int(now.Sub(o.Last) / decay)
+	}
+	if level < 0 {
+		level = 0
 	}
+	return level
+}
+
+// ModAction is a moderation action in a group, taken by the anti-spam module
+// or by a group admin with a command
+type ModAction struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	GroupCode    int64              `bson:"group_code" json:"groupCode"`
+	Uin          int64              `bson:"uin" json:"uin"` // the member acted on
+	Name         string             `bson:"name" json:"name"`
+	Action       string             `bson:"action" json:"action"`                         // e.g. warn, mute, unmute
+	Reason       string             `bson:"reason,omitempty" json:"reason,omitempty"`     // shown to the group
+	Scores       map[string]float64 `bson:"scores,omitempty" json:"scores,omitempty"`     // weighted detector scores
+	Score        float64            `bson:"score,omitempty" json:"score,omitempty"`       // sum of the scores
+	Excerpt      string             `bson:"excerpt,omitempty" json:"excerpt,omitempty"`   // of the offending message
+	Level        int                `bson:"level,omitempty" json:"level,omitempty"`       // offence number, from 1
+	Duration     int64              `bson:"duration,omitempty" json:"duration,omitempty"` // of a mute, in seconds
+	Operator     int64              `bson:"operator" json:"operator"`                     // 0 for the bot
+	OperatorName string             `bson:"operator_name,omitempty" json:"operatorName,omitempty"`
+	Time         time.Time          `bson:"time" json:"time"`
 }
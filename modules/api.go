@@ -0,0 +1,52 @@
+package modules
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// 各模块的网站接口共用的函数，每个模块用自己的地址和token提供接口
+
+func writeJSON(writer http.ResponseWriter, status int, v any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(v)
+}
+
+func writeError(writer http.ResponseWriter, status int, format string, args ...any) {
+	writeJSON(writer, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// 检查请求头 Authorization: Bearer <token>，token为空时拒绝所有请求
+func bearerAuth(token func() string, next httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		want := token()
+		auth := req.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if want == "" || given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(want)) != 1 {
+			writeError(writer, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(writer, req, params)
+	}
+}
+
+// 解析 ?group=，没有写时为0
+func queryGroup(writer http.ResponseWriter, req *http.Request) (int64, bool) {
+	group := req.URL.Query().Get("group")
+	if group == "" {
+		return 0, true
+	}
+	groupCode, err := strconv.ParseInt(group, 10, 64)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "invalid group %q", group)
+		return 0, false
+	}
+	return groupCode, true
+}
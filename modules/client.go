@@ -0,0 +1,161 @@
+package modules
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Logiase/MiraiGo-Template/bot"
+	"github.com/Mrs4s/MiraiGo/client"
+	"github.com/Mrs4s/MiraiGo/message"
+)
+
+// qqClient 是模块用到的 *client.QQClient 的方法，测试时用假的实现代替，不需要登录
+type qqClient interface {
+	SendGroupMessage(groupCode int64, m *message.SendingMessage) *message.GroupMessage
+	SendPrivateMessage(target int64, m *message.SendingMessage) *message.PrivateMessage
+	GetGroupInfo(groupCode int64) (*client.GroupInfo, error)
+	GetGroupMembers(group *client.GroupInfo) ([]*client.GroupMemberInfo, error)
+	GetGroupMessages(groupCode, beginSeq, endSeq int64) ([]*message.GroupMessage, error)
+	ReloadGroupList() error
+	UploadImage(target message.Source, img io.ReadSeeker, thread ...int) (message.IMessageElement, error)
+	UploadFile(target message.Source, file *client.LocalFile) error
+	SetEssenceMessage(groupCode int64, msgID, msgInternalId int32) error
+	AddGroupNoticeSimple(groupCode int64, text string) error
+	RecallGroupMessage(groupCode int64, msgID, msgInternalId int32) error
+
+	// *client.QQClient 中没有的方法，由 miraiClient 实现
+
+	// 已加载的群列表，即 QQClient.GroupList
+	Groups() []*client.GroupInfo
+	// 禁言群成员，d小于一分钟时按一分钟，为0时解除禁言
+	MuteGroupMember(groupCode, uin int64, d time.Duration) error
+	// 踢出群成员，block为true时拒绝此人再次加群
+	KickGroupMember(groupCode, uin int64, reason string, block bool) error
+}
+
+// miraiClient 把 *client.QQClient 适配为 qqClient
+type miraiClient struct {
+	*client.QQClient
+}
+
+func newMiraiClient(c *client.QQClient) qqClient {
+	return miraiClient{c}
+}
+
+func (c miraiClient) Groups() []*client.GroupInfo {
+	return c.GroupList
+}
+
+func (c miraiClient) MuteGroupMember(groupCode, uin int64, d time.Duration) error {
+	g, err := c.GetGroupInfo(groupCode)
+	if err != nil {
+		return fmt.Errorf("failed to mute member: %v", err)
+	}
+	g.Members, _ = c.GetGroupMembers(g)
+	member := g.FindMember(uin)
+	if member == nil {
+		return nil
+	}
+	// in seconds, if less than 60, 1 minute is used
+	return member.Mute(uint32(d.Seconds()))
+}
+
+func (c miraiClient) KickGroupMember(groupCode, uin int64, reason string, block bool) error {
+	g, err := c.GetGroupInfo(groupCode)
+	if err != nil {
+		return fmt.Errorf("failed to kick member: %v", err)
+	}
+	g.Members, _ = c.GetGroupMembers(g)
+	member := g.FindMember(uin)
+	if member == nil {
+		return nil
+	}
+	return member.Kick(reason, block)
+}
+
+// event 把MiraiGo的事件转发给模块，测试时可以不登录直接分发事件
+type event[T any] struct {
+	handlers []func(client qqClient, e T)
+	mu       sync.RWMutex
+}
+
+func (e *event[T]) subscribe(handler func(client qqClient, e T)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers = append(e.handlers, handler)
+}
+
+func (e *event[T]) dispatch(client qqClient, ev T) {
+	e.mu.RLock()
+	handlers := e.handlers
+	e.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(client, ev)
+	}
+}
+
+// 模块订阅的事件，自己发送的消息也会转发
+var (
+	groupMessageEvent       = new(event[*message.GroupMessage])
+	groupMemberJoinEvent    = new(event[*client.MemberJoinGroupEvent])
+	groupMemberLeaveEvent   = new(event[*client.MemberLeaveGroupEvent])
+	groupMessageRecallEvent = new(event[*client.GroupMessageRecalledEvent])
+	privateMessageEvent     = new(event[*message.PrivateMessage])
+	tempMessageEvent        = new(event[*client.TempMessageEvent])
+
+	boundBot   *bot.Bot
+	boundBotMu sync.Mutex
+)
+
+// eventBridge 在 Serve 时把bot的事件转发给本包的模块，
+// 单独注册，不属于任何功能模块，也不能在群内关闭
+type eventBridge struct{}
+
+var instanceBridge = new(eventBridge)
+
+func (*eventBridge) MiraiGoModule() bot.ModuleInfo {
+	return bot.ModuleInfo{
+		ID:       "botqq.events",
+		Instance: instanceBridge,
+	}
+}
+
+func (*eventBridge) Init() {}
+
+func (*eventBridge) PostInit() {}
+
+func (*eventBridge) Serve(b *bot.Bot) {
+	bindEvents(b)
+}
+
+func (*eventBridge) Start(*bot.Bot) {}
+
+func (*eventBridge) Stop(_ *bot.Bot, wg *sync.WaitGroup) {
+	defer wg.Done()
+}
+
+// 把bot的事件转发到模块订阅的事件上，同一个bot只转发一次
+func bindEvents(b *bot.Bot) {
+	boundBotMu.Lock()
+	defer boundBotMu.Unlock()
+	if boundBot == b {
+		return
+	}
+	boundBot = b
+	forward(groupMessageEvent, &b.GroupMessageEvent, &b.SelfGroupMessageEvent)
+	forward(groupMemberJoinEvent, &b.GroupMemberJoinEvent)
+	forward(groupMemberLeaveEvent, &b.GroupMemberLeaveEvent)
+	forward(groupMessageRecallEvent, &b.GroupMessageRecalledEvent)
+	forward(privateMessageEvent, &b.PrivateMessageEvent, &b.SelfPrivateMessageEvent)
+	forward(tempMessageEvent, &b.TempMessageEvent)
+}
+
+func forward[T any](e *event[T], handles ...*client.EventHandle[T]) {
+	for _, handle := range handles {
+		handle.Subscribe(func(c *client.QQClient, ev T) {
+			e.dispatch(newMiraiClient(c), ev)
+		})
+	}
+}
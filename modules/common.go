@@ -5,9 +5,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"unicode"
 
 	"github.com/Logiase/MiraiGo-Template/bot"
 	"github.com/Logiase/MiraiGo-Template/config"
@@ -15,15 +16,17 @@ import (
 	"github.com/Mrs4s/MiraiGo/message"
 	log "github.com/sirupsen/logrus"
 	"github.com/yangrq1018/botqq/utils"
-	"github.com/zyedidia/generic"
 	"github.com/zyedidia/generic/hashset"
 )
 
-// base implements bot.Module barely
+// base implements bot.Module barely, modules embedding it must implement Init
+// and call base.init with their own ID
 type base struct {
+	id            string              // 模块ID，用于查询群策略
 	monitorGroups *hashset.Set[int64] // 监听群组，在Serve前初始化，目前支持从config.GlobalConfig读取
 	botUin        int64
 	admin         *hashset.Set[int64]
+	_baseMu       sync.RWMutex // protects monitorGroups and admin, which are swapped on config reload
 }
 
 func (*base) MiraiGoModule() bot.ModuleInfo {
@@ -32,16 +35,36 @@ func (*base) MiraiGoModule() bot.ModuleInfo {
 	}
 }
 
-func (b *base) Init() {
-	b.monitorGroups = hashset.New(0, generic.Equals[int64], generic.HashInt64)
-	for _, code := range config.GlobalConfig.GetIntSlice("group_codes") {
-		b.monitorGroups.Put(int64(code))
-	}
+func (b *base) init(id bot.ModuleID) {
+	b.id = id.Name()
 	b.botUin = config.GlobalConfig.GetInt64("bot.account")
 	if b.botUin == 0 {
 		log.Fatal("must specify bot qq account")
 	}
-	b.admin = utils.Int64Set(config.GlobalConfig.GetIntSlice("admin"))
+	b.reloadBase()
+}
+
+// 重新读取监听群组和admin，配置文件修改后调用
+func (b *base) reloadBase() {
+	monitorGroups := utils.Int64Set(config.GlobalConfig.GetIntSlice("group_codes"))
+	admin := utils.Int64Set(config.GlobalConfig.GetIntSlice("admin"))
+	b._baseMu.Lock()
+	b.monitorGroups = monitorGroups
+	b.admin = admin
+	b._baseMu.Unlock()
+}
+
+// 监听的群组
+func (b *base) groups() []int64 {
+	b._baseMu.RLock()
+	defer b._baseMu.RUnlock()
+	return b.monitorGroups.Values()
+}
+
+func (b *base) isBotAdmin(uin int64) bool {
+	b._baseMu.RLock()
+	defer b._baseMu.RUnlock()
+	return b.admin.Has(uin)
 }
 
 func (*base) PostInit() {}
@@ -52,6 +75,14 @@ func (*base) Start(bot *bot.Bot) {}
 
 func (*base) Stop(bot *bot.Bot, wg *sync.WaitGroup) {}
 
+// 模块是否在该群启用：该群在监听列表中，且没有被群策略关闭
+func (b *base) serves(groupCode int64) bool {
+	b._baseMu.RLock()
+	monitored := b.monitorGroups.Has(groupCode)
+	b._baseMu.RUnlock()
+	return monitored && policies.enabled(groupCode, b.id)
+}
+
 // 只有@机器人的消息才会认为是发给bot的命令
 // 注意复制消息不会复制底层的AtElement，需要手动输入
 func (b *base) isToBot(msg *message.GroupMessage) bool {
@@ -97,19 +128,18 @@ func textOfTempMessage(msg *client.TempMessageEvent) *message.TextElement {
 	return searchForTextElement(msg.Message.Elements)
 }
 
-var commandRegexp = regexp.MustCompile(`/\w+`)
-
-func command(element *message.TextElement) (string, []string) {
-	var args []string
+// 切分出命令名与其后的原始参数文本，命令名为 / 开头直到第一个空白字符，支持中文命令如 /活跃成员
+// 若消息不是命令，返回空字符串
+func command(element *message.TextElement) (string, string) {
 	content := strings.TrimSpace(element.Content)
-	if strings.HasPrefix(content, "/") {
-		m := commandRegexp.FindString(content)
-		if m != "" {
-			args = strings.Fields(content)
-			return m, args[1:]
-		}
+	if !strings.HasPrefix(content, "/") {
+		return "", ""
+	}
+	end := strings.IndexFunc(content, unicode.IsSpace)
+	if end < 0 {
+		return content, ""
 	}
-	return "", nil
+	return content[:end], content[end:]
 }
 
 func readImageURI(uri string) (io.ReadSeeker, error) {
@@ -126,7 +156,7 @@ func readImageURI(uri string) (io.ReadSeeker, error) {
 	return bytes.NewReader(imageBytes), nil
 }
 
-func pictureMessage(client *client.QQClient, groupCode int64, data io.ReadSeeker) *message.SendingMessage {
+func pictureMessage(client qqClient, groupCode int64, data io.ReadSeeker) *message.SendingMessage {
 	source := message.Source{
 		SourceType: message.SourceGroup,
 		PrimaryID:  groupCode,
@@ -138,63 +168,323 @@ func pictureMessage(client *client.QQClient, groupCode int64, data io.ReadSeeker
 	return message.NewSendingMessage().Append(image)
 }
 
-type groupMessageHandleFunc func(client *client.QQClient, e *message.GroupMessage)
-type groupMemberJoinHandleFunc func(client *client.QQClient, e *client.MemberJoinGroupEvent)
-type groupMemberLeaveHandleFunc func(client *client.QQClient, e *client.MemberLeaveGroupEvent)
-type privateMessageHandleFunc func(client *client.QQClient, e *message.PrivateMessage)
-type tempMessageHandleFunc func(client *client.QQClient, e *client.TempMessageEvent)
-type groupMessageRecallHandleFunc func(client *client.QQClient, e *client.GroupMessageRecalledEvent)
+type groupMessageHandleFunc func(client qqClient, e *message.GroupMessage)
+type groupMemberJoinHandleFunc func(client qqClient, e *client.MemberJoinGroupEvent)
+type groupMemberLeaveHandleFunc func(client qqClient, e *client.MemberLeaveGroupEvent)
+type privateMessageHandleFunc func(client qqClient, e *message.PrivateMessage)
+type tempMessageHandleFunc func(client qqClient, e *client.TempMessageEvent)
+type groupMessageRecallHandleFunc func(client qqClient, e *client.GroupMessageRecalledEvent)
 
-func registerMessageListener(groupCode int64, callback groupMessageHandleFunc, events ...*client.EventHandle[*message.GroupMessage]) {
+// 群事件只分发给在该群启用的模块，群策略改变后即时生效
+
+func (b *base) registerMessageListener(callback groupMessageHandleFunc, events ...*event[*message.GroupMessage]) {
 	for _, event := range events {
-		event.Subscribe(func(client *client.QQClient, msg *message.GroupMessage) {
-			if msg.GroupCode == groupCode {
+		event.subscribe(func(client qqClient, msg *message.GroupMessage) {
+			if b.serves(msg.GroupCode) {
 				callback(client, msg)
 			}
 		})
 	}
 }
 
-func registerGroupMemberJoinListener(groupCode int64, callback groupMemberJoinHandleFunc, events ...*client.EventHandle[*client.MemberJoinGroupEvent]) {
+func (b *base) registerGroupMemberJoinListener(callback groupMemberJoinHandleFunc, events ...*event[*client.MemberJoinGroupEvent]) {
 	for _, event := range events {
-		event.Subscribe(func(client *client.QQClient, e *client.MemberJoinGroupEvent) {
-			if e.Group.Code == groupCode {
+		event.subscribe(func(client qqClient, e *client.MemberJoinGroupEvent) {
+			if b.serves(e.Group.Code) {
 				callback(client, e)
 			}
 		})
 	}
 }
 
-func registerGroupMemberLeaveListener(groupCode int64, callback groupMemberLeaveHandleFunc, events ...*client.EventHandle[*client.MemberLeaveGroupEvent]) {
+func (b *base) registerGroupMemberLeaveListener(callback groupMemberLeaveHandleFunc, events ...*event[*client.MemberLeaveGroupEvent]) {
 	for _, event := range events {
-		event.Subscribe(func(client *client.QQClient, e *client.MemberLeaveGroupEvent) {
-			if e.Group.Code == groupCode {
+		event.subscribe(func(client qqClient, e *client.MemberLeaveGroupEvent) {
+			if b.serves(e.Group.Code) {
 				callback(client, e)
 			}
 		})
 	}
 }
 
-func registerPrivateMessageListener(callback privateMessageHandleFunc, events ...*client.EventHandle[*message.PrivateMessage]) {
+func registerPrivateMessageListener(callback privateMessageHandleFunc, events ...*event[*message.PrivateMessage]) {
 	for _, event := range events {
-		event.Subscribe(func(client *client.QQClient, msg *message.PrivateMessage) {
+		event.subscribe(func(client qqClient, msg *message.PrivateMessage) {
 			callback(client, msg)
 		})
 	}
 }
 
-func registerTempMessageListener(callback tempMessageHandleFunc, events ...*client.EventHandle[*client.TempMessageEvent]) {
+func registerTempMessageListener(callback tempMessageHandleFunc, events ...*event[*client.TempMessageEvent]) {
 	for _, event := range events {
-		event.Subscribe(func(client *client.QQClient, msg *client.TempMessageEvent) {
+		event.subscribe(func(client qqClient, msg *client.TempMessageEvent) {
 			callback(client, msg)
 		})
 	}
 }
 
-func registerGroupMessageRecallListener(groupCode int64, callback groupMessageRecallHandleFunc, event *client.EventHandle[*client.GroupMessageRecalledEvent]) {
-	event.Subscribe(func(client *client.QQClient, e *client.GroupMessageRecalledEvent) {
-		if e.GroupCode == groupCode {
+func (b *base) registerGroupMessageRecallListener(callback groupMessageRecallHandleFunc, event *event[*client.GroupMessageRecalledEvent]) {
+	event.subscribe(func(client qqClient, e *client.GroupMessageRecalledEvent) {
+		if b.serves(e.GroupCode) {
 			callback(client, e)
 		}
 	})
 }
+
+// 执行命令所需的权限
+type permission int
+
+const (
+	permMember     permission = iota // 任何群成员
+	permGroupAdmin                   // 群管理员或群主
+	permBotAdmin                     // 配置文件中的admin
+)
+
+func (p permission) String() string {
+	switch p {
+	case permGroupAdmin:
+		return "群管理员"
+	case permBotAdmin:
+		return "机器人管理员"
+	default:
+		return "群成员"
+	}
+}
+
+// 命令参数的类型，解析时校验
+type argKind int
+
+const (
+	argString argKind = iota
+	argInt
+	argID   // #abcdef 形式的编号，解析后去掉#
+	argText // 剩余的全部原始文本，只能作为最后一个参数
+)
+
+type argSpec struct {
+	name     string
+	kind     argKind
+	optional bool
+}
+
+func (a argSpec) usage() string {
+	name := a.name
+	switch a.kind {
+	case argID:
+		name = "#" + name
+	case argText:
+		name += "..."
+	}
+	if a.optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+// commandArgs 是按 argSpec 解析校验后的参数
+type commandArgs struct {
+	raw    string // 命令名之后的原始文本
+	values map[string]string
+}
+
+func (a commandArgs) has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+func (a commandArgs) str(name string) string {
+	return a.values[name]
+}
+
+// 已经在解析时校验过，不会出错
+func (a commandArgs) int(name string) int {
+	n, _ := strconv.Atoi(a.values[name])
+	return n
+}
+
+type commandHandleFunc func(client qqClient, msg *message.GroupMessage, args commandArgs)
+
+// commandOwner 是注册命令的模块，命令只在模块启用的群中可用
+type commandOwner interface {
+	MiraiGoModule() bot.ModuleInfo
+	serves(groupCode int64) bool
+}
+
+// botCommand 是一个通过@机器人触发的群命令
+type botCommand struct {
+	name    string   // 命令名，如 /roll
+	aliases []string // 别名，如 /活跃成员
+	args    []argSpec
+	help    string // 一句话说明，在 /help 中显示
+	detail  string // 可选的详细说明，在 /help <命令> 中显示
+	perm    permission
+	handle  commandHandleFunc
+	owner   commandOwner
+}
+
+func (c *botCommand) module() string {
+	return c.owner.MiraiGoModule().ID.Name()
+}
+
+func (c *botCommand) usage() string {
+	var sb strings.Builder
+	sb.WriteString(c.name)
+	for _, a := range c.args {
+		sb.WriteString(" ")
+		sb.WriteString(a.usage())
+	}
+	return sb.String()
+}
+
+func (c *botCommand) parseArgs(raw string) (commandArgs, error) {
+	args := commandArgs{raw: strings.TrimSpace(raw), values: make(map[string]string)}
+	tokens, err := splitArgs(raw)
+	if err != nil {
+		return args, err
+	}
+	for i, spec := range c.args {
+		if i >= len(tokens) {
+			if spec.optional {
+				return args, nil
+			}
+			return args, fmt.Errorf("缺少参数%s", spec.usage())
+		}
+		v := tokens[i].value
+		switch spec.kind {
+		case argText:
+			args.values[spec.name] = strings.TrimSpace(raw[tokens[i].start:])
+			return args, nil
+		case argInt:
+			if _, err = strconv.Atoi(v); err != nil {
+				return args, fmt.Errorf("参数%s应为整数，而不是%q", spec.usage(), v)
+			}
+		case argID:
+			v = strings.TrimPrefix(v, "#")
+			if v == "" {
+				return args, fmt.Errorf("参数%s不能为空", spec.usage())
+			}
+		}
+		args.values[spec.name] = v
+	}
+	if len(tokens) > len(c.args) {
+		return args, fmt.Errorf("多余的参数%q", tokens[len(c.args)].value)
+	}
+	return args, nil
+}
+
+type argToken struct {
+	value string
+	start int // 在原始文本中的字节偏移
+}
+
+var closingQuotes = map[rune]rune{'"': '"', '\'': '\'', '“': '”', '‘': '’'}
+
+// 按空白切分参数，引号包裹的参数可以含有空格，如 /file "ts 中文补丁"
+func splitArgs(s string) ([]argToken, error) {
+	var tokens []argToken
+	var cur strings.Builder
+	var quote rune
+	inToken, start := false, 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, argToken{value: cur.String(), start: start})
+				cur.Reset()
+				inToken = false
+			}
+		default:
+			if !inToken {
+				inToken, start = true, i
+			}
+			if closing, ok := closingQuotes[r]; ok {
+				quote = closing
+			} else {
+				cur.WriteRune(r)
+			}
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("引号未闭合")
+	}
+	if inToken {
+		tokens = append(tokens, argToken{value: cur.String(), start: start})
+	}
+	return tokens, nil
+}
+
+// commandRegistry 保存所有模块注册的命令，命令名和别名在所有模块之间唯一
+type commandRegistry struct {
+	commands []*botCommand          // 注册顺序，用于 /help
+	index    map[string]*botCommand // 命令名和别名 -> 命令
+	mu       sync.RWMutex
+}
+
+var commands = &commandRegistry{index: make(map[string]*botCommand)}
+
+// 注册命令，同一模块重复注册（如重新Init）时覆盖旧的定义，
+// 不同模块注册了相同的命令名或别名时panic
+func (r *commandRegistry) register(cmd *botCommand) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range append([]string{cmd.name}, cmd.aliases...) {
+		if exist, ok := r.index[name]; ok && exist.module() != cmd.module() {
+			panic(fmt.Sprintf("command %s of module %s already registered by module %s", name, cmd.module(), exist.module()))
+		}
+	}
+	for i, exist := range r.commands {
+		if exist.name == cmd.name {
+			for _, name := range append([]string{exist.name}, exist.aliases...) {
+				delete(r.index, name)
+			}
+			r.commands = append(r.commands[:i], r.commands[i+1:]...)
+			break
+		}
+	}
+	r.commands = append(r.commands, cmd)
+	for _, name := range append([]string{cmd.name}, cmd.aliases...) {
+		r.index[name] = cmd
+	}
+}
+
+func (r *commandRegistry) lookup(name string) (*botCommand, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.index[name]
+	return cmd, ok
+}
+
+// 在该群可用的命令，按注册顺序
+func (r *commandRegistry) enabled(groupCode int64) []*botCommand {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var cmds []*botCommand
+	for _, cmd := range r.commands {
+		if cmd.owner.serves(groupCode) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+func registerCommand(cmd *botCommand) {
+	commands.register(cmd)
+}
+
+// 检查发送者是否有权限执行命令
+func (b *base) permitted(client qqClient, msg *message.GroupMessage, p permission) bool {
+	switch p {
+	case permGroupAdmin:
+		return isAdmin(client, msg.GroupCode, msg.Sender.Uin) || b.isBotAdmin(msg.Sender.Uin)
+	case permBotAdmin:
+		return b.isBotAdmin(msg.Sender.Uin)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,71 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommand(t *testing.T) {
+	name, raw := command(message.NewText(" /活跃成员"))
+	assert.Equal(t, "/活跃成员", name)
+	assert.Empty(t, raw)
+
+	name, raw = command(message.NewText("/roll\nAK-47\nnow"))
+	assert.Equal(t, "/roll", name)
+	assert.Equal(t, "\nAK-47\nnow", raw)
+
+	name, _ = command(message.NewText("csgo服务器"))
+	assert.Empty(t, name)
+}
+
+func TestParseArgs(t *testing.T) {
+	cmd := &botCommand{
+		name: "/test",
+		args: []argSpec{
+			{name: "id", kind: argID},
+			{name: "n", kind: argInt},
+			{name: "名称", kind: argString, optional: true},
+		},
+	}
+	assert.Equal(t, "/test <#id> <n> [名称]", cmd.usage())
+
+	args, err := cmd.parseArgs(` #abc123 2 "ts 中文补丁"`)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", args.str("id"))
+	assert.Equal(t, 2, args.int("n"))
+	assert.Equal(t, "ts 中文补丁", args.str("名称"))
+
+	args, err = cmd.parseArgs(" #abc123 2")
+	assert.NoError(t, err)
+	assert.False(t, args.has("名称"))
+
+	_, err = cmd.parseArgs(" #abc123 two")
+	assert.Error(t, err)
+	_, err = cmd.parseArgs(" #abc123")
+	assert.Error(t, err)
+	_, err = cmd.parseArgs(" #abc123 2 a b")
+	assert.Error(t, err)
+	_, err = cmd.parseArgs(` #abc123 2 "a`)
+	assert.Error(t, err)
+
+	text := &botCommand{name: "/roll", args: []argSpec{{name: "内容", kind: argText}}}
+	args, err = text.parseArgs("\nAK-47\n2022-06-18 20:00")
+	assert.NoError(t, err)
+	assert.Equal(t, "AK-47\n2022-06-18 20:00", args.str("内容"))
+}
+
+func TestRegisterCommand(t *testing.T) {
+	r := &commandRegistry{index: make(map[string]*botCommand)}
+	r.register(&botCommand{name: "/ping", aliases: []string{"/乒"}, owner: instanceManage})
+	// re-register by the same module replaces the old definition
+	r.register(&botCommand{name: "/ping", owner: instanceManage})
+	_, ok := r.lookup("/乒")
+	assert.False(t, ok)
+	assert.Len(t, r.commands, 1)
+
+	assert.Panics(t, func() {
+		r.register(&botCommand{name: "/pong", aliases: []string{"/ping"}, owner: instanceRoll})
+	})
+}
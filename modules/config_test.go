@@ -1,8 +1,11 @@
 package modules
 
 import (
-	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestReadConfig(t *testing.T) {
@@ -12,3 +15,76 @@ func TestReadConfig(t *testing.T) {
 	assert.NotEmpty(t, instanceManage.sendTime)
 	assert.NotEmpty(t, instanceManage.clearTime)
 }
+
+func TestDiffSettings(t *testing.T) {
+	old := flattenSettings(map[string]interface{}{
+		"group_codes": []interface{}{1},
+		"modules": map[string]interface{}{
+			"spam":   map[string]interface{}{"allow": 10, "mute_duration": "1m"},
+			"emby":   map[string]interface{}{"emby_token": "old-token"},
+			"roll":   map[string]interface{}{"api_token": "old-api-token"},
+			"manage": map[string]interface{}{"client_secret": "s"},
+		},
+	})
+	new := flattenSettings(map[string]interface{}{
+		"group_codes": []interface{}{1, 2},
+		"modules": map[string]interface{}{
+			"spam": map[string]interface{}{"allow": 20},
+			"roll": map[string]interface{}{"at_all": true, "api_token": "new-api-token"},
+			"emby": map[string]interface{}{"emby_token": "new-token"},
+		},
+		"password": "pw",
+	})
+	assert.Equal(t, []string{
+		"group_codes: [1] -> [1 2]",
+		"modules.emby.emby_token: changed",
+		"modules.manage.client_secret: removed",
+		"modules.roll.api_token: changed",
+		"modules.roll.at_all: added true",
+		"modules.spam.allow: 10 -> 20",
+		"modules.spam.mute_duration: removed 1m",
+		"password: added",
+	}, diffSettings(old, new))
+}
+
+func TestLoadSpamConfig(t *testing.T) {
+	v := viper.New()
+	v.Set("guard_duration", "60s")
+	v.Set("allow", 10)
+	v.Set("spam_threshold", 0.9)
+	v.Set("mute_duration", "1m")
+	v.Set("mute_multiplier", 2)
+	c, err := loadSpamConfig(v)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, c.allowMsgs)
+	assert.Equal(t, 1.0, c.verdict)
+	assert.Equal(t, 4, c.detectors["duplicate"].limit)
+
+	v.Set("detectors", map[string]interface{}{"link": map[string]interface{}{"weight": 0}, "mention": map[string]interface{}{"limit": 5}})
+	c, err = loadSpamConfig(v)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, c.detectors["link"].weight)
+	assert.Equal(t, 5, c.detectors["mention"].limit)
+	assert.Equal(t, 1.0, c.detectors["mention"].weight)
+
+	v.Set("detectors", map[string]interface{}{"duplicate": map[string]interface{}{"limit": 1}})
+	_, err = loadSpamConfig(v)
+	assert.Error(t, err)
+	v.Set("detectors", nil)
+
+	assert.Equal(t, 90*24*time.Hour, c.modLogKeep)
+	v.Set("modlog_retention", "-1h")
+	_, err = loadSpamConfig(v)
+	assert.Error(t, err)
+	v.Set("modlog_retention", nil)
+
+	assert.Equal(t, []punishment{punishWarn, punishRecall, punishMute}, c.ladder)
+	v.Set("ladder", []string{"warn", "shout"})
+	_, err = loadSpamConfig(v)
+	assert.Error(t, err)
+	v.Set("ladder", nil)
+
+	v.Set("spam_threshold", 1.5)
+	_, err = loadSpamConfig(v)
+	assert.Error(t, err)
+}
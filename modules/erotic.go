@@ -8,16 +8,11 @@ import (
 
 	"github.com/Logiase/MiraiGo-Template/bot"
 	"github.com/Logiase/MiraiGo-Template/config"
-	"github.com/Mrs4s/MiraiGo/client"
 	"github.com/Mrs4s/MiraiGo/message"
 )
 
 var instanceErotic *erotic
 
-const (
-	setuCommand = "/erotic"
-)
-
 // pixiv 图片需要代理下载
 var proxiedClient = http.Client{
 	Transport: &http.Transport{
@@ -28,9 +23,10 @@ var proxiedClient = http.Client{
 type erotic struct {
 	base
 	loliconURL string
+	_mu        sync.Mutex // protects loliconURL
 }
 
-func (s erotic) MiraiGoModule() bot.ModuleInfo {
+func (s *erotic) MiraiGoModule() bot.ModuleInfo {
 	return bot.ModuleInfo{
 		ID:       "setu",
 		Instance: instanceErotic,
@@ -38,42 +34,51 @@ func (s erotic) MiraiGoModule() bot.ModuleInfo {
 }
 
 func (s *erotic) Init() {
-	s.base.Init()
-	s.loliconURL = config.GlobalConfig.GetString("modules.erotic.url")
+	s.base.init(s.MiraiGoModule().ID)
+	if err := s.reload(); err != nil {
+		logger.Error(err)
+	}
+	registerCommand(&botCommand{
+		name:    "/erotic",
+		aliases: []string{"/涩图"},
+		help:    "来一张涩图",
+		handle:  s.dispatch,
+		owner:   s,
+	})
 }
 
-func (s erotic) PostInit() {}
-
-func (s *erotic) Serve(bot *bot.Bot) {
-	s.monitorGroups.Each(func(code int64) {
-		registerMessageListener(code, s.dispatch, &bot.GroupMessageEvent, &bot.SelfGroupMessageEvent)
-	})
+func (s *erotic) reload() error {
+	url := config.GlobalConfig.GetString("modules.erotic.url")
+	if url == "" {
+		return fmt.Errorf("modules.erotic.url not set")
+	}
+	s._mu.Lock()
+	s.loliconURL = url
+	s._mu.Unlock()
+	return nil
 }
 
-func (s erotic) Start(_ *bot.Bot) {}
+func (s *erotic) PostInit() {}
 
-func (s erotic) Stop(_ *bot.Bot, wg *sync.WaitGroup) {
+func (s *erotic) Start(_ *bot.Bot) {}
+
+func (s *erotic) Stop(_ *bot.Bot, wg *sync.WaitGroup) {
 	defer wg.Done()
 }
 
-func (s *erotic) dispatch(client *client.QQClient, msg *message.GroupMessage) {
-	if s.isToBot(msg) {
-		if text := textOfGroupMessage(msg); text != nil {
-			cmd, _ := command(text)
-			switch cmd {
-			case setuCommand:
-				go func() {
-					if err := s.handleCmd(client, msg); err != nil {
-						logger.Errorf("%s handle error: %s", setuCommand, err)
-					}
-				}()
-			}
+func (s *erotic) dispatch(client qqClient, msg *message.GroupMessage, _ commandArgs) {
+	go func() {
+		if err := s.handleCmd(client, msg); err != nil {
+			logger.Errorf("/erotic handle error: %s", err)
 		}
-	}
+	}()
 }
 
-func (s *erotic) handleCmd(client *client.QQClient, msg *message.GroupMessage) error {
-	res, err := proxiedClient.Get(s.loliconURL)
+func (s *erotic) handleCmd(client qqClient, msg *message.GroupMessage) error {
+	s._mu.Lock()
+	url := s.loliconURL
+	s._mu.Unlock()
+	res, err := proxiedClient.Get(url)
 	if err != nil {
 		return err
 	}
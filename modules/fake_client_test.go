@@ -0,0 +1,303 @@
+package modules
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Logiase/MiraiGo-Template/config"
+	"github.com/Mrs4s/MiraiGo/client"
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/spf13/viper"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+)
+
+const (
+	testBotUin    = 10000
+	testGroupCode = 20000
+	testOwnerUin  = 30000 // 群主，同时是配置文件中的admin
+	testMemberUin = 40000
+)
+
+// fakeClient 实现qqClient，记录机器人发出的消息和操作，不需要登录
+type fakeClient struct {
+	uin      int64
+	groups   []*client.GroupInfo
+	history  map[int64][]*message.GroupMessage // 群消息，下标+1即消息的seq
+	sent     []*message.GroupMessage           // 机器人发送的群消息
+	private  map[int64][]*message.SendingMessage
+	muted    map[int64]time.Duration
+	kicked   map[int64]bool // 踢出的成员 -> 是否拒绝再次加群
+	recalled []int32
+	essences []int32
+	notices  []string
+	files    []*client.LocalFile
+	mu       sync.Mutex
+}
+
+func newFakeClient() *fakeClient {
+	c := &fakeClient{
+		uin:     testBotUin,
+		history: make(map[int64][]*message.GroupMessage),
+		private: make(map[int64][]*message.SendingMessage),
+		muted:   make(map[int64]time.Duration),
+		kicked:  make(map[int64]bool),
+	}
+	c.addGroup(testGroupCode, "测试群")
+	return c
+}
+
+// 添加一个成员相同的群
+func (c *fakeClient) addGroup(groupCode int64, name string) {
+	group := &client.GroupInfo{Code: groupCode, Name: name, OwnerUin: testOwnerUin}
+	group.Members = []*client.GroupMemberInfo{
+		{Group: group, Uin: testBotUin, Nickname: "bot", Permission: client.Administrator},
+		{Group: group, Uin: testOwnerUin, Nickname: "owner", Permission: client.Owner},
+		{Group: group, Uin: testMemberUin, Nickname: "member", Permission: client.Member},
+	}
+	c.mu.Lock()
+	c.groups = append(c.groups, group)
+	c.mu.Unlock()
+}
+
+// 机器人在一个群发送的所有消息的文字内容
+func (c *fakeClient) groupTexts(groupCode int64) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var texts []string
+	for _, msg := range c.sent {
+		if msg.GroupCode == groupCode {
+			texts = append(texts, msg.ToString())
+		}
+	}
+	return texts
+}
+
+// 记录一条群消息并分配seq作为消息ID
+func (c *fakeClient) record(msg *message.GroupMessage) *message.GroupMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.history[msg.GroupCode] = append(c.history[msg.GroupCode], msg)
+	msg.Id = int32(len(c.history[msg.GroupCode]))
+	msg.InternalId = msg.Id
+	if msg.Time == 0 {
+		msg.Time = int32(time.Now().Unix())
+	}
+	return msg
+}
+
+func (c *fakeClient) SendGroupMessage(groupCode int64, m *message.SendingMessage) *message.GroupMessage {
+	msg := c.record(&message.GroupMessage{
+		GroupCode: groupCode,
+		Sender:    &message.Sender{Uin: c.uin, Nickname: "bot"},
+		Elements:  m.Elements,
+	})
+	c.mu.Lock()
+	c.sent = append(c.sent, msg)
+	c.mu.Unlock()
+	// 登录时机器人自己的消息由 SelfGroupMessageEvent 写入
+	groupHistory.add(msg)
+	return msg
+}
+
+func (c *fakeClient) SendPrivateMessage(target int64, m *message.SendingMessage) *message.PrivateMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.private[target] = append(c.private[target], m)
+	return &message.PrivateMessage{Target: target, Elements: m.Elements}
+}
+
+func (c *fakeClient) GetGroupInfo(groupCode int64) (*client.GroupInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.groups {
+		if g.Code == groupCode {
+			g.LastMsgSeq = int64(len(c.history[groupCode]))
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("group %d not found", groupCode)
+}
+
+func (c *fakeClient) GetGroupMembers(group *client.GroupInfo) ([]*client.GroupMemberInfo, error) {
+	return group.Members, nil
+}
+
+func (c *fakeClient) GetGroupMessages(groupCode, beginSeq, endSeq int64) ([]*message.GroupMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var msgs []*message.GroupMessage
+	for _, msg := range c.history[groupCode] {
+		if int64(msg.Id) > beginSeq && int64(msg.Id) <= endSeq {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (c *fakeClient) ReloadGroupList() error {
+	return nil
+}
+
+func (c *fakeClient) UploadImage(_ message.Source, img io.ReadSeeker, _ ...int) (message.IMessageElement, error) {
+	data, err := io.ReadAll(img)
+	if err != nil {
+		return nil, err
+	}
+	return &message.GroupImageElement{Size: int32(len(data))}, nil
+}
+
+func (c *fakeClient) UploadFile(_ message.Source, file *client.LocalFile) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files = append(c.files, file)
+	return nil
+}
+
+func (c *fakeClient) SetEssenceMessage(_ int64, msgID, _ int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.essences = append(c.essences, msgID)
+	return nil
+}
+
+func (c *fakeClient) AddGroupNoticeSimple(_ int64, text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notices = append(c.notices, text)
+	return nil
+}
+
+func (c *fakeClient) Groups() []*client.GroupInfo {
+	return c.groups
+}
+
+func (c *fakeClient) MuteGroupMember(_, uin int64, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d == 0 {
+		delete(c.muted, uin)
+	} else {
+		c.muted[uin] = d
+	}
+	return nil
+}
+
+func (c *fakeClient) KickGroupMember(_, uin int64, _ string, block bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kicked[uin] = block
+	return nil
+}
+
+func (c *fakeClient) RecallGroupMessage(_ int64, msgID, _ int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recalled = append(c.recalled, msgID)
+	return nil
+}
+
+// 机器人发送的所有群消息的文字内容
+func (c *fakeClient) sentTexts() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var texts []string
+	for _, msg := range c.sent {
+		texts = append(texts, msg.ToString())
+	}
+	return texts
+}
+
+// 机器人私聊target的所有消息的文字内容
+func (c *fakeClient) privateTexts(target int64) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var texts []string
+	for _, m := range c.private[target] {
+		texts = append(texts, (&message.PrivateMessage{Elements: m.Elements}).ToString())
+	}
+	return texts
+}
+
+// 机器人发送的最后一条群消息的文字内容
+func (c *fakeClient) lastText() string {
+	texts := c.sentTexts()
+	if len(texts) == 0 {
+		return ""
+	}
+	return texts[len(texts)-1]
+}
+
+// harness 把模拟的群事件注入到模块的监听函数中
+type harness struct {
+	t             *testing.T
+	client        *fakeClient
+	groupMessages *event[*message.GroupMessage]
+}
+
+func newHarness(t *testing.T) *harness {
+	config.GlobalConfig.Set("bot.account", testBotUin)
+	config.GlobalConfig.Set("group_codes", []int{testGroupCode})
+	config.GlobalConfig.Set("admin", []int{testOwnerUin})
+	storeOnce.Do(func() {})
+	dataStore = storage.NewMemory()
+	jobs = newScheduler()
+	resetPolicies()
+	resetHistory()
+	h := &harness{
+		t:             t,
+		client:        newFakeClient(),
+		groupMessages: new(event[*message.GroupMessage]),
+	}
+	h.groupMessages.subscribe(func(_ qqClient, m *message.GroupMessage) {
+		groupHistory.add(m)
+	})
+	return h
+}
+
+// 不读取数据库，所有模块在所有群启用
+func resetPolicies() {
+	policies.mu.Lock()
+	defer policies.mu.Unlock()
+	policies.policies = make(map[int64]*model.GroupPolicy)
+	policies.settings = make(map[string]*viper.Viper)
+	policies.loaded = true
+}
+
+func resetHistory() {
+	groupHistory.mu.Lock()
+	defer groupHistory.mu.Unlock()
+	groupHistory.groups = make(map[int64]*messageRing)
+}
+
+func sender(uin int64) *message.Sender {
+	return &message.Sender{Uin: uin, Nickname: fmt.Sprintf("user%d", uin)}
+}
+
+// 模拟群成员发送一条消息，以@机器人开头的消息写作"@bot ..."
+func (h *harness) say(from *message.Sender, text string, elems ...message.IMessageElement) *message.GroupMessage {
+	return h.sayIn(testGroupCode, from, text, elems...)
+}
+
+// 模拟群成员在指定的群发送一条消息
+func (h *harness) sayIn(groupCode int64, from *message.Sender, text string, elems ...message.IMessageElement) *message.GroupMessage {
+	if strings.HasPrefix(text, "@bot") {
+		elems = append([]message.IMessageElement{message.NewAt(testBotUin, "@bot")}, elems...)
+		text = strings.TrimPrefix(text, "@bot")
+	}
+	if text != "" {
+		elems = append(elems, message.NewText(text))
+	}
+	msg := h.client.record(&message.GroupMessage{
+		GroupCode: groupCode,
+		GroupName: "测试群",
+		Sender:    from,
+		Elements:  elems,
+	})
+	h.groupMessages.dispatch(h.client, msg)
+	return msg
+}
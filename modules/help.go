@@ -0,0 +1,114 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Logiase/MiraiGo-Template/bot"
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/utils"
+)
+
+var instanceHelp *help
+
+// help 把@机器人的命令分发给注册了该命令的模块，并提供 /help
+type help struct {
+	base
+}
+
+func (h *help) MiraiGoModule() bot.ModuleInfo {
+	return bot.ModuleInfo{
+		ID:       "help",
+		Instance: instanceHelp,
+	}
+}
+
+func (h *help) Init() {
+	h.base.init(h.MiraiGoModule().ID)
+	registerCommand(&botCommand{
+		name:    "/help",
+		aliases: []string{"/帮助"},
+		args:    []argSpec{{name: "命令", kind: argString, optional: true}},
+		help:    "列出本群可用的命令",
+		handle:  h.help,
+		owner:   h,
+	})
+}
+
+func (h *help) Serve(bot *bot.Bot) {
+	h.registerMessageListener(h.dispatch, groupMessageEvent)
+}
+
+func (h *help) Stop(_ *bot.Bot, wg *sync.WaitGroup) {
+	defer wg.Done()
+}
+
+func (h *help) dispatch(client qqClient, msg *message.GroupMessage) {
+	if !h.isToBot(msg) {
+		return
+	}
+	text := textOfGroupMessage(msg)
+	if text == nil {
+		return
+	}
+	name, raw := command(text)
+	if name == "" {
+		return
+	}
+	cmd, ok := commands.lookup(name)
+	if !ok || !cmd.owner.serves(msg.GroupCode) {
+		replyToGroupMessage(client, msg, fmt.Sprintf("本群没有命令%s，发送 /help 查看可用命令", name))
+		return
+	}
+	if !h.permitted(client, msg, cmd.perm) {
+		replyToGroupMessage(client, msg, fmt.Sprintf("%s需要%s权限", cmd.name, cmd.perm))
+		return
+	}
+	args, err := cmd.parseArgs(raw)
+	if err != nil {
+		replyToGroupMessage(client, msg, fmt.Sprintf("%s\n用法: %s", err, cmd.usage()))
+		return
+	}
+	logger.WithField("module", cmd.module()).Infof("%s called %s %s", msg.Sender.DisplayName(), cmd.name, args.raw)
+	cmd.handle(client, msg, args)
+}
+
+func (h *help) help(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	if args.has("命令") {
+		name := args.str("命令")
+		if !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		cmd, ok := commands.lookup(name)
+		if !ok || !cmd.owner.serves(msg.GroupCode) {
+			replyToGroupMessage(client, msg, fmt.Sprintf("本群没有命令%s", name))
+			return
+		}
+		text := fmt.Sprintf("%s\n用法: %s\n权限: %s\n模块: %s", cmd.help, cmd.usage(), cmd.perm, cmd.module())
+		if cmd.detail != "" {
+			text += "\n" + cmd.detail
+		}
+		if len(cmd.aliases) > 0 {
+			text += "\n别名: " + strings.Join(cmd.aliases, " ")
+		}
+		replyToGroupMessage(client, msg, text)
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("本群可用的命令（@我并发送）:\n")
+	for _, cmd := range commands.enabled(msg.GroupCode) {
+		sb.WriteString(cmd.usage())
+		if len(cmd.aliases) > 0 {
+			sb.WriteString("（" + strings.Join(cmd.aliases, " ") + "）")
+		}
+		sb.WriteString(" " + cmd.help)
+		if cmd.perm != permMember {
+			sb.WriteString("[" + cmd.perm.String() + "]")
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("发送 /help <命令> 查看详细用法")
+	client.SendGroupMessage(msg.GroupCode, utils.NewTextMessage(sb.String()))
+}
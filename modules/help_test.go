@@ -0,0 +1,80 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yangrq1018/botqq/model"
+)
+
+func newTestHelp(h *harness) *help {
+	m := new(help)
+	m.Init()
+	m.registerMessageListener(m.dispatch, h.groupMessages)
+	return m
+}
+
+func TestDispatchCommand(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	m := new(manage)
+	m.Init()
+
+	h.say(sender(testMemberUin), "@bot /ping")
+	assert.Equal(t, "pong", h.client.lastText())
+
+	h.say(sender(testMemberUin), "@bot /nosuchcommand")
+	assert.Contains(t, h.client.lastText(), "本群没有命令/nosuchcommand")
+
+	// 没有@机器人的命令不处理
+	n := len(h.client.sentTexts())
+	h.say(sender(testMemberUin), "/ping")
+	assert.Len(t, h.client.sentTexts(), n)
+}
+
+func TestDispatchPermission(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	m := new(manage)
+	m.Init()
+
+	h.say(sender(testMemberUin), "@bot /防撤回")
+	assert.Equal(t, "/recall需要机器人管理员权限", h.client.lastText())
+
+	h.say(sender(testOwnerUin), "@bot /recall")
+	assert.Equal(t, "没有最近记录的撤回消息", h.client.lastText())
+}
+
+func TestDispatchBadArgs(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	r := new(roll)
+	r.Init()
+
+	h.say(sender(testOwnerUin), "@bot /cancel")
+	assert.Equal(t, "缺少参数<#id>\n用法: /cancel <#id>", h.client.lastText())
+
+	h.say(sender(testOwnerUin), "@bot /cancel #abcdef")
+	assert.Equal(t, "没有抽奖#abcdef", h.client.lastText())
+}
+
+func TestHelp(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	m := new(manage)
+	m.Init()
+
+	h.say(sender(testMemberUin), "@bot /help")
+	assert.Contains(t, h.client.lastText(), "/top（/活跃成员）")
+	assert.Contains(t, h.client.lastText(), "/recall（/防撤回） 重发最近一条被撤回的消息[机器人管理员]")
+
+	h.say(sender(testMemberUin), "@bot /帮助 file")
+	assert.Contains(t, h.client.lastText(), "用法: /file <关键词>")
+
+	// 关闭的模块的命令不再列出
+	policies.policies[testGroupCode] = &model.GroupPolicy{Modules: map[string]bool{"manage": false}}
+	h.say(sender(testMemberUin), "@bot /help")
+	assert.NotContains(t, h.client.lastText(), "/top")
+	h.say(sender(testMemberUin), "@bot /ping")
+	assert.Equal(t, "本群没有命令/ping，发送 /help 查看可用命令", h.client.lastText())
+}
@@ -0,0 +1,117 @@
+package modules
+
+import (
+	"sync"
+
+	"github.com/Mrs4s/MiraiGo/client"
+	"github.com/Mrs4s/MiraiGo/message"
+)
+
+// 每个群保存的最近消息条数，超过后覆盖最早的消息
+const messageHistorySize = 100
+
+// 所有群最近的消息，包括机器人自己发送的，由群消息事件写入
+var groupHistory = newMessageHistory(messageHistorySize)
+
+func init() {
+	groupMessageEvent.subscribe(func(_ qqClient, m *message.GroupMessage) {
+		groupHistory.add(m)
+	})
+	// 撤回的消息不再参与刷屏检测，也不会被再次撤回
+	groupMessageRecallEvent.subscribe(func(_ qqClient, e *client.GroupMessageRecalledEvent) {
+		groupHistory.remove(e.GroupCode, e.MessageId)
+	})
+}
+
+// messageHistory 按群保存最近的消息，每个群是一个固定大小的环形缓冲区，
+// 不需要调用 GetGroupMessages，机器人被限流时也能使用
+type messageHistory struct {
+	size   int
+	groups map[int64]*messageRing
+	mu     sync.RWMutex
+}
+
+type messageRing struct {
+	msgs []*message.GroupMessage
+	next int // 下一条消息写入的位置，缓冲区满后也是最早的消息的位置
+}
+
+func newMessageHistory(size int) *messageHistory {
+	return &messageHistory{
+		size:   size,
+		groups: make(map[int64]*messageRing),
+	}
+}
+
+func (h *messageHistory) add(m *message.GroupMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.groups[m.GroupCode]
+	if !ok {
+		r = &messageRing{msgs: make([]*message.GroupMessage, 0, h.size)}
+		h.groups[m.GroupCode] = r
+	}
+	if len(r.msgs) < h.size {
+		r.msgs = append(r.msgs, m)
+	} else {
+		r.msgs[r.next] = m
+	}
+	r.next = (r.next + 1) % h.size
+}
+
+// 群里最近的n条消息，从早到晚排列
+func (h *messageHistory) recent(groupCode int64, n int) []*message.GroupMessage {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	r, ok := h.groups[groupCode]
+	if !ok {
+		return nil
+	}
+	if n > len(r.msgs) {
+		n = len(r.msgs)
+	}
+	msgs := make([]*message.GroupMessage, n)
+	for i := range msgs {
+		msgs[i] = r.msgs[(r.next-n+i+len(r.msgs))%len(r.msgs)]
+	}
+	return msgs
+}
+
+// 按消息ID查找群里最近的消息，已经被覆盖时返回nil
+func (h *messageHistory) find(groupCode int64, id int32) *message.GroupMessage {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	r, ok := h.groups[groupCode]
+	if !ok {
+		return nil
+	}
+	for _, m := range r.msgs {
+		if m.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// 删除群里的一条消息，保持其余消息的顺序，不存在时返回false
+func (h *messageHistory) remove(groupCode int64, id int32) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.groups[groupCode]
+	if !ok {
+		return false
+	}
+	n := len(r.msgs)
+	// 按从早到晚重新排列，去掉的位置留给下一条消息
+	msgs := make([]*message.GroupMessage, 0, h.size)
+	for i := 0; i < n; i++ {
+		if m := r.msgs[(r.next+i)%n]; m.Id != id {
+			msgs = append(msgs, m)
+		}
+	}
+	if len(msgs) == n {
+		return false
+	}
+	r.msgs, r.next = msgs, len(msgs)
+	return true
+}
@@ -0,0 +1,74 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/Logiase/MiraiGo-Template/bot"
+	"github.com/Mrs4s/MiraiGo/client"
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageHistory(t *testing.T) {
+	h := newMessageHistory(3)
+	ids := func(msgs []*message.GroupMessage) []int32 {
+		var ids []int32
+		for _, m := range msgs {
+			ids = append(ids, m.Id)
+		}
+		return ids
+	}
+	assert.Empty(t, h.recent(testGroupCode, 3))
+
+	for i := int32(1); i <= 2; i++ {
+		h.add(&message.GroupMessage{GroupCode: testGroupCode, Id: i})
+	}
+	h.add(&message.GroupMessage{GroupCode: testGroupCode + 1, Id: 1})
+	assert.Equal(t, []int32{1, 2}, ids(h.recent(testGroupCode, 5)))
+	assert.Equal(t, []int32{2}, ids(h.recent(testGroupCode, 1)))
+
+	// 超过容量后覆盖最早的消息
+	for i := int32(3); i <= 7; i++ {
+		h.add(&message.GroupMessage{GroupCode: testGroupCode, Id: i})
+	}
+	assert.Equal(t, []int32{5, 6, 7}, ids(h.recent(testGroupCode, 3)))
+	assert.Equal(t, []int32{6, 7}, ids(h.recent(testGroupCode, 2)))
+	assert.Len(t, h.groups[testGroupCode].msgs, 3)
+	assert.Nil(t, h.find(testGroupCode, 4))
+	assert.Equal(t, int32(6), h.find(testGroupCode, 6).Id)
+	assert.Equal(t, []int32{1}, ids(h.recent(testGroupCode+1, 3)))
+
+	// 撤回的消息被删除，后面的消息照常写入
+	assert.True(t, h.remove(testGroupCode, 6))
+	assert.False(t, h.remove(testGroupCode, 6))
+	assert.False(t, h.remove(testGroupCode+2, 6))
+	assert.Equal(t, []int32{5, 7}, ids(h.recent(testGroupCode, 3)))
+	h.add(&message.GroupMessage{GroupCode: testGroupCode, Id: 8})
+	assert.Equal(t, []int32{5, 7, 8}, ids(h.recent(testGroupCode, 3)))
+	h.add(&message.GroupMessage{GroupCode: testGroupCode, Id: 9})
+	assert.Equal(t, []int32{7, 8, 9}, ids(h.recent(testGroupCode, 3)))
+	assert.True(t, h.remove(testGroupCode, 9))
+	assert.Equal(t, []int32{7, 8}, ids(h.recent(testGroupCode, 3)))
+}
+
+func TestMessageHistoryRecall(t *testing.T) {
+	h := newHarness(t)
+	h.say(sender(testMemberUin), "hello")
+	recalled := h.say(sender(testMemberUin), "广告")
+	groupMessageRecallEvent.dispatch(h.client, &client.GroupMessageRecalledEvent{
+		GroupCode: testGroupCode, AuthorUin: testMemberUin, MessageId: recalled.Id,
+	})
+	assert.Nil(t, groupHistory.find(testGroupCode, recalled.Id))
+	assert.Len(t, groupHistory.recent(testGroupCode, 10), 1)
+}
+
+func TestEventBridge(t *testing.T) {
+	// 转发事件的模块单独注册，不依赖 help 等功能模块
+	info, err := bot.GetModule("botqq.events")
+	assert.NoError(t, err)
+	b := &bot.Bot{QQClient: client.NewClientEmpty()}
+	info.Instance.Serve(b)
+	boundBotMu.Lock()
+	defer boundBotMu.Unlock()
+	assert.Same(t, b, boundBot)
+}
@@ -1,44 +1,109 @@
 package modules
 
 import (
+	"context"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/yangrq1018/botqq/mongodb"
+	"github.com/yangrq1018/botqq/storage"
 
 	"github.com/Logiase/MiraiGo-Template/bot"
 	"github.com/Logiase/MiraiGo-Template/config"
 	"github.com/Logiase/MiraiGo-Template/utils"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var (
-	logger      = utils.GetModuleLogger("qq")
-	mongoClient *mongo.Client
+	logger    = utils.GetModuleLogger("qq")
+	dataStore storage.Store // opened on first use, see store()
+	storeOnce sync.Once
+	closeOnce sync.Once
+	// 本包注册的所有模块
+	registeredModules []bot.Module
 )
 
 func init() {
-	// imported packages are initialized before the package itself,
-	// so make sure that config.GlobalConfig is initialized before
-	// reading it
-	if config.GlobalConfig == nil {
-		config.Init()
-	}
-
+	// config.GlobalConfig is initialized by the main package (or TestMain),
+	// modules only read it in their Init
 	instanceRoll = new(roll)
 	instanceErotic = new(erotic)
 	instanceManage = new(manage)
 	instanceSpam = new(antiSpam)
 	instanceSuper = new(super)
+	instanceHelp = new(help)
 
-	bot.RegisterModule(instanceRoll)
-	bot.RegisterModule(instanceErotic)
-	bot.RegisterModule(instanceManage)
-	bot.RegisterModule(instanceSpam)
-	bot.RegisterModule(instanceSuper)
-
-	_mongoClient, err := mongodb.NewClient(os.Getenv("MONGO_URI"), os.Getenv("MONGO_PROXY"))
-	if err != nil {
-		logger.Fatalf("failed to create mongo client: %v", err)
+	registeredModules = []bot.Module{
+		instanceRoll,
+		instanceErotic,
+		instanceManage,
+		instanceSpam,
+		instanceSuper,
+		instanceHelp,
+	}
+	// 事件转发不依赖任何功能模块，功能模块都关闭或者没有注册时历史消息等也照常记录
+	bot.RegisterModule(instanceBridge)
+	for _, m := range registeredModules {
+		bot.RegisterModule(m)
 	}
-	mongoClient = _mongoClient
+}
+
+// 第一次使用时才打开存储，这样测试可以换成内存存储
+//
+// storage.driver 为 mongo 时使用环境变量 MONGO_URI 的数据库，为 file 时使用
+// storage.file 指定的文件，不配置时有 MONGO_URI 就用 mongo
+func store() storage.Store {
+	storeOnce.Do(func() {
+		if dataStore != nil {
+			return
+		}
+		uri := os.Getenv("MONGO_URI")
+		driver := config.GlobalConfig.GetString("storage.driver")
+		if driver == "" {
+			driver = "file"
+			if uri != "" {
+				driver = "mongo"
+			}
+		}
+		switch driver {
+		case "mongo":
+			client, err := mongodb.NewClient(uri, os.Getenv("MONGO_PROXY"))
+			if err != nil {
+				logger.Fatalf("failed to create mongo client: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			dataStore, err = storage.NewMongoStore(ctx, client, "qq")
+			if err != nil {
+				logger.Fatalf("failed to open mongo storage: %v", err)
+			}
+		case "file":
+			path := config.GlobalConfig.GetString("storage.file")
+			if path == "" {
+				path = "data/botqq.json"
+			}
+			s, err := storage.OpenFile(path)
+			if err != nil {
+				logger.Fatalf("failed to open storage file: %v", err)
+			}
+			dataStore = s
+		default:
+			logger.Fatalf("unknown storage driver %q", driver)
+		}
+		logger.Infof("using %s storage", driver)
+	})
+	return dataStore
+}
+
+// 停止时关闭存储，多个模块都会调用，只关闭一次
+func closeStore(ctx context.Context) {
+	closeOnce.Do(func() {
+		// 等正在执行的定时任务保存完
+		jobs.wait()
+		if dataStore != nil {
+			if err := dataStore.Close(ctx); err != nil {
+				logger.Errorf("failed to close storage: %v", err)
+			}
+		}
+	})
 }
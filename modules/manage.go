@@ -19,13 +19,11 @@ import (
 	"github.com/Logiase/MiraiGo-Template/config"
 	"github.com/Mrs4s/MiraiGo/client"
 	"github.com/Mrs4s/MiraiGo/message"
-	"github.com/fsnotify/fsnotify"
-	"github.com/go-co-op/gocron"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/viper"
+	"github.com/yangrq1018/botqq/model"
 	"github.com/yangrq1018/botqq/utils"
 	"github.com/zyedidia/generic/hashset"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // TODO: this is subject to pan.qq.come change
@@ -35,29 +33,20 @@ const recallMsgLife = 60 * time.Minute
 var instanceManage *manage
 var pwRegex = regexp.MustCompile(`完美(账号)?(\d+)?$`)
 
-type userMessageCount struct {
-	Uin       int64  `bson:"uin"`
-	GroupCode int64  `bson:"group_code"`
-	UserName  string `bson:"user_name"`
-	Count     int64  `bson:"count"`
-}
-
-type perfectWorldAccount struct {
-	Account       string `bson:"account"`
-	Password      string `bson:"password"`
-	Email         string `bson:"email"`
-	EmailPassword string `bson:"emailPassword"`
-	EmailSite     string `bson:"emailSite"`
-	Mobile        string `bson:"mobile"`
-	FriendCode    string `bson:"friendCode"`
-	Nickname      string `bson:"nickname"`
-}
-
 type manage struct {
 	base
-	database *mongo.Database
-	ctx      context.Context
+	ctx context.Context
 
+	*manageConfig                   // swapped as a whole on config reload, read through config()
+	configLock           sync.Mutex // protects manageConfig
+	client               qqClient   // for the scheduled jobs, set in Start
+	messageCache         *cache.Cache[int32, *message.GroupMessage]
+	lastRecallMessage    *message.GroupMessage
+	_lastRecallMessageMu sync.Mutex
+}
+
+// manageConfig 是 modules.manage 下的配置
+type manageConfig struct {
 	sendTime  string
 	clearTime string
 	embyURL   string
@@ -67,12 +56,7 @@ type manage struct {
 	notifyGroups         []int
 	approveFriendRequest bool
 	fileDict             map[string]fileSearch
-	keywordReplyDict     map[string]string
-	privateChatList      *hashset.Set[int64] // write once, no lock protected
-	configLock           sync.Mutex
-	messageCache         *cache.Cache[int32, *message.GroupMessage]
-	lastRecallMessage    *message.GroupMessage
-	_lastRecallMessageMu sync.Mutex
+	privateChatList      *hashset.Set[int64]
 }
 
 type fileSearch struct {
@@ -80,6 +64,47 @@ type fileSearch struct {
 	Msg string
 }
 
+// 读取并校验配置
+func loadManageConfig(moduleConfig *viper.Viper) (*manageConfig, error) {
+	if moduleConfig == nil {
+		return nil, fmt.Errorf("config not found")
+	}
+	c := &manageConfig{
+		sendTime:             moduleConfig.GetString("send"),
+		clearTime:            moduleConfig.GetString("clear"),
+		embyURL:              moduleConfig.GetString("emby"),
+		embyToken:            moduleConfig.GetString("emby_token"),
+		notifyGroups:         moduleConfig.GetIntSlice("notify_groups"),
+		messageCacheTime:     moduleConfig.GetDuration("message_cache_time"),
+		approveFriendRequest: moduleConfig.GetBool("approve_friend_request"),
+		fileDict:             make(map[string]fileSearch),
+		privateChatList:      utils.Int64Set(moduleConfig.GetIntSlice("private_chat_list")),
+	}
+	for _, spec := range []string{c.sendTime, c.clearTime} {
+		if _, err := cron.ParseStandard(spec); err != nil {
+			return nil, fmt.Errorf("invalid cron %q: %v", spec, err)
+		}
+	}
+	if c.messageCacheTime < 0 {
+		return nil, fmt.Errorf("negative message_cache_time %s", c.messageCacheTime)
+	}
+	for k, v := range moduleConfig.GetStringMap("files") {
+		file := fileSearch{}
+		switch x := v.(type) {
+		case string:
+			file.URL = x
+		case map[string]interface{}:
+			file.URL, _ = x["url"].(string)
+			file.Msg, _ = x["msg"].(string)
+		}
+		if file.URL == "" {
+			return nil, fmt.Errorf("file %q has no url", k)
+		}
+		c.fileDict[k] = file
+	}
+	return c, nil
+}
+
 // public methods
 
 func (s *manage) MiraiGoModule() bot.ModuleInfo {
@@ -90,73 +115,63 @@ func (s *manage) MiraiGoModule() bot.ModuleInfo {
 }
 
 func (s *manage) Init() {
-	s.base.Init()
+	s.base.init(s.MiraiGoModule().ID)
 
 	s.ctx = context.Background()
-	s.database = mongoClient.Database("qq")
-	s.fileDict = make(map[string]fileSearch)
-	moduleName := s.MiraiGoModule().ID.Name()
-	moduleConfig := config.GlobalConfig.Sub("modules." + moduleName)
-	s.privateChatList = utils.Int64Set(moduleConfig.GetIntSlice("private_chat_list"))
 	s.messageCache = cache.New[int32, *message.GroupMessage]()
 
-	// the call must be before WatchConfig()
-	config.GlobalConfig.OnConfigChange(func(in fsnotify.Event) {
-		logger.Infof("the config file has changed, op=%s, name=%s", in.Op.String(), in.Name)
-		s.configLock.Lock()
-		s.privateChatList = utils.Int64Set(config.GlobalConfig.GetIntSlice("modules." + moduleName + ".private_chat_list"))
-		s.configLock.Unlock()
-		logger.Infof("# of member in private chat list: %d", s.privateChatList.Size())
-	})
+	moduleName := s.MiraiGoModule().ID.Name()
+	c, err := loadManageConfig(config.GlobalConfig.Sub("modules." + moduleName))
+	if err != nil {
+		logger.Fatalf("module %s config not loaded: %v", moduleName, err)
+	}
+	s.manageConfig = c
+	s.registerCommands()
+}
 
-	if moduleConfig != nil {
-		s.sendTime = moduleConfig.GetString("send")
-		s.clearTime = moduleConfig.GetString("clear")
-		s.embyURL = moduleConfig.GetString("emby")
-		s.embyToken = moduleConfig.GetString("emby_token")
-		s.notifyGroups = moduleConfig.GetIntSlice("notify_groups")
-		s.messageCacheTime = moduleConfig.GetDuration("message_cache_time")
-		s.keywordReplyDict = moduleConfig.GetStringMapString("keyword_reply")
-		s.approveFriendRequest = moduleConfig.GetBool("approve_friend_request")
-		for k, v := range moduleConfig.GetStringMap("files") {
-			file := fileSearch{}
-			switch x := v.(type) {
-			case string:
-				file.URL = x
-			case map[string]interface{}:
-				file.URL = x["url"].(string)
-				file.Msg = x["msg"].(string)
-			default:
-			}
-			s.fileDict[k] = file
-		}
-	} else {
-		logger.Fatal("module %s config not loaded", s.MiraiGoModule().ID.Name())
+func (s *manage) config() *manageConfig {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	return s.manageConfig
+}
+
+func (s *manage) reload() error {
+	c, err := loadManageConfig(config.GlobalConfig.Sub("modules." + s.MiraiGoModule().ID.Name()))
+	if err != nil {
+		return err
+	}
+	s.configLock.Lock()
+	s.manageConfig = c
+	s.configLock.Unlock()
+	logger.Infof("# of member in private chat list: %d", c.privateChatList.Size())
+	if s.client != nil {
+		s.schedule()
 	}
+	return nil
 }
 
 func (s *manage) PostInit() {}
 
 func (s *manage) Serve(bot *bot.Bot) {
-	s.monitorGroups.Each(func(code int64) {
-		registerMessageListener(code, s.handleCommand, &bot.GroupMessageEvent, &bot.SelfGroupMessageEvent)
-		registerGroupMessageRecallListener(code, s.listenRecall, &bot.GroupMessageRecalledEvent)
-		registerGroupMemberJoinListener(code, handleNewMemberJoin, &bot.GroupMemberJoinEvent)
-		registerGroupMemberLeaveListener(code, handleMemberLeave, &bot.GroupMemberLeaveEvent)
-	})
+	s.registerMessageListener(s.handleCommand, groupMessageEvent)
+	s.registerGroupMessageRecallListener(s.listenRecall, groupMessageRecallEvent)
+	s.registerGroupMemberJoinListener(handleNewMemberJoin, groupMemberJoinEvent)
+	s.registerGroupMemberLeaveListener(handleMemberLeave, groupMemberLeaveEvent)
 
-	registerPrivateMessageListener(s.handlePrivate, &bot.PrivateMessageEvent, &bot.SelfPrivateMessageEvent)
+	registerPrivateMessageListener(s.handlePrivate, privateMessageEvent)
 	// TODO: in-group non-friend chat message won't work
-	registerTempMessageListener(s.handleTemp, &bot.TempMessageEvent)
+	registerTempMessageListener(s.handleTemp, tempMessageEvent)
 
 	// 自动通过好友申请
-	if s.approveFriendRequest {
+	if s.config().approveFriendRequest {
 		logger.Info("好友申请自动通过：启动")
-		bot.NewFriendRequestEvent.Subscribe(func(client *client.QQClient, req *client.NewFriendRequest) {
+	}
+	bot.NewFriendRequestEvent.Subscribe(func(client *client.QQClient, req *client.NewFriendRequest) {
+		if s.config().approveFriendRequest {
 			logger.Infof("approve friend request from %s", req.RequesterNick)
 			req.Accept()
-		})
-	}
+		}
+	})
 
 	bot.GroupMemberPermissionChangedEvent.Subscribe(func(client *client.QQClient, event *client.MemberPermissionChangedEvent) {
 		oldPem, newPem := utils.PermissionString(event.OldPermission), utils.PermissionString(event.NewPermission)
@@ -169,95 +184,147 @@ func (s *manage) Serve(bot *bot.Bot) {
 }
 
 func (s *manage) Start(bot *bot.Bot) {
-	sch := gocron.NewScheduler(time.Local)
-	_, err := sch.Cron(s.clearTime).Do(func() {
+	s.client = newMiraiClient(bot.QQClient)
+	s.schedule()
+}
+
+// 统计任务的key都以此开头
+const manageJobPrefix = "manage:"
+
+// (重新)安排定时任务，配置修改后清除旧的任务
+func (s *manage) schedule() {
+	c := s.config()
+	jobs.cancelPrefix(manageJobPrefix)
+	err := jobs.scheduleCron(manageJobPrefix+"clear", "清空发言统计", 0, c.clearTime, func() {
 		logger.Info("clear stat")
-		s.clearCounter(bot.QQClient)
+		s.clearCounter(s.client)
 	})
 	if err != nil {
 		logger.Error(err)
 		return
 	}
-	_, err = sch.Cron(s.sendTime).Do(func() {
-		for _, code := range s.notifyGroups {
-			s.sendStat(bot.QQClient, int64(code), 3)
+	for _, code := range c.notifyGroups {
+		code := int64(code)
+		err = jobs.scheduleCron(fmt.Sprintf("%sstat:%d", manageJobPrefix, code), "发送发言统计", code, c.sendTime, func() {
+			s.sendStat(s.client, code, 3)
+		})
+		if err != nil {
+			logger.Error(err)
+			return
 		}
-	})
-	if err != nil {
-		logger.Error(err)
-		return
 	}
-	sch.StartAsync()
+	logger.Infof("scheduled stat clear at %q and send at %q", c.clearTime, c.sendTime)
 }
 
 func (s *manage) Stop(_ *bot.Bot, wg *sync.WaitGroup) {
 	defer wg.Done()
-	_ = s.database.Client().Disconnect(s.ctx)
+	closeStore(s.ctx)
 }
 
 // private methods start here
 
-func (s *manage) handleCommand(client *client.QQClient, msg *message.GroupMessage) {
+func (s *manage) handleCommand(client qqClient, msg *message.GroupMessage) {
 	// 记录msg的发送者
 	s.addCounter(msg.Sender, msg.GroupCode, 1)
-	s.messageCache.Set(msg.Id, msg, cache.WithExpiration(s.messageCacheTime))
+	s.messageCache.Set(msg.Id, msg, cache.WithExpiration(s.config().messageCacheTime))
 
 	text := textOfGroupMessage(msg)
 	if text == nil {
 		return
 	}
 
+	// 命令由help模块分发，这里只处理关键词回复
 	if s.isToBot(msg) {
-		if k, ok := s.containKeyWord(text); ok {
-			replyToGroupMessage(client, msg, s.keywordReplyDict[k])
+		if cmd, _ := command(text); cmd != "" {
 			return
 		}
-		cmd, args := command(text)
-		switch cmd {
-		case "":
-			logger.Warnf("no command found, original message is %s", text.Content)
-		case "/ping":
-			client.SendGroupMessage(msg.GroupCode, utils.NewTextMessage("pong"))
-		case "/emby":
-			s.creatEmbyUser(client, msg)
-		case "/top", "/活跃成员":
-			s.sendStat(client, msg.GroupCode, 3)
-		case "/file", "/文件":
-			if len(args) > 0 {
-				err := s.uploadFileToGroup(client, msg.GroupCode, args[0])
-				if err != nil {
-					logger.Error(err)
-				}
-			}
-		case "/recall", "/防撤回":
-			if !s.admin.Has(msg.Sender.Uin) {
-				client.SendGroupMessage(msg.GroupCode, utils.NewTextMessage("你没有admin权限"))
-				return
-			}
-			s._lastRecallMessageMu.Lock()
-			if s.lastRecallMessage != nil {
-				m := s.lastRecallMessage
-				mTime := time.Unix(int64(m.Time), 0)
-				since := time.Since(mTime)
-				var sinceString string
-				if since.Seconds() < 60 {
-					sinceString = fmt.Sprintf("%.0f秒前", since.Seconds())
-				} else {
-					sinceString = fmt.Sprintf("%.0f分钟前", since.Minutes())
-				}
-				client.SendGroupMessage(m.GroupCode, utils.NewTextMessage(fmt.Sprintf("%s，%s撤回了", sinceString, m.Sender.DisplayName())))
-				client.SendGroupMessage(m.GroupCode, &message.SendingMessage{
-					Elements: m.Elements,
-				})
-			} else {
-				client.SendGroupMessage(msg.GroupCode, utils.NewTextMessage("没有最近记录的撤回消息"))
-			}
-			s._lastRecallMessageMu.Unlock()
+		keywordReplyDict := policies.groupSettings(msg.GroupCode, "manage").GetStringMapString("keyword_reply")
+		if k, ok := containKeyWord(keywordReplyDict, text); ok {
+			replyToGroupMessage(client, msg, keywordReplyDict[k])
 		}
 	}
 }
 
-func (s *manage) handlePrivateOrTemp(client *client.QQClient, sender *message.Sender, txt *message.TextElement) {
+func (s *manage) ping(client qqClient, msg *message.GroupMessage, _ commandArgs) {
+	client.SendGroupMessage(msg.GroupCode, utils.NewTextMessage("pong"))
+}
+
+func (s *manage) emby(client qqClient, msg *message.GroupMessage, _ commandArgs) {
+	s.creatEmbyUser(client, msg)
+}
+
+func (s *manage) stat(client qqClient, msg *message.GroupMessage, _ commandArgs) {
+	s.sendStat(client, msg.GroupCode, 3)
+}
+
+func (s *manage) file(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	err := s.uploadFileToGroup(client, msg.GroupCode, args.str("关键词"))
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func (s *manage) recall(client qqClient, msg *message.GroupMessage, _ commandArgs) {
+	s._lastRecallMessageMu.Lock()
+	defer s._lastRecallMessageMu.Unlock()
+	if s.lastRecallMessage == nil {
+		client.SendGroupMessage(msg.GroupCode, utils.NewTextMessage("没有最近记录的撤回消息"))
+		return
+	}
+	m := s.lastRecallMessage
+	mTime := time.Unix(int64(m.Time), 0)
+	since := time.Since(mTime)
+	var sinceString string
+	if since.Seconds() < 60 {
+		sinceString = fmt.Sprintf("%.0f秒前", since.Seconds())
+	} else {
+		sinceString = fmt.Sprintf("%.0f分钟前", since.Minutes())
+	}
+	client.SendGroupMessage(m.GroupCode, utils.NewTextMessage(fmt.Sprintf("%s，%s撤回了", sinceString, m.Sender.DisplayName())))
+	client.SendGroupMessage(m.GroupCode, &message.SendingMessage{
+		Elements: m.Elements,
+	})
+}
+
+func (s *manage) registerCommands() {
+	registerCommand(&botCommand{
+		name:   "/ping",
+		help:   "检查机器人是否在线",
+		handle: s.ping,
+		owner:  s,
+	})
+	registerCommand(&botCommand{
+		name:   "/emby",
+		help:   "创建EMBY账号，用户名为QQ号码",
+		handle: s.emby,
+		owner:  s,
+	})
+	registerCommand(&botCommand{
+		name:    "/top",
+		aliases: []string{"/活跃成员"},
+		help:    "最活跃的前三个成员",
+		handle:  s.stat,
+		owner:   s,
+	})
+	registerCommand(&botCommand{
+		name:    "/file",
+		aliases: []string{"/文件"},
+		args:    []argSpec{{name: "关键词", kind: argString}},
+		help:    "上传文件到群文件",
+		handle:  s.file,
+		owner:   s,
+	})
+	registerCommand(&botCommand{
+		name:    "/recall",
+		aliases: []string{"/防撤回"},
+		help:    "重发最近一条被撤回的消息",
+		perm:    permBotAdmin,
+		handle:  s.recall,
+		owner:   s,
+	})
+}
+
+func (s *manage) handlePrivateOrTemp(client qqClient, sender *message.Sender, txt *message.TextElement) {
 	if s.canPrivateChat(sender) {
 		tokens := pwRegex.FindStringSubmatch(txt.Content)
 		if tokens == nil {
@@ -303,7 +370,7 @@ func (s *manage) handlePrivateOrTemp(client *client.QQClient, sender *message.Se
 	}
 }
 
-func (s *manage) handlePrivate(client *client.QQClient, e *message.PrivateMessage) {
+func (s *manage) handlePrivate(client qqClient, e *message.PrivateMessage) {
 	txt := textOfPrivateMessage(e)
 	if txt == nil {
 		return
@@ -311,7 +378,7 @@ func (s *manage) handlePrivate(client *client.QQClient, e *message.PrivateMessag
 	s.handlePrivateOrTemp(client, e.Sender, txt)
 }
 
-func (s *manage) handleTemp(client *client.QQClient, e *client.TempMessageEvent) {
+func (s *manage) handleTemp(client qqClient, e *client.TempMessageEvent) {
 	txt := textOfTempMessage(e)
 	if txt == nil {
 		return
@@ -320,14 +387,12 @@ func (s *manage) handleTemp(client *client.QQClient, e *client.TempMessageEvent)
 }
 
 func (s *manage) canPrivateChat(sender *message.Sender) bool {
-	s.configLock.Lock()
-	defer s.configLock.Unlock()
-	return s.privateChatList.Has(int64(sender.Uin))
+	return s.config().privateChatList.Has(sender.Uin)
 }
 
-func (s *manage) containKeyWord(text *message.TextElement) (string, bool) {
+func containKeyWord(keywordReplyDict map[string]string, text *message.TextElement) (string, bool) {
 	content := strings.ToLower(text.Content)
-	for keyword := range s.keywordReplyDict {
+	for keyword := range keywordReplyDict {
 		// probably regexp here?
 		match := regexp.MustCompile(keyword).FindString(content)
 		if match != "" {
@@ -337,7 +402,7 @@ func (s *manage) containKeyWord(text *message.TextElement) (string, bool) {
 	return "", false
 }
 
-func (s *manage) makeStatMessage(group *client.GroupInfo, senders []userMessageCount) *message.SendingMessage {
+func (s *manage) makeStatMessage(group *client.GroupInfo, senders []model.MessageCount) *message.SendingMessage {
 	msg := message.NewSendingMessage()
 	msg.Append(message.NewText(fmt.Sprintf("%q最活跃的前%d个成员\n",
 		group.Name,
@@ -351,7 +416,7 @@ func (s *manage) makeStatMessage(group *client.GroupInfo, senders []userMessageC
 	return msg.Append(message.NewText("再接再厉!"))
 }
 
-func (s *manage) sendStat(c *client.QQClient, groupCode int64, n int64) {
+func (s *manage) sendStat(c qqClient, groupCode int64, n int64) {
 	senders, err := s.top(groupCode, n)
 	if err != nil {
 		logger.Error(err)
@@ -362,9 +427,9 @@ func (s *manage) sendStat(c *client.QQClient, groupCode int64, n int64) {
 		return
 	}
 	groupInfo := new(client.GroupInfo)
-	for i := range c.GroupList {
-		if c.GroupList[i].Code == groupCode {
-			groupInfo = c.GroupList[i]
+	for _, g := range c.Groups() {
+		if g.Code == groupCode {
+			groupInfo = g
 		}
 	}
 	reply := s.makeStatMessage(groupInfo, senders)
@@ -372,72 +437,24 @@ func (s *manage) sendStat(c *client.QQClient, groupCode int64, n int64) {
 }
 
 func (s *manage) addCounter(sender *message.Sender, groupCode, i int64) {
-	coll := s.database.Collection("stat")
-	_, err := coll.UpdateOne(
-		s.ctx,
-		bson.D{
-			{"uin", sender.Uin},
-			{"group_code", groupCode},
-		},
-		bson.D{
-			{
-				"$inc", bson.D{{"count", i}},
-			}, {
-				"$set", bson.D{{"user_name", sender.DisplayName()}},
-			},
-		},
-		options.Update().SetUpsert(true),
-	)
+	err := store().Stats().Add(s.ctx, groupCode, sender.Uin, sender.DisplayName(), i)
 	if err != nil {
 		logger.Error(err)
 	}
 }
 
-func (s *manage) getPWAccounts() ([]perfectWorldAccount, error) {
-	cur, err := s.database.Collection("perfectworld").
-		Find(s.ctx, bson.D{}, options.Find().SetSort(bson.M{"friendCode": 1}))
-	if err != nil {
-		return nil, err
-	}
-	var accounts []perfectWorldAccount
-	if err = cur.All(s.ctx, &accounts); err != nil {
-		return nil, err
-	}
-	return accounts, nil
+func (s *manage) getPWAccounts() ([]model.PerfectWorldAccount, error) {
+	return store().Accounts().List(s.ctx)
 }
 
-func (s *manage) top(groupCode, n int64) ([]userMessageCount, error) {
-	// have to parse string as int
-	cur, err := s.database.Collection("stat").Find(
-		s.ctx,
-		bson.D{
-			{"group_code", groupCode},
-		},
-		options.Find().SetSort(bson.D{{"count", -1}}),
-	)
-	if err != nil {
-		return nil, err
-	}
-	var results []userMessageCount
-	if err = cur.All(s.ctx, &results); err != nil {
-		return nil, err
-	}
-	if len(results) < int(n) {
-		return results, nil
-	}
-	return results[:n], nil
+func (s *manage) top(groupCode, n int64) ([]model.MessageCount, error) {
+	return store().Stats().Top(s.ctx, groupCode, int(n))
 }
 
-func (s *manage) clearCounter(client *client.QQClient) {
+func (s *manage) clearCounter(client qqClient) {
 	// client as parameter to keep client.GroupList updated
-	for _, group := range client.GroupList {
-		_, err := s.database.Collection("stat").DeleteMany(
-			s.ctx,
-			bson.D{
-				{"group_code", group.Code},
-			},
-		)
-		if err != nil {
+	for _, group := range client.Groups() {
+		if err := store().Stats().Clear(s.ctx, group.Code); err != nil {
 			logger.Error(err)
 		}
 	}
@@ -445,7 +462,7 @@ func (s *manage) clearCounter(client *client.QQClient) {
 
 func (s *manage) authReq(req *http.Request) {
 	q := req.URL.Query()
-	q.Set("api_key", s.embyToken)
+	q.Set("api_key", s.config().embyToken)
 	req.URL.RawQuery = q.Encode()
 	req.Header.Set("Content-Type", "application/json")
 }
@@ -453,13 +470,13 @@ func (s *manage) authReq(req *http.Request) {
 func (s *manage) endpoint(ep endpoint) string {
 	switch ep {
 	case createUser:
-		return s.embyURL + "/emby" + "/Users/New"
+		return s.config().embyURL + "/emby" + "/Users/New"
 	default:
 		return ""
 	}
 }
 
-func (s *manage) creatEmbyUser(client *client.QQClient, msg *message.GroupMessage) {
+func (s *manage) creatEmbyUser(client qqClient, msg *message.GroupMessage) {
 	body := bytes.NewBuffer(nil)
 	_ = json.NewEncoder(body).Encode(&struct {
 		Name string `json:"Name"`
@@ -483,10 +500,10 @@ func (s *manage) creatEmbyUser(client *client.QQClient, msg *message.GroupMessag
 	}
 	var user UserDto
 	_ = json.NewDecoder(res.Body).Decode(&user)
-	replyToGroupMessage(client, msg, fmt.Sprintf("EMBY: 成功创建用户，用户名为QQ号码，默认密码为空，请登录%s修改密码和观影", s.embyURL))
+	replyToGroupMessage(client, msg, fmt.Sprintf("EMBY: 成功创建用户，用户名为QQ号码，默认密码为空，请登录%s修改密码和观影", s.config().embyURL))
 }
 
-func (s *manage) listenRecall(client *client.QQClient, e *client.GroupMessageRecalledEvent) {
+func (s *manage) listenRecall(client qqClient, e *client.GroupMessageRecalledEvent) {
 	recallMsgID := e.MessageId
 	// TODO: fix recall too fast, before the message is received by bot
 	m, ok := s.messageCache.Get(recallMsgID)
@@ -504,11 +521,11 @@ func (s *manage) listenRecall(client *client.QQClient, e *client.GroupMessageRec
 }
 
 func (s *manage) lookUpFile(keyword string) (fileSearch, bool) {
-	f, ok := s.fileDict[keyword]
+	f, ok := s.config().fileDict[keyword]
 	return f, ok
 }
 
-func (s *manage) uploadFileToGroup(c *client.QQClient, groupCode int64, keyword string) error {
+func (s *manage) uploadFileToGroup(c qqClient, groupCode int64, keyword string) error {
 	item, ok := s.lookUpFile(keyword)
 	if !ok {
 		logger.Infof("keyword %s does not have a URL associated", keyword)
@@ -548,21 +565,11 @@ func (s *manage) uploadFileToGroup(c *client.QQClient, groupCode int64, keyword
 // helper functions
 
 // 禁言群组中的该条消息发言成员
-func muteGroupMember(client *client.QQClient, m *message.GroupMessage, d time.Duration) error {
-	g, err := client.GetGroupInfo(m.GroupCode)
-	if err != nil {
-		return fmt.Errorf("failed to mute member: %v", err)
-	}
-	g.Members, _ = client.GetGroupMembers(g)
-	member := g.FindMember(m.Sender.Uin)
-	if member == nil {
-		return nil
-	}
-	// in seconds, if less than 60, 1 minute is used
-	return member.Mute(uint32(d.Seconds()))
+func muteGroupMember(client qqClient, m *message.GroupMessage, d time.Duration) error {
+	return client.MuteGroupMember(m.GroupCode, m.Sender.Uin, d)
 }
 
-func handleNewMemberJoin(client *client.QQClient, event *client.MemberJoinGroupEvent) {
+func handleNewMemberJoin(client qqClient, event *client.MemberJoinGroupEvent) {
 	logger.WithField("uin", event.Member.Uin).Infof("a new member joined")
 	welcomeImage, err := readImageURI(os.Getenv("QQ_GROUP_WELCOME_URI"))
 	if err != nil {
@@ -579,7 +586,7 @@ func handleNewMemberJoin(client *client.QQClient, event *client.MemberJoinGroupE
 	client.SendGroupMessage(event.Group.Code, msg)
 }
 
-func handleMemberLeave(client *client.QQClient, event *client.MemberLeaveGroupEvent) {
+func handleMemberLeave(client qqClient, event *client.MemberLeaveGroupEvent) {
 	logger.WithField("uin", event.Member.Uin).Infof("a new member leaved")
 	msg := message.NewSendingMessage()
 	if event.Operator != nil {
@@ -5,6 +5,7 @@ import (
 	"github.com/Logiase/MiraiGo-Template/config"
 	"github.com/Mrs4s/MiraiGo/client"
 	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
@@ -12,11 +13,28 @@ import (
 )
 
 func TestMain(t *testing.M) {
-	config.Init()
+	// read application.yaml in the repository root when run from this directory
+	config.GlobalConfig = &config.Config{Viper: viper.New()}
+	config.GlobalConfig.SetConfigName("application")
+	config.GlobalConfig.SetConfigType("yaml")
+	config.GlobalConfig.AddConfigPath(".")
+	config.GlobalConfig.AddConfigPath("./config")
+	config.GlobalConfig.AddConfigPath("..")
+	if err := config.GlobalConfig.ReadInConfig(); err != nil {
+		panic(err)
+	}
 	os.Exit(t.Run())
 }
 
+// 需要扫码登录真实的QQ，设置QQ_LOGIN_TEST后运行
+func skipWithoutLogin(t *testing.T) {
+	if os.Getenv("QQ_LOGIN_TEST") == "" {
+		t.Skip("set QQ_LOGIN_TEST to run tests that log in to QQ")
+	}
+}
+
 func TestNewJoin(t *testing.T) {
+	skipWithoutLogin(t)
 	bot.Init()
 	bot.StartService()
 	bot.UseProtocol(bot.AndroidPhone)
@@ -28,7 +46,7 @@ func TestNewJoin(t *testing.T) {
 	group := &client.GroupInfo{
 		Code: 852485822,
 	}
-	handleNewMemberJoin(bot.Instance.QQClient, &client.MemberJoinGroupEvent{
+	handleNewMemberJoin(newMiraiClient(bot.Instance.QQClient), &client.MemberJoinGroupEvent{
 		Group: group,
 		Member: &client.GroupMemberInfo{
 			Group:    group,
@@ -40,6 +58,7 @@ func TestNewJoin(t *testing.T) {
 }
 
 func TestMuteMember(t *testing.T) {
+	skipWithoutLogin(t)
 	bot.Init()
 	bot.StartService()
 	bot.UseProtocol(bot.AndroidPhone)
@@ -48,7 +67,7 @@ func TestMuteMember(t *testing.T) {
 	bot.SaveToken()
 	bot.RefreshList()
 
-	assert.NoError(t, muteGroupMember(bot.Instance.QQClient, &message.GroupMessage{
+	assert.NoError(t, muteGroupMember(newMiraiClient(bot.Instance.QQClient), &message.GroupMessage{
 		GroupCode: 852485822,
 		Sender: &message.Sender{
 			Uin: 2411690005,
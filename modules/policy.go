@@ -0,0 +1,352 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/Logiase/MiraiGo-Template/bot"
+	"github.com/Logiase/MiraiGo-Template/config"
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/spf13/viper"
+	"github.com/yangrq1018/botqq/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 不能在群内关闭的模块，否则无法再通过命令打开
+var coreModules = map[string]bool{"help": true, "super": true}
+
+// groupConfigurable 是可以用 /module set 在群内覆盖配置的模块
+type groupConfigurable interface {
+	// 可以覆盖的配置项，都是 modules.<模块> 下的顶层配置
+	groupSettingKeys() []string
+	// 校验合并了群覆盖项之后的配置
+	checkGroupSettings(v *viper.Viper) error
+}
+
+// policyStore 保存每个群的模块开关与模块配置覆盖
+//
+// 配置文件中的写法:
+//
+//	groups:
+//	  852485822:
+//	    disabled_modules: [setu]
+//	    modules:
+//	      spam: {allow: 20}
+//
+// 通过 /module 命令修改的开关和配置保存在数据库中，优先于配置文件
+type policyStore struct {
+	policies map[int64]*model.GroupPolicy
+	settings map[string]*viper.Viper // 合并后的配置缓存, key为 群号/配置名
+	loaded   bool
+	mu       sync.RWMutex
+	ctx      context.Context
+}
+
+var policies = &policyStore{ctx: context.Background()}
+
+// 从配置文件和数据库读取所有群的策略，数据库中的开关覆盖配置文件
+func (p *policyStore) load() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loadLocked()
+}
+
+// 调用者需持有写锁
+func (p *policyStore) loadLocked() {
+	loaded := make(map[int64]*model.GroupPolicy)
+	get := func(groupCode int64) *model.GroupPolicy {
+		if _, ok := loaded[groupCode]; !ok {
+			loaded[groupCode] = &model.GroupPolicy{
+				GroupCode: groupCode,
+				Modules:   make(map[string]bool),
+				Settings:  make(map[string]map[string]interface{}),
+			}
+		}
+		return loaded[groupCode]
+	}
+
+	for key := range config.GlobalConfig.GetStringMap("groups") {
+		groupCode, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			logger.Errorf("invalid group code in config: %s", key)
+			continue
+		}
+		sub := config.GlobalConfig.Sub("groups." + key)
+		if sub == nil {
+			continue
+		}
+		policy := get(groupCode)
+		for _, id := range sub.GetStringSlice("disabled_modules") {
+			policy.Modules[id] = false
+		}
+		for name := range sub.GetStringMap("modules") {
+			policy.Settings[name] = sub.GetStringMap("modules." + name)
+		}
+	}
+
+	stored, err := store().Policies().List(p.ctx)
+	if err != nil {
+		logger.Errorf("failed to load group policies: %v", err)
+	} else {
+		for _, s := range stored {
+			policy := get(s.GroupCode)
+			for id, on := range s.Modules {
+				policy.Modules[id] = on
+			}
+			for name, values := range s.Settings {
+				if policy.Settings[name] == nil {
+					policy.Settings[name] = make(map[string]interface{})
+				}
+				for k, v := range values {
+					policy.Settings[name][k] = plainValue(v)
+				}
+			}
+		}
+	}
+
+	p.policies = loaded
+	p.settings = make(map[string]*viper.Viper)
+	p.loaded = true
+	logger.Infof("loaded policies of %d groups", len(loaded))
+}
+
+func (p *policyStore) ensureLoaded() {
+	p.mu.RLock()
+	loaded := p.loaded
+	p.mu.RUnlock()
+	if loaded {
+		return
+	}
+	// 在写锁内再检查一次，避免并发时重复读取并覆盖其他协程的修改
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.loaded {
+		p.loadLocked()
+	}
+}
+
+// 模块是否在该群启用
+func (p *policyStore) enabled(groupCode int64, id string) bool {
+	p.ensureLoaded()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if policy, ok := p.policies[groupCode]; ok {
+		if on, ok := policy.Modules[id]; ok {
+			return on
+		}
+	}
+	return true
+}
+
+// 打开或关闭该群的模块，并保存到数据库
+func (p *policyStore) setEnabled(groupCode int64, id string, on bool) error {
+	p.ensureLoaded()
+	if err := store().Policies().SetModule(p.ctx, groupCode, id, on); err != nil {
+		return fmt.Errorf("failed to save group policy: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policy(groupCode).Modules[id] = on
+	return nil
+}
+
+// 数据库读出的数组是 primitive.A，viper 不能转换，改为普通的 []interface{}
+func plainValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case primitive.A:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = plainValue(item)
+		}
+		return values
+	case primitive.D:
+		return plainValue(v.Map())
+	case primitive.M:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = plainValue(item)
+		}
+		return m
+	}
+	return v
+}
+
+// 群内生效的模块配置，即 modules.<name> 叠加该群的覆盖项
+func (p *policyStore) groupSettings(groupCode int64, name string) *viper.Viper {
+	p.ensureLoaded()
+	key := strconv.FormatInt(groupCode, 10) + "/" + name
+	p.mu.RLock()
+	v, ok := p.settings[key]
+	p.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v = mergeSettings(name, p.overrides(groupCode, name))
+	p.settings[key] = v
+	return v
+}
+
+// 该群模块配置的覆盖项的拷贝，需要持有锁
+func (p *policyStore) overrides(groupCode int64, name string) map[string]interface{} {
+	overrides := make(map[string]interface{})
+	if policy, ok := p.policies[groupCode]; ok {
+		for k, v := range policy.Settings[name] {
+			overrides[k] = v
+		}
+	}
+	return overrides
+}
+
+func mergeSettings(name string, overrides map[string]interface{}) *viper.Viper {
+	v := viper.New()
+	if global := config.GlobalConfig.Sub("modules." + name); global != nil {
+		_ = v.MergeConfigMap(global.AllSettings())
+	}
+	_ = v.MergeConfigMap(overrides)
+	return v
+}
+
+// 该群的策略，不存在时创建，需要持有锁
+func (p *policyStore) policy(groupCode int64) *model.GroupPolicy {
+	policy, ok := p.policies[groupCode]
+	if !ok {
+		policy = &model.GroupPolicy{
+			GroupCode: groupCode,
+			Modules:   make(map[string]bool),
+			Settings:  make(map[string]map[string]interface{}),
+		}
+		p.policies[groupCode] = policy
+	}
+	return policy
+}
+
+// 覆盖该群模块的一项配置并保存到数据库，value 为空时删除覆盖项，恢复配置文件的值；
+// 保存前用模块的 checkGroupSettings 校验合并后的配置
+func (p *policyStore) setSetting(groupCode int64, name, key, value string) error {
+	p.ensureLoaded()
+	m, ok := registeredModule(name).(groupConfigurable)
+	if !ok {
+		return fmt.Errorf("模块%s不能在群内修改配置", name)
+	}
+	allowed := false
+	for _, k := range m.groupSettingKeys() {
+		allowed = allowed || k == key
+	}
+	if !allowed {
+		return fmt.Errorf("模块%s可以修改的配置项: %s", name, strings.Join(m.groupSettingKeys(), ", "))
+	}
+
+	var stored interface{}
+	if value != "" {
+		stored = value
+		// 数组写成逗号或空格分隔
+		if _, ok := config.GlobalConfig.Get("modules." + name + "." + key).([]interface{}); ok {
+			stored = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '，' || unicode.IsSpace(r) })
+		}
+	}
+	p.mu.RLock()
+	overrides := p.overrides(groupCode, name)
+	p.mu.RUnlock()
+	if stored == nil {
+		delete(overrides, key)
+	} else {
+		overrides[key] = stored
+	}
+	if err := m.checkGroupSettings(mergeSettings(name, overrides)); err != nil {
+		return err
+	}
+
+	if err := store().Policies().SetSetting(p.ctx, groupCode, name, key, stored); err != nil {
+		return fmt.Errorf("failed to save group policy: %v", err)
+	}
+	p.mu.Lock()
+	p.policy(groupCode).Settings[name] = overrides
+	delete(p.settings, strconv.FormatInt(groupCode, 10)+"/"+name)
+	p.mu.Unlock()
+	// 模块缓存了群配置时重新读取
+	if r, ok := m.(reloadable); ok {
+		return r.reload()
+	}
+	return nil
+}
+
+func (s *super) module(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	action, id := args.str("操作"), args.str("模块")
+	switch action {
+	case "list", "ls":
+		var lines []string
+		for _, m := range registeredModules {
+			mid := m.MiraiGoModule().ID.Name()
+			state := "开启"
+			if !policies.enabled(msg.GroupCode, mid) {
+				state = "关闭"
+			}
+			lines = append(lines, mid+": "+state)
+		}
+		sort.Strings(lines)
+		replyToGroupMessage(client, msg, "本群模块状态:\n"+strings.Join(lines, "\n"))
+	case "enable", "disable":
+		if id == "" {
+			replyToGroupMessage(client, msg, "请指定模块，发送 /module list 查看所有模块")
+			return
+		}
+		if !isModuleRegistered(id) {
+			replyToGroupMessage(client, msg, "没有模块"+id)
+			return
+		}
+		on := action == "enable"
+		if !on && coreModules[id] {
+			replyToGroupMessage(client, msg, "模块"+id+"不能关闭")
+			return
+		}
+		if err := policies.setEnabled(msg.GroupCode, id, on); err != nil {
+			logger.Error(err)
+			replyToGroupMessage(client, msg, "保存失败: "+err.Error())
+			return
+		}
+		if on {
+			replyToGroupMessage(client, msg, "已在本群开启模块"+id)
+		} else {
+			replyToGroupMessage(client, msg, "已在本群关闭模块"+id)
+		}
+	case "set":
+		if !isModuleRegistered(id) {
+			replyToGroupMessage(client, msg, "请指定模块，发送 /module list 查看所有模块")
+			return
+		}
+		key, value := args.str("配置项"), args.str("值")
+		if err := policies.setSetting(msg.GroupCode, id, key, value); err != nil {
+			logger.Errorf("failed to set %s.%s of group %d: %v", id, key, msg.GroupCode, err)
+			replyToGroupMessage(client, msg, "修改失败: "+err.Error())
+			return
+		}
+		if value == "" {
+			replyToGroupMessage(client, msg, fmt.Sprintf("已恢复本群%s的配置%s", id, key))
+		} else {
+			replyToGroupMessage(client, msg, fmt.Sprintf("已把本群%s的配置%s改为%s", id, key, value))
+		}
+	default:
+		replyToGroupMessage(client, msg, "未知操作"+action+"\n用法: /module list|enable|disable [模块]，/module set <模块> <配置项> [值]")
+	}
+}
+
+func isModuleRegistered(id string) bool {
+	return registeredModule(id) != nil
+}
+
+func registeredModule(id string) bot.Module {
+	for _, m := range registeredModules {
+		if m.MiraiGoModule().ID.Name() == id {
+			return m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModuleSet(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	s := new(super)
+	s.Init()
+	a := newTestAntiSpam(h)
+
+	h.say(sender(testOwnerUin), "@bot /module set spam allow 20")
+	assert.Equal(t, "已把本群spam的配置allow改为20", h.client.lastText())
+	assert.Equal(t, 20, a.config(testGroupCode).allowMsgs)
+	h.say(sender(testOwnerUin), "@bot /module set spam ladder warn, kick")
+	assert.Equal(t, []string{"warn", "kick"}, policies.groupSettings(testGroupCode, "spam").GetStringSlice("ladder"))
+	h.say(sender(testOwnerUin), "@bot /module set roll reminders 1h,10m")
+	assert.Equal(t, []string{"1h", "10m"}, policies.groupSettings(testGroupCode, "roll").GetStringSlice("reminders"))
+
+	// 保存在数据库中，重新加载后仍然生效
+	policies.load()
+	assert.Equal(t, 20, policies.groupSettings(testGroupCode, "spam").GetInt("allow"))
+	assert.Equal(t, []string{"warn", "kick"}, policies.groupSettings(testGroupCode, "spam").GetStringSlice("ladder"))
+
+	// 用模块的配置校验
+	h.say(sender(testOwnerUin), "@bot /module set spam allow 0")
+	assert.Equal(t, "修改失败: allow must be positive", h.client.lastText())
+	h.say(sender(testOwnerUin), "@bot /module set spam decay soon")
+	assert.Contains(t, h.client.lastText(), "修改失败: invalid decay")
+	h.say(sender(testOwnerUin), "@bot /module set roll claim_window -1h")
+	assert.Contains(t, h.client.lastText(), "修改失败: invalid claim_window")
+	h.say(sender(testOwnerUin), "@bot /module set spam ladder warn,shout")
+	assert.Equal(t, `修改失败: unknown punishment "shout" in ladder`, h.client.lastText())
+	h.say(sender(testOwnerUin), "@bot /module set spam detectors off")
+	assert.Contains(t, h.client.lastText(), "修改失败: 模块spam可以修改的配置项: guard_duration, allow")
+	// 审计群和审计人只能在配置文件中修改
+	h.say(sender(testOwnerUin), "@bot /module set spam audit_group 20001")
+	assert.Contains(t, h.client.lastText(), "修改失败: 模块spam可以修改的配置项")
+	h.say(sender(testOwnerUin), "@bot /module set manage keyword_reply x")
+	assert.Equal(t, "修改失败: 模块manage不能在群内修改配置", h.client.lastText())
+	assert.Equal(t, 20, policies.groupSettings(testGroupCode, "spam").GetInt("allow"))
+
+	// 不写值时恢复配置文件的值
+	h.say(sender(testOwnerUin), "@bot /module set spam allow")
+	assert.Equal(t, "已恢复本群spam的配置allow", h.client.lastText())
+	assert.Equal(t, 10, policies.groupSettings(testGroupCode, "spam").GetInt("allow"))
+	policies.load()
+	assert.Equal(t, 10, policies.groupSettings(testGroupCode, "spam").GetInt("allow"))
+
+	h.say(sender(testMemberUin), "@bot /module set spam allow 100")
+	assert.Contains(t, h.client.sentTexts(), "/module需要群管理员权限")
+}
@@ -0,0 +1,129 @@
+package modules
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Logiase/MiraiGo-Template/config"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadable 模块在配置文件修改后重新读取自己的配置，
+// 校验失败时返回错误并保留旧的配置
+type reloadable interface {
+	reload() error
+}
+
+var (
+	lastSettings   map[string]interface{} // 上一次加载的配置，用于打印修改了哪些配置项
+	lastSettingsMu sync.Mutex
+)
+
+// 注册配置文件修改的回调，viper只保留最后一个回调，所以所有模块共用这一个
+func watchConfigChange() {
+	lastSettingsMu.Lock()
+	lastSettings = flattenSettings(config.GlobalConfig.AllSettings())
+	lastSettingsMu.Unlock()
+	config.GlobalConfig.OnConfigChange(func(in fsnotify.Event) {
+		logger.Infof("the config file has changed, op=%s, name=%s", in.Op.String(), in.Name)
+		reloadConfig()
+	})
+}
+
+func reloadConfig() {
+	lastSettingsMu.Lock()
+	settings := flattenSettings(config.GlobalConfig.AllSettings())
+	changes := diffSettings(lastSettings, settings)
+	lastSettings = settings
+	lastSettingsMu.Unlock()
+	if len(changes) == 0 {
+		logger.Info("no config item changed")
+		return
+	}
+	for _, change := range changes {
+		logger.Infof("config changed: %s", change)
+	}
+
+	policies.load()
+	for _, m := range registeredModules {
+		id := m.MiraiGoModule().ID.Name()
+		if b, ok := m.(interface{ reloadBase() }); ok {
+			b.reloadBase()
+		}
+		if r, ok := m.(reloadable); ok {
+			if err := r.reload(); err != nil {
+				logger.Errorf("module %s keeps the old config, reload failed: %v", id, err)
+				continue
+			}
+			logger.Infof("module %s reloaded", id)
+		}
+	}
+}
+
+// 把嵌套的配置展开成 a.b.c -> value
+func flattenSettings(settings map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			if sub, ok := v.(map[string]interface{}); ok {
+				walk(key, sub)
+			} else {
+				flat[key] = v
+			}
+		}
+	}
+	walk("", settings)
+	return flat
+}
+
+// 名称里带这些词的配置项只打印名称，不把值写进日志
+var secretKeywords = []string{"token", "password", "secret"}
+
+func isSecretKey(key string) bool {
+	name := strings.ToLower(key[strings.LastIndex(key, ".")+1:])
+	for _, w := range secretKeywords {
+		if strings.Contains(name, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func diffSettings(old, new map[string]interface{}) []string {
+	var changes []string
+	for k, v := range new {
+		o, ok := old[k]
+		switch {
+		case ok && reflect.DeepEqual(o, v):
+		case isSecretKey(k):
+			if ok {
+				changes = append(changes, fmt.Sprintf("%s: changed", k))
+			} else {
+				changes = append(changes, fmt.Sprintf("%s: added", k))
+			}
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s: added %v", k, v))
+		default:
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", k, o, v))
+		}
+	}
+	for k, o := range old {
+		if _, ok := new[k]; !ok {
+			if isSecretKey(k) {
+				changes = append(changes, fmt.Sprintf("%s: removed", k))
+			} else {
+				changes = append(changes, fmt.Sprintf("%s: removed %v", k, o))
+			}
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
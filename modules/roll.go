@@ -15,15 +15,14 @@ import (
 	"github.com/Mrs4s/MiraiGo/client"
 	"github.com/Mrs4s/MiraiGo/message"
 	"github.com/julienschmidt/httprouter"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
 	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
 	"github.com/yangrq1018/botqq/utils"
 	"github.com/yudeguang/ratelimit"
 	"github.com/zyedidia/generic"
 	"github.com/zyedidia/generic/hashset"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
@@ -33,14 +32,15 @@ var (
 type roll struct {
 	base
 
-	groupNotice       bool
-	rule              *ratelimit.Rule
-	database          *mongo.Database
+	rule              *ratelimit.Rule // protected by _mu, swapped on config reload
 	ctx               context.Context
-	atAll             bool
+	stop              context.CancelFunc // cancels ctx on Stop
 	backendServerAddr string
-	ctxMgr            map[string]context.CancelFunc // all operation on ctxMgr should hold _mu
+	apiToken          string        // protected by _mu, empty disables the api
+	pollEvery         time.Duration // protected by _mu, interval of polling new rolls
+	missedGrace       time.Duration // protected by _mu, missed draws older than this are cancelled on start
 	_mu               sync.Mutex
+	claimMu           sync.Mutex // serializes changes of claims
 }
 
 func (r *roll) MiraiGoModule() bot.ModuleInfo {
@@ -51,64 +51,162 @@ func (r *roll) MiraiGoModule() bot.ModuleInfo {
 }
 
 func (r *roll) Init() {
-	r.base.Init()
-	r.rule = ratelimit.NewRule()
-	r.ctx = context.Background()
-	r.ctxMgr = make(map[string]context.CancelFunc)
-	r.database = mongoClient.Database("qq")
+	r.base.init(r.MiraiGoModule().ID)
+	r.ctx, r.stop = context.WithCancel(context.Background())
+	if err := r.reload(); err != nil {
+		logger.Fatalf("module %s config not loaded: %v", r.MiraiGoModule().ID.Name(), err)
+	}
 
-	moduleConfig := config.GlobalConfig.Sub("modules.roll")
-	r.groupNotice = moduleConfig.GetBool("group_notice")
-	r.atAll = moduleConfig.GetBool("at_all")
-	r.backendServerAddr = moduleConfig.GetString("addr")
+	registerCommand(&botCommand{
+		name:    "/roll",
+		aliases: []string{"/抽奖"},
+		args:    []argSpec{{name: "奖品与开奖时间", kind: argText, optional: true}},
+		help:    "发起抽奖，第二行写奖品，第三行写开奖时间；/roll info #id 查看，/roll edit #id 修改，/roll export #id 导出参与者，/roll remind #id 开奖前私聊提醒，/roll stats 统计，/roll me 我的中奖记录",
+		detail:  "格式:\n" + rollUsage + "\n\n" + rollEditUsage,
+		perm:    permMember, // 发起和修改需要群管理员，在命令中检查
+		handle:  r.roll,
+		owner:   r,
+	})
+	registerCommand(&botCommand{
+		name:    "/cancel",
+		aliases: []string{"/取消抽奖"},
+		args:    []argSpec{{name: "id", kind: argID}},
+		help:    "取消抽奖",
+		perm:    permGroupAdmin,
+		handle:  r.cancel,
+		owner:   r,
+	})
+	registerCommand(&botCommand{
+		name:    "/join",
+		aliases: []string{"/参加"},
+		args:    []argSpec{{name: "id", kind: argID}, {name: "口令", kind: argText, optional: true}},
+		help:    "参加抽奖，也可以私聊机器人 参加 #id",
+		perm:    permMember,
+		handle:  r.joinCommand,
+		owner:   r,
+	})
+	registerCommand(&botCommand{
+		name:    "/leave",
+		aliases: []string{"/退出抽奖"},
+		args:    []argSpec{{name: "id", kind: argID}},
+		help:    "退出抽奖，也可以私聊机器人 退出 #id",
+		perm:    permMember,
+		handle:  r.leaveCommand,
+		owner:   r,
+	})
+	registerCommand(&botCommand{
+		name:    "/catalog",
+		aliases: []string{"/奖品库"},
+		args:    []argSpec{{name: "编号或操作", kind: argText, optional: true}},
+		help:    "查看奖品库，发起抽奖时奖品写奖品库中的编号",
+		detail:  catalogUsage,
+		perm:    permMember, // 修改需要机器人管理员，在命令中检查
+		handle:  r.catalog,
+		owner:   r,
+	})
+	registerCommand(&botCommand{
+		name:    "/rolls",
+		aliases: []string{"/抽奖列表"},
+		help:    "列出本群进行中的抽奖",
+		perm:    permMember,
+		handle:  r.list,
+		owner:   r,
+	})
+	registerCommand(&botCommand{
+		name:    "/verify",
+		aliases: []string{"/验证"},
+		args:    []argSpec{{name: "id", kind: argID}},
+		help:    "验证抽奖的开奖结果",
+		detail:  "算法: " + drawAlgorithm,
+		perm:    permMember,
+		handle:  r.verify,
+		owner:   r,
+	})
+}
 
+func (r *roll) reload() error {
+	moduleConfig := config.GlobalConfig.Sub("modules.roll")
+	if moduleConfig == nil {
+		return fmt.Errorf("config not found")
+	}
 	// 限制新建抽奖的频率最高为每分钟三次
+	rule := ratelimit.NewRule()
 	if moduleConfig.IsSet("rate") {
 		duration, times := moduleConfig.GetDuration("rate.duration"), moduleConfig.GetInt("rate.times")
+		if duration <= 0 || times <= 0 {
+			return fmt.Errorf("invalid rate %d per %s", times, duration)
+		}
 		logger.Infof("application (per user) rate limit set to %d per %s", times, duration)
-		r.rule.AddRule(duration, times)
+		rule.AddRule(duration, times)
+	}
+	addr := moduleConfig.GetString("addr")
+
+	r._mu.Lock()
+	defer r._mu.Unlock()
+	if r.backendServerAddr == "" {
+		r.backendServerAddr = addr
+	} else if addr != r.backendServerAddr {
+		logger.Warnf("roll server address changed to %s, restart to take effect", addr)
+	}
+	r.rule = rule
+	r.apiToken = moduleConfig.GetString("api_token")
+	r.missedGrace = moduleConfig.GetDuration("missed_grace")
+	r.pollEvery = moduleConfig.GetDuration("poll_interval")
+	if r.pollEvery <= 0 {
+		r.pollEvery = defaultPollInterval
 	}
+	return nil
+}
+
+func (r *roll) groupSettingKeys() []string {
+	return []string{"group_notice", "at_all", "claim_window", "reminders"}
+}
+
+func (r *roll) checkGroupSettings(v *viper.Viper) error {
+	for _, key := range []string{"group_notice", "at_all"} {
+		if _, err := cast.ToBoolE(v.Get(key)); err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	if d, err := cast.ToDurationE(v.Get("claim_window")); err != nil || d < 0 {
+		return fmt.Errorf("invalid claim_window %v", v.Get("claim_window"))
+	}
+	for _, s := range v.GetStringSlice("reminders") {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			return fmt.Errorf("invalid reminder %q", s)
+		}
+	}
+	return nil
+}
+
+func (r *roll) rateRule() *ratelimit.Rule {
+	r._mu.Lock()
+	defer r._mu.Unlock()
+	return r.rule
 }
 
 func (r *roll) PostInit() {}
 
 func (r *roll) Serve(bot *bot.Bot) {
-	r.monitorGroups.Each(func(code int64) {
-		registerMessageListener(code, r.dispatch, &bot.GroupMessageEvent, &bot.SelfGroupMessageEvent)
-	})
-	go r.startServer(bot.QQClient, r.backendServerAddr)
+	r.registerMessageListener(r.dispatch, groupMessageEvent)
+	registerPrivateMessageListener(r.handlePrivate, privateMessageEvent)
+	go r.startServer(newMiraiClient(bot.QQClient), r.backendServerAddr)
 }
 
 func (r *roll) Start(bot *bot.Bot) {
-	// start unfinished rolls
-	collection := r.collection()
-	r.monitorGroups.Each(func(groupCode int64) {
-		cursor, err := collection.Find(r.ctx, bson.M{
-			"group_code": groupCode,
-			"draw_time": bson.M{
-				"$gt": time.Now(),
-			},
-		})
-		if err != nil {
-			logger.Fatal(err)
-		}
-		logger.Info("checking unfinished rolls...")
-		for cursor.Next(r.ctx) {
-			var e rollEvent
-			err = cursor.Decode(&e)
-			if err != nil {
-				logger.Error(err)
-				continue
-			}
-			e.DrawTime = e.DrawTime.In(time.Local)
-			go r.drawLater(bot.QQClient, groupCode, &e)
-		}
-	})
-
-	go r.webSourceInsert(bot)
+	client := newMiraiClient(bot.QQClient)
+	r.restore(client)
+
+	// 网站写入的抽奖
+	if n, err := store().Rolls().ReleaseAnnouncing(r.ctx); err != nil {
+		logger.Errorf("failed to release announcing rolls: %v", err)
+	} else if n > 0 {
+		logger.Warnf("%d rolls were left announcing, announce them again", n)
+	}
+	go r.pollNew(client)
 }
 
-func (r *roll) startServer(c *client.QQClient, addr string) {
+func (r *roll) startServer(c qqClient, addr string) {
 	router := httprouter.New()
 	router.GET("/members/:group", func(writer http.ResponseWriter, _ *http.Request, params httprouter.Params) {
 		groupCode, _ := strconv.Atoi(params.ByName("group"))
@@ -133,6 +231,7 @@ func (r *roll) startServer(c *client.QQClient, addr string) {
 	router.GET("/groups", func(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 		err := c.ReloadGroupList()
 		if err == nil {
+			groupList := c.Groups()
 			groups := make([]struct {
 				Uin             int64
 				Code            int64
@@ -142,16 +241,16 @@ func (r *roll) startServer(c *client.QQClient, addr string) {
 				GroupLevel      uint32
 				MemberCount     uint16
 				MaxMemberCount  uint16
-			}, len(c.GroupList))
-			for i := range c.GroupList {
-				groups[i].Uin = c.GroupList[i].Uin
-				groups[i].Code = c.GroupList[i].Code
-				groups[i].Name = c.GroupList[i].Name
-				groups[i].OwnerUin = c.GroupList[i].OwnerUin
-				groups[i].GroupCreateTime = c.GroupList[i].GroupLevel
-				groups[i].GroupLevel = c.GroupList[i].GroupLevel
-				groups[i].MemberCount = c.GroupList[i].MemberCount
-				groups[i].MaxMemberCount = c.GroupList[i].MaxMemberCount
+			}, len(groupList))
+			for i := range groupList {
+				groups[i].Uin = groupList[i].Uin
+				groups[i].Code = groupList[i].Code
+				groups[i].Name = groupList[i].Name
+				groups[i].OwnerUin = groupList[i].OwnerUin
+				groups[i].GroupCreateTime = groupList[i].GroupLevel
+				groups[i].GroupLevel = groupList[i].GroupLevel
+				groups[i].MemberCount = groupList[i].MemberCount
+				groups[i].MaxMemberCount = groupList[i].MaxMemberCount
 			}
 			_ = json.NewEncoder(writer).Encode(&groups)
 			return
@@ -160,12 +259,15 @@ func (r *roll) startServer(c *client.QQClient, addr string) {
 			writer.WriteHeader(http.StatusInternalServerError)
 		}
 	})
+	router.GET("/rolls/:id/verify", r.verifyHandler)
+	r.registerAPI(router, c)
 	go http.ListenAndServe(addr, router)
 }
 
 func (r *roll) Stop(_ *bot.Bot, wg *sync.WaitGroup) {
 	defer wg.Done()
-	_ = r.database.Client().Disconnect(r.ctx)
+	r.stop()
+	closeStore(context.Background())
 }
 
 // 选出第一个回复元素, nil if none
@@ -179,82 +281,110 @@ func replyMessage(msg *message.GroupMessage) *message.ReplyElement {
 	return nil
 }
 
-func (r *roll) persistModel(event *rollEvent) {
-	model := event.Model()
-	model.ObjectID.ObjectID = primitive.NewObjectID() // get a new object ID here
-	model.Insert(r.ctx, r.collection())
-	event.ObjectID = model.ObjectID
+func (r *roll) persistModel(event *rollEvent) error {
+	if event.SeedHash == "" {
+		event.Seed, event.SeedHash = newSeed()
+	}
+	if event.Status == "" {
+		event.Status = model.RollPending
+	}
+	m := event.Model()
+	if err := store().Rolls().Insert(r.ctx, m); err != nil { // a new object ID is assigned here
+		logger.Errorf("failed to persist roll event: %v", err)
+		return err
+	}
+	event.ObjectID = m.ObjectID
+	return nil
 }
 
 func (r *roll) getRoll(groupCode int64, msgID int32) (*rollEvent, bool) {
-	var data model.MongoEvent
-	err, ok := data.Find(r.ctx, r.collection(), groupCode, msgID)
-	if !ok || err != nil {
+	data, err := store().Rolls().FindByMessage(r.ctx, groupCode, msgID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			logger.Errorf("failed to get roll event: %v", err)
+		}
 		return nil, false
 	}
-	return newRollEventFromModel(&data), true
-}
-
-func (r *roll) collection() *mongo.Collection {
-	return r.database.Collection("csgo")
+	return newRollEventFromModel(data), true
 }
 
-func replyToGroupMessage(client *client.QQClient, msg *message.GroupMessage, text string) {
+func replyToGroupMessage(client qqClient, msg *message.GroupMessage, text string) {
 	client.SendGroupMessage(msg.GroupCode, utils.NewTextMessage(text))
 }
 
-func (r *roll) dispatch(client *client.QQClient, msg *message.GroupMessage) {
+func (r *roll) dispatch(client qqClient, msg *message.GroupMessage) {
 	if reply := replyMessage(msg); reply != nil {
+		// 中奖者回复中奖消息领奖
+		if r.claimByReply(client, msg, reply) {
+			return
+		}
 		// 确认回复对象是发起roll的消息
 		if re, ok := r.getRoll(msg.GroupCode, reply.ReplySeq); ok {
-			if !re.participants.Has(*msg.Sender) {
-				re.Model().AddParticipant(r.ctx, r.collection(), *msg.Sender)
-				logger.Infof("add a participant %s, current # of participants %d", msg.Sender.DisplayName(), re.participants.Size()+1)
-				replyToGroupMessage(client, msg, msg.Sender.DisplayName()+"已加入抽奖")
-			} else {
+			err := r.addParticipant(client, re, msg.GroupCode, *msg.Sender, msg.ToString(), time.Unix(int64(msg.Time), 0))
+			switch {
+			case err == errAlreadyJoined:
 				logger.Infof("%s already in roll %d", msg.Sender.DisplayName(), re.identity())
+			case err != nil:
+				replyToGroupMessage(client, msg, msg.Sender.DisplayName()+"无法加入抽奖: "+err.Error())
+			default:
+				replyToGroupMessage(client, msg, msg.Sender.DisplayName()+"已加入抽奖")
 			}
 		}
 	}
-	if r.isToBot(msg) {
-		if text := textOfGroupMessage(msg); text != nil {
-			cmd, args := command(text)
-			switch cmd {
-			case "/cancel":
-				if len(args) < 1 {
-					return
-				}
-				objectID := strings.TrimPrefix(args[0], "#")
-				r._mu.Lock()
-				if cancel, ok := r.ctxMgr[objectID]; ok {
-					logger.Infof("called cancel func of %s", objectID)
-					cancel()
-					delete(r.ctxMgr, objectID)
-					// don't delete object in database, for now
-				}
-				r._mu.Unlock()
-			case "/roll":
-				go func() {
-					if !r.rule.AllowVisit(msg.Sender.Uin) {
-						replyToGroupMessage(client, msg, "您的抽奖操作过于频繁，请稍后再试")
-					} else if !isAdmin(client, msg.GroupCode, msg.Sender.Uin) {
-						replyToGroupMessage(client, msg, "您不是管理员，没有抽奖权限")
-					} else {
-						err := r.rollCSGOSkin(client, msg)
-						if err != nil {
-							logger.Errorf("failed to roll: %v", err)
-						}
-					}
-				}()
+}
+
+func (r *roll) roll(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	fields := strings.Fields(args.raw)
+	if len(fields) > 0 {
+		switch fields[0] {
+		case "info", "详情":
+			r.info(client, msg, strings.Join(fields[1:], " "))
+			return
+		case "remind", "提醒":
+			r.subscribe(client, msg, strings.Join(fields[1:], " "))
+			return
+		case "stats", "统计":
+			r.stats(client, msg)
+			return
+		case "me", "我的":
+			r.me(client, msg)
+			return
+		case "edit", "修改":
+			if !r.permitted(client, msg, permGroupAdmin) {
+				replyToGroupMessage(client, msg, fmt.Sprintf("修改抽奖需要%s权限", permGroupAdmin))
+				return
+			}
+			r.edit(client, msg, args.raw)
+			return
+		case "export", "导出":
+			if !r.permitted(client, msg, permGroupAdmin) {
+				replyToGroupMessage(client, msg, fmt.Sprintf("导出抽奖需要%s权限", permGroupAdmin))
+				return
 			}
+			r.export(client, msg, strings.Join(fields[1:], " "))
+			return
 		}
 	}
+	if !r.permitted(client, msg, permGroupAdmin) {
+		replyToGroupMessage(client, msg, fmt.Sprintf("发起抽奖需要%s权限", permGroupAdmin))
+		return
+	}
+	go func() {
+		if !r.rateRule().AllowVisit(msg.Sender.Uin) {
+			replyToGroupMessage(client, msg, "您的抽奖操作过于频繁，请稍后再试")
+		} else {
+			err := r.rollCSGOSkin(client, msg)
+			if err != nil {
+				logger.Errorf("failed to roll: %v", err)
+			}
+		}
+	}()
 }
 
 // 返回该qq号是否是一个群的管理员
-func isAdmin(qqc *client.QQClient, groupCode, uin int64) bool {
+func isAdmin(qqc qqClient, groupCode, uin int64) bool {
 	admins := hashset.New(0, generic.Equals[int64], generic.HashInt64)
-	for _, g := range qqc.GroupList {
+	for _, g := range qqc.Groups() {
 		if g.Code == groupCode {
 			for _, member := range g.Members {
 				if member.Permission == client.Administrator || member.Permission == client.Owner {
@@ -266,164 +396,166 @@ func isAdmin(qqc *client.QQClient, groupCode, uin int64) bool {
 	return admins.Has(uin)
 }
 
-func (r *roll) drawLater(client *client.QQClient, groupCode int64, event *rollEvent) {
-	// wait until draw time
-	ctx, cancel := context.WithCancel(r.ctx)
-	defer cancel()
-	r._mu.Lock()
-	r.ctxMgr[event.ShortHexID()] = cancel
-	r._mu.Unlock()
+// 登记开奖任务，修改开奖时间后重新登记会替换原来的任务
+func (r *roll) scheduleDraw(client qqClient, event *rollEvent) {
+	logger.WithField("object_id", event.ShortHexID()).
+		WithField("after", time.Until(event.DrawTime)).
+		Infof("draw %q", event.prizeSummary())
+	jobs.schedule(drawJobKey(event.ObjectID.ObjectID), fmt.Sprintf("抽奖#%s开奖: %s", event.ShortHexID(), event.prizeSummary()),
+		event.GroupCode, event.DrawTime, func() {
+			r.drawNow(client, event)
+		})
+	r.scheduleReminders(client, event)
+}
 
-	after := time.Until(event.DrawTime)
+// 开奖
+func (r *roll) drawNow(client qqClient, event *rollEvent) {
+	ctx := r.ctx
+	groupCode := event.GroupCode
 	en := logger.
 		WithField("identity", event.identity()).
-		WithField("object_id", event.ShortHexID()).
-		WithField("after", after)
-	en.Infof("draw %q", event.SkinName)
-	select {
-	case <-time.After(after):
-	case <-ctx.Done():
-		en.Infof("cancelled")
-		client.SendGroupMessage(groupCode, utils.NewTextMessage("取消#"+event.ShortHexID()))
+		WithField("object_id", event.ShortHexID())
+	// refresh participants from database, by ID since the message ID may not be saved
+	m, err := store().Rolls().Get(ctx, event.ObjectID.ObjectID)
+	if err != nil {
+		logger.Errorf("failed to get roll event: %v", err)
 		return
 	}
-
-	// refresh participants from database
-	e, ok := r.getRoll(event.GroupCode, event.MsgID)
-	if !ok {
+	e := newRollEventFromModel(m)
+	if e.Status == model.RollAnnouncing {
+		// 发布后没能改为 pending，已经发布过了照常开奖
+		if _, err = store().Rolls().SwapStatus(ctx, e.ObjectID.ObjectID, model.RollAnnouncing, model.RollPending); err != nil {
+			logger.Errorf("failed to set roll status: %v", err)
+			return
+		}
+		e.Status = model.RollPending
+	}
+	if e.Status != model.RollPending {
+		en.Infof("roll is %s, not drawn", e.Status)
+		return
+	}
+	event.participants = e.participants
+	event.Groups = e.Groups
+	event.Seed, event.SeedHash = e.Seed, e.SeedHash
+	// 先算出结果，和状态一起保存，同时被取消或已经开过奖时不再公布
+	var (
+		winners []message.Sender
+		record  *model.DrawRecord
+	)
+	if len(event.Participants()) > 0 {
+		var drawn model.DrawRecord
+		winners, drawn = event.draw(func(order []int64) []int64 {
+			return r.entryWeights(ctx, event, order)
+		})
+		record = &drawn
+	}
+	if ok, err := store().Rolls().FinishDraw(ctx, e.ObjectID.ObjectID, record, winners); err != nil {
+		logger.Errorf("failed to save the draw: %v", err)
+		return
+	} else if !ok {
+		en.Infof("roll is no longer pending, not drawn")
 		return
-	} else {
-		event.participants = e.participants
 	}
 
-	if len(event.Participants()) == 0 {
+	if len(winners) == 0 {
 		logger.Infof("no participants in roll")
+		client.SendGroupMessage(groupCode, utils.NewTextMessage("#"+event.ShortHexID()+" 没有人参加，抽奖结束"))
+		r.sendToOtherGroups(client, event, "#"+event.ShortHexID()+" 没有人参加，抽奖结束")
 		return
 	}
-	winners := event.Draw()
+	window := claimWindow(groupCode)
+	var claims []model.Claim
 	for i, w := range winners {
 		en.Infof("draw the [%d]-th winner: %d(%s)", i, w.Uin, w.DisplayName())
-		e.Model().AddWinner(ctx, r.collection(), w)
-		client.SendGroupMessage(groupCode, event.noticeRollWinnerMessage(&w))
+		if claim := r.announceWinner(client, event, w, event.prizeOf(i), window); claim != nil {
+			claims = append(claims, *claim)
+		}
+	}
+	client.SendGroupMessage(groupCode, utils.NewTextMessage(fmt.Sprintf(
+		"#%s 开奖种子: %s\n发送 /verify #%s 验证开奖结果", event.ShortHexID(), record.Seed, event.ShortHexID())))
+	r.sendToOtherGroups(client, event, event.drawResultText(winners, record.Seed, window > 0))
+	if len(claims) > 0 {
+		if err := store().Rolls().SetClaims(ctx, e.ObjectID.ObjectID, claims); err != nil {
+			logger.Errorf("failed to save claims: %v", err)
+		}
+		r.scheduleClaims(client, e.ObjectID.ObjectID, e.ShortHexID(), groupCode, claims)
 	}
 }
 
 // 启动一个抽奖事件
-func (r *roll) rollCSGOSkin(client *client.QQClient, msg *message.GroupMessage) error {
-	event := newRollEventFromMessage(msg)
-	r.persistModel(event)
+func (r *roll) rollCSGOSkin(client qqClient, msg *message.GroupMessage) error {
+	event, err := newRollEventFromMessage(msg)
+	if err != nil {
+		replyToGroupMessage(client, msg, "抽奖创建失败:\n"+err.Error()+"\n用法:\n"+rollUsage)
+		return nil
+	}
+	event.Prizes = r.resolvePrizes(event.Prizes)
+	event.SkinName = event.prizeSummary()
+	if event.Groups, err = r.resolveGroups(client, event, msg.Sender.Uin); err != nil {
+		replyToGroupMessage(client, msg, "抽奖创建失败:\n1. "+err.Error())
+		return nil
+	}
+	if err = r.persistModel(event); err != nil {
+		replyToGroupMessage(client, msg, "抽奖创建失败: 无法保存")
+		return err
+	}
 	r.notice(client, event, msg)
+	r.announceInGroups(client, event)
 	// 创建群公告
-	if r.groupNotice {
+	if policies.groupSettings(msg.GroupCode, "roll").GetBool("group_notice") {
 		err := client.AddGroupNoticeSimple(msg.GroupCode, event.GroupNotice())
 		if err != nil {
 			logger.Errorf("failed to add group notice: %v", err)
 		}
 	}
 	logger.WithField("event", event).Infof("roll event created")
-	r.drawLater(client, msg.GroupCode, event)
+	r.scheduleDraw(client, event)
 	return nil
 }
 
-// This is an example change event struct for inserts.
-// It does not include all possible change event fields.
-// You should consult the change event documentation for more info:
-// https://docs.mongodb.com/manual/reference/change-events/
-type changeEvent struct {
-	OperationType string      `bson:"operationType"`
-	DocumentKey   documentKey `bson:"documentKey"`
-}
-
-type documentKey struct {
-	ID primitive.ObjectID `bson:"_id"`
-}
-
-// this is not a reliable method
-func (r *roll) webSourceInsert(bot *bot.Bot) {
-reconnect:
-	collection := r.collection()
-	// specify a pipeline that will only match "insert" events
-	// specify the MaxAwaitTimeOption to have each attempt wait two seconds for new documents
-	matchStage := bson.D{{"$match", bson.D{{"operationType", "insert"}}}}
-	opts := options.ChangeStream().SetMaxAwaitTime(2 * time.Second)
-	cs, err := collection.Watch(context.TODO(), mongo.Pipeline{matchStage}, opts)
-	if err != nil {
-		logger.Error(err)
-		return
-	}
-
-	cleanup := func() {
-		_ = cs.Close(r.ctx)
-	}
-	defer cleanup()
-	logger.Infof("start listen to web source insert")
-	for cs.Next(r.ctx) {
-		var ce changeEvent
-		var re model.MongoEvent
-		_ = cs.Decode(&ce)
-		err = collection.FindOne(r.ctx, ce.DocumentKey).Decode(&re)
-		if err == nil {
-			logger.Infof("a new document insert: %v", ce.DocumentKey.ID)
-			if re.Source == "web" {
-				logger.Infof("a new web source mongo db document insert: %v", ce.DocumentKey.ID)
-				e := newRollEventFromModel(&re)
-				go func() {
-					msg2 := r.notice(bot.QQClient, e, nil)
-					_, err = collection.UpdateOne(r.ctx, ce.DocumentKey, bson.M{"$set": bson.M{"msg_id": msg2.Id}})
-					if err != nil {
-						logger.Error(err)
-						return
-					}
-					r.drawLater(bot.QQClient, e.GroupCode, e)
-				}()
-			}
-		} else {
-			break
+func (r *roll) notice(client qqClient, event *rollEvent, msg *message.GroupMessage) *message.GroupMessage {
+	if msg == nil {
+		msg2Res := r.sendNotice(client, event, event.GroupCode, "确认创建抽奖(来源Web)，回复本条任意内容以参加!")
+		if msg2Res != nil {
+			// set essential
+			_ = client.SetEssenceMessage(event.GroupCode, msg2Res.Id, msg2Res.InternalId)
+			event.MsgID = msg2Res.Id
 		}
+		return msg2Res
 	}
-	logger.Warn("the web source insert listen go routine stopped, err = %v", cs.Err())
-	cleanup()
-	logger.Info("reconnecting...")
-	goto reconnect
+	r.sendNotice(client, event, msg.GroupCode, "确认创建抽奖，回复上条消息（精华消息）任意内容以参加！")
+	_ = client.SetEssenceMessage(msg.GroupCode, msg.Id, msg.InternalId)
+	return msg
 }
 
-func (r *roll) notice(client *client.QQClient, event *rollEvent, msg *message.GroupMessage) *message.GroupMessage {
-	if msg == nil {
-		text2 := fmt.Sprintf(
-			`#%s
-确认创建抽奖(来源Web)，回复本条任意内容以参加!
-即将抽取奖品:%q 
-开奖时间:%s
-发起人:%s
-奖品数量:%d
-`, event.ObjectID.ShortHexID(), event.SkinName, event.DrawTime.In(time.Local).Format("01月02日 15:04"), event.SenderNickname, event.WinnerCount)
-		msg2 := message.NewSendingMessage()
-		if r.atAll {
-			msg2.Append(message.NewAt(0, ""))
-		}
-		msg2.Append(message.NewText(text2))
-		msg2Res := client.SendGroupMessage(event.GroupCode, msg2)
-
-		// set essential
-		_ = client.SetEssenceMessage(event.GroupCode, msg2Res.Id, msg2Res.InternalId)
-		event.MsgID = msg2Res.Id
-		return msg2Res
-	} else {
-		text2 := fmt.Sprintf(
-			`#%s
-确认创建抽奖，回复上条消息（精华消息）任意内容以参加！
+// 在群内发布抽奖，发送失败时返回nil
+func (r *roll) sendNotice(client qqClient, event *rollEvent, groupCode int64, header string) *message.GroupMessage {
+	text2 := fmt.Sprintf(
+		`#%s
+%s
 即将抽取奖品:%q 
 开奖时间:%s
 发起人:%s
 奖品数量:%d
-`, event.ShortHexID(), event.SkinName, event.DrawTime.Format("01月02日 15:04"), event.SenderNickname, event.WinnerCount)
-		msg2 := message.NewSendingMessage()
-		if r.atAll {
-			msg2.Append(message.NewAt(0, ""))
-		}
-		msg2.Append(message.NewText(text2))
-		client.SendGroupMessage(msg.GroupCode, msg2)
-		_ = client.SetEssenceMessage(msg.GroupCode, msg.Id, msg.InternalId)
-		return msg
+`, event.ShortHexID(), header, event.prizeSummary(), event.DrawTime.In(time.Local).Format("01月02日 15:04"), event.SenderNickname, event.WinnerCount)
+	text2 += "种子哈希:" + event.SeedHash + "\n"
+	if rules := describeRules(event.Rules); rules != "" {
+		text2 += "参与条件:" + rules + "\n"
+	}
+	if weights := describeWeights(event.Rules); weights != "" {
+		text2 += "加权:" + weights + "\n"
+	}
+	if len(event.Groups) > 0 {
+		text2 += fmt.Sprintf("同时在%d个群进行，参与者合并计算\n", len(event.Groups)+1)
+	}
+	if value := prizesValue(event.Prizes); value > 0 {
+		text2 += fmt.Sprintf("奖品估价:约¥%.2f\n", value)
+	}
+	msg2 := message.NewSendingMessage()
+	if policies.groupSettings(groupCode, "roll").GetBool("at_all") {
+		msg2.Append(message.NewAt(0, ""))
 	}
+	msg2.Append(message.NewText(text2))
+	appendPrizeImages(client, groupCode, msg2, event.Prizes)
+	return client.SendGroupMessage(groupCode, msg2)
 }
@@ -0,0 +1,391 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/julienschmidt/httprouter"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+	"github.com/yangrq1018/botqq/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 网站使用的抽奖接口，请求头需要带上 Authorization: Bearer <modules.roll.api_token>
+//
+//	POST  /api/rolls                    创建并在群内发布抽奖
+//	GET   /api/rolls?group=&status=     抽奖列表，status可以是多个，用逗号分隔
+//	GET   /api/rolls/:id                抽奖详情
+//	PATCH /api/rolls/:id                修改开奖时间、奖品或中奖人数
+//	POST  /api/rolls/:id/cancel         取消抽奖
+//	GET   /api/rolls/:id/participants   参与者、中奖者和领奖情况
+//	GET   /api/rolls/:id/export?format= 导出参与者和中奖者，format为csv（默认）或json
+//	GET   /api/jobs?group=              即将执行的定时任务
+//	GET   /api/catalog                  奖品库
+//	GET   /api/catalog/:id              奖品库中的奖品
+//	PUT   /api/catalog/:id              添加或替换奖品，body为奖品的JSON
+//	DELETE /api/catalog/:id             删除奖品
+//	GET   /api/stats?group=             抽奖统计，没有写group时统计所有群
+//	GET   /api/stats/:uin?group=        一个人的参加和中奖记录
+//
+// 出错时返回 {"error": "..."} 和对应的状态码
+
+// rollView 是接口返回的抽奖
+type rollView struct {
+	ID           string            `json:"id"`
+	ShortID      string            `json:"shortId"`
+	GroupCode    int64             `json:"groupCode"`
+	GroupName    string            `json:"groupName"`
+	Groups       []model.RollGroup `json:"groups,omitempty"`
+	Organiser    rollMember        `json:"organiser"`
+	Prizes       []model.Prize     `json:"prizes"`
+	Summary      string            `json:"summary"`
+	DrawTime     time.Time         `json:"drawTime"`
+	Status       model.RollStatus  `json:"status"`
+	WinnerCount  int               `json:"winnerCount"`
+	Rules        model.RollRules   `json:"rules"`
+	Source       string            `json:"source,omitempty"`
+	SeedHash     string            `json:"seedHash"`
+	Participants int               `json:"participantCount"`
+	Draw         *model.DrawRecord `json:"draw,omitempty"`
+}
+
+type rollMember struct {
+	Uin      int64  `json:"uin"`
+	Nickname string `json:"nickname"`
+}
+
+// rollRequest 是创建和修改抽奖的请求，修改时只处理出现的字段
+type rollRequest struct {
+	GroupCode   int64            `json:"groupCode"`
+	Groups      []int64          `json:"groups"`
+	Organiser   rollMember       `json:"organiser"`
+	Prizes      []model.Prize    `json:"prizes"`
+	DrawTime    *time.Time       `json:"drawTime"`
+	WinnerCount int              `json:"winnerCount"`
+	Rules       *model.RollRules `json:"rules"`
+}
+
+func newRollView(m *model.MongoEvent) rollView {
+	return rollView{
+		ID:           m.HexID(),
+		ShortID:      m.ShortHexID(),
+		GroupCode:    m.GroupCode,
+		GroupName:    m.GroupName,
+		Groups:       m.Groups,
+		Organiser:    rollMember{Uin: m.SenderID, Nickname: m.SenderNickname},
+		Prizes:       m.Prizes,
+		Summary:      m.SkinName,
+		DrawTime:     m.DrawTime,
+		Status:       m.State(),
+		WinnerCount:  m.WinnerCount,
+		Rules:        m.Rules,
+		Source:       m.Source,
+		SeedHash:     m.SeedHash,
+		Participants: len(m.Participants),
+		Draw:         m.Draw,
+	}
+}
+
+// 检查请求的token，没有配置token时拒绝所有请求
+func (r *roll) authorized(next httprouter.Handle) httprouter.Handle {
+	return bearerAuth(func() string {
+		r._mu.Lock()
+		defer r._mu.Unlock()
+		return r.apiToken
+	}, next)
+}
+
+func (r *roll) registerAPI(router *httprouter.Router, c qqClient) {
+	router.POST("/api/rolls", r.authorized(func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		r.apiCreate(c, writer, req)
+	}))
+	router.GET("/api/rolls", r.authorized(r.apiList))
+	router.GET("/api/rolls/:id", r.authorized(r.apiGet))
+	router.PATCH("/api/rolls/:id", r.authorized(func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		r.apiEdit(c, writer, req, params)
+	}))
+	router.POST("/api/rolls/:id/cancel", r.authorized(func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		r.apiCancel(c, writer, req, params)
+	}))
+	router.GET("/api/rolls/:id/participants", r.authorized(r.apiParticipants))
+	router.GET("/api/rolls/:id/export", r.authorized(r.apiExport))
+	router.GET("/api/jobs", r.authorized(apiJobs))
+	router.GET("/api/catalog", r.authorized(r.apiCatalog))
+	router.GET("/api/catalog/:id", r.authorized(r.apiCatalogItem))
+	router.PUT("/api/catalog/:id", r.authorized(r.apiPutCatalogItem))
+	router.DELETE("/api/catalog/:id", r.authorized(r.apiDeleteCatalogItem))
+	router.GET("/api/stats", r.authorized(r.apiStats))
+	router.GET("/api/stats/:uin", r.authorized(r.apiMemberStats))
+}
+
+// 按完整的24位编号查找抽奖，找不到时写入错误
+func (r *roll) apiFind(writer http.ResponseWriter, params httprouter.Params) (*model.MongoEvent, bool) {
+	id, err := primitive.ObjectIDFromHex(params.ByName("id"))
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "invalid id %q", params.ByName("id"))
+		return nil, false
+	}
+	m, err := store().Rolls().Get(r.ctx, id)
+	if err == storage.ErrNotFound {
+		writeError(writer, http.StatusNotFound, "roll %s not found", id.Hex())
+		return nil, false
+	} else if err != nil {
+		logger.Errorf("failed to get roll: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to get roll")
+		return nil, false
+	}
+	return m, true
+}
+
+func decodeRollRequest(writer http.ResponseWriter, req *http.Request) (*rollRequest, bool) {
+	var body rollRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(writer, http.StatusBadRequest, "invalid body: %v", err)
+		return nil, false
+	}
+	return &body, true
+}
+
+// 检查奖品与开奖时间，返回所有的问题
+func (body *rollRequest) validate(now time.Time) rollParseError {
+	var problems rollParseError
+	for _, p := range body.Prizes {
+		if strings.TrimSpace(p.Name) == "" || p.Quantity <= 0 {
+			problems = append(problems, fmt.Sprintf("奖品%q的数量必须是正整数", p.Name))
+		}
+	}
+	if body.DrawTime != nil && body.DrawTime.Before(now.Add(-time.Minute)) {
+		problems = append(problems, fmt.Sprintf("开奖时间%s已经过去", body.DrawTime.In(time.Local).Format("2006-01-02 15:04")))
+	}
+	if body.WinnerCount < 0 {
+		problems = append(problems, "中奖人数必须是正整数")
+	}
+	return problems
+}
+
+func (r *roll) apiCreate(c qqClient, writer http.ResponseWriter, req *http.Request) {
+	body, ok := decodeRollRequest(writer, req)
+	if !ok {
+		return
+	}
+	problems := body.validate(time.Now())
+	if len(body.Prizes) == 0 {
+		problems = append(problems, "缺少奖品")
+	}
+	if body.DrawTime == nil {
+		problems = append(problems, "缺少开奖时间")
+	}
+	total, err := resolveWinnerCount(body.Prizes, body.WinnerCount)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		writeError(writer, http.StatusBadRequest, "%s", problems.Error())
+		return
+	}
+	g, err := c.GetGroupInfo(body.GroupCode)
+	if err != nil || !r.serves(body.GroupCode) {
+		writeError(writer, http.StatusBadRequest, "group %d is not served", body.GroupCode)
+		return
+	}
+
+	e := newRollEvent()
+	e.SenderID = body.Organiser.Uin
+	e.SenderNickname = body.Organiser.Nickname
+	e.GroupCode = g.Code
+	e.GroupName = g.Name
+	e.Prizes = r.resolvePrizes(body.Prizes)
+	e.WinnerCount = total
+	e.SkinName = e.prizeSummary()
+	e.DrawTime = body.DrawTime.In(time.Local)
+	if e.DrawTime.Before(time.Now()) {
+		e.DrawTime = time.Now()
+	}
+	if body.Rules != nil {
+		e.Rules = *body.Rules
+	}
+	// 接口已经验证过token，不再检查发起人是否是其他群的管理员
+	e.wantGroups = body.Groups
+	if e.Groups, err = r.resolveGroups(c, e, 0); err != nil {
+		writeError(writer, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+	e.Source = "api"
+	// 与网站写入的抽奖一样排队发布，没能发布时稍后重试
+	e.Status = model.RollNew
+	if err = r.persistModel(e); err != nil {
+		writeError(writer, http.StatusInternalServerError, "failed to save roll")
+		return
+	}
+	logger.WithField("event", e).Infof("roll event created by api")
+	r.announceNew(c)
+
+	m, err := store().Rolls().Get(r.ctx, e.ObjectID.ObjectID)
+	if err != nil {
+		logger.Errorf("failed to get roll: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to get roll")
+		return
+	}
+	writeJSON(writer, http.StatusCreated, newRollView(m))
+}
+
+func (r *roll) apiList(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var filter storage.RollFilter
+	query := req.URL.Query()
+	if group := query.Get("group"); group != "" {
+		groupCode, err := strconv.ParseInt(group, 10, 64)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, "invalid group %q", group)
+			return
+		}
+		filter.GroupCode = groupCode
+	}
+	if status := query.Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			s := model.RollStatus(strings.TrimSpace(s))
+			if _, ok := statusNames[s]; !ok {
+				writeError(writer, http.StatusBadRequest, "invalid status %q", s)
+				return
+			}
+			filter.Status = append(filter.Status, s)
+		}
+	}
+	events, err := store().Rolls().List(r.ctx, filter)
+	if err != nil {
+		logger.Errorf("failed to list rolls: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to list rolls")
+		return
+	}
+	views := make([]rollView, len(events))
+	for i, m := range events {
+		views[i] = newRollView(m)
+	}
+	writeJSON(writer, http.StatusOK, map[string]any{"rolls": views})
+}
+
+func (r *roll) apiGet(writer http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+	if m, ok := r.apiFind(writer, params); ok {
+		writeJSON(writer, http.StatusOK, newRollView(m))
+	}
+}
+
+func (r *roll) apiEdit(c qqClient, writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	m, ok := r.apiFind(writer, params)
+	if !ok {
+		return
+	}
+	body, ok := decodeRollRequest(writer, req)
+	if !ok {
+		return
+	}
+	if m.State() != model.RollPending {
+		writeError(writer, http.StatusConflict, "roll %s is %s", m.HexID(), m.State())
+		return
+	}
+	problems := body.validate(time.Now())
+	var changes storage.RollChanges
+	if body.DrawTime != nil {
+		drawTime := body.DrawTime.In(time.Local)
+		changes.DrawTime = &drawTime
+	}
+	if body.Prizes != nil || body.WinnerCount > 0 {
+		prizes := r.resolvePrizes(body.Prizes)
+		if prizes == nil {
+			prizes = append([]model.Prize(nil), m.Prizes...)
+		}
+		if len(prizes) == 0 {
+			changes.WinnerCount = &body.WinnerCount
+		} else if total, err := resolveWinnerCount(prizes, body.WinnerCount); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			e := rollEvent{Prizes: prizes}
+			summary := e.prizeSummary()
+			changes.Prizes, changes.SkinName, changes.WinnerCount = prizes, &summary, &total
+		}
+	}
+	if len(problems) > 0 {
+		writeError(writer, http.StatusBadRequest, "%s", problems.Error())
+		return
+	}
+	e, err := r.editRoll(c, newRollEventFromModel(m), changes)
+	if err != nil {
+		logger.Errorf("failed to edit roll: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to edit roll")
+		return
+	}
+	// 和群里的 /roll edit 一样通知抽奖所在的群
+	c.SendGroupMessage(e.GroupCode, utils.NewTextMessage(e.editedText()))
+	r.sendToOtherGroups(c, e, e.editedText())
+	m, ok = r.apiFind(writer, httprouter.Params{{Key: "id", Value: e.HexID()}})
+	if ok {
+		writeJSON(writer, http.StatusOK, newRollView(m))
+	}
+}
+
+func (r *roll) apiCancel(c qqClient, writer http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+	m, ok := r.apiFind(writer, params)
+	if !ok {
+		return
+	}
+	if m.State() != model.RollPending {
+		writeError(writer, http.StatusConflict, "roll %s is %s", m.HexID(), m.State())
+		return
+	}
+	e := newRollEventFromModel(m)
+	if err := r.cancelRoll(e); err == errRollNotPending {
+		writeError(writer, http.StatusConflict, "roll %s is no longer pending", m.HexID())
+		return
+	} else if err != nil {
+		logger.Errorf("failed to cancel roll: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to cancel roll")
+		return
+	}
+	// 和群里的 /cancel 一样通知抽奖所在的群
+	c.SendGroupMessage(e.GroupCode, utils.NewTextMessage("取消#"+e.ShortHexID()))
+	r.sendToOtherGroups(c, e, "取消#"+e.ShortHexID())
+	m.Status = model.RollCancelled
+	writeJSON(writer, http.StatusOK, newRollView(m))
+}
+
+func (r *roll) apiParticipants(writer http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+	m, ok := r.apiFind(writer, params)
+	if !ok {
+		return
+	}
+	members := func(senders []message.Sender) []rollMember {
+		list := make([]rollMember, len(senders))
+		for i, s := range senders {
+			list[i] = rollMember{Uin: s.Uin, Nickname: s.DisplayName()}
+		}
+		return list
+	}
+	writeJSON(writer, http.StatusOK, map[string]any{
+		"participants": members(m.Participants),
+		"winners":      members(m.Winners),
+		"claims":       m.Claims,
+	})
+}
+
+func apiJobs(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	groupCode, ok := queryGroup(writer, req)
+	if !ok {
+		return
+	}
+	type jobView struct {
+		Key       string    `json:"key"`
+		Name      string    `json:"name"`
+		GroupCode int64     `json:"groupCode"`
+		Due       time.Time `json:"due"`
+	}
+	views := []jobView{}
+	for _, j := range jobs.upcoming(groupCode) {
+		views = append(views, jobView{Key: j.key, Name: j.name, GroupCode: j.groupCode, Due: j.due})
+	}
+	writeJSON(writer, http.StatusOK, map[string]any{"jobs": views})
+}
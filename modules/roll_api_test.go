@@ -0,0 +1,125 @@
+package modules
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/yangrq1018/botqq/model"
+)
+
+type apiHarness struct {
+	t      *testing.T
+	router *httprouter.Router
+}
+
+func newAPIHarness(h *harness, r *roll) *apiHarness {
+	r.apiToken = "secret"
+	router := httprouter.New()
+	r.registerAPI(router, h.client)
+	h.t.Cleanup(r.stop)
+	return &apiHarness{t: h.t, router: router}
+}
+
+// 发送请求，v不为nil时解析返回的JSON
+func (a *apiHarness) do(method, path, body string, v any) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	if v != nil {
+		assert.NoError(a.t, json.Unmarshal(rec.Body.Bytes(), v), rec.Body.String())
+	}
+	return rec.Code
+}
+
+func TestRollAPIAuth(t *testing.T) {
+	h := newHarness(t)
+	a := newAPIHarness(h, newTestRoll(h))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rolls", nil)
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec = httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// 必须使用 Bearer 方案
+	req.Header.Set("Authorization", "secret")
+	rec = httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestRollAPI(t *testing.T) {
+	h := newHarness(t)
+	r := newTestRoll(h)
+	a := newAPIHarness(h, r)
+
+	var apiErr struct{ Error string }
+	assert.Equal(t, http.StatusBadRequest, a.do(http.MethodPost, "/api/rolls",
+		`{"groupCode": 20000, "prizes": [{"name": "AK-47", "quantity": 0}]}`, &apiErr))
+	assert.Equal(t, "1. 奖品\"AK-47\"的数量必须是正整数\n2. 缺少开奖时间", apiErr.Error)
+	assert.Equal(t, http.StatusBadRequest, a.do(http.MethodPost, "/api/rolls",
+		`{"groupCode": 1, "prizes": [{"name": "AK-47", "quantity": 1}], "drawTime": "2099-01-01T20:00:00+08:00"}`, &apiErr))
+	assert.Equal(t, http.StatusBadRequest, a.do(http.MethodPost, "/api/rolls",
+		`{"groupCode": 20000, "groups": [30001], "prizes": [{"name": "AK-47", "quantity": 1}], "drawTime": "2099-01-01T20:00:00+08:00"}`, &apiErr))
+	assert.Equal(t, "机器人不在群30001或没有开启抽奖", apiErr.Error)
+
+	var created rollView
+	assert.Equal(t, http.StatusCreated, a.do(http.MethodPost, "/api/rolls", `{
+		"groupCode": 20000,
+		"organiser": {"uin": 30000, "nickname": "owner"},
+		"prizes": [{"name": "AK-47", "quantity": 2}],
+		"drawTime": "2099-01-01T20:00:00+08:00",
+		"rules": {"keyword": "冲"}
+	}`, &created))
+	assert.Equal(t, "AK-47 x2", created.Summary)
+	assert.Equal(t, 2, created.WinnerCount)
+	assert.Equal(t, model.RollPending, created.Status)
+	assert.Equal(t, "冲", created.Rules.Keyword)
+	assert.Contains(t, h.client.lastText(), "#"+created.ShortID+"\n确认创建抽奖")
+
+	var list struct{ Rolls []rollView }
+	assert.Equal(t, http.StatusOK, a.do(http.MethodGet, "/api/rolls?group=20000&status=pending", "", &list))
+	assert.Len(t, list.Rolls, 1)
+	assert.Equal(t, http.StatusBadRequest, a.do(http.MethodGet, "/api/rolls?status=done", "", &apiErr))
+
+	var got rollView
+	assert.Equal(t, http.StatusOK, a.do(http.MethodGet, "/api/rolls/"+created.ID, "", &got))
+	assert.Equal(t, created.SeedHash, got.SeedHash)
+	assert.Equal(t, http.StatusNotFound, a.do(http.MethodGet, "/api/rolls/000000000000000000000000", "", &apiErr))
+	assert.Equal(t, http.StatusBadRequest, a.do(http.MethodGet, "/api/rolls/abc", "", &apiErr))
+
+	assert.Equal(t, http.StatusBadRequest, a.do(http.MethodPatch, "/api/rolls/"+created.ID,
+		`{"drawTime": "2099-01-02T20:00:00+08:00", "winnerCount": 3}`, &apiErr))
+	assert.Equal(t, "1. 中奖人数3与奖品总数2不一致", apiErr.Error)
+	assert.Equal(t, http.StatusOK, a.do(http.MethodPatch, "/api/rolls/"+created.ID,
+		`{"drawTime": "2099-01-02T20:00:00+08:00", "prizes": [{"name": "蝴蝶刀", "quantity": 1}]}`, &got))
+	assert.Equal(t, "蝴蝶刀", got.Summary)
+	assert.True(t, time.Date(2099, 1, 2, 20, 0, 0, 0, time.FixedZone("", 8*3600)).Equal(got.DrawTime))
+	assert.Contains(t, h.client.lastText(), "已修改抽奖#"+created.ID[len(created.ID)-6:]+"\n奖品: 蝴蝶刀\n")
+
+	var participants struct {
+		Participants []rollMember
+		Winners      []rollMember
+	}
+	assert.Equal(t, http.StatusOK, a.do(http.MethodGet, "/api/rolls/"+created.ID+"/participants", "", &participants))
+	assert.Empty(t, participants.Participants)
+
+	assert.Equal(t, http.StatusOK, a.do(http.MethodPost, "/api/rolls/"+created.ID+"/cancel", "", &got))
+	assert.Equal(t, model.RollCancelled, got.Status)
+	assert.Equal(t, "取消#"+created.ID[len(created.ID)-6:], h.client.lastText())
+	assert.Equal(t, http.StatusConflict, a.do(http.MethodPost, "/api/rolls/"+created.ID+"/cancel", "", &apiErr))
+	assert.Equal(t, http.StatusConflict, a.do(http.MethodPatch, "/api/rolls/"+created.ID, `{"winnerCount": 1}`, &apiErr))
+	assert.Equal(t, http.StatusOK, a.do(http.MethodGet, "/api/rolls?status=cancelled,drawn", "", &list))
+	assert.Len(t, list.Rolls, 1)
+}
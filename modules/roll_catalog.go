@@ -0,0 +1,305 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/julienschmidt/httprouter"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+)
+
+// 奖品库: 发起抽奖时奖品写奖品库中的编号（如 ak-redline x2），
+// 奖品使用奖品库中的名称、图片和估价，发布和中奖消息附上图片，统计送出的总价值
+
+const catalogUsage = `/catalog 列出奖品库
+/catalog <编号> 查看奖品
+/catalog set <编号>
+名称: AK-47 | 红线
+稀有度: 保密
+磨损: 久经沙场
+图片: https://...
+估价: 120.5
+/catalog del <编号>`
+
+var (
+	catalogIDRegex   = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	catalogLineRegex = regexp.MustCompile(`^(名称|稀有度|磨损|图片|估价)\s*[:：]\s*(.*)$`)
+)
+
+// 奖品名是奖品库中的编号时，使用奖品库中的信息，其他奖品不变
+func (r *roll) resolvePrizes(prizes []model.Prize) []model.Prize {
+	if prizes == nil {
+		return nil
+	}
+	resolved := make([]model.Prize, len(prizes))
+	for i, p := range prizes {
+		resolved[i] = p
+		item, err := store().Catalog().Get(r.ctx, strings.ToLower(strings.TrimSpace(p.Name)))
+		if err != nil {
+			if err != storage.ErrNotFound {
+				logger.Errorf("failed to get catalog item: %v", err)
+			}
+			continue
+		}
+		resolved[i].Name = item.Name
+		resolved[i].ItemID = item.ID
+		resolved[i].ImageURL = item.ImageURL
+		resolved[i].Value = item.Value
+	}
+	return resolved
+}
+
+// 奖品的总估价，没有估价的奖品不计
+func prizesValue(prizes []model.Prize) float64 {
+	total := 0.0
+	for _, p := range prizes {
+		total += p.Value * float64(p.Quantity)
+	}
+	return total
+}
+
+// 按名称查找奖品，找不到时返回零值
+func findPrize(prizes []model.Prize, name string) model.Prize {
+	for _, p := range prizes {
+		if p.Name == name {
+			return p
+		}
+	}
+	return model.Prize{}
+}
+
+// 下载并上传奖品图片，失败时返回nil
+func prizeImage(client qqClient, groupCode int64, url string) message.IMessageElement {
+	if url == "" {
+		return nil
+	}
+	data, err := readImageURI(url)
+	if err != nil {
+		logger.Errorf("failed to read prize image: %v", err)
+		return nil
+	}
+	image, err := client.UploadImage(message.Source{SourceType: message.SourceGroup, PrimaryID: groupCode}, data)
+	if err != nil {
+		logger.Errorf("failed to upload prize image: %v", err)
+		return nil
+	}
+	return image
+}
+
+// 附上所有奖品的图片，相同的图片只附一次
+func appendPrizeImages(client qqClient, groupCode int64, msg *message.SendingMessage, prizes []model.Prize) {
+	seen := make(map[string]bool)
+	for _, p := range prizes {
+		if p.ImageURL == "" || seen[p.ImageURL] {
+			continue
+		}
+		seen[p.ImageURL] = true
+		if image := prizeImage(client, groupCode, p.ImageURL); image != nil {
+			msg.Append(image)
+		}
+	}
+}
+
+func describeCatalogItem(item *model.CatalogItem) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s %s", item.ID, item.Name))
+	if item.Rarity != "" {
+		sb.WriteString(" " + item.Rarity)
+	}
+	if item.Wear != "" {
+		sb.WriteString(" " + item.Wear)
+	}
+	if item.Value > 0 {
+		sb.WriteString(fmt.Sprintf(" 约¥%.2f", item.Value))
+	}
+	return sb.String()
+}
+
+// 解析 /catalog set 的内容
+func parseCatalogItem(id string, lines []string) (model.CatalogItem, rollParseError) {
+	item := model.CatalogItem{ID: strings.ToLower(id)}
+	var problems rollParseError
+	if !catalogIDRegex.MatchString(item.ID) {
+		problems = append(problems, fmt.Sprintf("编号%q只能包含字母、数字、-和_", id))
+	}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m := catalogLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			problems = append(problems, fmt.Sprintf("无法识别%q", line))
+			continue
+		}
+		value := strings.TrimSpace(m[2])
+		switch m[1] {
+		case "名称":
+			item.Name = value
+		case "稀有度":
+			item.Rarity = value
+		case "磨损":
+			item.Wear = value
+		case "图片":
+			item.ImageURL = value
+		case "估价":
+			v, err := strconv.ParseFloat(strings.TrimPrefix(value, "¥"), 64)
+			if err != nil || v < 0 {
+				problems = append(problems, fmt.Sprintf("估价%q不是有效的金额", value))
+			}
+			item.Value = v
+		}
+	}
+	if item.Name == "" {
+		problems = append(problems, "缺少名称")
+	}
+	return item, problems
+}
+
+// /catalog
+func (r *roll) catalog(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	lines := strings.Split(args.raw, "\n")
+	fields := strings.Fields(lines[0])
+	switch {
+	case len(fields) == 0:
+		items, err := store().Catalog().List(r.ctx)
+		if err != nil {
+			logger.Errorf("failed to list catalog: %v", err)
+			replyToGroupMessage(client, msg, "查询奖品库失败")
+			return
+		}
+		if len(items) == 0 {
+			replyToGroupMessage(client, msg, "奖品库是空的")
+			return
+		}
+		var sb strings.Builder
+		sb.WriteString("奖品库（发起抽奖时奖品写编号）:")
+		for i := range items {
+			sb.WriteString("\n" + describeCatalogItem(&items[i]))
+		}
+		replyToGroupMessage(client, msg, sb.String())
+	case fields[0] == "set" || fields[0] == "del":
+		if !r.permitted(client, msg, permBotAdmin) {
+			replyToGroupMessage(client, msg, fmt.Sprintf("修改奖品库需要%s权限", permBotAdmin))
+			return
+		}
+		if len(fields) != 2 {
+			replyToGroupMessage(client, msg, "用法:\n"+catalogUsage)
+			return
+		}
+		if fields[0] == "del" {
+			r.deleteCatalogItem(client, msg, fields[1])
+			return
+		}
+		item, problems := parseCatalogItem(fields[1], lines[1:])
+		if len(problems) > 0 {
+			replyToGroupMessage(client, msg, "修改奖品库失败:\n"+problems.Error()+"\n用法:\n"+catalogUsage)
+			return
+		}
+		if err := store().Catalog().Put(r.ctx, item); err != nil {
+			logger.Errorf("failed to save catalog item: %v", err)
+			replyToGroupMessage(client, msg, "修改奖品库失败: 无法保存")
+			return
+		}
+		replyToGroupMessage(client, msg, "已保存奖品 "+describeCatalogItem(&item))
+	default:
+		item, err := store().Catalog().Get(r.ctx, strings.ToLower(fields[0]))
+		if err == storage.ErrNotFound {
+			replyToGroupMessage(client, msg, "奖品库中没有"+fields[0])
+			return
+		} else if err != nil {
+			logger.Errorf("failed to get catalog item: %v", err)
+			replyToGroupMessage(client, msg, "查询奖品库失败")
+			return
+		}
+		reply := message.NewSendingMessage().Append(message.NewText(describeCatalogItem(item)))
+		if image := prizeImage(client, msg.GroupCode, item.ImageURL); image != nil {
+			reply.Append(image)
+		}
+		client.SendGroupMessage(msg.GroupCode, reply)
+	}
+}
+
+func (r *roll) deleteCatalogItem(client qqClient, msg *message.GroupMessage, id string) {
+	err := store().Catalog().Delete(r.ctx, strings.ToLower(id))
+	if err == storage.ErrNotFound {
+		replyToGroupMessage(client, msg, "奖品库中没有"+id)
+	} else if err != nil {
+		logger.Errorf("failed to delete catalog item: %v", err)
+		replyToGroupMessage(client, msg, "删除奖品失败")
+	} else {
+		replyToGroupMessage(client, msg, "已删除奖品"+id)
+	}
+}
+
+// GET /api/catalog
+func (r *roll) apiCatalog(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	items, err := store().Catalog().List(r.ctx)
+	if err != nil {
+		logger.Errorf("failed to list catalog: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to list catalog")
+		return
+	}
+	if items == nil {
+		items = []model.CatalogItem{}
+	}
+	writeJSON(writer, http.StatusOK, map[string]any{"items": items})
+}
+
+// GET /api/catalog/:id
+func (r *roll) apiCatalogItem(writer http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+	item, err := store().Catalog().Get(r.ctx, strings.ToLower(params.ByName("id")))
+	if err == storage.ErrNotFound {
+		writeError(writer, http.StatusNotFound, "item %s not found", params.ByName("id"))
+		return
+	} else if err != nil {
+		logger.Errorf("failed to get catalog item: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to get item")
+		return
+	}
+	writeJSON(writer, http.StatusOK, item)
+}
+
+// PUT /api/catalog/:id
+func (r *roll) apiPutCatalogItem(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	var item model.CatalogItem
+	if err := json.NewDecoder(req.Body).Decode(&item); err != nil {
+		writeError(writer, http.StatusBadRequest, "invalid body: %v", err)
+		return
+	}
+	item.ID = strings.ToLower(params.ByName("id"))
+	if !catalogIDRegex.MatchString(item.ID) {
+		writeError(writer, http.StatusBadRequest, "invalid id %q", params.ByName("id"))
+		return
+	}
+	if strings.TrimSpace(item.Name) == "" || item.Value < 0 {
+		writeError(writer, http.StatusBadRequest, "name is required and value must not be negative")
+		return
+	}
+	if err := store().Catalog().Put(r.ctx, item); err != nil {
+		logger.Errorf("failed to save catalog item: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to save item")
+		return
+	}
+	writeJSON(writer, http.StatusOK, item)
+}
+
+// DELETE /api/catalog/:id
+func (r *roll) apiDeleteCatalogItem(writer http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+	err := store().Catalog().Delete(r.ctx, strings.ToLower(params.ByName("id")))
+	if err == storage.ErrNotFound {
+		writeError(writer, http.StatusNotFound, "item %s not found", params.ByName("id"))
+		return
+	} else if err != nil {
+		logger.Errorf("failed to delete catalog item: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to delete item")
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,230 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+	"github.com/yangrq1018/botqq/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 领奖: 设置了 claim_window 时，中奖者需要在期限内回复中奖消息或私聊机器人确认，
+// 可以附上Steam交易链接等信息，超时未确认的奖品从剩余参与者中重新抽取，
+// 全部确认或无人可抽后把结果私聊发给发起人
+
+// 群内的领奖期限，为0时不需要确认
+func claimWindow(groupCode int64) time.Duration {
+	return policies.groupSettings(groupCode, "roll").GetDuration("claim_window")
+}
+
+func newClaim(winner message.Sender, prize string, msgID int32, window time.Duration) model.Claim {
+	claim := model.Claim{
+		Uin:      winner.Uin,
+		Nickname: winner.DisplayName(),
+		Prize:    prize,
+		Status:   model.ClaimWaiting,
+		MsgID:    msgID,
+		Deadline: time.Now().Add(window),
+	}
+	if winner.Uin < 0 {
+		// 发起人按昵称添加的参与者无法确认，由发起人自己联系
+		claim.Status = model.ClaimConfirmed
+		claim.Detail = "由发起人添加的参与者"
+		claim.ConfirmedAt = time.Now()
+	}
+	return claim
+}
+
+func waitingClaims(claims []model.Claim) int {
+	n := 0
+	for _, c := range claims {
+		if c.Status == model.ClaimWaiting {
+			n++
+		}
+	}
+	return n
+}
+
+// 宣布中奖者，需要领奖时返回领奖记录
+func (r *roll) announceWinner(client qqClient, e *rollEvent, winner message.Sender, prize string, window time.Duration) *model.Claim {
+	msg := e.noticeRollWinnerMessage(&winner, prize)
+	if image := prizeImage(client, e.GroupCode, findPrize(e.Prizes, prize).ImageURL); image != nil {
+		msg.Append(image)
+	}
+	if window > 0 && winner.Uin > 0 {
+		msg.Append(message.NewText(fmt.Sprintf("\n请在%s内回复本消息或私聊机器人（可附上Steam交易链接）确认领奖，超时将重新抽取",
+			window)))
+	}
+	sent := client.SendGroupMessage(e.GroupCode, msg)
+	if window <= 0 {
+		return nil
+	}
+	var msgID int32
+	if sent != nil {
+		msgID = sent.Id
+	}
+	claim := newClaim(winner, prize, msgID, window)
+	return &claim
+}
+
+// 登记领奖期限的任务，到期后重新抽取未确认的奖品，没有等待确认的中奖者时取消任务
+func (r *roll) scheduleClaims(client qqClient, id primitive.ObjectID, shortID string, groupCode int64, claims []model.Claim) {
+	var next time.Time
+	for _, c := range claims {
+		if c.Status == model.ClaimWaiting && (next.IsZero() || c.Deadline.Before(next)) {
+			next = c.Deadline
+		}
+	}
+	if next.IsZero() {
+		jobs.cancel(claimJobKey(id))
+		return
+	}
+	jobs.schedule(claimJobKey(id), fmt.Sprintf("抽奖#%s领奖期限", shortID), groupCode, next, func() {
+		r.expireClaims(client, id)
+	})
+}
+
+// 重新抽取到期未确认的奖品
+func (r *roll) expireClaims(client qqClient, id primitive.ObjectID) {
+	r.claimMu.Lock()
+	defer r.claimMu.Unlock()
+	m, err := store().Rolls().Get(r.ctx, id)
+	if err != nil || m.Draw == nil {
+		logger.Errorf("failed to get the draw of roll %s: %v", id.Hex(), err)
+		return
+	}
+	e := newRollEventFromModel(m)
+	window := claimWindow(e.GroupCode)
+	senders := make(map[int64]message.Sender)
+	for _, p := range e.Participants() {
+		senders[p.Uin] = p
+	}
+	claims := m.Claims
+	waiting := waitingClaims(claims)
+	now := time.Now()
+	for i := range claims {
+		c := &claims[i]
+		if c.Status != model.ClaimWaiting || c.Deadline.After(now) {
+			continue
+		}
+		c.Status = model.ClaimExpired
+		logger.Infof("claim of %d in roll %s expired", c.Uin, e.ShortHexID())
+		if len(m.Draw.Winners) >= len(m.Draw.Order) {
+			client.SendGroupMessage(e.GroupCode, utils.NewTextMessage(fmt.Sprintf(
+				"#%s %s未在期限内领取奖品%q，已没有可以重新抽取的参与者", e.ShortHexID(), c.Nickname, c.Prize)))
+			continue
+		}
+		// 继续按种子抽取下一个，开奖记录仍然可以验证
+		picks := drawWinners(m.Draw.Seed, m.Draw.Order, m.Draw.Weights, len(m.Draw.Winners)+1)
+		uin := picks[len(picks)-1]
+		m.Draw.Winners = append(m.Draw.Winners, uin)
+		winner := senders[uin]
+		client.SendGroupMessage(e.GroupCode, utils.NewTextMessage(fmt.Sprintf(
+			"#%s %s未在期限内领取奖品%q，重新抽取", e.ShortHexID(), c.Nickname, c.Prize)))
+		if err = store().Rolls().AddWinner(r.ctx, id, winner); err != nil {
+			logger.Error(err)
+		}
+		if claim := r.announceWinner(client, e, winner, c.Prize, window); claim != nil {
+			claims = append(claims, *claim)
+		}
+		r.sendToOtherGroups(client, e, fmt.Sprintf("#%s %s未在期限内领取奖品%q，重新抽取: 恭喜用户%q(qq号码%d)!",
+			e.ShortHexID(), c.Nickname, c.Prize, winner.DisplayName(), winner.Uin))
+	}
+	if err = store().Rolls().RecordDraw(r.ctx, id, *m.Draw); err != nil {
+		logger.Errorf("failed to record the draw: %v", err)
+	}
+	if err = store().Rolls().SetClaims(r.ctx, id, claims); err != nil {
+		logger.Errorf("failed to save claims: %v", err)
+	}
+	r.scheduleClaims(client, id, e.ShortHexID(), e.GroupCode, claims)
+	if waiting > 0 && waitingClaims(claims) == 0 {
+		m.Claims = claims
+		r.sendClaimSummary(client, m)
+	}
+}
+
+// 确认领奖，msgID不为0时只确认该中奖消息对应的奖品，没有可以确认的奖品时返回false
+func (r *roll) confirmClaim(client qqClient, uin int64, groupCode int64, msgID int32, detail string) (*model.Claim, bool) {
+	r.claimMu.Lock()
+	defer r.claimMu.Unlock()
+	events, err := store().Rolls().List(r.ctx, storage.RollFilter{GroupCode: groupCode, Claimant: uin})
+	if err != nil {
+		logger.Errorf("failed to find claims: %v", err)
+		return nil, false
+	}
+	for _, m := range events {
+		// 中奖消息只在发起的群，其他群的回复不算
+		if groupCode != 0 && m.GroupCode != groupCode {
+			continue
+		}
+		for i := range m.Claims {
+			c := &m.Claims[i]
+			if c.Uin != uin || c.Status != model.ClaimWaiting || msgID != 0 && c.MsgID != msgID {
+				continue
+			}
+			c.Status = model.ClaimConfirmed
+			c.Detail = detail
+			c.ConfirmedAt = time.Now()
+			if err = store().Rolls().SetClaims(r.ctx, m.ObjectID.ObjectID, m.Claims); err != nil {
+				logger.Errorf("failed to save claims: %v", err)
+				return nil, false
+			}
+			if waitingClaims(m.Claims) == 0 {
+				r.sendClaimSummary(client, m)
+			}
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// 私聊发给发起人领奖结果
+func (r *roll) sendClaimSummary(client qqClient, m *model.MongoEvent) {
+	if m.SenderID <= 0 {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("抽奖#%s（%s）领奖结果:", m.ShortHexID(), m.GroupName))
+	for _, c := range m.Claims {
+		switch c.Status {
+		case model.ClaimConfirmed:
+			sb.WriteString(fmt.Sprintf("\n%s - %s(%d) 已确认", c.Prize, c.Nickname, c.Uin))
+			if c.Detail != "" {
+				sb.WriteString(": " + c.Detail)
+			}
+		case model.ClaimExpired:
+			sb.WriteString(fmt.Sprintf("\n%s - %s(%d) 超时未领取", c.Prize, c.Nickname, c.Uin))
+		}
+	}
+	client.SendPrivateMessage(m.SenderID, utils.NewTextMessage(sb.String()))
+}
+
+// 中奖者回复中奖消息确认领奖
+func (r *roll) claimByReply(client qqClient, msg *message.GroupMessage, reply *message.ReplyElement) bool {
+	detail := ""
+	if text := textOfGroupMessage(msg); text != nil {
+		detail = strings.TrimSpace(text.Content)
+	}
+	claim, ok := r.confirmClaim(client, msg.Sender.Uin, msg.GroupCode, reply.ReplySeq, detail)
+	if ok {
+		replyToGroupMessage(client, msg, fmt.Sprintf("%s已确认领取奖品%q", msg.Sender.DisplayName(), claim.Prize))
+	}
+	return ok
+}
+
+// 中奖者私聊机器人确认领奖
+func (r *roll) claimByPrivate(client qqClient, msg *message.PrivateMessage) {
+	text := textOfPrivateMessage(msg)
+	if text == nil {
+		return
+	}
+	claim, ok := r.confirmClaim(client, msg.Sender.Uin, 0, 0, strings.TrimSpace(text.Content))
+	if ok {
+		client.SendPrivateMessage(msg.Sender.Uin, utils.NewTextMessage(
+			fmt.Sprintf("已确认领取奖品%q，发起人会联系你", claim.Prize)))
+	}
+}
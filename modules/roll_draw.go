@@ -0,0 +1,236 @@
+package modules
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/julienschmidt/httprouter"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 可验证的开奖:
+//  1. 发布抽奖时生成随机种子，只公布种子的SHA-256
+//  2. 开奖时参与者按QQ号从小到大排列，每人有若干张票（不加权时都是1张），
+//     第i个(从0开始)中奖者是剩余参与者的票依次排开后的第
+//     SHA-256("种子:i")前8字节(大端)除以剩余总票数的余数张票的主人，选出后从剩余参与者中移除
+//  3. 开奖后公布种子、参与者顺序和票数，任何人都可以重新计算
+//  4. 中奖者未领奖时按同样的方法继续抽取，接在中奖者后面
+const drawAlgorithm = `第i个(从0开始)中奖者 = 剩余参与者的票依次排开后第[SHA-256("种子:i")前8字节 mod 剩余总票数]张票的主人，参与者按QQ号从小到大排列，不加权时每人1张票`
+
+// 生成随机种子和它的哈希
+func newSeed() (seed, hash string) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	seed = hex.EncodeToString(b)
+	return seed, hashSeed(seed)
+}
+
+func hashSeed(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(sum[:])
+}
+
+// 开奖时参与者的顺序
+func drawOrder(participants []message.Sender) []int64 {
+	order := make([]int64, len(participants))
+	for i, p := range participants {
+		order[i] = p.Uin
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	return order
+}
+
+// 从order中不重复地选出n个中奖者，weights为每个参与者的票数，为空时每人1张
+func drawWinners(seed string, order, weights []int64, n int) []int64 {
+	type entry struct{ uin, tickets int64 }
+	pool := make([]entry, len(order))
+	var total uint64
+	for i, uin := range order {
+		pool[i] = entry{uin, 1}
+		if weights != nil {
+			pool[i].tickets = weights[i]
+		}
+		total += uint64(pool[i].tickets)
+	}
+	var winners []int64
+	for i := 0; i < n && len(pool) > 0 && total > 0; i++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", seed, i)))
+		ticket := binary.BigEndian.Uint64(sum[:8]) % total
+		j := 0
+		for ticket >= uint64(pool[j].tickets) {
+			ticket -= uint64(pool[j].tickets)
+			j++
+		}
+		winners = append(winners, pool[j].uin)
+		total -= uint64(pool[j].tickets)
+		pool = append(pool[:j], pool[j+1:]...)
+	}
+	return winners
+}
+
+// 重新计算开奖结果，与记录不一致时返回错误
+func verifyDraw(e *model.MongoEvent) error {
+	if e.Draw == nil {
+		return fmt.Errorf("尚未开奖")
+	}
+	if hashSeed(e.Draw.Seed) != e.SeedHash {
+		return fmt.Errorf("种子的哈希与发布时的%s不一致", e.SeedHash)
+	}
+	n := e.WinnerCount
+	if n == 0 {
+		n = 1
+	}
+	if len(e.Draw.Weights) > 0 && len(e.Draw.Weights) != len(e.Draw.Order) {
+		return fmt.Errorf("票数与参与者人数不一致")
+	}
+	for _, w := range e.Draw.Weights {
+		if w <= 0 {
+			return fmt.Errorf("票数必须是正整数")
+		}
+	}
+	if n > len(e.Draw.Order) {
+		n = len(e.Draw.Order)
+	}
+	if len(e.Draw.Winners) < n {
+		return fmt.Errorf("中奖者%v少于%d人", e.Draw.Winners, n)
+	}
+	// 未领奖后重新抽取的中奖者接在后面
+	winners := drawWinners(e.Draw.Seed, e.Draw.Order, e.Draw.Weights, len(e.Draw.Winners))
+	if fmt.Sprint(winners) != fmt.Sprint(e.Draw.Winners) {
+		return fmt.Errorf("重新计算的中奖者%v与记录的%v不一致", winners, e.Draw.Winners)
+	}
+	return nil
+}
+
+// 开奖，返回中奖者与公布的开奖记录，weigh返回参与者的票数，为nil时不加权
+// 如果设置的开奖人数大于或等于当前人数，则全部参与者都中奖，但顺序仍由种子决定
+func (e *rollEvent) draw(weigh func(order []int64) []int64) ([]message.Sender, model.DrawRecord) {
+	e._mu.Lock()
+	defer e._mu.Unlock()
+	nWinner := e.WinnerCount
+	if nWinner == 0 {
+		nWinner = 1
+	}
+	senders := make(map[int64]message.Sender)
+	for _, p := range e.participants.Values() {
+		senders[p.Uin] = p
+	}
+	record := model.DrawRecord{
+		Seed:    e.Seed,
+		Order:   drawOrder(e.participants.Values()),
+		DrawnAt: time.Now(),
+	}
+	if weigh != nil {
+		record.Weights = weigh(record.Order)
+	}
+	record.Winners = drawWinners(e.Seed, record.Order, record.Weights, nWinner)
+	winners := make([]message.Sender, len(record.Winners))
+	for i, uin := range record.Winners {
+		winners[i] = senders[uin]
+	}
+	return winners, record
+}
+
+// 为还没有种子的抽奖（如网页创建的）生成种子并保存
+func (r *roll) ensureSeed(e *rollEvent) {
+	if e.SeedHash != "" {
+		return
+	}
+	e.Seed, e.SeedHash = newSeed()
+	if err := store().Rolls().SetSeed(r.ctx, e.ObjectID.ObjectID, e.Seed, e.SeedHash); err != nil {
+		logger.Errorf("failed to save the seed of roll %s: %v", e.ShortHexID(), err)
+	}
+}
+
+// 按#后的短编号查找本群的抽奖
+func (r *roll) findRoll(groupCode int64, shortID string) (*model.MongoEvent, error) {
+	events, err := store().Rolls().List(r.ctx, storage.RollFilter{GroupCode: groupCode})
+	if err != nil {
+		return nil, err
+	}
+	shortID = strings.ToLower(shortID)
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].ShortHexID() == shortID {
+			return events[i], nil
+		}
+	}
+	return nil, storage.ErrNotFound
+}
+
+func (r *roll) verify(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	id := args.str("id")
+	e, err := r.findRoll(msg.GroupCode, id)
+	if err == storage.ErrNotFound {
+		replyToGroupMessage(client, msg, "没有抽奖#"+id)
+		return
+	} else if err != nil {
+		logger.Errorf("failed to find roll: %v", err)
+		replyToGroupMessage(client, msg, "查询抽奖失败")
+		return
+	}
+	if e.Draw == nil {
+		replyToGroupMessage(client, msg, fmt.Sprintf("抽奖#%s尚未开奖\n种子哈希: %s", id, e.SeedHash))
+		return
+	}
+	result := "验证通过"
+	if err = verifyDraw(e); err != nil {
+		result = "验证失败: " + err.Error()
+	}
+	weights := ""
+	if len(e.Draw.Weights) > 0 {
+		weights = fmt.Sprintf("\n票数: %v", e.Draw.Weights)
+	}
+	replyToGroupMessage(client, msg, fmt.Sprintf("抽奖#%s %s\n种子: %s\n种子哈希: %s\n参与者顺序: %v%s\n中奖者: %v\n算法: %s",
+		id, result, e.Draw.Seed, e.SeedHash, e.Draw.Order, weights, e.Draw.Winners, drawAlgorithm))
+}
+
+// GET /rolls/:id/verify 返回开奖记录和重新计算的结果，id为完整的24位编号
+func (r *roll) verifyHandler(writer http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+	id, err := primitive.ObjectIDFromHex(params.ByName("id"))
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e, err := store().Rolls().Get(r.ctx, id)
+	if err == storage.ErrNotFound {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Error(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := struct {
+		ID        string            `json:"id"`
+		SeedHash  string            `json:"seedHash"`
+		Draw      *model.DrawRecord `json:"draw,omitempty"`
+		Algorithm string            `json:"algorithm"`
+		Valid     bool              `json:"valid"`
+		Error     string            `json:"error,omitempty"`
+	}{
+		ID:        e.HexID(),
+		SeedHash:  e.SeedHash,
+		Draw:      e.Draw,
+		Algorithm: drawAlgorithm,
+	}
+	if err = verifyDraw(e); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Valid = true
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(&result)
+}
@@ -1,9 +1,7 @@
 package modules
 
 import (
-	"bufio"
 	"fmt"
-	"math/rand"
 	"strings"
 	"sync"
 	"time"
@@ -17,14 +15,25 @@ import (
 type rollEvent struct {
 	model.ObjectID `bson:",inline"`
 
-	SenderID       int64     `bson:"sender_id"`
-	SenderNickname string    `bson:"sender_nickname"`
-	SkinName       string    `bson:"skin_name"`
-	DrawTime       time.Time `bson:"draw_time"`
-	MsgID          int32     `bson:"msg_id"`
-	GroupCode      int64     `bson:"group_code"`
-	GroupName      string    `bson:"group_name"`
-	WinnerCount    int       `bson:"winner_count"`
+	SenderID       int64             `bson:"sender_id"`
+	SenderNickname string            `bson:"sender_nickname"`
+	SkinName       string            `bson:"skin_name"`
+	DrawTime       time.Time         `bson:"draw_time"`
+	MsgID          int32             `bson:"msg_id"`
+	GroupCode      int64             `bson:"group_code"`
+	GroupName      string            `bson:"group_name"`
+	Groups         []model.RollGroup `bson:"groups"`
+	WinnerCount    int               `bson:"winner_count"`
+	Prizes         []model.Prize     `bson:"prizes"`
+	Rules          model.RollRules   `bson:"rules"`
+	Status         model.RollStatus  `bson:"status"`
+	SeedHash       string            `bson:"seed_hash"`
+	Seed           string            `bson:"seed"`
+	Source         string            `bson:"source"`
+
+	// 发起时写的其他群，发布前由 resolveGroups 检查后写入Groups
+	wantGroups    []int64
+	wantAllGroups bool
 
 	participants *hashset.Set[message.Sender] `bson:"-"`
 	_mu          sync.Mutex                   `bson:"-"`
@@ -51,61 +60,20 @@ func newRollEventFromModel(m *model.MongoEvent) *rollEvent {
 	r.MsgID = m.MsgID
 	r.GroupCode = m.GroupCode
 	r.GroupName = m.GroupName
+	r.Groups = m.Groups
 	r.WinnerCount = m.WinnerCount
+	r.Prizes = m.Prizes
+	r.Rules = m.Rules
+	r.Status = m.State()
+	r.SeedHash = m.SeedHash
+	r.Seed = m.Seed
+	r.Source = m.Source
 	for _, p := range m.Participants {
 		r.participants.Put(p)
 	}
 	return r
 }
 
-// msg is assumed to contain text element(s)
-func newRollEventFromMessage(msg *message.GroupMessage) *rollEvent {
-	event := newRollEvent()
-	event.MsgID = msg.Id
-	event.SenderID = msg.Sender.Uin
-	event.SenderNickname = msg.Sender.DisplayName()
-	event.GroupCode = msg.GroupCode
-	event.GroupName = msg.GroupName
-
-	content := textOfGroupMessage(msg).Content
-	// use scanner for consistency across platforms
-	scanner := bufio.NewScanner(strings.NewReader(content))
-	var i int // line number
-	for scanner.Scan() {
-		line := scanner.Text()
-		switch i {
-		case 1:
-			// 物品名称
-			event.SkinName = strings.TrimSpace(line)
-		case 2:
-			// 开奖时间
-			line = strings.TrimSpace(line)
-			switch line {
-			case "now":
-				event.DrawTime = time.Now()
-			default:
-				if drawTime, err := time.ParseInLocation("2006-01-02 15:04", line, time.Local); err != nil {
-					logger.Errorf("failed to parse draw time: %v", line)
-				} else {
-					event.DrawTime = drawTime
-				}
-			}
-		case 0:
-			// ignore
-		default:
-			// provide an optional list of initial participants
-			event.participants.Put(message.Sender{
-				Uin:      -int64(i), // fake at
-				Nickname: strings.TrimSpace(line),
-			})
-			logger.WithField("identity", event.identity()).Infof("add participant (by nickname) %q", strings.TrimSpace(line))
-		}
-		i++
-	}
-	event.WinnerCount = 1
-	return event
-}
-
 func (e *rollEvent) AddParticipant(sender *message.Sender) {
 	e._mu.Lock()
 	e.participants.Put(*sender)
@@ -116,46 +84,42 @@ func (e *rollEvent) GroupNotice() string {
 	return fmt.Sprintf(`老板%s即将roll一个 %q
 开奖时间%s
 回复上条消息（任意内容）以参加抽奖`,
-		e.SenderNickname, e.SkinName, e.DrawTime.Format("2006-01-02 15:04 -0700 MST"))
+		e.SenderNickname, e.prizeSummary(), e.DrawTime.Format("2006-01-02 15:04 -0700 MST"))
 }
 
 func (e *rollEvent) Participants() []message.Sender {
 	return e.participants.Values()
 }
 
-// 开奖
-// 如果设置的开奖人数少于或等于当前人数，则返回全部参与者
-// 否则一直抽取胜者只到达到开奖人数
-// hold the lock
-func (e *rollEvent) Draw() []message.Sender {
-	e._mu.Lock()
-	defer e._mu.Unlock()
-	nParticipants := e.participants.Size()
-	if nParticipants == 0 {
-		return nil
+// 所有奖品写成一行，如 AK-47 x2、蝴蝶刀
+func (e *rollEvent) prizeSummary() string {
+	if len(e.Prizes) == 0 {
+		return e.SkinName
 	}
-
-	nWinner := e.WinnerCount
-	if nWinner == 0 {
-		nWinner = 1
-	}
-
-	if nWinner >= nParticipants {
-		return e.Participants()
+	names := make([]string, len(e.Prizes))
+	for i, p := range e.Prizes {
+		names[i] = p.Name
+		if p.Quantity > 1 {
+			names[i] += fmt.Sprintf(" x%d", p.Quantity)
+		}
 	}
+	return strings.Join(names, "、")
+}
 
-	pool := e.participants.Copy()
-	var winners []message.Sender
-	for len(winners) < nWinner {
-		winner := pool.Values()[rand.Intn(pool.Size())]
-		winners = append(winners, winner)
-		pool.Remove(winner)
+// 第i个（从0开始）中奖者的奖品，按奖品列出的顺序分配
+// 网页创建的抽奖没有奖品列表，所有中奖者都是SkinName
+func (e *rollEvent) prizeOf(i int) string {
+	for _, p := range e.Prizes {
+		if i < p.Quantity {
+			return p.Name
+		}
+		i -= p.Quantity
 	}
-	return winners
+	return e.SkinName
 }
 
-func (e *rollEvent) noticeRollWinnerMessage(winner *message.Sender) *message.SendingMessage {
-	text := fmt.Sprintf(`恭喜用户%q(qq号码%d)抽中了奖品%q!`, winner.DisplayName(), winner.Uin, e.SkinName)
+func (e *rollEvent) noticeRollWinnerMessage(winner *message.Sender, prize string) *message.SendingMessage {
+	text := fmt.Sprintf(`恭喜用户%q(qq号码%d)抽中了奖品%q!`, winner.DisplayName(), winner.Uin, prize)
 	msg := message.NewSendingMessage()
 	// At元素必须在第一个
 	if winner.Uin > 0 {
@@ -178,7 +142,14 @@ func (e *rollEvent) Model() *model.MongoEvent {
 		MsgID:          e.MsgID,
 		GroupCode:      e.GroupCode,
 		GroupName:      e.GroupName,
+		Groups:         e.Groups,
 		WinnerCount:    e.WinnerCount,
+		Prizes:         e.Prizes,
+		Rules:          e.Rules,
+		Status:         e.Status,
+		SeedHash:       e.SeedHash,
+		Seed:           e.Seed,
+		Source:         e.Source,
 		Participants:   []message.Sender{},
 	}
 	e.participants.Each(func(sender message.Sender) {
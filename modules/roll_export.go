@@ -0,0 +1,136 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/client"
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/julienschmidt/httprouter"
+	"github.com/yangrq1018/botqq/model"
+)
+
+// 导出抽奖的参与者和中奖者，/roll export #id 上传到群文件，或者从 /api/rolls/:id/export 下载
+
+// 导出的一行，每个参与者一行
+type rollExportRow struct {
+	Uin        int64             `json:"uin"` // 按昵称添加的参与者是负数
+	Name       string            `json:"name"`
+	JoinedAt   time.Time         `json:"joinedAt"`
+	ByNickname bool              `json:"byNickname"` // 发起时按昵称添加的参与者
+	Winner     bool              `json:"winner"`
+	Prize      string            `json:"prize,omitempty"`
+	Claim      model.ClaimStatus `json:"claim,omitempty"`
+}
+
+var rollExportHeader = []string{"uin", "name", "joined_at", "by_nickname", "winner", "prize", "claim"}
+
+func rollExportRows(m *model.MongoEvent) []rollExportRow {
+	won := make(map[int64]rollAward)
+	for _, a := range rollAwards(m) {
+		won[a.winner.Uin] = a
+	}
+	rows := make([]rollExportRow, 0, len(m.Participants))
+	for _, p := range m.Participants {
+		a, winner := won[p.Uin]
+		rows = append(rows, rollExportRow{
+			Uin:        p.Uin,
+			Name:       p.DisplayName(),
+			JoinedAt:   m.JoinedAt(p.Uin),
+			ByNickname: p.Uin < 0,
+			Winner:     winner,
+			Prize:      a.prize,
+			Claim:      a.claim,
+		})
+	}
+	return rows
+}
+
+// 写成CSV，开头加上BOM以便Excel识别UTF-8
+func writeRollCSV(buf *bytes.Buffer, rows []rollExportRow) error {
+	buf.WriteString("\ufeff")
+	w := csv.NewWriter(buf)
+	_ = w.Write(rollExportHeader)
+	for _, row := range rows {
+		_ = w.Write([]string{
+			strconv.FormatInt(row.Uin, 10),
+			csvText(row.Name),
+			row.JoinedAt.In(time.Local).Format(time.RFC3339),
+			strconv.FormatBool(row.ByNickname),
+			strconv.FormatBool(row.Winner),
+			csvText(row.Prize),
+			string(row.Claim),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// 昵称和奖品由用户填写，以这些字符开头时Excel会当作公式执行，前面加上单引号
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func rollExportName(m *model.MongoEvent, ext string) string {
+	return fmt.Sprintf("roll-%s.%s", m.ShortHexID(), ext)
+}
+
+// /roll export #id
+func (r *roll) export(client qqClient, msg *message.GroupMessage, id string) {
+	m, ok := r.mustFindRollModel(client, msg, id)
+	if !ok {
+		return
+	}
+	if err := r.uploadExport(client, msg.GroupCode, m); err != nil {
+		logger.Errorf("failed to upload the export of roll %s: %v", m.ShortHexID(), err)
+		replyToGroupMessage(client, msg, "上传群文件失败")
+		return
+	}
+	replyToGroupMessage(client, msg, fmt.Sprintf("已上传%s到群文件，共%d名参与者", rollExportName(m, "csv"), len(m.Participants)))
+}
+
+func (r *roll) uploadExport(c qqClient, groupCode int64, m *model.MongoEvent) error {
+	buf := new(bytes.Buffer)
+	if err := writeRollCSV(buf, rollExportRows(m)); err != nil {
+		return err
+	}
+	return c.UploadFile(message.Source{SourceType: message.SourceGroup, PrimaryID: groupCode}, &client.LocalFile{
+		FileName:     rollExportName(m, "csv"),
+		Body:         bytes.NewReader(buf.Bytes()),
+		RemoteFolder: "/",
+	})
+}
+
+// GET /api/rolls/:id/export?format=csv|json
+func (r *roll) apiExport(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	m, ok := r.apiFind(writer, params)
+	if !ok {
+		return
+	}
+	rows := rollExportRows(m)
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "csv":
+		buf := new(bytes.Buffer)
+		if err := writeRollCSV(buf, rows); err != nil {
+			logger.Errorf("failed to write csv: %v", err)
+			writeError(writer, http.StatusInternalServerError, "failed to export")
+			return
+		}
+		writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer.Header().Set("Content-Disposition", `attachment; filename="`+rollExportName(m, "csv")+`"`)
+		_, _ = writer.Write(buf.Bytes())
+	case "json":
+		writer.Header().Set("Content-Disposition", `attachment; filename="`+rollExportName(m, "json")+`"`)
+		writeJSON(writer, http.StatusOK, map[string]any{"id": m.HexID(), "participants": rows})
+	default:
+		writeError(writer, http.StatusBadRequest, "invalid format %q", format)
+	}
+}
@@ -0,0 +1,110 @@
+package modules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/utils"
+)
+
+// 多群抽奖: 发起时写 "群: 群号;群号" 或 "群: 全部"，抽奖同时在这些群发布，
+// 在任一群回复发布消息都可以参加，参与者按QQ号合并，开奖结果在每个群公布；
+// 中奖消息和领奖回复只在发起的群，其他群的中奖者可以私聊机器人领奖
+
+// 解析 群: 后的群号，全部/all 表示机器人服务的所有群
+func parseGroupCodes(value string) ([]int64, bool, error) {
+	var codes []int64
+	all := false
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ';' || r == '；' || r == ',' || r == '，' || r == ' '
+	}) {
+		if item == "全部" || strings.EqualFold(item, "all") {
+			all = true
+			continue
+		}
+		code, err := strconv.ParseInt(item, 10, 64)
+		if err != nil || code <= 0 {
+			return codes, all, fmt.Errorf("无法识别的群号%q", item)
+		}
+		codes = append(codes, code)
+	}
+	return codes, all, nil
+}
+
+// 检查发起时写的其他群，organiser不为0时需要是这些群的管理员（写全部时跳过不是管理员的群）
+func (r *roll) resolveGroups(client qqClient, e *rollEvent, organiser int64) ([]model.RollGroup, error) {
+	permitted := func(groupCode int64) bool {
+		return organiser == 0 || r.isBotAdmin(organiser) || isAdmin(client, groupCode, organiser)
+	}
+	codes := e.wantGroups
+	if e.wantAllGroups {
+		for _, code := range r.groups() {
+			if r.serves(code) && permitted(code) {
+				codes = append(codes, code)
+			}
+		}
+	}
+	seen := map[int64]bool{e.GroupCode: true}
+	var groups []model.RollGroup
+	for _, code := range codes {
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+		if !r.serves(code) {
+			return nil, fmt.Errorf("机器人不在群%d或没有开启抽奖", code)
+		}
+		if !permitted(code) {
+			return nil, fmt.Errorf("发起人不是群%d的管理员", code)
+		}
+		g, err := client.GetGroupInfo(code)
+		if err != nil {
+			return nil, fmt.Errorf("无法获取群%d的信息", code)
+		}
+		groups = append(groups, model.RollGroup{GroupCode: code, GroupName: g.Name})
+	}
+	return groups, nil
+}
+
+// 在其他群发布抽奖并保存发布消息的ID
+func (r *roll) announceInGroups(client qqClient, e *rollEvent) {
+	if len(e.Groups) == 0 {
+		return
+	}
+	for i, g := range e.Groups {
+		if g.MsgID != 0 {
+			continue
+		}
+		if msg := r.sendNotice(client, e, g.GroupCode, "确认创建抽奖(多群同步)，回复本条任意内容以参加!"); msg != nil {
+			_ = client.SetEssenceMessage(g.GroupCode, msg.Id, msg.InternalId)
+			e.Groups[i].MsgID = msg.Id
+		}
+	}
+	if err := store().Rolls().SetGroups(r.ctx, e.ObjectID.ObjectID, e.Groups); err != nil {
+		logger.Errorf("failed to save the groups of roll %s: %v", e.ShortHexID(), err)
+	}
+}
+
+// 发送到抽奖的其他群
+func (r *roll) sendToOtherGroups(client qqClient, e *rollEvent, text string) {
+	for _, g := range e.Groups {
+		client.SendGroupMessage(g.GroupCode, utils.NewTextMessage(text))
+	}
+}
+
+// 在其他群公布的开奖结果
+func (e *rollEvent) drawResultText(winners []message.Sender, seed string, claimable bool) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("#%s 开奖结果:", e.ShortHexID()))
+	for i, w := range winners {
+		sb.WriteString(fmt.Sprintf("\n恭喜用户%q(qq号码%d)抽中了奖品%q!", w.DisplayName(), w.Uin, e.prizeOf(i)))
+	}
+	if claimable {
+		sb.WriteString("\n中奖者请在期限内私聊机器人确认领奖")
+	}
+	sb.WriteString(fmt.Sprintf("\n开奖种子: %s\n发送 /verify #%s 验证开奖结果", seed, e.ShortHexID()))
+	return sb.String()
+}
@@ -0,0 +1,170 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+	"github.com/yangrq1018/botqq/utils"
+)
+
+// 参加和退出抽奖: 回复抽奖消息、/join #id、/leave #id，或者私聊机器人 参加 #id、退出 #id
+
+var (
+	errAlreadyJoined = errors.New("已经参加了抽奖")
+	errNotJoined     = errors.New("没有参加抽奖")
+
+	// 私聊的参加和退出，后面可以写口令
+	privateJoinRegex = regexp.MustCompile(`^(?i)(/join|/leave|参加|退出)\s*#?([0-9a-f]{6})(?:\s+(.*))?$`)
+)
+
+// 进行中的抽奖可以参加和退出，已经发出但没能改为 pending 的也算进行中
+func (e *rollEvent) joinable() bool {
+	return e.Status == model.RollPending || e.Status == model.RollAnnouncing && e.MsgID != 0
+}
+
+// 检查后加入抽奖，groupCode是参加者所在的群
+func (r *roll) addParticipant(client qqClient, e *rollEvent, groupCode int64, sender message.Sender, text string, at time.Time) error {
+	if !e.joinable() {
+		return fmt.Errorf("抽奖%s", statusNames[e.Status])
+	}
+	if e.participants.Has(sender) {
+		return errAlreadyJoined
+	}
+	if err := r.checkEligible(client, e, groupCode, sender.Uin, text); err != nil {
+		return err
+	}
+	if err := store().Rolls().AddParticipant(r.ctx, e.ObjectID.ObjectID, sender, at); err != nil {
+		logger.Errorf("failed to append participants: %v", err)
+		return fmt.Errorf("无法保存")
+	}
+	logger.Infof("add a participant %s, current # of participants %d", sender.DisplayName(), e.participants.Size()+1)
+	return nil
+}
+
+func (r *roll) removeParticipant(e *rollEvent, uin int64) error {
+	if !e.joinable() {
+		return fmt.Errorf("抽奖%s", statusNames[e.Status])
+	}
+	if !e.participants.Has(message.Sender{Uin: uin}) {
+		return errNotJoined
+	}
+	if err := store().Rolls().RemoveParticipant(r.ctx, e.ObjectID.ObjectID, uin); err != nil {
+		logger.Errorf("failed to remove participant: %v", err)
+		return fmt.Errorf("无法保存")
+	}
+	logger.Infof("remove a participant %d from roll %s", uin, e.ShortHexID())
+	return nil
+}
+
+// /join #id [口令]
+func (r *roll) joinCommand(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	e, ok := r.mustFindRoll(client, msg, args.str("id"))
+	if !ok {
+		return
+	}
+	name := msg.Sender.DisplayName()
+	if err := r.addParticipant(client, e, msg.GroupCode, *msg.Sender, args.str("口令"), time.Unix(int64(msg.Time), 0)); err != nil {
+		replyToGroupMessage(client, msg, fmt.Sprintf("%s无法加入抽奖#%s: %v", name, e.ShortHexID(), err))
+		return
+	}
+	replyToGroupMessage(client, msg, fmt.Sprintf("%s已加入抽奖#%s", name, e.ShortHexID()))
+}
+
+// /leave #id
+func (r *roll) leaveCommand(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	e, ok := r.mustFindRoll(client, msg, args.str("id"))
+	if !ok {
+		return
+	}
+	name := msg.Sender.DisplayName()
+	if err := r.removeParticipant(e, msg.Sender.Uin); err != nil {
+		replyToGroupMessage(client, msg, fmt.Sprintf("%s无法退出抽奖#%s: %v", name, e.ShortHexID(), err))
+		return
+	}
+	replyToGroupMessage(client, msg, fmt.Sprintf("%s已退出抽奖#%s", name, e.ShortHexID()))
+}
+
+// 参加者所在的抽奖群，不在任何一个群时返回false
+func memberGroup(client qqClient, e *rollEvent, uin int64) (int64, bool) {
+	codes := []int64{e.GroupCode}
+	for _, g := range e.Groups {
+		codes = append(codes, g.GroupCode)
+	}
+	for _, code := range codes {
+		g, err := client.GetGroupInfo(code)
+		if err != nil {
+			continue
+		}
+		members, err := client.GetGroupMembers(g)
+		if err != nil {
+			continue
+		}
+		for _, m := range members {
+			if m.Uin == uin {
+				return code, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// 私聊参加或退出抽奖，不是参加或退出的消息时返回false
+func (r *roll) joinByPrivate(client qqClient, msg *message.PrivateMessage) bool {
+	text := textOfPrivateMessage(msg)
+	if text == nil {
+		return false
+	}
+	match := privateJoinRegex.FindStringSubmatch(strings.TrimSpace(text.Content))
+	if match == nil {
+		return false
+	}
+	reply := func(s string) {
+		client.SendPrivateMessage(msg.Sender.Uin, utils.NewTextMessage(s))
+	}
+	m, err := r.findRoll(0, match[2])
+	if err == storage.ErrNotFound {
+		reply("没有抽奖#" + match[2])
+		return true
+	} else if err != nil {
+		logger.Errorf("failed to find roll: %v", err)
+		reply("查询抽奖失败")
+		return true
+	}
+	e := newRollEventFromModel(m)
+	groupCode, ok := memberGroup(client, e, msg.Sender.Uin)
+	if !ok || !r.serves(groupCode) {
+		reply(fmt.Sprintf("你不在抽奖#%s的群里", e.ShortHexID()))
+		return true
+	}
+	if verb := strings.ToLower(match[1]); verb == "/leave" || verb == "退出" {
+		if err = r.removeParticipant(e, msg.Sender.Uin); err != nil {
+			reply(fmt.Sprintf("无法退出抽奖#%s: %v", e.ShortHexID(), err))
+		} else {
+			reply(fmt.Sprintf("已退出抽奖#%s", e.ShortHexID()))
+		}
+		return true
+	}
+	if err = r.addParticipant(client, e, groupCode, *msg.Sender, match[3], time.Unix(int64(msg.Time), 0)); err != nil {
+		reply(fmt.Sprintf("无法加入抽奖#%s: %v", e.ShortHexID(), err))
+	} else {
+		reply(fmt.Sprintf("已加入抽奖#%s %s", e.ShortHexID(), e.prizeSummary()))
+	}
+	return true
+}
+
+// 私聊机器人: 参加或退出抽奖，其他消息作为领奖确认
+func (r *roll) handlePrivate(client qqClient, msg *message.PrivateMessage) {
+	if msg.Sender == nil || msg.Sender.Uin == r.botUin {
+		return
+	}
+	if r.joinByPrivate(client, msg) {
+		return
+	}
+	r.claimByPrivate(client, msg)
+}
@@ -0,0 +1,324 @@
+package modules
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+)
+
+const rollEditUsage = `修改抽奖（只能修改进行中的抽奖）:
+/roll edit #id
+开奖时间: 明天 20:00
+奖品: AK-47 x2;蝴蝶刀
+人数: 3`
+
+var (
+	timeLineRegex = regexp.MustCompile(`^(?i:开奖时间|时间|time)\s*[:：]\s*(.+)$`)
+	statusNames   = map[model.RollStatus]string{
+		model.RollNew:        "待发布",
+		model.RollAnnouncing: "发布中",
+		model.RollPending:    "进行中",
+		model.RollCancelled:  "已取消",
+		model.RollDrawn:      "已开奖",
+	}
+	claimStatusNames = map[model.ClaimStatus]string{
+		model.ClaimWaiting:   "等待确认",
+		model.ClaimConfirmed: "已确认",
+		model.ClaimExpired:   "超时未领取",
+	}
+)
+
+// 中奖人数与奖品总数一致时返回中奖人数
+// 只有一个奖品且没有写数量时，中奖人数作为奖品数量
+func resolveWinnerCount(prizes []model.Prize, winnerCount int) (int, error) {
+	total := 0
+	for _, p := range prizes {
+		total += p.Quantity
+	}
+	if winnerCount == 0 || winnerCount == total {
+		return total, nil
+	}
+	if len(prizes) == 1 && prizes[0].Quantity == 1 {
+		prizes[0].Quantity = winnerCount
+		return winnerCount, nil
+	}
+	return 0, fmt.Errorf("中奖人数%d与奖品总数%d不一致", winnerCount, total)
+}
+
+// 找到本群的抽奖，找不到时回复
+func (r *roll) mustFindRoll(client qqClient, msg *message.GroupMessage, id string) (*rollEvent, bool) {
+	m, ok := r.mustFindRollModel(client, msg, id)
+	if !ok {
+		return nil, false
+	}
+	return newRollEventFromModel(m), true
+}
+
+// 与 mustFindRoll 相同，返回保存的文档，需要中奖者、领奖等记录时使用
+func (r *roll) mustFindRollModel(client qqClient, msg *message.GroupMessage, id string) (*model.MongoEvent, bool) {
+	id = strings.TrimPrefix(id, "#")
+	if id == "" {
+		replyToGroupMessage(client, msg, "请指定抽奖编号，如 #abcdef，发送 /rolls 查看进行中的抽奖")
+		return nil, false
+	}
+	m, err := r.findRoll(msg.GroupCode, id)
+	if err == storage.ErrNotFound {
+		replyToGroupMessage(client, msg, "没有抽奖#"+id)
+		return nil, false
+	} else if err != nil {
+		logger.Errorf("failed to find roll: %v", err)
+		replyToGroupMessage(client, msg, "查询抽奖失败")
+		return nil, false
+	}
+	return m, true
+}
+
+// 取消开奖任务，不会回复
+func (r *roll) stopDraw(e *rollEvent) {
+	if jobs.cancel(drawJobKey(e.ObjectID.ObjectID)) {
+		logger.Infof("cancelled the draw of %s", e.ShortHexID())
+	}
+	r.stopReminders(e)
+}
+
+// 保存修改并按新的开奖时间重新等待开奖，返回修改后的抽奖
+func (r *roll) editRoll(client qqClient, e *rollEvent, changes storage.RollChanges) (*rollEvent, error) {
+	id := e.ObjectID.ObjectID
+	if err := store().Rolls().Edit(r.ctx, id, changes); err != nil {
+		return nil, err
+	}
+	stored, err := store().Rolls().Get(r.ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	e = newRollEventFromModel(stored)
+	e.DrawTime = e.DrawTime.In(time.Local)
+	r.scheduleDraw(client, e)
+	return e, nil
+}
+
+// 开奖和取消同时发生时，后到的一方得到这个错误
+var errRollNotPending = errors.New("抽奖已经开奖或取消")
+
+// 取消进行中的抽奖
+func (r *roll) cancelRoll(e *rollEvent) error {
+	// don't delete object in database, the status is kept for history
+	ok, err := store().Rolls().SwapStatus(r.ctx, e.ObjectID.ObjectID, model.RollPending, model.RollCancelled)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errRollNotPending
+	}
+	r.stopDraw(e)
+	return nil
+}
+
+func (r *roll) list(client qqClient, msg *message.GroupMessage, _ commandArgs) {
+	events, err := store().Rolls().List(r.ctx, storage.RollFilter{
+		GroupCode: msg.GroupCode,
+		Status:    []model.RollStatus{model.RollPending},
+	})
+	if err != nil {
+		logger.Errorf("failed to list rolls: %v", err)
+		replyToGroupMessage(client, msg, "查询抽奖失败")
+		return
+	}
+	if len(events) == 0 {
+		replyToGroupMessage(client, msg, "本群没有进行中的抽奖")
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("本群进行中的抽奖:")
+	for _, m := range events {
+		e := newRollEventFromModel(m)
+		sb.WriteString(fmt.Sprintf("\n#%s %s %s开奖 %d人参加",
+			e.ShortHexID(), e.prizeSummary(), e.DrawTime.In(time.Local).Format("01月02日 15:04"), e.participants.Size()))
+	}
+	replyToGroupMessage(client, msg, sb.String())
+}
+
+func (r *roll) info(client qqClient, msg *message.GroupMessage, id string) {
+	stored, ok := r.mustFindRollModel(client, msg, id)
+	if !ok {
+		return
+	}
+	e := newRollEventFromModel(stored)
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("#%s %s\n奖品: %s\n开奖时间: %s\n发起人: %s\n中奖人数: %d",
+		e.ShortHexID(), statusNames[e.Status], e.prizeSummary(),
+		e.DrawTime.In(time.Local).Format("2006-01-02 15:04"), e.SenderNickname, e.WinnerCount))
+	if rules := describeRules(e.Rules); rules != "" {
+		sb.WriteString("\n参与条件: " + rules)
+	}
+	if len(e.Groups) > 0 {
+		names := []string{e.GroupName}
+		for _, g := range e.Groups {
+			names = append(names, g.GroupName)
+		}
+		sb.WriteString("\n同时在: " + strings.Join(names, "、"))
+	}
+	if weights := describeWeights(e.Rules); weights != "" {
+		sb.WriteString("\n加权: " + weights)
+	}
+	participants := e.Participants()
+	names := make([]string, len(participants))
+	tickets := r.participantTickets(e, stored)
+	for i, p := range participants {
+		names[i] = p.DisplayName()
+		if n, ok := tickets[p.Uin]; ok {
+			names[i] += fmt.Sprintf("(%d票)", n)
+		}
+	}
+	sb.WriteString(fmt.Sprintf("\n参与者(%d人): %s", len(names), strings.Join(names, "、")))
+	if len(stored.Winners) > 0 {
+		winners := make([]string, len(stored.Winners))
+		for i, w := range stored.Winners {
+			winners[i] = w.DisplayName()
+		}
+		sb.WriteString("\n中奖者: " + strings.Join(winners, "、"))
+	}
+	if len(stored.Claims) > 0 {
+		claims := make([]string, len(stored.Claims))
+		for i, c := range stored.Claims {
+			claims[i] = fmt.Sprintf("%s %s", c.Nickname, claimStatusNames[c.Status])
+		}
+		sb.WriteString("\n领奖: " + strings.Join(claims, "、"))
+	}
+	sb.WriteString("\n种子哈希: " + e.SeedHash)
+	replyToGroupMessage(client, msg, sb.String())
+}
+
+// 加权抽奖中每个参与者的票数，开奖后为开奖时使用的票数，不加权时为空
+func (r *roll) participantTickets(e *rollEvent, stored *model.MongoEvent) map[int64]int64 {
+	var order, weights []int64
+	if stored != nil && stored.Draw != nil {
+		order, weights = stored.Draw.Order, stored.Draw.Weights
+	} else {
+		order = drawOrder(e.Participants())
+		weights = r.entryWeights(r.ctx, e, order)
+	}
+	tickets := make(map[int64]int64, len(weights))
+	for i, w := range weights {
+		tickets[order[i]] = w
+	}
+	return tickets
+}
+
+// raw 为 edit 及之后的文本
+func (r *roll) edit(client qqClient, msg *message.GroupMessage, raw string) {
+	scanner := bufio.NewScanner(strings.NewReader(raw))
+	var id string
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if id == "" {
+			// 第一行 edit #id，之后可以接一项修改
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				break
+			}
+			id = fields[1]
+			line = strings.TrimSpace(strings.Join(fields[2:], " "))
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	e, ok := r.mustFindRoll(client, msg, id)
+	if !ok {
+		return
+	}
+	if e.Status != model.RollPending {
+		replyToGroupMessage(client, msg, fmt.Sprintf("抽奖#%s%s，不能修改", e.ShortHexID(), statusNames[e.Status]))
+		return
+	}
+
+	var changes storage.RollChanges
+	var problems rollParseError
+	var prizes []model.Prize
+	winnerCount := 0
+	for _, line := range lines {
+		switch {
+		case timeLineRegex.MatchString(line):
+			drawTime, err := parseDrawTime(timeLineRegex.FindStringSubmatch(line)[1], time.Now())
+			if err != nil {
+				problems = append(problems, err.Error())
+			} else {
+				changes.DrawTime = &drawTime
+			}
+		case prizeLineRegex.MatchString(line):
+			p, bad := parsePrizes(prizeLineRegex.FindStringSubmatch(line)[1])
+			prizes = append(prizes, r.resolvePrizes(p)...)
+			problems = append(problems, bad...)
+		case winnerLineRegex.MatchString(line):
+			winnerCount, _ = strconv.Atoi(winnerLineRegex.FindStringSubmatch(line)[1])
+			if winnerCount <= 0 {
+				problems = append(problems, "中奖人数必须是正整数")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("无法识别的修改%q", line))
+		}
+	}
+	if len(lines) == 0 {
+		problems = append(problems, "没有要修改的内容")
+	}
+	if prizes != nil || winnerCount > 0 {
+		if prizes == nil {
+			prizes = append([]model.Prize(nil), e.Prizes...)
+		}
+		if len(prizes) == 0 {
+			// 网页创建的抽奖没有奖品列表，只修改人数
+			changes.WinnerCount = &winnerCount
+		} else if total, err := resolveWinnerCount(prizes, winnerCount); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			e.Prizes = prizes
+			summary := e.prizeSummary()
+			changes.Prizes, changes.SkinName, changes.WinnerCount = prizes, &summary, &total
+		}
+	}
+	if len(problems) > 0 {
+		replyToGroupMessage(client, msg, "修改失败:\n"+problems.Error()+"\n用法:\n"+rollEditUsage)
+		return
+	}
+
+	e, err := r.editRoll(client, e, changes)
+	if err != nil {
+		logger.Errorf("failed to edit roll: %v", err)
+		replyToGroupMessage(client, msg, "保存失败: "+err.Error())
+		return
+	}
+	replyToGroupMessage(client, msg, e.editedText())
+}
+
+// 修改抽奖后公布的内容
+func (e *rollEvent) editedText() string {
+	return fmt.Sprintf("已修改抽奖#%s\n奖品: %s\n开奖时间: %s\n中奖人数: %d",
+		e.ShortHexID(), e.prizeSummary(), e.DrawTime.Format("2006-01-02 15:04"), e.WinnerCount)
+}
+
+func (r *roll) cancel(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	e, ok := r.mustFindRoll(client, msg, args.str("id"))
+	if !ok {
+		return
+	}
+	if e.Status != model.RollPending {
+		replyToGroupMessage(client, msg, fmt.Sprintf("抽奖#%s%s，不能取消", e.ShortHexID(), statusNames[e.Status]))
+		return
+	}
+	if err := r.cancelRoll(e); err != nil {
+		logger.Errorf("failed to cancel roll: %v", err)
+		replyToGroupMessage(client, msg, "取消失败: "+err.Error())
+		return
+	}
+	replyToGroupMessage(client, msg, "取消#"+e.ShortHexID())
+}
@@ -0,0 +1,223 @@
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+)
+
+const rollUsage = `/roll
+奖品（多个奖品用;分隔，数量写作 x2）
+开奖时间（now、in 30m、30分钟后、today 21:00、明天 20:00、2006-01-02 15:04）
+人数: 3（可选，只有一个奖品时作为奖品数量）
+奖品: 其他奖品 x2（可选，可以有多行）
+群: 123456;234567（可选，同时在这些群发布，参与者合并计算，写 全部 表示所有群）
+其他行是初始参与者，每行一个
+` + rollRulesUsage
+
+var (
+	quantityRegex    = regexp.MustCompile(`^(.+?)\s*[xX×*]\s*(\d+)$`)
+	prizeLineRegex   = regexp.MustCompile(`^(?i:奖品|prize)\s*[:：]\s*(.+)$`)
+	winnerLineRegex  = regexp.MustCompile(`^(?i:人数|中奖人数|winners?)\s*[:：]?\s*(\d+)$`)
+	groupLineRegex   = regexp.MustCompile(`^(?i:群|同步群|groups?)\s*[:：]\s*(.+)$`)
+	relativeRegex    = regexp.MustCompile(`^(\d+)\s*(分钟|小时|天)后$`)
+	dayClockRegex    = regexp.MustCompile(`^(?i:(today|tomorrow|今天|明天|后天))\s*(\d{1,2}[:：]\d{2})$`)
+	clockRegex       = regexp.MustCompile(`^(\d{1,2})[:：](\d{2})$`)
+	chineseDurations = map[string]time.Duration{"分钟": time.Minute, "小时": time.Hour, "天": 24 * time.Hour}
+	dayOffsets       = map[string]int{"today": 0, "今天": 0, "tomorrow": 1, "明天": 1, "后天": 2}
+)
+
+// rollParseError 列出创建抽奖的消息中所有的错误
+type rollParseError []string
+
+func (e rollParseError) Error() string {
+	lines := make([]string, len(e))
+	for i, problem := range e {
+		lines[i] = fmt.Sprintf("%d. %s", i+1, problem)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 解析开奖时间，不能早于now
+func parseDrawTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+	var t time.Time
+	switch {
+	case lower == "now" || s == "现在" || s == "立即":
+		return now, nil
+	case strings.HasPrefix(lower, "in "):
+		d, err := time.ParseDuration(strings.TrimSpace(lower[3:]))
+		if err != nil || d < 0 {
+			return t, fmt.Errorf("无法识别的时长%q，例如 in 30m、in 1h30m", s[3:])
+		}
+		return now.Add(d), nil
+	case relativeRegex.MatchString(s):
+		m := relativeRegex.FindStringSubmatch(s)
+		n, _ := strconv.Atoi(m[1])
+		return now.Add(time.Duration(n) * chineseDurations[m[2]]), nil
+	case dayClockRegex.MatchString(s):
+		m := dayClockRegex.FindStringSubmatch(s)
+		clock, err := parseClock(m[2], now)
+		if err != nil {
+			return t, err
+		}
+		t = clock.AddDate(0, 0, dayOffsets[strings.ToLower(m[1])])
+	case clockRegex.MatchString(s):
+		clock, err := parseClock(s, now)
+		if err != nil {
+			return t, err
+		}
+		t = clock
+	default:
+		var err error
+		t, err = time.ParseInLocation("2006-01-02 15:04", s, now.Location())
+		if err != nil {
+			return t, fmt.Errorf("无法识别的开奖时间%q", s)
+		}
+	}
+	// 允许一分钟的误差，例如发送时写的是当前分钟
+	if t.Before(now.Add(-time.Minute)) {
+		return t, fmt.Errorf("开奖时间%s已经过去", t.Format("2006-01-02 15:04"))
+	}
+	if t.Before(now) {
+		t = now
+	}
+	return t, nil
+}
+
+// 当天的 15:04
+func parseClock(s string, now time.Time) (time.Time, error) {
+	m := clockRegex.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("无法识别的时刻%q", s)
+	}
+	hour, _ := strconv.Atoi(m[1])
+	minute, _ := strconv.Atoi(m[2])
+	if hour > 23 || minute > 59 {
+		return time.Time{}, fmt.Errorf("无法识别的时刻%q", s)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location()), nil
+}
+
+// 解析一行奖品，多个奖品用;分隔，数量写作 x2
+func parsePrizes(line string) ([]model.Prize, []string) {
+	var prizes []model.Prize
+	var problems []string
+	for _, item := range strings.FieldsFunc(line, func(r rune) bool { return r == ';' || r == '；' }) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prize := model.Prize{Name: item, Quantity: 1}
+		if m := quantityRegex.FindStringSubmatch(item); m != nil {
+			n, err := strconv.Atoi(m[2])
+			if err != nil || n <= 0 {
+				problems = append(problems, fmt.Sprintf("奖品%q的数量必须是正整数", m[1]))
+				continue
+			}
+			prize = model.Prize{Name: m[1], Quantity: n}
+		}
+		prizes = append(prizes, prize)
+	}
+	return prizes, problems
+}
+
+// msg is assumed to contain text element(s)
+// 返回的错误是 rollParseError，包含消息中所有的错误
+func newRollEventFromMessage(msg *message.GroupMessage) (*rollEvent, error) {
+	event := newRollEvent()
+	event.MsgID = msg.Id
+	event.SenderID = msg.Sender.Uin
+	event.SenderNickname = msg.Sender.DisplayName()
+	event.GroupCode = msg.GroupCode
+	event.GroupName = msg.GroupName
+
+	var problems rollParseError
+	var hasTime bool
+	var winnerCount int
+	now := time.Now()
+	content := textOfGroupMessage(msg).Content
+	// use scanner for consistency across platforms
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	var i int // line number
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case i == 0:
+			// ignore the command
+		case line == "":
+			// skip empty lines, they don't count as a line
+			continue
+		case i == 1:
+			// 物品名称
+			prizes, bad := parsePrizes(line)
+			event.Prizes = append(event.Prizes, prizes...)
+			problems = append(problems, bad...)
+		case i == 2:
+			// 开奖时间
+			drawTime, err := parseDrawTime(line, now)
+			if err != nil {
+				problems = append(problems, err.Error())
+			} else {
+				event.DrawTime = drawTime
+				hasTime = true
+			}
+		case prizeLineRegex.MatchString(line):
+			prizes, bad := parsePrizes(prizeLineRegex.FindStringSubmatch(line)[1])
+			event.Prizes = append(event.Prizes, prizes...)
+			problems = append(problems, bad...)
+		case winnerLineRegex.MatchString(line):
+			n, err := strconv.Atoi(winnerLineRegex.FindStringSubmatch(line)[1])
+			if err != nil || n <= 0 {
+				problems = append(problems, "中奖人数必须是正整数")
+			} else {
+				winnerCount = n
+			}
+		case groupLineRegex.MatchString(line):
+			codes, all, err := parseGroupCodes(groupLineRegex.FindStringSubmatch(line)[1])
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+			event.wantGroups = append(event.wantGroups, codes...)
+			event.wantAllGroups = event.wantAllGroups || all
+		default:
+			if ok, err := parseRuleLine(line, &event.Rules); ok {
+				if err != nil {
+					problems = append(problems, err.Error())
+				}
+				break
+			}
+			// provide an optional list of initial participants
+			event.participants.Put(message.Sender{
+				Uin:      -int64(i), // fake at
+				Nickname: line,
+			})
+			logger.WithField("identity", event.identity()).Infof("add participant (by nickname) %q", line)
+		}
+		i++
+	}
+
+	if len(event.Prizes) == 0 {
+		problems = append(problems, "缺少奖品（第二行）")
+	}
+	if !hasTime && i <= 2 {
+		problems = append(problems, "缺少开奖时间（第三行）")
+	}
+	total, err := resolveWinnerCount(event.Prizes, winnerCount)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	event.WinnerCount = total
+	event.SkinName = event.prizeSummary()
+	return event, nil
+}
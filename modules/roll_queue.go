@@ -0,0 +1,118 @@
+package modules
+
+import (
+	"time"
+
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+)
+
+// 网站创建抽奖时写入 status 为 new 的文档，机器人定时领取（改为 announcing）并在群内发布，
+// 发布后保存消息ID并改为 pending，领取是原子的，同一个抽奖只会被发布一次；
+// 启动时把上次没有发布完的 announcing 改回 new 重新发布，所以停机期间写入的抽奖也不会遗漏，
+// 已经有消息ID的说明发布过了，改为 pending
+
+const defaultPollInterval = 10 * time.Second
+
+// 发布后保存状态失败时的重试次数和间隔，测试中改为0
+var (
+	markAnnouncedRetries = 3
+	markAnnouncedDelay   = time.Second
+)
+
+func (r *roll) pollInterval() time.Duration {
+	r._mu.Lock()
+	defer r._mu.Unlock()
+	return r.pollEvery
+}
+
+// 定时发布网站写入的抽奖，直到模块停止
+func (r *roll) pollNew(client qqClient) {
+	for {
+		r.announceNew(client)
+		select {
+		case <-time.After(r.pollInterval()):
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// 发布所有等待发布的抽奖，返回发布的个数
+func (r *roll) announceNew(client qqClient) int {
+	n := 0
+	for {
+		m, err := store().Rolls().ClaimNew(r.ctx)
+		if err == storage.ErrNotFound {
+			return n
+		} else if err != nil {
+			logger.Errorf("failed to claim new rolls: %v", err)
+			return n
+		}
+		e := newRollEventFromModel(m)
+		e.DrawTime = e.DrawTime.In(time.Local)
+		id := e.ObjectID.ObjectID
+		if !r.serves(e.GroupCode) {
+			logger.Warnf("roll %s is in group %d not served, cancelled", e.ShortHexID(), e.GroupCode)
+			if err = store().Rolls().SetStatus(r.ctx, id, model.RollCancelled); err != nil {
+				logger.Error(err)
+			}
+			continue
+		}
+		r.ensureSeed(e)
+		// 网站写入的其他群，跳过机器人不服务的群
+		groups := e.Groups[:0:0]
+		for _, g := range e.Groups {
+			if g.GroupCode != e.GroupCode && r.serves(g.GroupCode) {
+				groups = append(groups, g)
+			}
+		}
+		e.Groups = groups
+		msg := r.notice(client, e, nil)
+		if msg == nil {
+			// 发送失败，放回队列下次再试
+			logger.Errorf("failed to announce roll %s", e.ShortHexID())
+			if err = store().Rolls().SetStatus(r.ctx, id, model.RollNew); err != nil {
+				logger.Error(err)
+			}
+			return n
+		}
+		// 已经发布了，保存失败也要开奖，不能放回队列
+		e.MsgID = msg.Id
+		r.markAnnounced(e)
+		r.announceInGroups(client, e)
+		logger.Infof("announced roll %s from %s", e.ShortHexID(), m.Source)
+		r.scheduleDraw(client, e)
+		n++
+	}
+}
+
+// 先单独保存发布的消息ID，再改为 pending，失败时都会重试。改状态一直失败时
+// 留在 announcing，开奖时和下次启动时 ReleaseAnnouncing 按消息ID改为 pending，不会再次发布
+func (r *roll) markAnnounced(e *rollEvent) {
+	id := e.ObjectID.ObjectID
+	if err := r.retry(func() error { return store().Rolls().SetMsgID(r.ctx, id, e.MsgID) }); err != nil {
+		logger.Errorf("failed to save the message of roll %s: %v", e.ShortHexID(), err)
+	}
+	if err := r.retry(func() error { return store().Rolls().MarkAnnounced(r.ctx, id, e.MsgID) }); err != nil {
+		logger.Errorf("failed to mark roll %s announced: %v", e.ShortHexID(), err)
+	}
+}
+
+// 最多重试 markAnnouncedRetries 次，返回最后一次的错误
+func (r *roll) retry(fn func() error) error {
+	var err error
+	for i := 0; i <= markAnnouncedRetries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(markAnnouncedDelay):
+			case <-r.ctx.Done():
+				return r.ctx.Err()
+			}
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
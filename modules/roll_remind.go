@@ -0,0 +1,148 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 开奖前的提醒，在 reminders 配置的时间（如 1h、10m）引用抽奖消息在群里提醒，
+// 发送 /roll remind #id 的参与者还会收到私聊提醒
+
+// 同一个抽奖的提醒任务的key都以此开头，配置的提醒时间改变后也能全部取消
+func remindJobPrefix(id primitive.ObjectID) string {
+	return "remind:" + id.Hex() + ":"
+}
+
+func remindJobKey(id primitive.ObjectID, before time.Duration) string {
+	return remindJobPrefix(id) + before.String()
+}
+
+// 开奖前多久提醒，从早到晚排列，无法识别的配置被忽略
+func rollReminders(groupCode int64) []time.Duration {
+	var list []time.Duration
+	for _, s := range policies.groupSettings(groupCode, "roll").GetStringSlice("reminders") {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			logger.Warnf("invalid roll reminder %q", s)
+			continue
+		}
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i] > list[k] })
+	return list
+}
+
+// 写成 1小时30分钟 的形式，不足一分钟的部分省略
+func formatChineseDuration(d time.Duration) string {
+	hours, minutes := int(d.Hours()), int(d.Minutes())%60
+	switch {
+	case hours > 0 && minutes > 0:
+		return fmt.Sprintf("%d小时%d分钟", hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%d小时", hours)
+	default:
+		return fmt.Sprintf("%d分钟", minutes)
+	}
+}
+
+// 登记还没有到时间的提醒，替换之前登记的
+func (r *roll) scheduleReminders(client qqClient, e *rollEvent) {
+	id := e.ObjectID.ObjectID
+	now := time.Now()
+	r.stopReminders(e)
+	for _, before := range rollReminders(e.GroupCode) {
+		key := remindJobKey(id, before)
+		due := e.DrawTime.Add(-before)
+		if !due.After(now) {
+			continue
+		}
+		before := before
+		jobs.schedule(key, fmt.Sprintf("抽奖#%s开奖前%s提醒", e.ShortHexID(), formatChineseDuration(before)), e.GroupCode, due, func() {
+			r.remind(client, id, before)
+		})
+	}
+}
+
+// 取消抽奖的所有提醒，包括按之前的配置登记的
+func (r *roll) stopReminders(e *rollEvent) {
+	jobs.cancelPrefix(remindJobPrefix(e.ObjectID.ObjectID))
+}
+
+// 引用发布的消息，获取不到原消息时只引用编号
+func quoteMessage(client qqClient, groupCode int64, msgID int32) *message.ReplyElement {
+	msgs, err := client.GetGroupMessages(groupCode, int64(msgID)-1, int64(msgID))
+	if err == nil {
+		for _, m := range msgs {
+			if m.Id == msgID {
+				return message.NewReply(m)
+			}
+		}
+	}
+	return &message.ReplyElement{ReplySeq: msgID}
+}
+
+func (r *roll) remind(client qqClient, id primitive.ObjectID, before time.Duration) {
+	m, err := store().Rolls().Get(r.ctx, id)
+	if err != nil {
+		logger.Errorf("failed to get roll: %v", err)
+		return
+	}
+	if m.State() != model.RollPending {
+		return
+	}
+	e := newRollEventFromModel(m)
+	text := fmt.Sprintf("#%s %s还有%s开奖，当前%d人参加，回复抽奖消息参加",
+		e.ShortHexID(), e.prizeSummary(), formatChineseDuration(before), e.participants.Size())
+	send := func(groupCode int64, msgID int32) {
+		msg := message.NewSendingMessage().Append(quoteMessage(client, groupCode, msgID)).Append(message.NewText(text))
+		client.SendGroupMessage(groupCode, msg)
+	}
+	send(e.GroupCode, e.MsgID)
+	for _, g := range e.Groups {
+		send(g.GroupCode, g.MsgID)
+	}
+	for _, uin := range m.Subscribers {
+		if e.participants.Has(message.Sender{Uin: uin}) {
+			client.SendPrivateMessage(uin, utils.NewTextMessage(fmt.Sprintf("你参加的抽奖#%s %s还有%s开奖",
+				e.ShortHexID(), e.prizeSummary(), formatChineseDuration(before))))
+		}
+	}
+}
+
+// /roll remind #id 参与者开启或关闭私聊提醒
+func (r *roll) subscribe(client qqClient, msg *message.GroupMessage, id string) {
+	e, ok := r.mustFindRoll(client, msg, id)
+	if !ok {
+		return
+	}
+	if !e.participants.Has(*msg.Sender) {
+		replyToGroupMessage(client, msg, "请先参加抽奖#"+e.ShortHexID())
+		return
+	}
+	m, err := store().Rolls().Get(r.ctx, e.ObjectID.ObjectID)
+	if err != nil {
+		logger.Errorf("failed to get roll: %v", err)
+		replyToGroupMessage(client, msg, "查询抽奖失败")
+		return
+	}
+	on := true
+	for _, uin := range m.Subscribers {
+		on = on && uin != msg.Sender.Uin
+	}
+	if err = store().Rolls().Subscribe(r.ctx, m.ObjectID.ObjectID, msg.Sender.Uin, on); err != nil {
+		logger.Errorf("failed to subscribe: %v", err)
+		replyToGroupMessage(client, msg, "设置提醒失败")
+		return
+	}
+	if on {
+		replyToGroupMessage(client, msg, fmt.Sprintf("%s将在抽奖#%s开奖前收到私聊提醒", msg.Sender.DisplayName(), e.ShortHexID()))
+	} else {
+		replyToGroupMessage(client, msg, fmt.Sprintf("%s已关闭抽奖#%s的私聊提醒", msg.Sender.DisplayName(), e.ShortHexID()))
+	}
+}
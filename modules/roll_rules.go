@@ -0,0 +1,235 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yangrq1018/botqq/model"
+)
+
+const rollRulesUsage = `参与条件（可选，每行一个）:
+入群天数: 30
+等级: 10
+发言数: 100（本统计周期内的发言次数）
+口令: 关键词（回复中必须包含）
+人数上限: 50
+允许发起人（默认发起人不能参加）
+加权（可选，每人默认1张票）:
+发言加权: 100（本统计周期内每发言100次多1张票）
+额外票数: 12345 x3;23456 x2（按QQ号额外加票，如发起人的好友或积分兑换）
+最多票数: 5（每人最多的票数）`
+
+var ruleLineRegex = regexp.MustCompile(`^(\S+?)\s*[:：]\s*(.+)$`)
+
+// 参与条件的写法，key为小写
+var ruleSetters = map[string]func(r *model.RollRules, value string) error{
+	"入群天数":            intRule(func(r *model.RollRules, n int) { r.MinMemberDays = n }),
+	"min_days":        intRule(func(r *model.RollRules, n int) { r.MinMemberDays = n }),
+	"等级":              intRule(func(r *model.RollRules, n int) { r.MinLevel = n }),
+	"level":           intRule(func(r *model.RollRules, n int) { r.MinLevel = n }),
+	"发言数":             intRule(func(r *model.RollRules, n int) { r.MinMessages = int64(n) }),
+	"messages":        intRule(func(r *model.RollRules, n int) { r.MinMessages = int64(n) }),
+	"人数上限":            intRule(func(r *model.RollRules, n int) { r.MaxParticipants = n }),
+	"max":             intRule(func(r *model.RollRules, n int) { r.MaxParticipants = n }),
+	"口令":              func(r *model.RollRules, v string) error { r.Keyword = v; return nil },
+	"keyword":         func(r *model.RollRules, v string) error { r.Keyword = v; return nil },
+	"允许发起人":           func(r *model.RollRules, _ string) error { r.AllowOrganiser = true; return nil },
+	"allow_organiser": func(r *model.RollRules, _ string) error { r.AllowOrganiser = true; return nil },
+	"发言加权":            intRule(func(r *model.RollRules, n int) { r.MessagesPerTicket = int64(n) }),
+	"message_weight":  intRule(func(r *model.RollRules, n int) { r.MessagesPerTicket = int64(n) }),
+	"最多票数":            intRule(func(r *model.RollRules, n int) { r.MaxTickets = int64(n) }),
+	"max_tickets":     intRule(func(r *model.RollRules, n int) { r.MaxTickets = int64(n) }),
+	"额外票数":            bonusRule,
+	"bonus":           bonusRule,
+}
+
+func intRule(set func(r *model.RollRules, n int)) func(r *model.RollRules, value string) error {
+	return func(r *model.RollRules, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("必须是正整数")
+		}
+		set(r, n)
+		return nil
+	}
+}
+
+// 12345 x3;23456，没有写数量时加1张票
+func bonusRule(r *model.RollRules, value string) error {
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '；' }) {
+		item = strings.TrimSpace(item)
+		tickets := "1"
+		if m := quantityRegex.FindStringSubmatch(item); m != nil {
+			item, tickets = m[1], m[2]
+		}
+		uin, err := strconv.ParseInt(item, 10, 64)
+		if err != nil || uin <= 0 {
+			return fmt.Errorf("的%q不是QQ号", item)
+		}
+		n, err := strconv.ParseInt(tickets, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("的票数必须是正整数")
+		}
+		r.BonusTickets = append(r.BonusTickets, model.BonusTicket{Uin: uin, Tickets: n})
+	}
+	return nil
+}
+
+// 解析一行参与条件，不是参与条件时返回false
+func parseRuleLine(line string, rules *model.RollRules) (bool, error) {
+	key, value := line, ""
+	if m := ruleLineRegex.FindStringSubmatch(line); m != nil {
+		key, value = m[1], strings.TrimSpace(m[2])
+	}
+	set, ok := ruleSetters[strings.ToLower(key)]
+	if !ok {
+		return false, nil
+	}
+	if err := set(rules, value); err != nil {
+		return true, fmt.Errorf("%s%s", key, err)
+	}
+	return true, nil
+}
+
+// 参与条件的说明，没有条件时为空
+func describeRules(rules model.RollRules) string {
+	var conditions []string
+	if rules.MinMemberDays > 0 {
+		conditions = append(conditions, fmt.Sprintf("入群满%d天", rules.MinMemberDays))
+	}
+	if rules.MinLevel > 0 {
+		conditions = append(conditions, fmt.Sprintf("群等级%d以上", rules.MinLevel))
+	}
+	if rules.MinMessages > 0 {
+		conditions = append(conditions, fmt.Sprintf("发言%d次以上", rules.MinMessages))
+	}
+	if rules.Keyword != "" {
+		conditions = append(conditions, fmt.Sprintf("回复口令%q", rules.Keyword))
+	}
+	if rules.MaxParticipants > 0 {
+		conditions = append(conditions, fmt.Sprintf("限%d人", rules.MaxParticipants))
+	}
+	return strings.Join(conditions, "，")
+}
+
+// 加权的说明，不加权时为空
+func describeWeights(rules model.RollRules) string {
+	if !rules.Weighted() {
+		return ""
+	}
+	weights := []string{"每人1张票"}
+	if rules.MessagesPerTicket > 0 {
+		weights = append(weights, fmt.Sprintf("每发言%d次多1张", rules.MessagesPerTicket))
+	}
+	for _, b := range rules.BonusTickets {
+		weights = append(weights, fmt.Sprintf("%d多%d张", b.Uin, b.Tickets))
+	}
+	if rules.MaxTickets > 0 {
+		weights = append(weights, fmt.Sprintf("最多%d张", rules.MaxTickets))
+	}
+	return strings.Join(weights, "，")
+}
+
+// 参与者的票数，与order一一对应，不加权时返回nil
+func (r *roll) entryWeights(ctx context.Context, e *rollEvent, order []int64) []int64 {
+	rules := e.Rules
+	if !rules.Weighted() {
+		return nil
+	}
+	weights := make([]int64, len(order))
+	for i, uin := range order {
+		w := int64(1)
+		if rules.MessagesPerTicket > 0 && uin > 0 {
+			w += messageCount(ctx, e, uin) / rules.MessagesPerTicket
+		}
+		for _, b := range rules.BonusTickets {
+			if b.Uin == uin {
+				w += b.Tickets
+			}
+		}
+		if rules.MaxTickets > 0 && w > rules.MaxTickets {
+			w = rules.MaxTickets
+		}
+		weights[i] = w
+	}
+	return weights
+}
+
+// 成员在发起群和其他公布抽奖的群里的发言次数之和，参加者可能来自任何一个群
+func messageCount(ctx context.Context, e *rollEvent, uin int64) int64 {
+	groups := []int64{e.GroupCode}
+	for _, g := range e.Groups {
+		groups = append(groups, g.GroupCode)
+	}
+	var total int64
+	for _, groupCode := range groups {
+		count, err := store().Stats().Get(ctx, groupCode, uin)
+		if err != nil {
+			logger.Errorf("failed to get message count of %d in group %d: %v", uin, groupCode, err)
+			continue
+		}
+		total += count.Count
+	}
+	return total
+}
+
+// 检查群成员能否参加抽奖，不能参加时返回原因
+func (r *roll) checkEligible(client qqClient, e *rollEvent, groupCode, uin int64, text string) error {
+	rules := e.Rules
+	if uin == r.botUin {
+		return fmt.Errorf("机器人不能参加抽奖")
+	}
+	if uin == e.SenderID && !rules.AllowOrganiser {
+		return fmt.Errorf("发起人不能参加自己的抽奖")
+	}
+	if rules.Keyword != "" && !strings.Contains(text, rules.Keyword) {
+		return fmt.Errorf("回复中没有口令%q", rules.Keyword)
+	}
+	if rules.MaxParticipants > 0 && e.participants.Size() >= rules.MaxParticipants {
+		return fmt.Errorf("参与人数已满%d人", rules.MaxParticipants)
+	}
+	if rules.MinMemberDays > 0 || rules.MinLevel > 0 {
+		g, err := client.GetGroupInfo(groupCode)
+		if err != nil {
+			return fmt.Errorf("无法获取群成员信息")
+		}
+		members, err := client.GetGroupMembers(g)
+		if err != nil {
+			return fmt.Errorf("无法获取群成员信息")
+		}
+		found := false
+		for _, m := range members {
+			if m.Uin != uin {
+				continue
+			}
+			found = true
+			if rules.MinMemberDays > 0 {
+				days := int(time.Since(time.Unix(m.JoinTime, 0)).Hours() / 24)
+				if days < rules.MinMemberDays {
+					return fmt.Errorf("入群%d天，需要满%d天", days, rules.MinMemberDays)
+				}
+			}
+			if rules.MinLevel > 0 && int(m.Level) < rules.MinLevel {
+				return fmt.Errorf("群等级%d，需要%d以上", m.Level, rules.MinLevel)
+			}
+		}
+		if !found {
+			return fmt.Errorf("无法获取群成员信息")
+		}
+	}
+	if rules.MinMessages > 0 {
+		count, err := store().Stats().Get(context.Background(), groupCode, uin)
+		if err != nil {
+			logger.Errorf("failed to get message count: %v", err)
+			return fmt.Errorf("无法获取发言次数")
+		}
+		if count.Count < rules.MinMessages {
+			return fmt.Errorf("发言%d次，需要%d次以上", count.Count, rules.MinMessages)
+		}
+	}
+	return nil
+}
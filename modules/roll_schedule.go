@@ -0,0 +1,86 @@
+package modules
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+	"github.com/yangrq1018/botqq/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func drawJobKey(id primitive.ObjectID) string {
+	return "roll:" + id.Hex()
+}
+
+func claimJobKey(id primitive.ObjectID) string {
+	return "claim:" + id.Hex()
+}
+
+func (r *roll) missedGraceDuration() time.Duration {
+	r._mu.Lock()
+	defer r._mu.Unlock()
+	return r.missedGrace
+}
+
+// 启动时登记所有进行中的抽奖和领奖期限
+// 机器人离线期间错过开奖时间的抽奖，在 missed_grace 内的立即补开，超过的取消并通知
+func (r *roll) restore(client qqClient) {
+	logger.Info("checking unfinished rolls...")
+	now := time.Now()
+	grace := r.missedGraceDuration()
+	// 多群抽奖会在每个群各查到一次
+	seen := make(map[primitive.ObjectID]bool)
+	for _, groupCode := range r.groups() {
+		events, err := store().Rolls().List(r.ctx, storage.RollFilter{
+			GroupCode: groupCode,
+			Status:    []model.RollStatus{model.RollPending},
+		})
+		if err != nil {
+			logger.Fatal(err)
+		}
+		for _, m := range events {
+			if seen[m.ObjectID.ObjectID] {
+				continue
+			}
+			seen[m.ObjectID.ObjectID] = true
+			e := newRollEventFromModel(m)
+			e.DrawTime = e.DrawTime.In(time.Local)
+			missed := now.Sub(e.DrawTime)
+			if missed > 0 && grace > 0 && missed > grace {
+				logger.Warnf("roll %s missed its draw time by %s, cancelled", e.ShortHexID(), missed)
+				if err = r.cancelRoll(e); err != nil {
+					logger.Errorf("failed to cancel roll: %v", err)
+					continue
+				}
+				text := fmt.Sprintf("#%s 机器人离线期间错过了开奖时间%s，超过补开期限%s，抽奖已取消",
+					e.ShortHexID(), e.DrawTime.Format("01月02日 15:04"), grace)
+				client.SendGroupMessage(e.GroupCode, utils.NewTextMessage(text))
+				r.sendToOtherGroups(client, e, text)
+				continue
+			}
+			if missed > 0 {
+				logger.Warnf("roll %s missed its draw time by %s, draw now", e.ShortHexID(), missed)
+			}
+			r.scheduleDraw(client, e)
+		}
+
+		// 领奖期限
+		events, err = store().Rolls().List(r.ctx, storage.RollFilter{
+			GroupCode: groupCode,
+			Status:    []model.RollStatus{model.RollDrawn},
+		})
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		for _, m := range events {
+			if seen[m.ObjectID.ObjectID] {
+				continue
+			}
+			seen[m.ObjectID.ObjectID] = true
+			r.scheduleClaims(client, m.ObjectID.ObjectID, m.ShortHexID(), m.GroupCode, m.Claims)
+		}
+	}
+}
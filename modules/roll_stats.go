@@ -0,0 +1,294 @@
+package modules
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/julienschmidt/httprouter"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+)
+
+// 抽奖统计，从保存的抽奖记录计算，/roll stats 查看本群，/roll me 查看自己的中奖记录
+
+const (
+	statsTop    = 5  // 排行榜列出的人数
+	statsMonths = 6  // 参与趋势的月数
+	statsWins   = 10 // /roll me 列出的最近中奖记录
+)
+
+type rollStats struct {
+	GroupCode   int64        `json:"groupCode"`
+	Drawn       int          `json:"drawn"`
+	Pending     int          `json:"pending"`
+	Cancelled   int          `json:"cancelled"`
+	PrizesGiven int          `json:"prizesGiven"`
+	ValueGiven  float64      `json:"valueGiven"` // 奖品库估价的总和
+	Entries     int          `json:"entries"`    // 参与人次
+	Members     int          `json:"members"`    // 参与人数
+	Organisers  []statsRank  `json:"topOrganisers"`
+	Winners     []statsRank  `json:"topWinners"`
+	Trend       []statsMonth `json:"trend"`
+}
+
+type statsRank struct {
+	Uin      int64  `json:"uin"`
+	Nickname string `json:"nickname"`
+	Count    int    `json:"count"`
+}
+
+// 一个月内开奖的抽奖个数和参与人次
+type statsMonth struct {
+	Month   string `json:"month"`
+	Rolls   int    `json:"rolls"`
+	Entries int    `json:"entries"`
+}
+
+// 一个人的抽奖记录
+type memberHistory struct {
+	Uin     int64       `json:"uin"`
+	Entered int         `json:"entered"`
+	Wins    []memberWin `json:"wins"`
+}
+
+type memberWin struct {
+	ID        string            `json:"id"`
+	GroupCode int64             `json:"groupCode"`
+	Prize     string            `json:"prize"`
+	DrawTime  time.Time         `json:"drawTime"`
+	Claim     model.ClaimStatus `json:"claim,omitempty"`
+}
+
+// 发出的奖品，需要领奖时不算超时未领的
+type rollAward struct {
+	winner message.Sender
+	prize  string
+	claim  model.ClaimStatus
+}
+
+func rollAwards(m *model.MongoEvent) []rollAward {
+	var awards []rollAward
+	if len(m.Claims) > 0 {
+		for _, c := range m.Claims {
+			if c.Status != model.ClaimExpired {
+				awards = append(awards, rollAward{winner: message.Sender{Uin: c.Uin, Nickname: c.Nickname}, prize: c.Prize, claim: c.Status})
+			}
+		}
+		return awards
+	}
+	e := newRollEventFromModel(m)
+	for i, w := range m.Winners {
+		awards = append(awards, rollAward{winner: w, prize: e.prizeOf(i)})
+	}
+	return awards
+}
+
+// 按次数从多到少排列，次数相同时按QQ号
+type rankCounter map[int64]*statsRank
+
+func (c rankCounter) add(uin int64, nickname string) {
+	if r, ok := c[uin]; ok {
+		r.Count++
+		r.Nickname = nickname
+		return
+	}
+	c[uin] = &statsRank{Uin: uin, Nickname: nickname, Count: 1}
+}
+
+func (c rankCounter) top(n int) []statsRank {
+	list := make([]statsRank, 0, len(c))
+	for _, r := range c {
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, k int) bool {
+		if list[i].Count != list[k].Count {
+			return list[i].Count > list[k].Count
+		}
+		return list[i].Uin < list[k].Uin
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// 统计抽奖记录，参与趋势为now之前statsMonths个月（包括本月）
+func computeRollStats(groupCode int64, events []*model.MongoEvent, now time.Time) rollStats {
+	stats := rollStats{GroupCode: groupCode}
+	organisers, winners := make(rankCounter), make(rankCounter)
+	members := make(map[int64]bool)
+	now = now.In(time.Local)
+	first := time.Date(now.Year(), now.Month()-statsMonths+1, 1, 0, 0, 0, 0, time.Local)
+	for i := 0; i < statsMonths; i++ {
+		stats.Trend = append(stats.Trend, statsMonth{Month: first.AddDate(0, i, 0).Format("2006-01")})
+	}
+	for _, m := range events {
+		switch m.State() {
+		case model.RollPending:
+			stats.Pending++
+			continue
+		case model.RollCancelled:
+			stats.Cancelled++
+			continue
+		case model.RollDrawn:
+			stats.Drawn++
+		default:
+			continue
+		}
+		organisers.add(m.SenderID, m.SenderNickname)
+		for _, a := range rollAwards(m) {
+			stats.PrizesGiven++
+			stats.ValueGiven += findPrize(m.Prizes, a.prize).Value
+			winners.add(a.winner.Uin, a.winner.DisplayName())
+		}
+		stats.Entries += len(m.Participants)
+		for _, p := range m.Participants {
+			members[p.Uin] = true
+		}
+		drawTime := m.DrawTime.In(time.Local)
+		if !drawTime.Before(first) && !drawTime.After(now) {
+			month := (drawTime.Year()-first.Year())*12 + int(drawTime.Month()-first.Month())
+			stats.Trend[month].Rolls++
+			stats.Trend[month].Entries += len(m.Participants)
+		}
+	}
+	stats.Members = len(members)
+	stats.Organisers = organisers.top(statsTop)
+	stats.Winners = winners.top(statsTop)
+	return stats
+}
+
+// 一个人参加和中奖的记录，中奖记录按开奖时间从新到旧
+func computeMemberHistory(uin int64, events []*model.MongoEvent) memberHistory {
+	h := memberHistory{Uin: uin, Wins: []memberWin{}}
+	for _, m := range events {
+		if m.State() != model.RollDrawn {
+			continue
+		}
+		for _, p := range m.Participants {
+			if p.Uin == uin {
+				h.Entered++
+				break
+			}
+		}
+		for _, a := range rollAwards(m) {
+			if a.winner.Uin == uin {
+				h.Wins = append(h.Wins, memberWin{
+					ID:        m.ShortHexID(),
+					GroupCode: m.GroupCode,
+					Prize:     a.prize,
+					DrawTime:  m.DrawTime,
+					Claim:     a.claim,
+				})
+			}
+		}
+	}
+	sort.SliceStable(h.Wins, func(i, k int) bool { return h.Wins[i].DrawTime.After(h.Wins[k].DrawTime) })
+	return h
+}
+
+func describeRanks(ranks []statsRank) string {
+	names := make([]string, len(ranks))
+	for i, r := range ranks {
+		names[i] = fmt.Sprintf("%s(%d次)", r.Nickname, r.Count)
+	}
+	return strings.Join(names, "、")
+}
+
+func (r *roll) groupRolls(client qqClient, msg *message.GroupMessage) ([]*model.MongoEvent, bool) {
+	events, err := store().Rolls().List(r.ctx, storage.RollFilter{GroupCode: msg.GroupCode})
+	if err != nil {
+		logger.Errorf("failed to list rolls: %v", err)
+		replyToGroupMessage(client, msg, "查询抽奖失败")
+		return nil, false
+	}
+	return events, true
+}
+
+// /roll stats
+func (r *roll) stats(client qqClient, msg *message.GroupMessage) {
+	events, ok := r.groupRolls(client, msg)
+	if !ok {
+		return
+	}
+	stats := computeRollStats(msg.GroupCode, events, time.Now())
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("本群抽奖统计:\n已开奖%d次，进行中%d个，已取消%d个\n发出奖品%d件，参与%d人次(%d人)",
+		stats.Drawn, stats.Pending, stats.Cancelled, stats.PrizesGiven, stats.Entries, stats.Members))
+	if stats.ValueGiven > 0 {
+		sb.WriteString(fmt.Sprintf("，估价约¥%.2f", stats.ValueGiven))
+	}
+	if len(stats.Organisers) > 0 {
+		sb.WriteString("\n发起最多: " + describeRanks(stats.Organisers))
+	}
+	if len(stats.Winners) > 0 {
+		sb.WriteString("\n中奖最多: " + describeRanks(stats.Winners))
+	}
+	sb.WriteString(fmt.Sprintf("\n最近%d个月:", statsMonths))
+	for _, m := range stats.Trend {
+		sb.WriteString(fmt.Sprintf("\n%s 开奖%d次 参与%d人次", m.Month, m.Rolls, m.Entries))
+	}
+	replyToGroupMessage(client, msg, sb.String())
+}
+
+// /roll me
+func (r *roll) me(client qqClient, msg *message.GroupMessage) {
+	events, ok := r.groupRolls(client, msg)
+	if !ok {
+		return
+	}
+	h := computeMemberHistory(msg.Sender.Uin, events)
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s在本群参加抽奖%d次，中奖%d次", msg.Sender.DisplayName(), h.Entered, len(h.Wins)))
+	for i, w := range h.Wins {
+		if i == statsWins {
+			sb.WriteString(fmt.Sprintf("\n只列出最近%d次", statsWins))
+			break
+		}
+		sb.WriteString(fmt.Sprintf("\n%s #%s %s", w.DrawTime.In(time.Local).Format("2006-01-02"), w.ID, w.Prize))
+		if w.Claim != "" {
+			sb.WriteString(" " + claimStatusNames[w.Claim])
+		}
+	}
+	replyToGroupMessage(client, msg, sb.String())
+}
+
+func (r *roll) apiListStats(writer http.ResponseWriter, req *http.Request) ([]*model.MongoEvent, int64, bool) {
+	groupCode, ok := queryGroup(writer, req)
+	if !ok {
+		return nil, 0, false
+	}
+	events, err := store().Rolls().List(r.ctx, storage.RollFilter{GroupCode: groupCode})
+	if err != nil {
+		logger.Errorf("failed to list rolls: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to list rolls")
+		return nil, 0, false
+	}
+	return events, groupCode, true
+}
+
+func (r *roll) apiStats(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	events, groupCode, ok := r.apiListStats(writer, req)
+	if !ok {
+		return
+	}
+	writeJSON(writer, http.StatusOK, computeRollStats(groupCode, events, time.Now()))
+}
+
+func (r *roll) apiMemberStats(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	uin, err := strconv.ParseInt(params.ByName("uin"), 10, 64)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "invalid uin %q", params.ByName("uin"))
+		return
+	}
+	events, _, ok := r.apiListStats(writer, req)
+	if !ok {
+		return
+	}
+	writeJSON(writer, http.StatusOK, computeMemberHistory(uin, events))
+}
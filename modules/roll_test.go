@@ -0,0 +1,929 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Logiase/MiraiGo-Template/config"
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestRoll(h *harness) *roll {
+	r := new(roll)
+	r.Init()
+	r.registerMessageListener(r.dispatch, h.groupMessages)
+	return r
+}
+
+func TestRollReplyToJoin(t *testing.T) {
+	h := newHarness(t)
+	r := newTestRoll(h)
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\n2099-01-01 20:00")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	r.persistModel(event)
+
+	reply := &message.ReplyElement{ReplySeq: announce.Id}
+	h.say(sender(testMemberUin), "", reply, message.NewText("1"))
+	assert.Equal(t, "user40000已加入抽奖", h.client.lastText())
+	// 重复回复不会重复加入
+	h.say(sender(testMemberUin), "", reply, message.NewText("2"))
+
+	stored, err := store().Rolls().Get(context.Background(), event.ObjectID.ObjectID)
+	assert.NoError(t, err)
+	assert.Equal(t, "AK-47", stored.SkinName)
+	assert.Len(t, stored.Participants, 1)
+	assert.Equal(t, int64(testMemberUin), stored.Participants[0].Uin)
+}
+
+func TestRollDraw(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	r := newTestRoll(h)
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\nnow")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	event.DrawTime = time.Now()
+	r.persistModel(event)
+	h.say(sender(testMemberUin), "", &message.ReplyElement{ReplySeq: announce.Id})
+
+	r.drawNow(h.client, event)
+	texts := h.client.sentTexts()
+	assert.Contains(t, texts[len(texts)-2], `恭喜用户"user40000"`)
+	stored, _ := store().Rolls().Get(context.Background(), event.ObjectID.ObjectID)
+	assert.Len(t, stored.Winners, 1)
+	assert.Equal(t, []int64{testMemberUin}, stored.Draw.Winners)
+	assert.NoError(t, verifyDraw(stored))
+
+	h.say(sender(testMemberUin), "@bot /verify #"+event.ShortHexID())
+	assert.Contains(t, h.client.lastText(), "验证通过\n种子: "+stored.Seed)
+}
+
+func TestVerifyDraw(t *testing.T) {
+	seed := "seed"
+	order := []int64{-3, 100, 200, 300, 400}
+	winners := drawWinners(seed, order, nil, 3)
+	assert.Len(t, winners, 3)
+	assert.Equal(t, winners, drawWinners(seed, order, nil, 3), "the draw is deterministic")
+	assert.ElementsMatch(t, order, drawWinners(seed, order, nil, 10))
+
+	e := &model.MongoEvent{
+		WinnerCount: 3,
+		SeedHash:    hashSeed(seed),
+		Draw:        &model.DrawRecord{Seed: seed, Order: order, Winners: winners},
+	}
+	assert.NoError(t, verifyDraw(e))
+	e.Draw.Winners = []int64{100, 200, 300}
+	assert.Error(t, verifyDraw(e))
+	e.Draw.Winners = winners
+	e.Draw.Seed = "another"
+	assert.Error(t, verifyDraw(e))
+}
+
+func TestWeightedDraw(t *testing.T) {
+	seed := "seed"
+	order := []int64{100, 200, 300}
+	assert.Equal(t, drawWinners(seed, order, nil, 3), drawWinners(seed, order, []int64{1, 1, 1}, 3),
+		"one ticket each is the same as no weighting")
+	for i := 0; i < 20; i++ {
+		s := fmt.Sprint(seed, i)
+		assert.Equal(t, []int64{200}, drawWinners(s, order, []int64{1, 1 << 40, 1}, 1))
+	}
+
+	weights := []int64{1, 5, 2}
+	e := &model.MongoEvent{
+		WinnerCount: 2,
+		SeedHash:    hashSeed(seed),
+		Draw:        &model.DrawRecord{Seed: seed, Order: order, Weights: weights, Winners: drawWinners(seed, order, weights, 2)},
+	}
+	assert.NoError(t, verifyDraw(e))
+	e.Draw.Weights = []int64{1, 5}
+	assert.Error(t, verifyDraw(e))
+}
+
+func TestRollWeighted(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	r := newTestRoll(h)
+	ctx := context.Background()
+	assert.NoError(t, store().Stats().Add(ctx, testGroupCode, testMemberUin, "member", 35))
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\n2099-01-01 20:00\n发言加权: 10\n额外票数: 50000 x2\n最多票数: 4")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	assert.Equal(t, "每人1张票，每发言10次多1张，50000多2张，最多4张", describeWeights(event.Rules))
+	r.persistModel(event)
+	for _, uin := range []int64{testMemberUin, 50000, 60000} {
+		h.say(sender(uin), "", &message.ReplyElement{ReplySeq: announce.Id})
+	}
+
+	h.say(sender(testMemberUin), "@bot /roll info #"+event.ShortHexID())
+	assert.Contains(t, h.client.lastText(), "加权: 每人1张票，每发言10次多1张，50000多2张，最多4张\n")
+	assert.Contains(t, h.client.lastText(), "user40000(4票)")
+	assert.Contains(t, h.client.lastText(), "user50000(3票)")
+	assert.Contains(t, h.client.lastText(), "user60000(1票)")
+
+	// 其他公布抽奖的群里的发言也计入
+	assert.NoError(t, store().Stats().Add(ctx, 20001, 60000, "other", 12))
+	assert.NoError(t, store().Rolls().SetGroups(ctx, event.ObjectID.ObjectID, []model.RollGroup{{GroupCode: 20001}}))
+	event, _ = r.getRoll(testGroupCode, announce.Id)
+	event.DrawTime = time.Now()
+	r.drawNow(h.client, event)
+	stored, _ := store().Rolls().Get(ctx, event.ObjectID.ObjectID)
+	assert.Equal(t, []int64{4, 3, 2}, stored.Draw.Weights)
+	assert.NoError(t, verifyDraw(stored))
+
+	_, err = newRollEventFromMessage(h.say(sender(testOwnerUin), "/roll\nAK-47\nnow\n额外票数: abc x2"))
+	assert.EqualError(t, err, `1. 额外票数的"abc"不是QQ号`)
+}
+
+func TestParseDrawTime(t *testing.T) {
+	now := time.Date(2022, 6, 1, 20, 30, 0, 0, time.Local)
+	cases := []struct {
+		in   string
+		want time.Time
+	}{
+		{"now", now},
+		{"in 30m", now.Add(30 * time.Minute)},
+		{"in 1h30m", now.Add(90 * time.Minute)},
+		{"30分钟后", now.Add(30 * time.Minute)},
+		{"2小时后", now.Add(2 * time.Hour)},
+		{"today 21:00", time.Date(2022, 6, 1, 21, 0, 0, 0, time.Local)},
+		{"今天 21:00", time.Date(2022, 6, 1, 21, 0, 0, 0, time.Local)},
+		{"明天 20:00", time.Date(2022, 6, 2, 20, 0, 0, 0, time.Local)},
+		{"Tomorrow 8:05", time.Date(2022, 6, 2, 8, 5, 0, 0, time.Local)},
+		{"22:00", time.Date(2022, 6, 1, 22, 0, 0, 0, time.Local)},
+		{"2022-06-03 15:04", time.Date(2022, 6, 3, 15, 4, 0, 0, time.Local)},
+	}
+	for _, c := range cases {
+		got, err := parseDrawTime(c.in, now)
+		assert.NoError(t, err, c.in)
+		assert.True(t, c.want.Equal(got), "%s: want %s, got %s", c.in, c.want, got)
+	}
+
+	for _, in := range []string{"today 20:00", "2022-05-01 15:04", "in 3x", "明天 25:00", "下周"} {
+		_, err := parseDrawTime(in, now)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestNewRollEventFromMessage(t *testing.T) {
+	h := newHarness(t)
+	msg := h.say(sender(testOwnerUin), "/roll\nAK-47 | 红线 x2；蝴蝶刀\nin 1h\n张三\n奖品: 贴纸 x3\n\n李四")
+	event, err := newRollEventFromMessage(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, event.WinnerCount)
+	assert.Equal(t, "AK-47 | 红线 x2、蝴蝶刀、贴纸 x3", event.SkinName)
+	assert.Equal(t, "AK-47 | 红线", event.prizeOf(1))
+	assert.Equal(t, "蝴蝶刀", event.prizeOf(2))
+	assert.Equal(t, "贴纸", event.prizeOf(5))
+	assert.Len(t, event.Participants(), 2)
+
+	msg = h.say(sender(testOwnerUin), "/roll\n蝴蝶刀\n明天 20:00\n人数: 3")
+	event, err = newRollEventFromMessage(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, event.WinnerCount)
+	assert.Equal(t, "蝴蝶刀 x3", event.SkinName)
+
+	msg = h.say(sender(testOwnerUin), "/roll\nAK-47 x2;蝴蝶刀\n2000-01-01 00:00\n人数 5")
+	_, err = newRollEventFromMessage(msg)
+	assert.Equal(t, rollParseError{"开奖时间2000-01-01 00:00已经过去", "中奖人数5与奖品总数3不一致"}, err)
+
+	msg = h.say(sender(testOwnerUin), "/roll")
+	_, err = newRollEventFromMessage(msg)
+	assert.Equal(t, rollParseError{"缺少奖品（第二行）", "缺少开奖时间（第三行）"}, err)
+}
+
+func TestRollBadSyntax(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	newTestRoll(h)
+	h.say(sender(testOwnerUin), "@bot /roll\nAK-47\n昨天")
+	assert.Eventually(t, func() bool {
+		return strings.HasPrefix(h.client.lastText(), "抽奖创建失败:\n1. 无法识别的开奖时间\"昨天\"")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRollEligibility(t *testing.T) {
+	h := newHarness(t)
+	r := newTestRoll(h)
+	h.client.groups[0].FindMember(testMemberUin).JoinTime = time.Now().Add(-48 * time.Hour).Unix()
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\nin 1h\n口令: 冲冲冲\n入群天数: 3\n人数上限: 1")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	assert.Equal(t, "入群满3天，回复口令\"冲冲冲\"，限1人", describeRules(event.Rules))
+	r.persistModel(event)
+	reply := &message.ReplyElement{ReplySeq: announce.Id}
+
+	h.say(sender(testOwnerUin), "", reply, message.NewText("冲冲冲"))
+	assert.Equal(t, "user30000无法加入抽奖: 发起人不能参加自己的抽奖", h.client.lastText())
+	h.say(sender(testBotUin), "", reply, message.NewText("冲冲冲"))
+	assert.Equal(t, "user10000无法加入抽奖: 机器人不能参加抽奖", h.client.lastText())
+	h.say(sender(testMemberUin), "", reply, message.NewText("参加"))
+	assert.Equal(t, "user40000无法加入抽奖: 回复中没有口令\"冲冲冲\"", h.client.lastText())
+	h.say(sender(testMemberUin), "", reply, message.NewText("冲冲冲"))
+	assert.Equal(t, "user40000无法加入抽奖: 入群2天，需要满3天", h.client.lastText())
+
+	h.client.groups[0].FindMember(testMemberUin).JoinTime = time.Now().Add(-96 * time.Hour).Unix()
+	h.say(sender(testMemberUin), "", reply, message.NewText("冲冲冲"))
+	assert.Equal(t, "user40000已加入抽奖", h.client.lastText())
+	h.say(sender(50000), "", reply, message.NewText("冲冲冲"))
+	assert.Equal(t, "user50000无法加入抽奖: 参与人数已满1人", h.client.lastText())
+}
+
+func TestRollMinMessages(t *testing.T) {
+	h := newHarness(t)
+	r := newTestRoll(h)
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\nin 1h\n发言数: 2\n允许发起人")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	r.persistModel(event)
+	reply := &message.ReplyElement{ReplySeq: announce.Id}
+
+	assert.NoError(t, store().Stats().Add(context.Background(), testGroupCode, testOwnerUin, "owner", 1))
+	h.say(sender(testOwnerUin), "", reply)
+	assert.Equal(t, "user30000无法加入抽奖: 发言1次，需要2次以上", h.client.lastText())
+	assert.NoError(t, store().Stats().Add(context.Background(), testGroupCode, testOwnerUin, "owner", 1))
+	h.say(sender(testOwnerUin), "", reply)
+	assert.Equal(t, "user30000已加入抽奖", h.client.lastText())
+}
+
+func TestRollListEditCancel(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	r := newTestRoll(h)
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\n2099-01-01 20:00")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	r.persistModel(event)
+	id := event.ShortHexID()
+	h.say(sender(testMemberUin), "", &message.ReplyElement{ReplySeq: announce.Id})
+
+	h.say(sender(testMemberUin), "@bot /rolls")
+	assert.Equal(t, "本群进行中的抽奖:\n#"+id+" AK-47 01月01日 20:00开奖 1人参加", h.client.lastText())
+
+	h.say(sender(testMemberUin), "@bot /roll info #"+id)
+	assert.Contains(t, h.client.lastText(), "#"+id+" 进行中\n奖品: AK-47\n")
+	assert.Contains(t, h.client.lastText(), "参与者(1人): user40000")
+	// 中奖者等只保存在数据库的记录
+	assert.NoError(t, store().Rolls().AddWinner(context.Background(), event.ObjectID.ObjectID, *sender(testMemberUin)))
+	h.say(sender(testMemberUin), "@bot /roll info #"+id)
+	assert.Contains(t, h.client.lastText(), "中奖者: user40000")
+
+	h.say(sender(testMemberUin), "@bot /roll edit #"+id+"\n人数: 2")
+	assert.Equal(t, "修改抽奖需要群管理员权限", h.client.lastText())
+	h.say(sender(testOwnerUin), "@bot /roll edit #"+id+"\n奖品: 蝴蝶刀 x2;贴纸\n人数: 2")
+	assert.Contains(t, h.client.lastText(), "修改失败:\n1. 中奖人数2与奖品总数3不一致")
+	h.say(sender(testOwnerUin), "@bot /roll edit #"+id+" 开奖时间: 2099-01-02 20:00\n人数: 2")
+	assert.Equal(t, "已修改抽奖#"+id+"\n奖品: AK-47 x2\n开奖时间: 2099-01-02 20:00\n中奖人数: 2", h.client.lastText())
+	stored, _ := store().Rolls().Get(context.Background(), event.ObjectID.ObjectID)
+	assert.Equal(t, 2, stored.WinnerCount)
+	assert.Equal(t, "AK-47 x2", stored.SkinName)
+
+	h.say(sender(testOwnerUin), "@bot /cancel #"+id)
+	assert.Equal(t, "取消#"+id, h.client.lastText())
+	stored, _ = store().Rolls().Get(context.Background(), event.ObjectID.ObjectID)
+	assert.Equal(t, model.RollCancelled, stored.Status)
+	h.say(sender(testOwnerUin), "@bot /cancel #"+id)
+	assert.Equal(t, "抽奖#"+id+"已取消，不能取消", h.client.lastText())
+	h.say(sender(testMemberUin), "@bot /rolls")
+	assert.Equal(t, "本群没有进行中的抽奖", h.client.lastText())
+}
+
+// 两人参加并开奖，返回抽奖和等待领奖的中奖者
+func drawWithClaims(t *testing.T, h *harness, r *roll) (*rollEvent, model.Claim) {
+	config.GlobalConfig.Set("modules.roll.claim_window", "1h")
+	t.Cleanup(func() {
+		config.GlobalConfig.Set("modules.roll.claim_window", 0)
+		r.stop()
+	})
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\nnow")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	event.DrawTime = time.Now()
+	r.persistModel(event)
+	h.say(sender(testMemberUin), "", &message.ReplyElement{ReplySeq: announce.Id})
+	h.say(sender(50000), "", &message.ReplyElement{ReplySeq: announce.Id})
+
+	r.drawNow(h.client, event)
+	stored, _ := store().Rolls().Get(context.Background(), event.ObjectID.ObjectID)
+	assert.Len(t, stored.Claims, 1)
+	claim := stored.Claims[0]
+	assert.Equal(t, model.ClaimWaiting, claim.Status)
+	assert.Equal(t, "AK-47", claim.Prize)
+	return event, claim
+}
+
+func TestRollClaimByReply(t *testing.T) {
+	h := newHarness(t)
+	r := newTestRoll(h)
+	event, claim := drawWithClaims(t, h, r)
+	loser := int64(testMemberUin + 50000 - claim.Uin)
+
+	// 只有中奖者本人回复中奖消息才能领奖
+	before := len(h.client.sentTexts())
+	h.say(sender(loser), "", &message.ReplyElement{ReplySeq: claim.MsgID}, message.NewText("我的"))
+	assert.Len(t, h.client.sentTexts(), before)
+
+	h.say(sender(claim.Uin), "", &message.ReplyElement{ReplySeq: claim.MsgID},
+		message.NewText("https://steamcommunity.com/tradeoffer/new/?partner=1"))
+	assert.Equal(t, fmt.Sprintf(`user%d已确认领取奖品"AK-47"`, claim.Uin), h.client.lastText())
+	stored, _ := store().Rolls().Get(context.Background(), event.ObjectID.ObjectID)
+	assert.Equal(t, model.ClaimConfirmed, stored.Claims[0].Status)
+
+	summary := h.client.privateTexts(testOwnerUin)
+	assert.Len(t, summary, 1)
+	assert.Contains(t, summary[0], "已确认: https://steamcommunity.com/tradeoffer/new/?partner=1")
+}
+
+func TestRollClaimExpired(t *testing.T) {
+	h := newHarness(t)
+	r := newTestRoll(h)
+	event, claim := drawWithClaims(t, h, r)
+	id := event.ObjectID.ObjectID
+	loser := int64(testMemberUin + 50000 - claim.Uin)
+
+	claim.Deadline = time.Now().Add(-time.Second)
+	assert.NoError(t, store().Rolls().SetClaims(context.Background(), id, []model.Claim{claim}))
+	r.expireClaims(h.client, id)
+
+	stored, _ := store().Rolls().Get(context.Background(), id)
+	assert.Equal(t, []int64{claim.Uin, loser}, stored.Draw.Winners)
+	assert.NoError(t, verifyDraw(stored), "the re-draw is verifiable")
+	assert.Len(t, stored.Claims, 2)
+	assert.Equal(t, model.ClaimExpired, stored.Claims[0].Status)
+	assert.Equal(t, loser, stored.Claims[1].Uin)
+	assert.Contains(t, h.client.lastText(), fmt.Sprintf(`恭喜用户"user%d"`, loser))
+	assert.Empty(t, h.client.privateTexts(testOwnerUin))
+
+	r.handlePrivate(h.client, &message.PrivateMessage{
+		Sender:   sender(loser),
+		Elements: []message.IMessageElement{message.NewText("交易链接")},
+	})
+	assert.Equal(t, `已确认领取奖品"AK-47"，发起人会联系你`, h.client.privateTexts(loser)[0])
+	summary := h.client.privateTexts(testOwnerUin)
+	assert.Len(t, summary, 1)
+	assert.Contains(t, summary[0], fmt.Sprintf("user%d(%d) 超时未领取", claim.Uin, claim.Uin))
+	assert.Contains(t, summary[0], fmt.Sprintf("user%d(%d) 已确认: 交易链接", loser, loser))
+}
+
+func TestRollWebQueue(t *testing.T) {
+	h := newHarness(t)
+	r := newTestRoll(h)
+	t.Cleanup(r.stop)
+	ctx := context.Background()
+
+	web := &model.MongoEvent{
+		SenderID:       testOwnerUin,
+		SenderNickname: "owner",
+		SkinName:       "AK-47",
+		DrawTime:       time.Now().Add(time.Hour),
+		Source:         "web",
+		Status:         model.RollNew,
+		GroupCode:      testGroupCode,
+		WinnerCount:    1,
+	}
+	other := &model.MongoEvent{Source: "web", Status: model.RollNew, GroupCode: 1}
+	assert.NoError(t, store().Rolls().Insert(ctx, web))
+	assert.NoError(t, store().Rolls().Insert(ctx, other))
+
+	assert.Equal(t, 1, r.announceNew(h.client))
+	assert.Contains(t, h.client.lastText(), "#"+web.ShortHexID()+"\n确认创建抽奖(来源Web)")
+	announced, _ := store().Rolls().Get(ctx, web.ObjectID.ObjectID)
+	assert.Equal(t, model.RollPending, announced.Status)
+	assert.Equal(t, h.client.sent[len(h.client.sent)-1].Id, announced.MsgID)
+	assert.NotEmpty(t, announced.SeedHash)
+	stored, _ := store().Rolls().Get(ctx, other.ObjectID.ObjectID)
+	assert.Equal(t, model.RollCancelled, stored.Status, "the group is not served")
+
+	// 不会重复发布
+	sent := len(h.client.sentTexts())
+	assert.Equal(t, 0, r.announceNew(h.client))
+	assert.Len(t, h.client.sentTexts(), sent)
+
+	// 回复发布的消息参加
+	h.say(sender(testMemberUin), "", &message.ReplyElement{ReplySeq: announced.MsgID})
+	assert.Equal(t, "user40000已加入抽奖", h.client.lastText())
+	stored, _ = store().Rolls().Get(ctx, web.ObjectID.ObjectID)
+	assert.Len(t, stored.Participants, 1)
+}
+
+// MarkAnnounced 失败指定的次数
+type failingAnnounce struct {
+	storage.RollRepository
+	fails int
+}
+
+func (f *failingAnnounce) MarkAnnounced(ctx context.Context, id primitive.ObjectID, msgID int32) error {
+	if f.fails > 0 {
+		f.fails--
+		return errors.New("connection reset")
+	}
+	return f.RollRepository.MarkAnnounced(ctx, id, msgID)
+}
+
+type failingAnnounceStore struct {
+	storage.Store
+	rolls *failingAnnounce
+}
+
+func (s failingAnnounceStore) Rolls() storage.RollRepository {
+	return s.rolls
+}
+
+func TestRollWebQueueMarkFailure(t *testing.T) {
+	h := newHarness(t)
+	r := newTestRoll(h)
+	t.Cleanup(r.stop)
+	ctx := context.Background()
+	delay := markAnnouncedDelay
+	markAnnouncedDelay = 0
+	t.Cleanup(func() { markAnnouncedDelay = delay })
+	rolls := &failingAnnounce{RollRepository: dataStore.Rolls()}
+	dataStore = failingAnnounceStore{Store: dataStore, rolls: rolls}
+	newWebRoll := func() *model.MongoEvent {
+		e := &model.MongoEvent{
+			SenderID:    testOwnerUin,
+			SkinName:    "AK-47",
+			DrawTime:    time.Now().Add(time.Hour),
+			Source:      "web",
+			Status:      model.RollNew,
+			GroupCode:   testGroupCode,
+			WinnerCount: 1,
+		}
+		assert.NoError(t, store().Rolls().Insert(ctx, e))
+		return e
+	}
+	drawScheduled := func(e *model.MongoEvent) bool {
+		for _, j := range jobs.upcoming(testGroupCode) {
+			if j.key == drawJobKey(e.ObjectID.ObjectID) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// 重试后成功
+	rolls.fails = markAnnouncedRetries
+	retried := newWebRoll()
+	assert.Equal(t, 1, r.announceNew(h.client))
+	stored, _ := store().Rolls().Get(ctx, retried.ObjectID.ObjectID)
+	assert.Equal(t, model.RollPending, stored.Status)
+	assert.NotZero(t, stored.MsgID)
+	assert.True(t, drawScheduled(retried))
+
+	// 一直失败也会开奖，并且不会再次发布
+	rolls.fails = markAnnouncedRetries + 1
+	failed := newWebRoll()
+	sent := len(h.client.sentTexts())
+	assert.Equal(t, 1, r.announceNew(h.client))
+	assert.Len(t, h.client.sentTexts(), sent+1)
+	assert.True(t, drawScheduled(failed))
+	assert.Equal(t, 0, r.announceNew(h.client))
+	assert.Len(t, h.client.sentTexts(), sent+1)
+
+	// 消息ID单独保存，可以回复参加，开奖一次，重启后也不会再次发布
+	rolls.fails = 1 << 20
+	never := newWebRoll()
+	assert.Equal(t, 1, r.announceNew(h.client))
+	stored, _ = store().Rolls().Get(ctx, never.ObjectID.ObjectID)
+	assert.Equal(t, model.RollAnnouncing, stored.Status)
+	assert.NotZero(t, stored.MsgID)
+	h.say(sender(testMemberUin), "", &message.ReplyElement{ReplySeq: stored.MsgID})
+	assert.Equal(t, "user40000已加入抽奖", h.client.lastText())
+	event := newRollEventFromModel(stored)
+	r.drawNow(h.client, event)
+	r.drawNow(h.client, event)
+	seeds := 0
+	for _, text := range h.client.groupTexts(testGroupCode) {
+		if strings.Contains(text, "#"+event.ShortHexID()+" 开奖种子") {
+			seeds++
+		}
+	}
+	assert.Equal(t, 1, seeds)
+	stored, _ = store().Rolls().Get(ctx, never.ObjectID.ObjectID)
+	assert.Equal(t, model.RollDrawn, stored.Status)
+	assert.Len(t, stored.Winners, 1)
+	n, err := store().Rolls().ReleaseAnnouncing(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	sent = len(h.client.sentTexts())
+	assert.Equal(t, 0, r.announceNew(h.client))
+	assert.Len(t, h.client.sentTexts(), sent)
+}
+
+func TestRollRestore(t *testing.T) {
+	h := newHarness(t)
+	r := newTestRoll(h)
+	r.missedGrace = time.Hour
+	ctx := context.Background()
+
+	insert := func(drawTime time.Time, participants ...int64) *model.MongoEvent {
+		m := &model.MongoEvent{
+			SkinName:    "AK-47",
+			Prizes:      []model.Prize{{Name: "AK-47", Quantity: 1}},
+			DrawTime:    drawTime,
+			Status:      model.RollPending,
+			GroupCode:   testGroupCode,
+			MsgID:       int32(len(h.client.history[testGroupCode]) + 100),
+			WinnerCount: 1,
+		}
+		m.Seed, m.SeedHash = newSeed()
+		for _, uin := range participants {
+			m.Participants = append(m.Participants, *sender(uin))
+		}
+		assert.NoError(t, store().Rolls().Insert(ctx, m))
+		return m
+	}
+	missed := insert(time.Now().Add(-10*time.Minute), testMemberUin)
+	tooOld := insert(time.Now().Add(-2 * time.Hour))
+	future := insert(time.Now().Add(time.Hour))
+
+	r.restore(h.client)
+	assert.Equal(t, "#"+tooOld.ShortHexID()+" 机器人离线期间错过了开奖时间"+
+		tooOld.DrawTime.Format("01月02日 15:04")+"，超过补开期限1h0m0s，抽奖已取消", h.client.lastText())
+	stored, _ := store().Rolls().Get(ctx, tooOld.ObjectID.ObjectID)
+	assert.Equal(t, model.RollCancelled, stored.Status)
+
+	list := jobs.upcoming(testGroupCode)
+	assert.Len(t, list, 2)
+	assert.Equal(t, drawJobKey(missed.ObjectID.ObjectID), list[0].key)
+	assert.Equal(t, drawJobKey(future.ObjectID.ObjectID), list[1].key)
+
+	// 错过的抽奖立即补开
+	for _, j := range jobs.popDue(time.Now()) {
+		j.run()
+	}
+	stored, _ = store().Rolls().Get(ctx, missed.ObjectID.ObjectID)
+	assert.Equal(t, model.RollDrawn, stored.Status)
+	assert.Equal(t, []int64{testMemberUin}, stored.Draw.Winners)
+
+	newTestHelp(h)
+	new(super).Init()
+	h.say(sender(testMemberUin), "@bot /jobs")
+	assert.Equal(t, "本群的定时任务:\n"+future.DrawTime.Format("01月02日 15:04")+" 抽奖#"+future.ShortHexID()+"开奖: AK-47", h.client.lastText())
+}
+
+func TestParseGroupCodes(t *testing.T) {
+	codes, all, err := parseGroupCodes("20001；20002, 全部")
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{20001, 20002}, codes)
+	assert.True(t, all)
+	_, _, err = parseGroupCodes("20001;abc")
+	assert.EqualError(t, err, `无法识别的群号"abc"`)
+}
+
+func TestRollMultiGroup(t *testing.T) {
+	const otherGroup = 20001
+	h := newHarness(t)
+	h.client.addGroup(otherGroup, "另一个群")
+	config.GlobalConfig.Set("group_codes", []int{testGroupCode, otherGroup})
+	r := newTestRoll(h)
+	ctx := context.Background()
+
+	// 机器人不在的群
+	bad := h.say(sender(testOwnerUin), "/roll\nAK-47\n2099-01-01 20:00\n群: 30001")
+	assert.NoError(t, r.rollCSGOSkin(h.client, bad))
+	assert.Equal(t, "抽奖创建失败:\n1. 机器人不在群30001或没有开启抽奖", h.client.lastText())
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\n2099-01-01 20:00\n群: 全部")
+	assert.NoError(t, r.rollCSGOSkin(h.client, announce))
+	events, _ := store().Rolls().List(ctx, storage.RollFilter{GroupCode: otherGroup})
+	assert.Len(t, events, 1)
+	m := events[0]
+	assert.Equal(t, []model.RollGroup{{GroupCode: otherGroup, GroupName: "另一个群", MsgID: m.Groups[0].MsgID}}, m.Groups)
+	assert.Contains(t, h.client.groupTexts(otherGroup)[0], "确认创建抽奖(多群同步)")
+	assert.Contains(t, h.client.groupTexts(otherGroup)[0], "同时在2个群进行")
+
+	// 在两个群参加，同一个人只算一次
+	h.say(sender(testMemberUin), "", &message.ReplyElement{ReplySeq: m.MsgID})
+	h.sayIn(otherGroup, sender(testMemberUin), "", &message.ReplyElement{ReplySeq: m.Groups[0].MsgID})
+	h.sayIn(otherGroup, sender(50000), "", &message.ReplyElement{ReplySeq: m.Groups[0].MsgID})
+	assert.Equal(t, "user50000已加入抽奖", h.client.lastText())
+	m, _ = store().Rolls().Get(ctx, m.ObjectID.ObjectID)
+	assert.Len(t, m.Participants, 2)
+
+	event := newRollEventFromModel(m)
+	r.drawNow(h.client, event)
+	texts := h.client.groupTexts(otherGroup)
+	assert.Contains(t, texts[len(texts)-1], "#"+m.ShortHexID()+" 开奖结果:\n恭喜用户")
+	assert.Contains(t, texts[len(texts)-1], "开奖种子: ")
+	m, _ = store().Rolls().Get(ctx, m.ObjectID.ObjectID)
+	assert.Equal(t, model.RollDrawn, m.Status)
+	assert.Len(t, m.Winners, 1)
+}
+
+func TestRollStats(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	r := newTestRoll(h)
+	ctx := context.Background()
+
+	now := time.Now()
+	a, b := message.Sender{Uin: 100, Nickname: "a"}, message.Sender{Uin: 200, Nickname: "b"}
+	for _, m := range []*model.MongoEvent{
+		{
+			SenderID: testOwnerUin, SenderNickname: "owner", GroupCode: testGroupCode, Status: model.RollDrawn,
+			Prizes: []model.Prize{{Name: "AK-47", Quantity: 1}}, SkinName: "AK-47", DrawTime: now,
+			Participants: []message.Sender{a, b}, Winners: []message.Sender{a},
+		},
+		{
+			SenderID: testOwnerUin, SenderNickname: "owner", GroupCode: testGroupCode, Status: model.RollDrawn,
+			SkinName: "蝴蝶刀", DrawTime: now.AddDate(0, -1, 0),
+			Participants: []message.Sender{a, b}, Winners: []message.Sender{b, a},
+			Claims: []model.Claim{
+				{Uin: 200, Nickname: "b", Prize: "蝴蝶刀", Status: model.ClaimExpired},
+				{Uin: 100, Nickname: "a", Prize: "蝴蝶刀", Status: model.ClaimConfirmed},
+			},
+		},
+		{SenderID: testMemberUin, GroupCode: testGroupCode, Status: model.RollCancelled, DrawTime: now},
+		{SenderID: testMemberUin, GroupCode: testGroupCode, Status: model.RollPending, DrawTime: now.Add(time.Hour)},
+		{SenderID: testMemberUin, GroupCode: 1, Status: model.RollDrawn, DrawTime: now, Winners: []message.Sender{b}},
+	} {
+		assert.NoError(t, store().Rolls().Insert(ctx, m))
+	}
+
+	events, _ := store().Rolls().List(ctx, storage.RollFilter{GroupCode: testGroupCode})
+	stats := computeRollStats(testGroupCode, events, now)
+	assert.Equal(t, 2, stats.Drawn)
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, 1, stats.Cancelled)
+	assert.Equal(t, 2, stats.PrizesGiven, "the expired claim is not given")
+	assert.Equal(t, 4, stats.Entries)
+	assert.Equal(t, 2, stats.Members)
+	assert.Equal(t, []statsRank{{Uin: testOwnerUin, Nickname: "owner", Count: 2}}, stats.Organisers)
+	assert.Equal(t, []statsRank{{Uin: 100, Nickname: "a", Count: 2}}, stats.Winners)
+	assert.Len(t, stats.Trend, statsMonths)
+	assert.Equal(t, statsMonth{Month: now.Format("2006-01"), Rolls: 1, Entries: 2}, stats.Trend[statsMonths-1])
+
+	h.say(sender(testMemberUin), "@bot /roll stats")
+	assert.Contains(t, h.client.lastText(), "已开奖2次，进行中1个，已取消1个\n发出奖品2件，参与4人次(2人)\n发起最多: owner(2次)\n中奖最多: a(2次)")
+
+	h.say(&a, "@bot /roll me")
+	text := h.client.lastText()
+	assert.Contains(t, text, "a在本群参加抽奖2次，中奖2次\n"+now.Format("2006-01-02")+" #")
+	assert.Contains(t, text, "蝴蝶刀 已确认")
+
+	api := newAPIHarness(h, r)
+	var all rollStats
+	assert.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/stats", "", &all))
+	assert.Equal(t, 3, all.Drawn)
+	var history memberHistory
+	assert.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/stats/200?group=20000", "", &history))
+	assert.Equal(t, 2, history.Entered)
+	assert.Empty(t, history.Wins)
+}
+
+func TestRollExport(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	r := newTestRoll(h)
+	ctx := context.Background()
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\nnow\n张三")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	event.DrawTime = time.Now()
+	assert.NoError(t, r.persistModel(event))
+	join := h.say(sender(testMemberUin), "", &message.ReplyElement{ReplySeq: announce.Id})
+	m, _ := store().Rolls().Get(ctx, event.ObjectID.ObjectID)
+	assert.Equal(t, time.Unix(int64(join.Time), 0), m.JoinedAt(testMemberUin).Local())
+	m.Winners = []message.Sender{*sender(testMemberUin)}
+	m.Status = model.RollDrawn
+
+	rows := rollExportRows(m)
+	assert.Len(t, rows, 2)
+	for _, row := range rows {
+		if row.ByNickname {
+			assert.Equal(t, "张三", row.Name)
+			assert.Less(t, row.Uin, int64(0))
+			assert.False(t, row.Winner)
+		} else {
+			assert.Equal(t, int64(testMemberUin), row.Uin)
+			assert.True(t, row.Winner)
+			assert.Equal(t, "AK-47", row.Prize)
+		}
+	}
+
+	h.say(sender(testMemberUin), "@bot /roll export #"+event.ShortHexID())
+	assert.Equal(t, "导出抽奖需要群管理员权限", h.client.lastText())
+	h.say(sender(testOwnerUin), "@bot /roll export #"+event.ShortHexID())
+	assert.Equal(t, "已上传roll-"+event.ShortHexID()+".csv到群文件，共2名参与者", h.client.lastText())
+	assert.Len(t, h.client.files, 1)
+	body, _ := io.ReadAll(h.client.files[0].Body)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	assert.Equal(t, "\ufeffuin,name,joined_at,by_nickname,winner,prize,claim", lines[0])
+	assert.Len(t, lines, 3)
+	assert.Contains(t, string(body), "40000,user40000,")
+
+	a := newAPIHarness(h, r)
+	req := httptest.NewRequest(http.MethodGet, "/api/rolls/"+event.HexID()+"/export", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "by_nickname")
+	var exported struct{ Participants []rollExportRow }
+	assert.Equal(t, http.StatusOK, a.do(http.MethodGet, "/api/rolls/"+event.HexID()+"/export?format=json", "", &exported))
+	assert.Len(t, exported.Participants, 2)
+	var apiErr struct{ Error string }
+	assert.Equal(t, http.StatusBadRequest, a.do(http.MethodGet, "/api/rolls/"+event.HexID()+"/export?format=xml", "", &apiErr))
+	// 防止表格公式注入
+	buf := new(bytes.Buffer)
+	assert.NoError(t, writeRollCSV(buf, []rollExportRow{{Uin: 1, Name: "=HYPERLINK(\"http://x\")", Prize: "@SUM(A1)"}, {Uin: 2, Name: "-1+1", Prize: "\tx"}}))
+	assert.Contains(t, buf.String(), `1,"'=HYPERLINK(""http://x"")",`)
+	assert.Contains(t, buf.String(), ",'@SUM(A1),")
+	assert.Contains(t, buf.String(), "2,'-1+1,")
+	assert.Contains(t, buf.String(), ",'\tx,")
+}
+
+func TestRollReminders(t *testing.T) {
+	config.GlobalConfig.Set("modules.roll.reminders", []string{"10m", "1h", "abc"})
+	t.Cleanup(func() { config.GlobalConfig.Set("modules.roll.reminders", []string{}) })
+	h := newHarness(t)
+	newTestHelp(h)
+	r := newTestRoll(h)
+	t.Cleanup(r.stop)
+	assert.Equal(t, []time.Duration{time.Hour, 10 * time.Minute}, rollReminders(testGroupCode))
+	assert.Equal(t, "1小时30分钟", formatChineseDuration(90*time.Minute))
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\nnow")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	event.DrawTime = time.Now().Add(30 * time.Minute)
+	assert.NoError(t, r.persistModel(event))
+	r.scheduleDraw(h.client, event)
+	var names []string
+	for _, j := range jobs.upcoming(testGroupCode) {
+		names = append(names, j.name)
+	}
+	id := event.ShortHexID()
+	assert.Equal(t, []string{"抽奖#" + id + "开奖前10分钟提醒", "抽奖#" + id + "开奖: AK-47"}, names)
+
+	h.say(sender(testMemberUin), "@bot /roll remind #"+id)
+	assert.Equal(t, "请先参加抽奖#"+id, h.client.lastText())
+	h.say(sender(testMemberUin), "", &message.ReplyElement{ReplySeq: announce.Id})
+	h.say(sender(testMemberUin), "@bot /roll remind #"+id)
+	assert.Equal(t, "user40000将在抽奖#"+id+"开奖前收到私聊提醒", h.client.lastText())
+
+	r.remind(h.client, event.ObjectID.ObjectID, 10*time.Minute)
+	last := h.client.sent[len(h.client.sent)-1]
+	reply, ok := last.Elements[0].(*message.ReplyElement)
+	assert.True(t, ok)
+	assert.Equal(t, announce.Id, reply.ReplySeq)
+	assert.Equal(t, announce.Elements, reply.Elements)
+	assert.Contains(t, h.client.lastText(), "#"+id+" AK-47还有10分钟开奖，当前1人参加")
+	assert.Equal(t, []string{"你参加的抽奖#" + id + " AK-47还有10分钟开奖"}, h.client.privateTexts(testMemberUin))
+
+	h.say(sender(testMemberUin), "@bot /roll remind #"+id)
+	assert.Equal(t, "user40000已关闭抽奖#"+id+"的私聊提醒", h.client.lastText())
+	r.remind(h.client, event.ObjectID.ObjectID, 10*time.Minute)
+	assert.Len(t, h.client.privateTexts(testMemberUin), 1)
+
+	// 修改配置后，按之前的配置登记的提醒也会取消
+	config.GlobalConfig.Set("modules.roll.reminders", []string{"20m"})
+	resetPolicies()
+	h.say(sender(testOwnerUin), "@bot /cancel #"+id)
+	assert.Empty(t, jobs.upcoming(testGroupCode))
+}
+
+func TestRollJoinLeave(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	r := newTestRoll(h)
+	ctx := context.Background()
+
+	announce := h.say(sender(testOwnerUin), "/roll\nAK-47\n2099-01-01 20:00")
+	event, err := newRollEventFromMessage(announce)
+	assert.NoError(t, err)
+	assert.NoError(t, r.persistModel(event))
+	id := event.ShortHexID()
+	participants := func() []message.Sender {
+		m, _ := store().Rolls().Get(ctx, event.ObjectID.ObjectID)
+		return m.Participants
+	}
+
+	h.say(sender(testMemberUin), "@bot /join #"+id)
+	assert.Equal(t, "user40000已加入抽奖#"+id, h.client.lastText())
+	h.say(sender(testMemberUin), "@bot /join #"+id)
+	assert.Equal(t, "user40000无法加入抽奖#"+id+": 已经参加了抽奖", h.client.lastText())
+	assert.Len(t, participants(), 1)
+	h.say(sender(testMemberUin), "@bot /leave #"+id)
+	assert.Equal(t, "user40000已退出抽奖#"+id, h.client.lastText())
+	assert.Empty(t, participants())
+	h.say(sender(testMemberUin), "@bot /leave #"+id)
+	assert.Equal(t, "user40000无法退出抽奖#"+id+": 没有参加抽奖", h.client.lastText())
+
+	private := func(from int64, text string) string {
+		r.handlePrivate(h.client, &message.PrivateMessage{
+			Sender:   sender(from),
+			Elements: []message.IMessageElement{message.NewText(text)},
+		})
+		texts := h.client.privateTexts(from)
+		return texts[len(texts)-1]
+	}
+	assert.Equal(t, "已加入抽奖#"+id+" AK-47", private(testMemberUin, "参加 #"+id))
+	assert.Len(t, participants(), 1)
+	assert.Equal(t, "你不在抽奖#"+id+"的群里", private(50000, "/join "+id))
+	assert.Equal(t, "没有抽奖#abcdef", private(testMemberUin, "参加 #abcdef"))
+	assert.Equal(t, "已退出抽奖#"+id, private(testMemberUin, "退出 #"+id))
+	assert.Empty(t, participants())
+
+	// 已经开奖的抽奖不能再参加
+	assert.NoError(t, store().Rolls().SetStatus(ctx, event.ObjectID.ObjectID, model.RollDrawn))
+	h.say(sender(testMemberUin), "", &message.ReplyElement{ReplySeq: announce.Id})
+	assert.Equal(t, "user40000无法加入抽奖: 抽奖已开奖", h.client.lastText())
+}
+
+func TestRollCatalog(t *testing.T) {
+	image := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("png"))
+	}))
+	t.Cleanup(image.Close)
+	h := newHarness(t)
+	newTestHelp(h)
+	r := newTestRoll(h)
+	t.Cleanup(r.stop)
+	ctx := context.Background()
+	hasImage := func(msg *message.GroupMessage) bool {
+		for _, elem := range msg.Elements {
+			if _, ok := elem.(*message.GroupImageElement); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	set := "@bot /catalog set AK-Redline\n名称: AK-47 | 红线\n稀有度: 保密\n图片: " + image.URL + "\n估价: 120.5"
+	h.say(sender(testMemberUin), set)
+	assert.Equal(t, "修改奖品库需要机器人管理员权限", h.client.lastText())
+	h.say(sender(testOwnerUin), "@bot /catalog set m4\n估价: abc")
+	assert.Contains(t, h.client.lastText(), "修改奖品库失败:\n1. 估价\"abc\"不是有效的金额\n2. 缺少名称")
+	h.say(sender(testOwnerUin), set)
+	assert.Equal(t, "已保存奖品 ak-redline AK-47 | 红线 保密 约¥120.50", h.client.lastText())
+	h.say(sender(testMemberUin), "@bot /catalog")
+	assert.Equal(t, "奖品库（发起抽奖时奖品写编号）:\nak-redline AK-47 | 红线 保密 约¥120.50", h.client.lastText())
+	h.say(sender(testMemberUin), "@bot /catalog ak-redline")
+	assert.True(t, hasImage(h.client.sent[len(h.client.sent)-1]))
+
+	announce := h.say(sender(testOwnerUin), "/roll\nak-redline x2;贴纸\nnow")
+	assert.NoError(t, r.rollCSGOSkin(h.client, announce))
+	assert.Contains(t, h.client.lastText(), "奖品估价:约¥241.00")
+	assert.True(t, hasImage(h.client.sent[len(h.client.sent)-1]))
+	events, _ := store().Rolls().List(ctx, storage.RollFilter{GroupCode: testGroupCode})
+	m := events[0]
+	assert.Equal(t, "AK-47 | 红线 x2、贴纸", m.SkinName)
+	assert.Equal(t, model.Prize{Name: "AK-47 | 红线", Quantity: 2, ItemID: "ak-redline", ImageURL: image.URL, Value: 120.5}, m.Prizes[0])
+
+	for _, uin := range []int64{testMemberUin, 50000, 60000} {
+		h.say(sender(uin), "", &message.ReplyElement{ReplySeq: m.MsgID})
+	}
+	sent := len(h.client.sent)
+	r.drawNow(h.client, newRollEventFromModel(m))
+	images := 0
+	for _, msg := range h.client.sent[sent:] {
+		if hasImage(msg) {
+			images++
+		}
+	}
+	assert.Equal(t, 2, images, "only the winners of the catalogue item")
+	events, _ = store().Rolls().List(ctx, storage.RollFilter{GroupCode: testGroupCode})
+	assert.Equal(t, 241.0, computeRollStats(testGroupCode, events, time.Now()).ValueGiven)
+
+	a := newAPIHarness(h, r)
+	var item model.CatalogItem
+	assert.Equal(t, http.StatusOK, a.do(http.MethodPut, "/api/catalog/M4", `{"name": "M4A4 | 咆哮", "value": 3000}`, &item))
+	assert.Equal(t, "m4", item.ID)
+	var apiErr struct{ Error string }
+	assert.Equal(t, http.StatusBadRequest, a.do(http.MethodPut, "/api/catalog/m4", `{"value": 1}`, &apiErr))
+	var list struct{ Items []model.CatalogItem }
+	assert.Equal(t, http.StatusOK, a.do(http.MethodGet, "/api/catalog", "", &list))
+	assert.Len(t, list.Items, 2)
+	item = model.CatalogItem{}
+	assert.Equal(t, http.StatusOK, a.do(http.MethodGet, "/api/catalog/M4", "", &item))
+	assert.Equal(t, "M4A4 | 咆哮", item.Name)
+	assert.Equal(t, http.StatusNoContent, a.do(http.MethodDelete, "/api/catalog/M4", "", nil))
+	assert.Equal(t, http.StatusNotFound, a.do(http.MethodGet, "/api/catalog/m4", "", &apiErr))
+
+	h.say(sender(testOwnerUin), "@bot /catalog del ak-redline")
+	assert.Equal(t, "已删除奖品ak-redline", h.client.lastText())
+}
@@ -0,0 +1,187 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/robfig/cron/v3"
+)
+
+// 定时任务的调度器，所有模块的定时任务都在这里登记，可以用 /jobs 查看
+// 任务的时间由各模块保存在数据库中（如开奖时间、领奖期限），启动时重新登记；
+// 调度器按墙上时间比较，并且最多隔 schedulerTick 重新检查一次，
+// 系统时间被调整后任务仍然在设定的时刻执行，而不是在休眠了原定的时长之后
+var jobs = newScheduler()
+
+const schedulerTick = 30 * time.Second
+
+type job struct {
+	key       string // 同一个key只保留最后登记的任务
+	name      string
+	groupCode int64 // 任务所在的群，0表示不属于某个群
+	due       time.Time
+	run       func()
+}
+
+type scheduler struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	wake    chan struct{}
+	running sync.WaitGroup
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		jobs: make(map[string]*job),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// 登记任务，替换相同key的任务，due已经过去的任务会尽快执行
+func (s *scheduler) schedule(key, name string, groupCode int64, due time.Time, run func()) {
+	s.mu.Lock()
+	s.jobs[key] = &job{key: key, name: name, groupCode: groupCode, due: due.Round(0), run: run}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// 按cron表达式(如 "0 19 * * *")重复执行的任务，每次执行前先登记下一次
+func (s *scheduler) scheduleCron(key, name string, groupCode int64, spec string, run func()) error {
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return err
+	}
+	var next func()
+	next = func() {
+		s.schedule(key, name, groupCode, sched.Next(time.Now()), func() {
+			next()
+			run()
+		})
+	}
+	next()
+	return nil
+}
+
+// 取消任务，任务不存在时返回false
+func (s *scheduler) cancel(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.jobs[key]
+	delete(s.jobs, key)
+	return ok
+}
+
+// 取消key以prefix开头的所有任务，返回取消的个数
+func (s *scheduler) cancelPrefix(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key := range s.jobs {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.jobs, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 取出到期的任务，按时间先后排列
+func (s *scheduler) popDue(now time.Time) []*job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*job
+	for key, j := range s.jobs {
+		if !j.due.After(now) {
+			due = append(due, j)
+			delete(s.jobs, key)
+		}
+	}
+	sort.Slice(due, func(i, k int) bool { return due[i].due.Before(due[k].due) })
+	return due
+}
+
+// 距离下一个任务的时间，最长为schedulerTick
+func (s *scheduler) nextWait(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wait := schedulerTick
+	for _, j := range s.jobs {
+		if d := j.due.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// 即将执行的任务，groupCode不为0时只列出该群的任务
+func (s *scheduler) upcoming(groupCode int64) []job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []job
+	for _, j := range s.jobs {
+		if groupCode == 0 || j.groupCode == groupCode {
+			list = append(list, *j)
+		}
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].due.Before(list[k].due) })
+	return list
+}
+
+// 执行到期的任务直到ctx结束，每个任务在单独的协程中执行
+func (s *scheduler) run(ctx context.Context) {
+	for {
+		// Round(0) 去掉单调时钟，按墙上时间比较
+		for _, j := range s.popDue(time.Now().Round(0)) {
+			logger.Infof("run job %s: %s", j.key, j.name)
+			s.running.Add(1)
+			go func(j *job) {
+				defer s.running.Done()
+				j.run()
+			}(j)
+		}
+		timer := time.NewTimer(s.nextWait(time.Now().Round(0)))
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// 等待正在执行的任务结束
+func (s *scheduler) wait() {
+	s.running.Wait()
+}
+
+// /jobs 列出本群即将执行的定时任务
+func listJobs(client qqClient, msg *message.GroupMessage, _ commandArgs) {
+	list := jobs.upcoming(msg.GroupCode)
+	if len(list) == 0 {
+		replyToGroupMessage(client, msg, "本群没有定时任务")
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("本群的定时任务:")
+	for _, j := range list {
+		sb.WriteString(fmt.Sprintf("\n%s %s", j.due.In(time.Local).Format("01月02日 15:04"), j.name))
+	}
+	replyToGroupMessage(client, msg, sb.String())
+}
@@ -0,0 +1,90 @@
+package modules
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	var ran []string
+	add := func(key string, due time.Time) {
+		s.schedule(key, key, testGroupCode, due, func() { ran = append(ran, key) })
+	}
+	add("b", now.Add(-time.Minute))
+	add("a", now.Add(-time.Hour))
+	add("c", now.Add(time.Hour))
+	add("d", now.Add(2*time.Hour))
+	s.schedule("other", "other", 1, now.Add(10*time.Second), func() {})
+
+	assert.Len(t, s.upcoming(0), 5)
+	list := s.upcoming(testGroupCode)
+	assert.Len(t, list, 4)
+	assert.Equal(t, "a", list[0].key)
+	assert.Equal(t, time.Duration(0), s.nextWait(now))
+
+	for _, j := range s.popDue(now) {
+		j.run()
+	}
+	assert.Equal(t, []string{"a", "b"}, ran)
+	assert.Equal(t, 10*time.Second, s.nextWait(now))
+	assert.True(t, s.cancel("other"))
+	assert.False(t, s.cancel("other"))
+	assert.Equal(t, schedulerTick, s.nextWait(now))
+
+	// 重新登记替换原来的任务
+	add("c", now.Add(-time.Second))
+	assert.Len(t, s.upcoming(0), 2)
+	for _, j := range s.popDue(now) {
+		j.run()
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, ran)
+
+	add("remind:1:10m", now.Add(time.Hour))
+	add("remind:1:1h", now.Add(time.Hour))
+	add("remind:10:1h", now.Add(time.Hour))
+	assert.Equal(t, 2, s.cancelPrefix("remind:1:"))
+	assert.Len(t, s.upcoming(0), 2)
+}
+
+func TestSchedulerRun(t *testing.T) {
+	s := newScheduler()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	done := make(chan struct{})
+	s.schedule("soon", "soon", 0, time.Now().Add(10*time.Millisecond), func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the job did not run")
+	}
+	s.wait()
+	assert.Empty(t, s.upcoming(0))
+}
+
+func TestSchedulerCron(t *testing.T) {
+	s := newScheduler()
+	assert.Error(t, s.scheduleCron("bad", "bad", 0, "every day", func() {}))
+
+	runs := 0
+	assert.NoError(t, s.scheduleCron("stat", "发送发言统计", testGroupCode, "0 19 * * *", func() { runs++ }))
+	list := s.upcoming(testGroupCode)
+	assert.Len(t, list, 1)
+	due := list[0].due
+	assert.Equal(t, 19, due.Hour())
+	assert.True(t, due.After(time.Now()))
+
+	// 执行后登记下一次
+	for _, j := range s.popDue(due) {
+		j.run()
+	}
+	assert.Equal(t, 1, runs)
+	assert.Len(t, s.upcoming(testGroupCode), 1)
+	assert.Equal(t, 1, s.cancelPrefix("stat"))
+}
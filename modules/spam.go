@@ -1,15 +1,19 @@
 package modules
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
-	cache "github.com/Code-Hex/go-generics-cache"
 	"github.com/Logiase/MiraiGo-Template/bot"
 	"github.com/Logiase/MiraiGo-Template/config"
-	"github.com/Mrs4s/MiraiGo/client"
 	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/julienschmidt/httprouter"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
 	"github.com/yudeguang/ratelimit"
 )
 
@@ -17,14 +21,42 @@ var instanceSpam *antiSpam
 
 type antiSpam struct {
 	base
+	ctx      context.Context
+	defaults spamConfig           // modules.spam 下的配置，群配置无效时使用
+	configs  map[int64]spamConfig // 校验过的群配置，重新加载配置时清空
+	rules    map[int64]*spamRule  // 每个群的频率限制，群配置改变后重建
+	// 用命令加入白名单的成员，修改白名单时清空
+	whitelists map[int64]map[int64]bool
+	apiAddr    string // 处罚记录接口的地址，为空时不提供接口，修改后需要重启
+	apiToken   string
+	_mu        sync.Mutex
+}
+
+// spamConfig 是群内生效的反刷屏配置，可以被群策略覆盖
+type spamConfig struct {
+	guardDuration time.Duration
 	// max number of msgs allowed in guard_duration
 	// also the lookback window
 	allowMsgs      int
 	spamThreshold  float64
 	muteDuration   time.Duration
 	muteMultiplier int
-	mutedCache     *cache.Cache[int64, time.Duration]
-	rules          *ratelimit.Rule
+	muteMax        time.Duration
+	ladder         []punishment  // 第N次刷屏的处罚
+	decay          time.Duration // 每过多久没有刷屏，违规次数减一，为0时不减少
+	whitelist      []int64       // 配置的白名单，还可以用 /whitelist 添加
+	auditGroup     int64         // 处罚记录转发到的群，为0时不转发
+	auditUsers     []int64       // 处罚记录私聊转发给这些人
+	modLogKeep     time.Duration // 处罚记录保存多久，为0时永久保存
+	historyMsgs    int           // 内容检测时检查最近多少条消息
+	verdict        float64       // 检测器的总分达到此值时按刷屏处理
+	detectors      map[string]detectorConfig
+}
+
+type spamRule struct {
+	guardDuration time.Duration
+	allowMsgs     int
+	rule          *ratelimit.Rule
 }
 
 func (a *antiSpam) MiraiGoModule() bot.ModuleInfo {
@@ -35,78 +67,228 @@ func (a *antiSpam) MiraiGoModule() bot.ModuleInfo {
 }
 
 func (a *antiSpam) Init() {
-	a.base.Init()
+	a.base.init(a.MiraiGoModule().ID)
 
-	a.rules = ratelimit.NewRule()
-	a.mutedCache = cache.New[int64, time.Duration]()
-
-	moduleName := a.MiraiGoModule().ID.Name()
-	moduleConfig := config.GlobalConfig.Sub("modules." + moduleName)
-	if moduleConfig != nil {
-		a.allowMsgs = moduleConfig.GetInt("allow")
-		a.rules.AddRule(moduleConfig.GetDuration("guard_duration"), a.allowMsgs)
-		a.spamThreshold = moduleConfig.GetFloat64("spam_threshold")
-		a.muteDuration = moduleConfig.GetDuration("mute_duration")
-		a.muteMultiplier = moduleConfig.GetInt("mute_multiplier")
+	a.rules = make(map[int64]*spamRule)
+	a.configs = make(map[int64]spamConfig)
+	a.ctx = context.Background()
+	a.whitelists = make(map[int64]map[int64]bool)
+	if err := a.reload(); err != nil {
+		logger.Fatalf("module %s config not loaded: %v", a.MiraiGoModule().ID.Name(), err)
 	}
+	a.registerCommands()
 }
 
-func (*antiSpam) PostInit() {}
+func (a *antiSpam) reload() error {
+	defaults, err := loadSpamConfig(config.GlobalConfig.Sub("modules." + a.MiraiGoModule().ID.Name()))
+	if err != nil {
+		return err
+	}
+	moduleConfig := config.GlobalConfig.Sub("modules." + a.MiraiGoModule().ID.Name())
+	addr := moduleConfig.GetString("addr")
+	a._mu.Lock()
+	a.defaults = defaults
+	a.configs = make(map[int64]spamConfig)
+	if a.apiAddr == "" {
+		a.apiAddr = addr
+	} else if addr != a.apiAddr {
+		logger.Warnf("spam server address changed to %s, restart to take effect", addr)
+	}
+	a.apiToken = moduleConfig.GetString("api_token")
+	a._mu.Unlock()
+	return nil
+}
 
-func (a *antiSpam) Serve(bot *bot.Bot) {
-	a.monitorGroups.Each(func(code int64) {
-		registerMessageListener(code, a.antiSpam, &bot.GroupMessageEvent, &bot.SelfGroupMessageEvent)
-	})
+// 检测时需要的最近消息条数
+func (c spamConfig) historyLength() int {
+	if c.allowMsgs > c.historyMsgs {
+		return c.allowMsgs
+	}
+	return c.historyMsgs
 }
 
-func (*antiSpam) Start(bot *bot.Bot) {}
+// 读取并校验配置
+func loadSpamConfig(moduleConfig *viper.Viper) (spamConfig, error) {
+	if moduleConfig == nil {
+		return spamConfig{}, fmt.Errorf("config not found")
+	}
+	c := spamConfig{
+		guardDuration:  moduleConfig.GetDuration("guard_duration"),
+		allowMsgs:      moduleConfig.GetInt("allow"),
+		spamThreshold:  moduleConfig.GetFloat64("spam_threshold"),
+		muteDuration:   moduleConfig.GetDuration("mute_duration"),
+		muteMultiplier: moduleConfig.GetInt("mute_multiplier"),
+		historyMsgs:    moduleConfig.GetInt("history"),
+		verdict:        moduleConfig.GetFloat64("verdict"),
+	}
+	if !moduleConfig.IsSet("history") {
+		c.historyMsgs = 30
+	}
+	if !moduleConfig.IsSet("verdict") {
+		c.verdict = 1
+	}
+	c.muteMax, c.decay, c.modLogKeep = 24*time.Hour, 24*time.Hour, 90*24*time.Hour
+	if moduleConfig.IsSet("mute_max") {
+		c.muteMax = moduleConfig.GetDuration("mute_max")
+	}
+	if moduleConfig.IsSet("decay") {
+		c.decay = moduleConfig.GetDuration("decay")
+	}
+	if moduleConfig.IsSet("modlog_retention") {
+		c.modLogKeep = moduleConfig.GetDuration("modlog_retention")
+	}
+	for _, p := range moduleConfig.GetStringSlice("ladder") {
+		if !punishments[punishment(p)] {
+			return c, fmt.Errorf("unknown punishment %q in ladder", p)
+		}
+		c.ladder = append(c.ladder, punishment(p))
+	}
+	var err error
+	if c.whitelist, err = uinList(moduleConfig, "whitelist"); err != nil {
+		return c, err
+	}
+	if c.auditUsers, err = uinList(moduleConfig, "audit_users"); err != nil {
+		return c, err
+	}
+	c.auditGroup = moduleConfig.GetInt64("audit_group")
+	if len(c.ladder) == 0 {
+		c.ladder = []punishment{punishWarn, punishRecall, punishMute}
+	}
+	switch {
+	case c.guardDuration <= 0:
+		return c, fmt.Errorf("guard_duration must be positive")
+	case c.allowMsgs <= 0:
+		return c, fmt.Errorf("allow must be positive")
+	case c.spamThreshold <= 0 || c.spamThreshold > 1:
+		return c, fmt.Errorf("spam_threshold must be in (0, 1]")
+	case c.muteDuration < time.Minute:
+		return c, fmt.Errorf("mute_duration must be at least 1m")
+	case c.muteMultiplier < 1:
+		return c, fmt.Errorf("mute_multiplier must be at least 1")
+	case c.muteMax < c.muteDuration || c.muteMax > 30*24*time.Hour:
+		return c, fmt.Errorf("mute_max must be between mute_duration and 30 days")
+	case c.decay < 0:
+		return c, fmt.Errorf("decay must not be negative")
+	case c.modLogKeep < 0:
+		return c, fmt.Errorf("modlog_retention must not be negative")
+	case c.historyMsgs <= 0 || c.historyMsgs > messageHistorySize:
+		return c, fmt.Errorf("history must be in [1, %d]", messageHistorySize)
+	case c.allowMsgs > messageHistorySize:
+		return c, fmt.Errorf("allow must not exceed %d", messageHistorySize)
+	case c.verdict <= 0:
+		return c, fmt.Errorf("verdict must be positive")
+	}
+	detectors, err := loadDetectorConfigs(moduleConfig)
+	if err != nil {
+		return c, err
+	}
+	c.detectors = detectors
+	return c, nil
+}
 
-func (*antiSpam) Stop(_ *bot.Bot, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (a *antiSpam) groupSettingKeys() []string {
+	return []string{"guard_duration", "allow", "spam_threshold", "ladder", "mute_duration", "mute_multiplier",
+		"mute_max", "decay", "modlog_retention", "whitelist", "history", "verdict"}
 }
 
-func (a *antiSpam) antiSpam(client *client.QQClient, m *message.GroupMessage) {
-	if a.rules.AllowVisit(m.Sender.Uin) {
-		return
+func (a *antiSpam) checkGroupSettings(v *viper.Viper) error {
+	// GetDuration 把无法识别的时长当作0
+	for _, key := range []string{"guard_duration", "mute_duration", "mute_max", "decay", "modlog_retention"} {
+		if _, err := cast.ToDurationE(v.Get(key)); err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
 	}
+	_, err := loadSpamConfig(v)
+	return err
+}
 
-	// check if this user is spamming the group
-	if a.isSpam(client, m) {
-		logger.Infof("mute member %s: spam message %q", m.Sender.Nickname, m.ToString())
-		duration := a.muteDuration
-		if d, ok := a.mutedCache.Get(m.Sender.Uin); ok {
-			duration = d
-			duration *= time.Duration(a.muteMultiplier)
+// 配置中的QQ号列表
+func uinList(v *viper.Viper, key string) ([]int64, error) {
+	var uins []int64
+	for _, uin := range v.GetStringSlice(key) {
+		n, err := strconv.ParseInt(uin, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uin %q in %s", uin, key)
 		}
-		// repeatedly spam the group, increase that
-		logger.Infof("try to mute member %s for %s", m.Sender.DisplayName(), duration)
-		a.mutedCache.Set(m.Sender.Uin, duration, cache.WithExpiration(24*time.Hour))
-		if err := muteGroupMember(client, m, duration); err != nil {
-			logger.Error(err)
-			return
-		}
-		replyToGroupMessage(client, m, fmt.Sprintf("%s发送消息太过频繁，已被禁言%d分钟", m.Sender.DisplayName(), int(duration.Minutes())))
+		uins = append(uins, n)
 	}
+	return uins, nil
 }
 
-// 判断刷屏逻辑
-func (a *antiSpam) isSpam(client *client.QQClient, m *message.GroupMessage) bool {
-	g, err := client.GetGroupInfo(m.GroupCode)
-	if err != nil {
-		return false
+// 群内生效的配置，群配置无效时使用 modules.spam 下的配置
+func (a *antiSpam) config(groupCode int64) spamConfig {
+	a._mu.Lock()
+	defer a._mu.Unlock()
+	if c, ok := a.configs[groupCode]; ok {
+		return c
 	}
-	// parameter here
-	history, err := client.GetGroupMessages(m.GroupCode, g.LastMsgSeq-int64(a.allowMsgs), g.LastMsgSeq)
+	c, err := loadSpamConfig(policies.groupSettings(groupCode, "spam"))
 	if err != nil {
-		return false
+		logger.Errorf("invalid spam config of group %d, use the default: %v", groupCode, err)
+		c = a.defaults
 	}
-	var from int
-	for _, msg := range history {
-		if msg.Sender.Uin == m.Sender.Uin {
-			from++
+	a.configs[groupCode] = c
+	return c
+}
+
+// 群内的频率限制，配置改变时重新创建
+func (a *antiSpam) rule(groupCode int64, c spamConfig) *ratelimit.Rule {
+	a._mu.Lock()
+	defer a._mu.Unlock()
+	r, ok := a.rules[groupCode]
+	if !ok || r.guardDuration != c.guardDuration || r.allowMsgs != c.allowMsgs {
+		r = &spamRule{
+			guardDuration: c.guardDuration,
+			allowMsgs:     c.allowMsgs,
+			rule:          ratelimit.NewRule(),
 		}
+		r.rule.AddRule(c.guardDuration, c.allowMsgs)
+		a.rules[groupCode] = r
 	}
-	// 如果超过阈值百分比的消息来自一个人，认为刷屏
-	ratio := float64(from) / float64(len(history))
-	return ratio > a.spamThreshold
+	return r.rule
+}
+
+func (*antiSpam) PostInit() {}
+
+func (a *antiSpam) Serve(bot *bot.Bot) {
+	a.registerMessageListener(a.antiSpam, groupMessageEvent)
+	a._mu.Lock()
+	addr := a.apiAddr
+	a._mu.Unlock()
+	if addr != "" {
+		router := httprouter.New()
+		a.registerAPI(router)
+		go http.ListenAndServe(addr, router)
+	}
+}
+
+func (a *antiSpam) Start(bot *bot.Bot) {
+	a.schedulePrune()
+}
+
+func (*antiSpam) Stop(_ *bot.Bot, wg *sync.WaitGroup) {
+	defer wg.Done()
+}
+
+func (a *antiSpam) antiSpam(client qqClient, m *message.GroupMessage) {
+	c := a.config(m.GroupCode)
+	if m.Sender.Uin == a.botUin || a.immune(client, m.GroupCode, m.Sender.Uin, c) {
+		return
+	}
+	sample := &spamSample{
+		msg:       m,
+		overLimit: !a.rule(m.GroupCode, c).AllowVisit(m.Sender.Uin),
+		c:         c,
+		recent:    groupHistory.recent(m.GroupCode, c.historyLength()),
+	}
+	if text := textOfGroupMessage(m); text != nil {
+		sample.text = text.Content
+	}
+	verdict := judgeSpam(sample)
+	if !verdict.spam {
+		return
+	}
+
+	logger.Infof("spam message %q from %s, score %s", m.ToString(), m.Sender.Nickname, verdict)
+	a.punish(client, m, c, sample, verdict)
 }
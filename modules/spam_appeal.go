@@ -0,0 +1,237 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+)
+
+// 反刷屏的豁免和申诉: 群管理员、群主、机器人管理员和白名单成员不受限制，
+// 群管理员可以解除禁言 (/unmute)、清零违规次数 (/forgive) 和管理白名单 (/whitelist)
+
+func (a *antiSpam) registerCommands() {
+	// @的成员不在文字中，参数可以为空
+	target := []argSpec{{name: "@成员或QQ号", kind: argString, optional: true}}
+	registerCommand(&botCommand{
+		name:    "/unmute",
+		aliases: []string{"/解除禁言"},
+		args:    target,
+		help:    "解除成员的禁言",
+		perm:    permGroupAdmin,
+		handle:  a.unmute,
+		owner:   a,
+	})
+	registerCommand(&botCommand{
+		name:    "/forgive",
+		aliases: []string{"/原谅"},
+		args:    target,
+		help:    "解除成员的禁言并清零刷屏的违规次数",
+		perm:    permGroupAdmin,
+		handle:  a.forgive,
+		owner:   a,
+	})
+	registerCommand(&botCommand{
+		name:    "/whitelist",
+		aliases: []string{"/白名单"},
+		args:    target,
+		help:    "查看反刷屏白名单，或者把成员加入、移出白名单",
+		perm:    permGroupAdmin,
+		handle:  a.whitelist,
+		owner:   a,
+	})
+	registerCommand(&botCommand{
+		name:    "/modlog",
+		aliases: []string{"/处罚记录"},
+		args:    target,
+		help:    "最近的刷屏处罚和群管理员的操作，可以只看一个成员的",
+		perm:    permGroupAdmin,
+		handle:  a.modlog,
+		owner:   a,
+	})
+}
+
+// 不受反刷屏限制的成员
+func (a *antiSpam) immune(client qqClient, groupCode, uin int64, c spamConfig) bool {
+	if a.isBotAdmin(uin) || isAdmin(client, groupCode, uin) {
+		return true
+	}
+	for _, trusted := range c.whitelist {
+		if trusted == uin {
+			return true
+		}
+	}
+	return a.trusted(groupCode)[uin]
+}
+
+// 用命令加入白名单的成员，每个群第一次用到时从数据库读取
+func (a *antiSpam) trusted(groupCode int64) map[int64]bool {
+	a._mu.Lock()
+	defer a._mu.Unlock()
+	if trusted, ok := a.whitelists[groupCode]; ok {
+		return trusted
+	}
+	offences, err := store().Offences().List(a.ctx, groupCode)
+	if err != nil {
+		logger.Errorf("failed to list offences: %v", err)
+		return nil
+	}
+	trusted := make(map[int64]bool)
+	for _, o := range offences {
+		if o.Trusted {
+			trusted[o.Uin] = true
+		}
+	}
+	a.whitelists[groupCode] = trusted
+	return trusted
+}
+
+// 命令的目标成员: 消息中@的第一个人（不包括机器人），或者参数中的QQ号
+func (a *antiSpam) commandTarget(client qqClient, msg *message.GroupMessage, args commandArgs) (int64, string, bool) {
+	if at := a.mentioned(msg); at != nil {
+		return at.Target, strings.TrimPrefix(at.Display, "@"), true
+	}
+	uin, err := strconv.ParseInt(strings.TrimPrefix(args.str("@成员或QQ号"), "@"), 10, 64)
+	if err != nil || uin <= 0 {
+		return 0, "", false
+	}
+	return uin, memberName(client, msg.GroupCode, uin), true
+}
+
+// 群名片或昵称，找不到成员时为QQ号
+func memberName(client qqClient, groupCode, uin int64) string {
+	if g, err := client.GetGroupInfo(groupCode); err == nil {
+		if member := g.FindMember(uin); member != nil {
+			return member.DisplayName()
+		}
+	}
+	return strconv.FormatInt(uin, 10)
+}
+
+// 读取成员的记录，没有时返回新的记录
+func (a *antiSpam) offence(groupCode, uin int64) (model.Offence, error) {
+	o, err := store().Offences().Get(a.ctx, groupCode, uin)
+	if err == storage.ErrNotFound {
+		return model.Offence{GroupCode: groupCode, Uin: uin}, nil
+	}
+	if err != nil {
+		return model.Offence{}, err
+	}
+	return *o, nil
+}
+
+// /unmute @成员
+func (a *antiSpam) unmute(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	uin, name, ok := a.commandTarget(client, msg, args)
+	if !ok {
+		replyToGroupMessage(client, msg, "请@要解除禁言的成员或者写QQ号")
+		return
+	}
+	if err := client.MuteGroupMember(msg.GroupCode, uin, 0); err != nil {
+		logger.Errorf("failed to unmute member: %v", err)
+		replyToGroupMessage(client, msg, "解除禁言失败")
+		return
+	}
+	// 解除禁言后再刷屏照常处罚
+	if o, err := store().Offences().Get(a.ctx, msg.GroupCode, uin); err == nil && !o.Until.IsZero() {
+		o.Until = time.Time{}
+		if err = store().Offences().Put(a.ctx, *o); err != nil {
+			logger.Errorf("failed to end the grace of offence: %v", err)
+		}
+	}
+	a.logAction(client, a.config(msg.GroupCode), commandAction(msg, actionUnmute, uin, name))
+	replyToGroupMessage(client, msg, fmt.Sprintf("已解除%s的禁言", name))
+}
+
+// /forgive @成员
+func (a *antiSpam) forgive(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	uin, name, ok := a.commandTarget(client, msg, args)
+	if !ok {
+		replyToGroupMessage(client, msg, "请@要原谅的成员或者写QQ号")
+		return
+	}
+	o, err := a.offence(msg.GroupCode, uin)
+	if err == nil {
+		o.Level, o.Until = 0, time.Time{}
+		err = store().Offences().Put(a.ctx, o)
+	}
+	if err != nil {
+		logger.Errorf("failed to reset offence: %v", err)
+		replyToGroupMessage(client, msg, "清零违规次数失败")
+		return
+	}
+	if err = client.MuteGroupMember(msg.GroupCode, uin, 0); err != nil {
+		logger.Errorf("failed to unmute member: %v", err)
+	}
+	a.logAction(client, a.config(msg.GroupCode), commandAction(msg, actionForgive, uin, name))
+	replyToGroupMessage(client, msg, fmt.Sprintf("已原谅%s，解除禁言并清零刷屏的违规次数", name))
+}
+
+// /whitelist [@成员]
+func (a *antiSpam) whitelist(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	if !args.has("@成员或QQ号") && a.mentioned(msg) == nil {
+		a.listWhitelist(client, msg)
+		return
+	}
+	uin, name, ok := a.commandTarget(client, msg, args)
+	if !ok {
+		replyToGroupMessage(client, msg, "请@要加入或移出白名单的成员或者写QQ号")
+		return
+	}
+	o, err := a.offence(msg.GroupCode, uin)
+	if err == nil {
+		o.Trusted = !o.Trusted
+		err = store().Offences().Put(a.ctx, o)
+	}
+	if err != nil {
+		logger.Errorf("failed to save whitelist: %v", err)
+		replyToGroupMessage(client, msg, "修改白名单失败")
+		return
+	}
+	a._mu.Lock()
+	delete(a.whitelists, msg.GroupCode)
+	a._mu.Unlock()
+	action := actionUnwhitelist
+	if o.Trusted {
+		action = actionWhitelist
+	}
+	a.logAction(client, a.config(msg.GroupCode), commandAction(msg, action, uin, name))
+	if o.Trusted {
+		replyToGroupMessage(client, msg, fmt.Sprintf("已将%s加入反刷屏白名单", name))
+	} else {
+		replyToGroupMessage(client, msg, fmt.Sprintf("已将%s移出反刷屏白名单", name))
+	}
+}
+
+// 消息中@的第一个人，不包括机器人和全体成员
+func (a *antiSpam) mentioned(msg *message.GroupMessage) *message.AtElement {
+	for _, elem := range msg.Elements {
+		if at, ok := elem.(*message.AtElement); ok && at.Target != a.botUin && at.Target != 0 {
+			return at
+		}
+	}
+	return nil
+}
+
+func (a *antiSpam) listWhitelist(client qqClient, msg *message.GroupMessage) {
+	trusted := a.trusted(msg.GroupCode)
+	uins := append([]int64(nil), a.config(msg.GroupCode).whitelist...)
+	for uin := range trusted {
+		uins = append(uins, uin)
+	}
+	if len(uins) == 0 {
+		replyToGroupMessage(client, msg, "反刷屏白名单是空的，群管理员不受限制")
+		return
+	}
+	names := make([]string, len(uins))
+	for i, uin := range uins {
+		names[i] = fmt.Sprintf("%s(%d)", memberName(client, msg.GroupCode, uin), uin)
+	}
+	sort.Strings(names)
+	replyToGroupMessage(client, msg, "反刷屏白名单（群管理员不受限制）:\n"+strings.Join(names, "\n"))
+}
@@ -0,0 +1,393 @@
+package modules
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/spf13/viper"
+)
+
+// 内容检测: 每个检测器给消息打0~1分，乘以权重后相加，达到 verdict 时按刷屏处理
+
+// 近似重复的文字，相邻两字组合的重合比例不低于此值
+const nearDuplicateSimilarity = 0.6
+
+var (
+	urlRegex          = regexp.MustCompile(`(?i)(https?://|www\.)[^\s]+|[a-z0-9-]+(\.[a-z0-9-]+)*\.(com|cn|net|org|top|xyz|cc|vip|me|io)\b`)
+	forwardCountRegex = regexp.MustCompile(`查看(\d+)条转发消息`)
+)
+
+// detectorConfig 是一个检测器的配置，limit 是得满分的数量，各检测器含义不同
+type detectorConfig struct {
+	weight       float64
+	limit        int
+	minLength    int      // duplicate: 短于此长度的文字不检查，避免误判复读
+	keywords     []string // link: 广告关键词
+	allowDomains []string // link: 不算作广告的域名
+}
+
+type spamDetector struct {
+	name     string // modules.spam.detectors 下的名称
+	reason   string // 告诉群成员的处罚原因
+	defaults detectorConfig
+	score    func(s *spamSample, c detectorConfig) float64
+}
+
+// 所有检测器，按处罚原因的先后排列
+var spamDetectors = []spamDetector{
+	{
+		name:     "flood",
+		reason:   "发送消息太过频繁",
+		defaults: detectorConfig{weight: 1},
+		score:    floodScore,
+	},
+	{
+		name:     "duplicate",
+		reason:   "重复发送相同内容",
+		defaults: detectorConfig{weight: 1, limit: 4, minLength: 10},
+		score:    duplicateScore,
+	},
+	{
+		name:     "image",
+		reason:   "重复发送相同图片",
+		defaults: detectorConfig{weight: 0.5, limit: 4},
+		score:    imageScore,
+	},
+	{
+		name:     "mention",
+		reason:   "@太多人",
+		defaults: detectorConfig{weight: 1, limit: 10},
+		score:    mentionScore,
+	},
+	{
+		name:     "link",
+		reason:   "发送广告链接",
+		defaults: detectorConfig{weight: 0.5, keywords: []string{"扫码", "二维码", "加微信", "加群"}},
+		score:    linkScore,
+	},
+	{
+		name:     "forward",
+		reason:   "发送大量转发消息",
+		defaults: detectorConfig{weight: 1, limit: 50},
+		score:    forwardScore,
+	},
+}
+
+// 读取检测器配置，没有配置的项使用默认值
+func loadDetectorConfigs(v *viper.Viper) (map[string]detectorConfig, error) {
+	configs := make(map[string]detectorConfig, len(spamDetectors))
+	for _, d := range spamDetectors {
+		c := d.defaults
+		if sub := v.Sub("detectors." + d.name); sub != nil {
+			if sub.IsSet("weight") {
+				c.weight = sub.GetFloat64("weight")
+			}
+			if sub.IsSet("limit") {
+				c.limit = sub.GetInt("limit")
+			}
+			if sub.IsSet("min_length") {
+				c.minLength = sub.GetInt("min_length")
+			}
+			if sub.IsSet("keywords") {
+				c.keywords = sub.GetStringSlice("keywords")
+			}
+			if sub.IsSet("allow_domains") {
+				c.allowDomains = sub.GetStringSlice("allow_domains")
+			}
+		}
+		switch {
+		case c.weight < 0:
+			return nil, fmt.Errorf("detectors.%s.weight must not be negative", d.name)
+		case d.defaults.limit > 0 && c.limit < 2:
+			return nil, fmt.Errorf("detectors.%s.limit must be at least 2", d.name)
+		}
+		configs[d.name] = c
+	}
+	return configs, nil
+}
+
+// spamSample 是检测一条消息时的上下文
+type spamSample struct {
+	msg       *message.GroupMessage
+	text      string
+	overLimit bool // 发送者超过了频率限制
+	c         spamConfig
+	recent    []*message.GroupMessage // 群里最近的消息，包括这条
+}
+
+// 最近的消息中除了这条消息之外的
+func (s *spamSample) others() []*message.GroupMessage {
+	var others []*message.GroupMessage
+	for _, m := range s.recent {
+		if m.Id != s.msg.Id {
+			others = append(others, m)
+		}
+	}
+	return others
+}
+
+type detectorScore struct {
+	name   string
+	reason string
+	score  float64 // 乘以权重后的分数
+}
+
+// spamVerdict 是一条消息的检测结果
+type spamVerdict struct {
+	scores []detectorScore // 得分的检测器，按分数从高到低排列
+	total  float64
+	spam   bool
+}
+
+// 处罚原因，只列出分数占比较大的检测器
+func (v spamVerdict) reasons() []string {
+	var reasons []string
+	for _, s := range v.scores {
+		if s.score >= v.total/4 {
+			reasons = append(reasons, s.reason)
+		}
+	}
+	return reasons
+}
+
+func (v spamVerdict) String() string {
+	parts := make([]string, len(v.scores))
+	for i, s := range v.scores {
+		parts[i] = fmt.Sprintf("%s=%.2f", s.name, s.score)
+	}
+	return fmt.Sprintf("%.2f (%s)", v.total, strings.Join(parts, " "))
+}
+
+func judgeSpam(s *spamSample) spamVerdict {
+	var v spamVerdict
+	for _, d := range spamDetectors {
+		c := s.c.detectors[d.name]
+		if c.weight == 0 {
+			continue
+		}
+		if score := d.score(s, c); score > 0 {
+			v.scores = append(v.scores, detectorScore{name: d.name, reason: d.reason, score: score * c.weight})
+			v.total += score * c.weight
+		}
+	}
+	sort.SliceStable(v.scores, func(i, k int) bool { return v.scores[i].score > v.scores[k].score })
+	v.spam = v.total >= s.c.verdict
+	return v
+}
+
+// 超过频率限制，并且最近allow条消息中超过spam_threshold来自发送者
+func floodScore(s *spamSample, _ detectorConfig) float64 {
+	if !s.overLimit {
+		return 0
+	}
+	history := s.recent
+	if len(history) > s.c.allowMsgs {
+		history = history[len(history)-s.c.allowMsgs:]
+	}
+	if len(history) == 0 {
+		return 0
+	}
+	var from int
+	for _, msg := range history {
+		if msg.Sender.Uin == s.msg.Sender.Uin {
+			from++
+		}
+	}
+	if float64(from)/float64(len(history)) > s.c.spamThreshold {
+		return 1
+	}
+	return 0
+}
+
+// 最近的消息中有limit-1条与这条近似重复时得满分，不区分发送者
+func duplicateScore(s *spamSample, c detectorConfig) float64 {
+	normalized := normalizeSpamText(s.text)
+	if len([]rune(normalized)) < c.minLength {
+		return 0
+	}
+	features := shingles(normalized)
+	var matches int
+	for _, m := range s.others() {
+		text := textOfGroupMessage(m)
+		if text == nil {
+			continue
+		}
+		other := normalizeSpamText(text.Content)
+		if len([]rune(other)) >= c.minLength && similarity(features, shingles(other)) >= nearDuplicateSimilarity {
+			matches++
+		}
+	}
+	return ratio(matches, c.limit-1)
+}
+
+// 消息中的图片在最近的消息中出现了limit次（包括这条）时得满分
+func imageScore(s *spamSample, c detectorConfig) float64 {
+	hashes := imageHashes(s.msg.Elements)
+	if len(hashes) == 0 {
+		return 0
+	}
+	counts := make(map[string]int)
+	for _, h := range hashes {
+		counts[h]++
+	}
+	for _, m := range s.others() {
+		for _, h := range imageHashes(m.Elements) {
+			if _, ok := counts[h]; ok {
+				counts[h]++
+			}
+		}
+	}
+	var most int
+	for _, n := range counts {
+		if n > most {
+			most = n
+		}
+	}
+	return ratio(most-1, c.limit-1)
+}
+
+// @了limit个不同的人时得满分
+func mentionScore(s *spamSample, c detectorConfig) float64 {
+	targets := make(map[int64]bool)
+	for _, elem := range s.msg.Elements {
+		if at, ok := elem.(*message.AtElement); ok {
+			targets[at.Target] = true
+		}
+	}
+	return ratio(len(targets), c.limit)
+}
+
+// 包含不在白名单中的链接或者广告关键词，也检查分享卡片的内容
+func linkScore(s *spamSample, c detectorConfig) float64 {
+	contents := []string{s.text}
+	for _, elem := range s.msg.Elements {
+		switch e := elem.(type) {
+		case *message.LightAppElement:
+			contents = append(contents, e.Content)
+		case *message.ServiceElement:
+			contents = append(contents, e.Content)
+		}
+	}
+	for _, content := range contents {
+		for _, url := range urlRegex.FindAllString(content, -1) {
+			if !allowedDomain(url, c.allowDomains) {
+				return 1
+			}
+		}
+		for _, keyword := range c.keywords {
+			if keyword != "" && strings.Contains(strings.ToLower(content), strings.ToLower(keyword)) {
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+// 转发的消息条数达到limit时得满分
+func forwardScore(s *spamSample, c detectorConfig) float64 {
+	var nodes int
+	for _, elem := range s.msg.Elements {
+		if f, ok := elem.(*message.ForwardElement); ok {
+			n := len(f.Items)
+			if m := forwardCountRegex.FindStringSubmatch(f.Content); m != nil {
+				n, _ = strconv.Atoi(m[1])
+			}
+			nodes += n
+		}
+	}
+	return ratio(nodes, c.limit)
+}
+
+func ratio(n, limit int) float64 {
+	if n <= 0 || limit <= 0 {
+		return 0
+	}
+	if n >= limit {
+		return 1
+	}
+	return float64(n) / float64(limit)
+}
+
+func allowedDomain(url string, domains []string) bool {
+	host := strings.ToLower(url)
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, "/?#:"); i >= 0 {
+		host = host[:i]
+	}
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// 图片的md5，没有md5时使用图片ID
+func imageHashes(elements []message.IMessageElement) []string {
+	var hashes []string
+	for _, elem := range elements {
+		if img, ok := elem.(*message.GroupImageElement); ok {
+			if len(img.Md5) > 0 {
+				hashes = append(hashes, fmt.Sprintf("%x", img.Md5))
+			} else if img.ImageId != "" {
+				hashes = append(hashes, img.ImageId)
+			}
+		}
+	}
+	return hashes
+}
+
+// 去掉空白、标点和符号，数字统一成0，刷屏时常见的小改动不影响比较
+func normalizeSpamText(s string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r):
+		case unicode.IsDigit(r):
+			sb.WriteRune('0')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// 相邻两个字的哈希，只有一个字时为这个字的哈希
+func shingles(s string) map[uint64]bool {
+	runes := []rune(s)
+	features := make(map[uint64]bool)
+	for i := 0; i == 0 || i+1 < len(runes); i++ {
+		end := i + 2
+		if end > len(runes) {
+			end = len(runes)
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(string(runes[i:end])))
+		features[h.Sum64()] = true
+	}
+	return features
+}
+
+// 两组特征的Jaccard相似度
+func similarity(a, b map[uint64]bool) float64 {
+	var common int
+	for h := range a {
+		if b[h] {
+			common++
+		}
+	}
+	union := len(a) + len(b) - common
+	if union == 0 {
+		return 0
+	}
+	return float64(common) / float64(union)
+}
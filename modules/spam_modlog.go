@@ -0,0 +1,238 @@
+package modules
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/julienschmidt/httprouter"
+	"github.com/yangrq1018/botqq/model"
+	"github.com/yangrq1018/botqq/storage"
+	"github.com/yangrq1018/botqq/utils"
+)
+
+// 处罚记录: 自动处罚和群管理员的操作都保存到数据库，可以用 /modlog 和 GET /api/modlog 查看，
+// 配置了 audit_group 或 audit_users 时还会转发给管理员，超过 modlog_retention 的记录每天清理一次
+//
+// 处罚记录接口在 modules.spam.addr 上提供，请求头需要带上 Authorization: Bearer <modules.spam.api_token>
+//
+//	GET   /api/modlog?group=&uin=       反刷屏的处罚记录，最新的在前，可以用limit指定条数（默认100）
+
+// 群管理员用命令执行的操作，自动处罚使用 punishment
+const (
+	actionUnmute      = "unmute"
+	actionForgive     = "forgive"
+	actionWhitelist   = "whitelist"
+	actionUnwhitelist = "unwhitelist"
+)
+
+var actionNames = map[string]string{
+	string(punishWarn):   "警告",
+	string(punishRecall): "撤回消息",
+	string(punishMute):   "禁言",
+	string(punishKick):   "踢出",
+	string(punishBan):    "踢出并拉黑",
+	actionUnmute:         "解除禁言",
+	actionForgive:        "原谅",
+	actionWhitelist:      "加入白名单",
+	actionUnwhitelist:    "移出白名单",
+}
+
+// /modlog 显示的条数
+const modLogLines = 10
+
+// 消息的前50个字
+func excerpt(m *message.GroupMessage) string {
+	runes := []rune(m.ToString())
+	if len(runes) > 50 {
+		return string(runes[:50]) + "…"
+	}
+	return string(runes)
+}
+
+// 检测结果作为处罚记录
+func verdictAction(m *message.GroupMessage, verdict spamVerdict) model.ModAction {
+	scores := make(map[string]float64, len(verdict.scores))
+	for _, s := range verdict.scores {
+		scores[s.name] = s.score
+	}
+	return model.ModAction{
+		GroupCode: m.GroupCode,
+		Uin:       m.Sender.Uin,
+		Name:      m.Sender.DisplayName(),
+		Reason:    strings.Join(verdict.reasons(), "、"),
+		Scores:    scores,
+		Score:     verdict.total,
+		Excerpt:   excerpt(m),
+	}
+}
+
+// 群管理员用命令执行的操作
+func commandAction(msg *message.GroupMessage, action string, uin int64, name string) model.ModAction {
+	return model.ModAction{
+		GroupCode:    msg.GroupCode,
+		Uin:          uin,
+		Name:         name,
+		Action:       action,
+		Operator:     msg.Sender.Uin,
+		OperatorName: msg.Sender.DisplayName(),
+	}
+}
+
+// 保存处罚记录并转发给管理员，同时删除群里超过 modlog_retention 的记录
+func (a *antiSpam) logAction(client qqClient, c spamConfig, action model.ModAction) {
+	action.Time = time.Now()
+	if err := store().ModLog().Insert(a.ctx, &action); err != nil {
+		logger.Errorf("failed to save moderation action: %v", err)
+	}
+	if c.auditGroup == 0 && len(c.auditUsers) == 0 {
+		return
+	}
+	group := strconv.FormatInt(action.GroupCode, 10)
+	if g, err := client.GetGroupInfo(action.GroupCode); err == nil {
+		group = fmt.Sprintf("%s(%d)", g.Name, g.Code)
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("[反刷屏] %s\n%s", group, describeAction(&action)))
+	if len(action.Scores) > 0 {
+		sb.WriteString(fmt.Sprintf("\n分数: %.2f", action.Score))
+		for _, d := range spamDetectors {
+			if score, ok := action.Scores[d.name]; ok {
+				sb.WriteString(fmt.Sprintf(" %s=%.2f", d.name, score))
+			}
+		}
+	}
+	if action.Excerpt != "" {
+		sb.WriteString("\n消息: " + action.Excerpt)
+	}
+	text := sb.String()
+	if c.auditGroup != 0 {
+		client.SendGroupMessage(c.auditGroup, utils.NewTextMessage(text))
+	}
+	for _, uin := range c.auditUsers {
+		client.SendPrivateMessage(uin, utils.NewTextMessage(text))
+	}
+}
+
+// 每天清理一次过期的处罚记录
+const modLogPruneCron = "30 4 * * *"
+
+func (a *antiSpam) schedulePrune() {
+	if err := jobs.scheduleCron("spam:prune", "清理过期的处罚记录", 0, modLogPruneCron, a.pruneModLog); err != nil {
+		logger.Error(err)
+	}
+}
+
+// 按各群的 modlog_retention 删除过期的处罚记录
+func (a *antiSpam) pruneModLog() {
+	now := time.Now()
+	for _, groupCode := range a.groups() {
+		c := a.config(groupCode)
+		if c.modLogKeep <= 0 {
+			continue
+		}
+		n, err := store().ModLog().Prune(a.ctx, groupCode, now.Add(-c.modLogKeep))
+		if err != nil {
+			logger.Errorf("failed to prune moderation actions of group %d: %v", groupCode, err)
+			continue
+		}
+		if n > 0 {
+			logger.Infof("pruned %d moderation actions of group %d", n, groupCode)
+		}
+	}
+}
+
+func (a *antiSpam) registerAPI(router *httprouter.Router) {
+	router.GET("/api/modlog", bearerAuth(func() string {
+		a._mu.Lock()
+		defer a._mu.Unlock()
+		return a.apiToken
+	}, apiModLog))
+}
+
+// 01-02 15:04 禁言 成员(QQ号) 2分钟 第3次 原因 by 机器人
+func describeAction(action *model.ModAction) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s %s %s(%d)", action.Time.Format("01-02 15:04"), actionNames[action.Action], action.Name, action.Uin))
+	if action.Duration > 0 {
+		sb.WriteString(" " + formatChineseDuration(time.Duration(action.Duration)*time.Second))
+	}
+	if action.Level > 0 {
+		sb.WriteString(fmt.Sprintf(" 第%d次", action.Level))
+	}
+	if action.Reason != "" {
+		sb.WriteString(" " + action.Reason)
+	}
+	if action.Operator == 0 {
+		sb.WriteString(" by 机器人")
+	} else {
+		sb.WriteString(fmt.Sprintf(" by %s(%d)", action.OperatorName, action.Operator))
+	}
+	return sb.String()
+}
+
+// /modlog [@成员]
+func (a *antiSpam) modlog(client qqClient, msg *message.GroupMessage, args commandArgs) {
+	filter := storage.ModLogFilter{GroupCode: msg.GroupCode, Limit: modLogLines}
+	if args.has("@成员或QQ号") || a.mentioned(msg) != nil {
+		uin, _, ok := a.commandTarget(client, msg, args)
+		if !ok {
+			replyToGroupMessage(client, msg, "请@要查看的成员或者写QQ号")
+			return
+		}
+		filter.Uin = uin
+	}
+	actions, err := store().ModLog().List(a.ctx, filter)
+	if err != nil {
+		logger.Errorf("failed to list moderation actions: %v", err)
+		replyToGroupMessage(client, msg, "查询处罚记录失败")
+		return
+	}
+	if len(actions) == 0 {
+		replyToGroupMessage(client, msg, "没有处罚记录")
+		return
+	}
+	lines := []string{fmt.Sprintf("最近%d条处罚记录:", len(actions))}
+	for i := range actions {
+		lines = append(lines, describeAction(&actions[i]))
+	}
+	replyToGroupMessage(client, msg, strings.Join(lines, "\n"))
+}
+
+// GET /api/modlog?group=&uin=&limit=
+func apiModLog(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	groupCode, ok := queryGroup(writer, req)
+	if !ok {
+		return
+	}
+	filter := storage.ModLogFilter{GroupCode: groupCode, Limit: 100}
+	if uin := req.URL.Query().Get("uin"); uin != "" {
+		n, err := strconv.ParseInt(uin, 10, 64)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, "invalid uin %q", uin)
+			return
+		}
+		filter.Uin = n
+	}
+	if limit := req.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > 1000 {
+			writeError(writer, http.StatusBadRequest, "limit must be in [1, 1000]")
+			return
+		}
+		filter.Limit = n
+	}
+	actions, err := store().ModLog().List(req.Context(), filter)
+	if err != nil {
+		logger.Errorf("failed to list moderation actions: %v", err)
+		writeError(writer, http.StatusInternalServerError, "failed to list moderation actions")
+		return
+	}
+	if actions == nil {
+		actions = []model.ModAction{}
+	}
+	writeJSON(writer, http.StatusOK, map[string]any{"actions": actions})
+}
@@ -0,0 +1,121 @@
+package modules
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+)
+
+// 刷屏的处罚，按违规次数沿 ladder 逐级升级，违规记录保存在数据库中，
+// 每过 decay 没有再刷屏，违规次数减一
+
+type punishment string
+
+const (
+	punishWarn   punishment = "warn"   // 警告
+	punishRecall punishment = "recall" // 撤回最近的消息
+	punishMute   punishment = "mute"   // 禁言，每次禁言的时间乘以 mute_multiplier
+	punishKick   punishment = "kick"   // 踢出群
+	punishBan    punishment = "ban"    // 踢出群并拒绝再次加群
+)
+
+var punishments = map[punishment]bool{
+	punishWarn:   true,
+	punishRecall: true,
+	punishMute:   true,
+	punishKick:   true,
+	punishBan:    true,
+}
+
+// 第level次违规（从0开始）的处罚，超过 ladder 长度时重复最后一项
+func (c spamConfig) punishment(level int) punishment {
+	if level >= len(c.ladder) {
+		return c.ladder[len(c.ladder)-1]
+	}
+	return c.ladder[level]
+}
+
+// 第level次违规的禁言时间，之前每禁言过一次乘以一次 mute_multiplier，不超过 mute_max
+func (c spamConfig) muteFor(level int) time.Duration {
+	d := c.muteDuration
+	for i := 0; i < level && d < c.muteMax; i++ {
+		if c.punishment(i) == punishMute {
+			d *= time.Duration(c.muteMultiplier)
+		}
+	}
+	if d > c.muteMax {
+		d = c.muteMax
+	}
+	return d
+}
+
+// 记录一次违规，返回这是第几次违规（从0开始），衰减和加一在存储中一次完成，
+// 同一个成员同时刷屏也不会少算，写入失败时按第一次处理。
+// 上次处罚后 guard_duration 内（禁言时到禁言结束）的刷屏算作同一次，不再升级，返回false
+func (a *antiSpam) recordOffence(groupCode, uin int64, c spamConfig, now time.Time) (int, bool) {
+	level, counted, err := store().Offences().Record(a.ctx, groupCode, uin, now, c.decay, c.guardDuration)
+	if err != nil {
+		logger.Errorf("failed to record offence: %v", err)
+		return 0, true
+	}
+	return level, counted
+}
+
+func (a *antiSpam) punish(client qqClient, m *message.GroupMessage, c spamConfig, s *spamSample, verdict spamVerdict) {
+	now := time.Now()
+	level, counted := a.recordOffence(m.GroupCode, m.Sender.Uin, c, now)
+	if !counted {
+		logger.Infof("member %s is still in the grace of offence #%d, not punished again", m.Sender.DisplayName(), level+1)
+		return
+	}
+	p := c.punishment(level)
+	action := verdictAction(m, verdict)
+	action.Action, action.Level = string(p), level+1
+	name, reason := action.Name, action.Reason
+	logger.Infof("punish member %s by %s for offence #%d", name, p, level+1)
+	switch p {
+	case punishWarn:
+		replyToGroupMessage(client, m, fmt.Sprintf("%s%s，请注意，再次刷屏将被处罚", name, reason))
+	case punishRecall:
+		var recalled int
+		for _, msg := range s.recent {
+			if msg.Sender.Uin != m.Sender.Uin {
+				continue
+			}
+			if err := client.RecallGroupMessage(m.GroupCode, msg.Id, msg.InternalId); err != nil {
+				logger.Errorf("failed to recall message: %v", err)
+				continue
+			}
+			// 机器人自己撤回时不一定收到撤回事件
+			groupHistory.remove(m.GroupCode, msg.Id)
+			recalled++
+		}
+		client.SendGroupMessage(m.GroupCode, message.NewSendingMessage().Append(message.NewText(
+			fmt.Sprintf("%s%s，已撤回%d条消息，再次刷屏将被%s", name, reason, recalled, actionNames[string(c.punishment(level+1))]))))
+	case punishMute:
+		duration := c.muteFor(level)
+		logger.Infof("try to mute member %s for %s", name, duration)
+		if err := muteGroupMember(client, m, duration); err != nil {
+			logger.Error(err)
+			return
+		}
+		// 禁言结束前发出的消息不再升级处罚
+		if err := store().Offences().Extend(a.ctx, m.GroupCode, m.Sender.Uin, now.Add(duration)); err != nil {
+			logger.Errorf("failed to extend the grace of offence: %v", err)
+		}
+		action.Duration = int64(duration.Seconds())
+		replyToGroupMessage(client, m, fmt.Sprintf("%s%s，已被禁言%s", name, reason, formatChineseDuration(duration)))
+	case punishKick, punishBan:
+		if err := client.KickGroupMember(m.GroupCode, m.Sender.Uin, "刷屏", p == punishBan); err != nil {
+			logger.Errorf("failed to kick member: %v", err)
+			return
+		}
+		text := fmt.Sprintf("%s%s，已被移出本群", name, reason)
+		if p == punishBan {
+			text += "并禁止再次加入"
+		}
+		client.SendGroupMessage(m.GroupCode, message.NewSendingMessage().Append(message.NewText(text)))
+	}
+	a.logAction(client, c, action)
+}
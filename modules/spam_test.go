@@ -0,0 +1,401 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/julienschmidt/httprouter"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/yangrq1018/botqq/model"
+)
+
+func newTestAntiSpam(h *harness) *antiSpam {
+	a := new(antiSpam)
+	a.Init()
+	a.registerMessageListener(a.antiSpam, h.groupMessages)
+	return a
+}
+
+// 结束成员上次处罚的宽限期，下次刷屏时升级处罚
+func endGrace(t *testing.T, uin int64) {
+	o, err := store().Offences().Get(context.Background(), testGroupCode, uin)
+	assert.NoError(t, err)
+	o.Until = time.Time{}
+	assert.NoError(t, store().Offences().Put(context.Background(), *o))
+}
+
+// 第一次刷屏就禁言，检查检测结果时使用
+func muteOnFirstOffence() {
+	policies.policies[testGroupCode] = &model.GroupPolicy{
+		Settings: map[string]map[string]interface{}{"spam": {"ladder": []string{"mute"}}},
+	}
+}
+
+func TestAntiSpam(t *testing.T) {
+	h := newHarness(t)
+	a := newTestAntiSpam(h)
+	c := a.config(testGroupCode)
+
+	// allow条消息以内不检查
+	for i := 0; i < c.allowMsgs; i++ {
+		h.say(sender(testMemberUin), fmt.Sprintf("刷屏%d", i))
+	}
+	assert.Empty(t, h.client.muted)
+
+	// 第一次警告，第二次撤回最近的消息，之后禁言
+	h.say(sender(testMemberUin), "继续刷屏")
+	assert.Empty(t, h.client.muted)
+	assert.Equal(t, fmt.Sprintf("user%d发送消息太过频繁，请注意，再次刷屏将被处罚", testMemberUin), h.client.lastText())
+
+	// 机器人的提醒消息离开检查窗口后再次判定为刷屏
+	endGrace(t, testMemberUin)
+	for i := 0; i < c.allowMsgs; i++ {
+		h.say(sender(testMemberUin), "还在刷屏")
+	}
+	assert.Len(t, h.client.recalled, 2*c.allowMsgs+1, "all recent messages of the member")
+	assert.Equal(t, fmt.Sprintf("user%d发送消息太过频繁，已撤回%d条消息，再次刷屏将被禁言", testMemberUin, len(h.client.recalled)), h.client.lastText())
+	assert.Empty(t, h.client.muted)
+
+	endGrace(t, testMemberUin)
+	for i := 0; i < c.allowMsgs; i++ {
+		h.say(sender(testMemberUin), "还在刷屏")
+	}
+	assert.Equal(t, c.muteDuration, h.client.muted[testMemberUin])
+	assert.Equal(t, fmt.Sprintf("user%d发送消息太过频繁，已被禁言%d分钟", testMemberUin, int(c.muteDuration.Minutes())), h.client.lastText())
+
+	// 禁言时间翻倍
+	endGrace(t, testMemberUin)
+	for i := 0; i < c.allowMsgs; i++ {
+		h.say(sender(testMemberUin), "还在刷屏")
+	}
+	assert.Equal(t, c.muteDuration*time.Duration(c.muteMultiplier), h.client.muted[testMemberUin])
+	o, err := store().Offences().Get(a.ctx, testGroupCode, testMemberUin)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, o.Level)
+}
+
+func TestAntiSpamBurst(t *testing.T) {
+	h := newHarness(t)
+	a := newTestAntiSpam(h)
+	policies.policies[testGroupCode] = &model.GroupPolicy{
+		Settings: map[string]map[string]interface{}{"spam": {"ladder": []string{"recall", "kick"}}},
+	}
+	c := a.config(testGroupCode)
+
+	// 同样的内容连续刷屏，宽限期内只处罚一次
+	for i := 0; i < 3*c.allowMsgs; i++ {
+		h.say(sender(testMemberUin), "加群领福利")
+	}
+	assert.Empty(t, h.client.kicked)
+	var notices []string
+	for _, text := range h.client.groupTexts(testGroupCode) {
+		if strings.Contains(text, "已撤回") {
+			notices = append(notices, text)
+		}
+	}
+	assert.Len(t, notices, 1)
+	// 提示下一级的处罚
+	assert.Contains(t, notices[0], "再次刷屏将被踢出")
+	o, err := store().Offences().Get(a.ctx, testGroupCode, testMemberUin)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, o.Level)
+	assert.True(t, o.Until.After(time.Now()))
+
+	endGrace(t, testMemberUin)
+	for i := 0; i < c.allowMsgs; i++ {
+		h.say(sender(testMemberUin), "加群领福利")
+	}
+	assert.Equal(t, map[int64]bool{testMemberUin: false}, h.client.kicked)
+}
+
+func TestAntiSpamConversation(t *testing.T) {
+	h := newHarness(t)
+	a := newTestAntiSpam(h)
+	c := a.config(testGroupCode)
+
+	// 两个人交替发言，没有人超过阈值
+	for i := 0; i <= c.allowMsgs*2; i++ {
+		h.say(sender(testMemberUin), "你好")
+		h.say(sender(testOwnerUin), "你也好")
+	}
+	assert.Empty(t, h.client.muted)
+}
+
+func TestAntiSpamGroupSettings(t *testing.T) {
+	h := newHarness(t)
+	a := newTestAntiSpam(h)
+	policies.policies[testGroupCode] = &model.GroupPolicy{
+		Settings: map[string]map[string]interface{}{"spam": {"allow": 3, "ladder": []string{"mute"}}},
+	}
+
+	for i := 0; i < 4; i++ {
+		h.say(sender(testMemberUin), "刷屏")
+	}
+	assert.Equal(t, 3, a.config(testGroupCode).allowMsgs)
+	assert.Contains(t, h.client.muted, int64(testMemberUin))
+}
+
+func TestAntiSpamDuplicates(t *testing.T) {
+	h := newHarness(t)
+	newTestAntiSpam(h)
+	muteOnFirstOffence()
+
+	// 复读短消息不算刷屏
+	for i := 0; i < 6; i++ {
+		h.say(sender(testMemberUin), "哈哈哈哈")
+		h.say(sender(testOwnerUin), "哈哈哈哈")
+	}
+	assert.Empty(t, h.client.muted)
+
+	// 两个账号交替发送只改了数字的广告，第四条时处罚
+	for i := 0; i < 2; i++ {
+		h.say(sender(testMemberUin), fmt.Sprintf("免费领取皮肤，名额只剩%d个，先到先得！", 10-i))
+		h.say(sender(50000), fmt.Sprintf("免费领取皮肤, 名额只剩 %d 个 先到先得", 20-i))
+	}
+	assert.NotContains(t, h.client.muted, int64(testMemberUin))
+	assert.Contains(t, h.client.muted, int64(50000))
+	assert.Equal(t, "user50000重复发送相同内容，已被禁言1分钟", h.client.lastText())
+}
+
+func TestAntiSpamContent(t *testing.T) {
+	h := newHarness(t)
+	newTestAntiSpam(h)
+	muteOnFirstOffence()
+
+	// 白名单中的链接和只有链接的消息不处罚
+	h.say(sender(testMemberUin), "看看这个 https://steamcommunity.com/market")
+	h.say(sender(testMemberUin), "看看这个 https://example.top/free")
+	assert.Empty(t, h.client.muted)
+
+	var ats []message.IMessageElement
+	for i := 0; i < 10; i++ {
+		ats = append(ats, message.NewAt(int64(60000+i), "@someone"))
+	}
+	h.say(sender(testMemberUin), "", ats...)
+	assert.Equal(t, "user40000@太多人，已被禁言1分钟", h.client.lastText())
+
+	// 链接加上@几个人
+	h.say(sender(50001), "扫码进群领福利", ats[:5]...)
+	assert.Equal(t, "user50001@太多人、发送广告链接，已被禁言1分钟", h.client.lastText())
+
+	h.say(sender(50000), "", &message.ForwardElement{Content: `<title>群聊的聊天记录</title><summary>查看120条转发消息</summary>`})
+	assert.Equal(t, "user50000发送大量转发消息，已被禁言1分钟", h.client.lastText())
+
+	// 不同的人重复发同一张图片，权重较低，需要配合其他检测器
+	image := &message.GroupImageElement{Md5: []byte{1, 2, 3}}
+	for i := 0; i < 4; i++ {
+		h.say(sender(int64(70000+i)), "", image)
+	}
+	assert.NotContains(t, h.client.muted, int64(70003))
+	h.say(sender(70004), "加微信领取", image)
+	assert.Equal(t, "user70004重复发送相同图片、发送广告链接，已被禁言1分钟", h.client.lastText())
+}
+
+func TestSpamVerdict(t *testing.T) {
+	assert.Equal(t, "免费领取皮肤名额只剩00个先到先得", normalizeSpamText("免费领取皮肤，名额只剩 12 个，先到先得！"))
+	ad := shingles("免费领取皮肤名额只剩00个先到先得")
+	assert.GreaterOrEqual(t, similarity(ad, shingles("免费领取皮肤名额剩00个先到先得")), nearDuplicateSimilarity)
+	assert.Less(t, similarity(ad, shingles("今天晚上有人一起打比赛吗")), nearDuplicateSimilarity)
+	assert.True(t, allowedDomain("https://store.steampowered.com/app/730", []string{"steampowered.com"}))
+	assert.False(t, allowedDomain("https://steampowered.com.example.top", []string{"steampowered.com"}))
+
+	v := spamVerdict{scores: []detectorScore{{reason: "a", score: 0.9}, {reason: "b", score: 0.1}}, total: 1}
+	assert.Equal(t, []string{"a"}, v.reasons())
+}
+
+func TestSpamPunishmentLadder(t *testing.T) {
+	c := spamConfig{
+		ladder:         []punishment{punishWarn, punishMute, punishRecall, punishMute},
+		muteDuration:   10 * time.Minute,
+		muteMultiplier: 3,
+		muteMax:        time.Hour,
+	}
+	assert.Equal(t, punishWarn, c.punishment(0))
+	assert.Equal(t, punishMute, c.punishment(3))
+	assert.Equal(t, punishMute, c.punishment(10))
+	assert.Equal(t, 10*time.Minute, c.muteFor(1))
+	assert.Equal(t, 30*time.Minute, c.muteFor(3))
+	assert.Equal(t, time.Hour, c.muteFor(4), "capped by mute_max")
+	assert.Equal(t, time.Hour, c.muteFor(100))
+
+	now := time.Now()
+	o := &model.Offence{Level: 3, Last: now.Add(-50 * time.Hour)}
+	assert.Equal(t, 1, o.DecayedLevel(24*time.Hour, now))
+	assert.Equal(t, 0, o.DecayedLevel(10*time.Hour, now))
+	assert.Equal(t, 3, o.DecayedLevel(0, now))
+}
+
+func TestAntiSpamKick(t *testing.T) {
+	h := newHarness(t)
+	newTestAntiSpam(h)
+	policies.policies[testGroupCode] = &model.GroupPolicy{
+		Settings: map[string]map[string]interface{}{"spam": {"ladder": []string{"kick", "ban"}}},
+	}
+	var ats []message.IMessageElement
+	for i := 0; i < 10; i++ {
+		ats = append(ats, message.NewAt(int64(60000+i), "@someone"))
+	}
+
+	h.say(sender(testMemberUin), "", ats...)
+	assert.Equal(t, map[int64]bool{testMemberUin: false}, h.client.kicked)
+	assert.Equal(t, "user40000@太多人，已被移出本群", h.client.lastText())
+
+	endGrace(t, testMemberUin)
+	h.say(sender(testMemberUin), "", ats...)
+	assert.Equal(t, map[int64]bool{testMemberUin: true}, h.client.kicked)
+	assert.Equal(t, "user40000@太多人，已被移出本群并禁止再次加入", h.client.lastText())
+
+	// 很久以前的违规已经衰减
+	assert.NoError(t, store().Offences().Put(context.Background(), model.Offence{
+		GroupCode: testGroupCode, Uin: 50000, Level: 1, Last: time.Now().Add(-48 * time.Hour),
+	}))
+	h.say(sender(50000), "", ats...)
+	assert.False(t, h.client.kicked[50000])
+}
+
+func TestAntiSpamImmunity(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	a := newTestAntiSpam(h)
+	muteOnFirstOffence()
+	c := a.config(testGroupCode)
+	var ats []message.IMessageElement
+	for i := 0; i < 10; i++ {
+		ats = append(ats, message.NewAt(int64(60000+i), "@someone"))
+	}
+
+	// 群主和机器人管理员
+	for i := 0; i <= c.allowMsgs; i++ {
+		h.say(sender(testOwnerUin), "通知", ats...)
+	}
+	assert.Empty(t, h.client.muted)
+
+	h.say(sender(testMemberUin), "@bot /whitelist")
+	assert.Equal(t, "/whitelist需要群管理员权限", h.client.lastText())
+	h.say(sender(testOwnerUin), "@bot /whitelist")
+	assert.Equal(t, "反刷屏白名单是空的，群管理员不受限制", h.client.lastText())
+	h.say(sender(testOwnerUin), "@bot /whitelist ", message.NewAt(testMemberUin, "@member"))
+	assert.Equal(t, "已将member加入反刷屏白名单", h.client.lastText())
+	h.say(sender(testMemberUin), "", ats...)
+	assert.Empty(t, h.client.muted)
+
+	// 配置的白名单
+	policies.policies[testGroupCode].Settings["spam"]["whitelist"] = []int64{50000}
+	policies.settings = make(map[string]*viper.Viper)
+	a.configs = make(map[int64]spamConfig)
+	h.say(sender(50000), "", ats...)
+	assert.Empty(t, h.client.muted)
+	h.say(sender(testOwnerUin), "@bot /白名单")
+	assert.Equal(t, "反刷屏白名单（群管理员不受限制）:\n50000(50000)\nmember(40000)", h.client.lastText())
+
+	h.say(sender(testOwnerUin), "@bot /whitelist 40000")
+	assert.Equal(t, "已将member移出反刷屏白名单", h.client.lastText())
+	h.say(sender(testMemberUin), "", ats...)
+	assert.Equal(t, c.muteDuration, h.client.muted[testMemberUin])
+}
+
+func TestAntiSpamForgive(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	a := newTestAntiSpam(h)
+	muteOnFirstOffence()
+	var ats []message.IMessageElement
+	for i := 0; i < 10; i++ {
+		ats = append(ats, message.NewAt(int64(60000+i), "@someone"))
+	}
+
+	h.say(sender(testMemberUin), "", ats...)
+	endGrace(t, testMemberUin)
+	h.say(sender(testMemberUin), "", ats...)
+	assert.Equal(t, 2*time.Minute, h.client.muted[testMemberUin])
+	h.say(sender(testOwnerUin), "@bot /unmute")
+	assert.Equal(t, "请@要解除禁言的成员或者写QQ号", h.client.lastText())
+	h.say(sender(testOwnerUin), "@bot /unmute ", message.NewAt(testMemberUin, "@member"))
+	assert.Equal(t, "已解除member的禁言", h.client.lastText())
+	assert.Empty(t, h.client.muted)
+
+	// 解除禁言不清零违规次数
+	h.say(sender(testMemberUin), "", ats...)
+	assert.Equal(t, 4*time.Minute, h.client.muted[testMemberUin])
+	h.say(sender(testOwnerUin), "@bot /forgive 40000")
+	assert.Equal(t, "已原谅member，解除禁言并清零刷屏的违规次数", h.client.lastText())
+	assert.Empty(t, h.client.muted)
+	o, err := store().Offences().Get(a.ctx, testGroupCode, testMemberUin)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, o.Level)
+	h.say(sender(testMemberUin), "", ats...)
+	assert.Equal(t, time.Minute, h.client.muted[testMemberUin])
+}
+
+func TestAntiSpamModLog(t *testing.T) {
+	h := newHarness(t)
+	newTestHelp(h)
+	a := newTestAntiSpam(h)
+	h.client.addGroup(20001, "管理群")
+	policies.policies[testGroupCode] = &model.GroupPolicy{
+		Settings: map[string]map[string]interface{}{"spam": {
+			"ladder":      []string{"mute"},
+			"audit_group": 20001,
+			"audit_users": []int64{testOwnerUin},
+		}},
+	}
+	var ats []message.IMessageElement
+	for i := 0; i < 10; i++ {
+		ats = append(ats, message.NewAt(int64(60000+i), "@someone"))
+	}
+
+	h.say(sender(testOwnerUin), "@bot /modlog")
+	assert.Equal(t, "没有处罚记录", h.client.lastText())
+	// 超过 modlog_retention 的记录由定时任务删除
+	assert.NoError(t, store().ModLog().Insert(context.Background(), &model.ModAction{
+		GroupCode: testGroupCode, Uin: testMemberUin, Action: "warn", Time: time.Now().Add(-91 * 24 * time.Hour),
+	}))
+	a.pruneModLog()
+
+	h.say(sender(testMemberUin), "大家快来看", ats...)
+	audit := h.client.groupTexts(20001)
+	assert.Len(t, audit, 1)
+	assert.Regexp(t, `^\[反刷屏\] 测试群\(20000\)\n\d\d-\d\d \d\d:\d\d 禁言 user40000\(40000\) 1分钟 第1次 @太多人 by 机器人\n分数: 1\.00 mention=1\.00\n消息: `, audit[0])
+	assert.Equal(t, audit, h.client.privateTexts(testOwnerUin))
+
+	h.say(sender(50000), "", ats...)
+	h.say(sender(testOwnerUin), "@bot /unmute ", message.NewAt(testMemberUin, "@member"))
+	assert.Contains(t, h.client.groupTexts(20001)[2], "解除禁言 member(40000) by user30000(30000)")
+
+	h.say(sender(testOwnerUin), "@bot /modlog")
+	lines := strings.Split(h.client.lastText(), "\n")
+	assert.Equal(t, "最近3条处罚记录:", lines[0])
+	assert.Contains(t, lines[1], "解除禁言 member(40000)")
+	assert.Contains(t, lines[2], "禁言 user50000(50000) 1分钟")
+	h.say(sender(testOwnerUin), "@bot /处罚记录 50000")
+	assert.Equal(t, 2, len(strings.Split(h.client.lastText(), "\n")))
+	h.say(sender(testMemberUin), "@bot /modlog")
+	assert.Equal(t, "/modlog需要群管理员权限", h.client.lastText())
+
+	// 处罚记录接口由反刷屏模块提供，不再挂在抽奖的接口上
+	a.apiToken = "secret"
+	router := httprouter.New()
+	a.registerAPI(router)
+	api := &apiHarness{t: t, router: router}
+	assert.Equal(t, http.StatusNotFound, newAPIHarness(h, newTestRoll(h)).do(http.MethodGet, "/api/modlog", "", nil))
+	var res struct{ Actions []model.ModAction }
+	assert.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/modlog?group=20000&uin=40000", "", &res))
+	assert.Len(t, res.Actions, 2)
+	assert.Equal(t, "unmute", res.Actions[0].Action)
+	mute := res.Actions[1]
+	assert.Equal(t, "mute", mute.Action)
+	assert.Equal(t, int64(60), mute.Duration)
+	assert.Equal(t, map[string]float64{"mention": 1}, mute.Scores)
+	assert.Len(t, []rune(mute.Excerpt), 51)
+	assert.True(t, strings.HasSuffix(mute.Excerpt, "…"))
+	assert.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/modlog?limit=1", "", &res))
+	assert.Len(t, res.Actions, 1)
+	var apiErr struct{ Error string }
+	assert.Equal(t, http.StatusBadRequest, api.do(http.MethodGet, "/api/modlog?limit=0", "", &apiErr))
+}
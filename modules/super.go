@@ -1,13 +1,17 @@
 package modules
 
 import (
+	"context"
+	"sync"
+
 	"github.com/Logiase/MiraiGo-Template/bot"
-	"github.com/Mrs4s/MiraiGo/client"
 	"github.com/Mrs4s/MiraiGo/message"
 )
 
+// super 不能在群里关闭，定时任务的调度器也由它启动，其他模块都关闭时也照常执行
 type super struct {
 	base
+	stopJobs context.CancelFunc
 }
 
 var instanceSuper *super
@@ -19,14 +23,54 @@ func (s *super) MiraiGoModule() bot.ModuleInfo {
 	}
 }
 
-func (s *super) Serve(bot *bot.Bot) {
-	s.monitorGroups.Each(func(code int64) {
-		registerMessageListener(code, s.handle, &bot.GroupMessageEvent, &bot.SelfGroupMessageEvent)
+func (s *super) Init() {
+	s.base.init(s.MiraiGoModule().ID)
+	watchConfigChange()
+	registerCommand(&botCommand{
+		name:    "/module",
+		aliases: []string{"/模块"},
+		args: []argSpec{
+			{name: "操作", kind: argString},
+			{name: "模块", kind: argString, optional: true},
+			{name: "配置项", kind: argString, optional: true},
+			{name: "值", kind: argText, optional: true},
+		},
+		help:   "查看(list)、开启(enable)或关闭(disable)本群的模块，或修改本群的模块配置(set)",
+		detail: "/module set <模块> <配置项> <值> 覆盖本群的配置，数组用逗号分隔，不写值时恢复配置文件的值",
+		perm:   permGroupAdmin,
+		handle: s.module,
+		owner:  s,
+	})
+	registerCommand(&botCommand{
+		name:    "/jobs",
+		aliases: []string{"/定时任务"},
+		help:    "列出本群即将执行的定时任务，如开奖、领奖期限和发言统计",
+		perm:    permMember,
+		handle:  listJobs,
+		owner:   s,
 	})
 }
 
-func (s *super) handle(client *client.QQClient, e *message.GroupMessage) {
-	if s.admin.Has(e.Sender.Uin) {
+func (s *super) Serve(bot *bot.Bot) {
+	s.registerMessageListener(s.handle, groupMessageEvent)
+}
+
+func (s *super) Start(*bot.Bot) {
+	var ctx context.Context
+	ctx, s.stopJobs = context.WithCancel(context.Background())
+	go jobs.run(ctx)
+}
+
+func (s *super) Stop(_ *bot.Bot, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if s.stopJobs != nil {
+		s.stopJobs()
+	}
+	jobs.wait()
+}
+
+func (s *super) handle(client qqClient, e *message.GroupMessage) {
+	if s.isBotAdmin(e.Sender.Uin) {
 		// enable super mode, send log messages to chat
 		logger.Infof("Enter super admin mode, instructed by %s", e.Sender.DisplayName())
 	}
@@ -0,0 +1,757 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fileData is the content of the store file, in mongo extended JSON so the
+// documents have the same fields as in the mongo collections
+type fileData struct {
+	Rolls    []*model.MongoEvent          `bson:"csgo"`
+	Stats    []*model.MessageCount        `bson:"stat"`
+	Accounts []*model.PerfectWorldAccount `bson:"perfectworld"`
+	Policies []*model.GroupPolicy         `bson:"group_policy"`
+	Catalog  []*model.CatalogItem         `bson:"catalog"`
+	Offences []*model.Offence             `bson:"offence"`
+	ModLog   []*model.ModAction           `bson:"modlog"`
+}
+
+// flushDelay is how long changes are kept in memory before the file is
+// rewritten, so a burst of changes such as counting chat messages costs one write
+const flushDelay = 5 * time.Second
+
+// fileStore keeps all data in memory and rewrites the whole file at most once
+// per flushDelay and on Close, it is meant for small deployments and tests
+type fileStore struct {
+	path  string // empty for a memory only store
+	data  fileData
+	mu    sync.RWMutex
+	delay time.Duration
+	timer *time.Timer // pending flush, nil if the file is up to date
+	err   error       // the last failed flush, returned by Close if it fails again
+}
+
+// OpenFile loads the store from the file at path, which is created on the
+// first change if it does not exist
+func OpenFile(path string) (Store, error) {
+	s := &fileStore{path: path, delay: flushDelay}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = bson.UnmarshalExtJSON(content, false, &s.data); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// NewMemory returns a store which is never saved
+func NewMemory() Store {
+	return &fileStore{}
+}
+
+// changed schedules a flush of the changes, hold the lock
+func (s *fileStore) changed() {
+	if s.path == "" || s.timer != nil {
+		return
+	}
+	s.timer = time.AfterFunc(s.delay, s.flush)
+}
+
+func (s *fileStore) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timer = nil
+	s.err = s.save()
+}
+
+// save writes the data to a temporary file and renames it, hold the lock
+func (s *fileStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	content, err := bson.MarshalExtJSONIndent(&s.data, false, false, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err = os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileStore) Rolls() RollRepository {
+	return fileRolls{s}
+}
+
+func (s *fileStore) Stats() StatRepository {
+	return fileStats{s}
+}
+
+func (s *fileStore) Accounts() AccountRepository {
+	return fileAccounts{s}
+}
+
+func (s *fileStore) Policies() PolicyRepository {
+	return filePolicies{s}
+}
+
+func (s *fileStore) Catalog() CatalogRepository {
+	return fileCatalog{s}
+}
+
+func (s *fileStore) Offences() OffenceRepository {
+	return fileOffences{s}
+}
+
+func (s *fileStore) ModLog() ModLogRepository {
+	return fileModLog{s}
+}
+
+// Close writes the pending changes, the store can still be used afterwards
+func (s *fileStore) Close(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer == nil && s.err == nil {
+		return nil
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.err = s.save()
+	return s.err
+}
+
+// clone deep copies a document through bson, so the callers never share the
+// stored values, and the values round trip the same way as in mongo
+func clone[T any](v *T) *T {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	c := new(T)
+	if err = bson.Unmarshal(raw, c); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+type fileRolls struct {
+	*fileStore
+}
+
+func (r fileRolls) Insert(_ context.Context, e *model.MongoEvent) error {
+	if e.ObjectID.ObjectID.IsZero() {
+		e.ObjectID.ObjectID = primitive.NewObjectID()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stored := range r.data.Rolls {
+		if stored.ObjectID == e.ObjectID {
+			return fmt.Errorf("duplicate roll event %s", e.HexID())
+		}
+	}
+	r.data.Rolls = append(r.data.Rolls, clone(e))
+	r.changed()
+	return nil
+}
+
+// find returns the stored event, hold the lock
+func (r fileRolls) find(match func(e *model.MongoEvent) bool) *model.MongoEvent {
+	for _, e := range r.data.Rolls {
+		if match(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (r fileRolls) byID(id primitive.ObjectID) func(e *model.MongoEvent) bool {
+	return func(e *model.MongoEvent) bool {
+		return e.ObjectID.ObjectID == id
+	}
+}
+
+func (r fileRolls) Get(_ context.Context, id primitive.ObjectID) (*model.MongoEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e := r.find(r.byID(id)); e != nil {
+		return clone(e), nil
+	}
+	return nil, ErrNotFound
+}
+
+func (r fileRolls) FindByMessage(_ context.Context, groupCode int64, msgID int32) (*model.MongoEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e := r.find(func(e *model.MongoEvent) bool {
+		if e.GroupCode == groupCode && e.MsgID == msgID {
+			return true
+		}
+		for _, g := range e.Groups {
+			if g.GroupCode == groupCode && g.MsgID == msgID {
+				return true
+			}
+		}
+		return false
+	})
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	return clone(e), nil
+}
+
+func (r fileRolls) List(_ context.Context, filter RollFilter) ([]*model.MongoEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var events []*model.MongoEvent
+	for _, e := range r.data.Rolls {
+		if filter.match(e) {
+			events = append(events, clone(e))
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].DrawTime.Before(events[j].DrawTime)
+	})
+	return events, nil
+}
+
+// update applies fn to the stored event
+func (r fileRolls) update(id primitive.ObjectID, fn func(e *model.MongoEvent)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.find(r.byID(id))
+	if e == nil {
+		return ErrNotFound
+	}
+	fn(e)
+	r.changed()
+	return nil
+}
+
+func (r fileRolls) SetMsgID(_ context.Context, id primitive.ObjectID, msgID int32) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		e.MsgID = msgID
+	})
+}
+
+func (r fileRolls) AddParticipant(_ context.Context, id primitive.ObjectID, p message.Sender, at time.Time) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		e.Participants = append(e.Participants, p)
+		e.Joins = append(e.Joins, model.Join{Uin: p.Uin, Time: at})
+	})
+}
+
+func (r fileRolls) RemoveParticipant(_ context.Context, id primitive.ObjectID, uin int64) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		participants := e.Participants[:0:0]
+		for _, p := range e.Participants {
+			if p.Uin != uin {
+				participants = append(participants, p)
+			}
+		}
+		joins := e.Joins[:0:0]
+		for _, j := range e.Joins {
+			if j.Uin != uin {
+				joins = append(joins, j)
+			}
+		}
+		subscribers := e.Subscribers[:0:0]
+		for _, s := range e.Subscribers {
+			if s != uin {
+				subscribers = append(subscribers, s)
+			}
+		}
+		e.Participants, e.Joins, e.Subscribers = participants, joins, subscribers
+	})
+}
+
+func (r fileRolls) AddWinner(_ context.Context, id primitive.ObjectID, w message.Sender) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		e.Winners = append(e.Winners, w)
+	})
+}
+
+func (r fileRolls) SetStatus(_ context.Context, id primitive.ObjectID, status model.RollStatus) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		e.Status = status
+	})
+}
+
+func (r fileRolls) SwapStatus(_ context.Context, id primitive.ObjectID, from, to model.RollStatus) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.find(r.byID(id))
+	if e == nil {
+		return false, ErrNotFound
+	}
+	if e.State() != from {
+		return false, nil
+	}
+	e.Status = to
+	r.changed()
+	return true, nil
+}
+
+func (r fileRolls) Edit(_ context.Context, id primitive.ObjectID, changes RollChanges) error {
+	return r.update(id, changes.apply)
+}
+
+func (r fileRolls) Subscribe(_ context.Context, id primitive.ObjectID, uin int64, on bool) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		subscribers := e.Subscribers[:0:0]
+		for _, s := range e.Subscribers {
+			if s != uin {
+				subscribers = append(subscribers, s)
+			}
+		}
+		if on {
+			subscribers = append(subscribers, uin)
+		}
+		e.Subscribers = subscribers
+	})
+}
+
+func (r fileRolls) SetGroups(_ context.Context, id primitive.ObjectID, groups []model.RollGroup) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		e.Groups = append([]model.RollGroup(nil), groups...)
+	})
+}
+
+// ClaimNew takes the first new event, events are kept in insertion order
+func (r fileRolls) ClaimNew(_ context.Context) (*model.MongoEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.find(func(e *model.MongoEvent) bool {
+		return e.Status == model.RollNew
+	})
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	e.Status = model.RollAnnouncing
+	r.changed()
+	return clone(e), nil
+}
+
+func (r fileRolls) MarkAnnounced(_ context.Context, id primitive.ObjectID, msgID int32) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		e.MsgID = msgID
+		e.Status = model.RollPending
+	})
+}
+
+func (r fileRolls) ReleaseAnnouncing(_ context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	changed := false
+	for _, e := range r.data.Rolls {
+		if e.Status != model.RollAnnouncing {
+			continue
+		}
+		changed = true
+		if e.MsgID != 0 {
+			e.Status = model.RollPending
+			continue
+		}
+		e.Status = model.RollNew
+		n++
+	}
+	if changed {
+		r.changed()
+	}
+	return n, nil
+}
+
+func (r fileRolls) SetSeed(_ context.Context, id primitive.ObjectID, seed, hash string) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		e.Seed = seed
+		e.SeedHash = hash
+	})
+}
+
+func (r fileRolls) RecordDraw(_ context.Context, id primitive.ObjectID, record model.DrawRecord) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		e.Draw = clone(&record)
+	})
+}
+
+func (r fileRolls) FinishDraw(_ context.Context, id primitive.ObjectID, record *model.DrawRecord, winners []message.Sender) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.find(r.byID(id))
+	if e == nil {
+		return false, ErrNotFound
+	}
+	if e.State() != model.RollPending {
+		return false, nil
+	}
+	e.Status = model.RollDrawn
+	if record != nil {
+		e.Draw = clone(record)
+	}
+	e.Winners = append([]message.Sender(nil), winners...)
+	r.changed()
+	return true, nil
+}
+
+func (r fileRolls) SetClaims(_ context.Context, id primitive.ObjectID, claims []model.Claim) error {
+	return r.update(id, func(e *model.MongoEvent) {
+		e.Claims = append([]model.Claim(nil), claims...)
+	})
+}
+
+type fileStats struct {
+	*fileStore
+}
+
+func (s fileStats) Add(_ context.Context, groupCode, uin int64, userName string, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.data.Stats {
+		if c.GroupCode == groupCode && c.Uin == uin {
+			c.Count += n
+			c.UserName = userName
+			s.changed()
+			return nil
+		}
+	}
+	s.data.Stats = append(s.data.Stats, &model.MessageCount{
+		Uin:       uin,
+		GroupCode: groupCode,
+		UserName:  userName,
+		Count:     n,
+	})
+	s.changed()
+	return nil
+}
+
+func (s fileStats) Get(_ context.Context, groupCode, uin int64) (model.MessageCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.data.Stats {
+		if c.GroupCode == groupCode && c.Uin == uin {
+			return *c, nil
+		}
+	}
+	return model.MessageCount{Uin: uin, GroupCode: groupCode}, nil
+}
+
+func (s fileStats) Top(_ context.Context, groupCode int64, n int) ([]model.MessageCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var results []model.MessageCount
+	for _, c := range s.data.Stats {
+		if c.GroupCode == groupCode {
+			results = append(results, *c)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Count > results[j].Count
+	})
+	if len(results) > n {
+		results = results[:n]
+	}
+	return results, nil
+}
+
+func (s fileStats) Clear(_ context.Context, groupCode int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.data.Stats[:0]
+	for _, c := range s.data.Stats {
+		if c.GroupCode != groupCode {
+			kept = append(kept, c)
+		}
+	}
+	s.data.Stats = kept
+	s.changed()
+	return nil
+}
+
+type fileAccounts struct {
+	*fileStore
+}
+
+func (a fileAccounts) List(_ context.Context) ([]model.PerfectWorldAccount, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var accounts []model.PerfectWorldAccount
+	for _, account := range a.data.Accounts {
+		accounts = append(accounts, *account)
+	}
+	sort.SliceStable(accounts, func(i, j int) bool {
+		return accounts[i].FriendCode < accounts[j].FriendCode
+	})
+	return accounts, nil
+}
+
+type filePolicies struct {
+	*fileStore
+}
+
+func (p filePolicies) List(_ context.Context) ([]model.GroupPolicy, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var policies []model.GroupPolicy
+	for _, policy := range p.data.Policies {
+		policies = append(policies, *clone(policy))
+	}
+	return policies, nil
+}
+
+// get returns the stored policy of the group, created if missing, hold the lock
+func (p filePolicies) get(groupCode int64) *model.GroupPolicy {
+	for _, stored := range p.data.Policies {
+		if stored.GroupCode == groupCode {
+			return stored
+		}
+	}
+	policy := &model.GroupPolicy{GroupCode: groupCode}
+	p.data.Policies = append(p.data.Policies, policy)
+	return policy
+}
+
+func (p filePolicies) SetModule(_ context.Context, groupCode int64, id string, on bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	policy := p.get(groupCode)
+	if policy.Modules == nil {
+		policy.Modules = make(map[string]bool)
+	}
+	policy.Modules[id] = on
+	p.changed()
+	return nil
+}
+
+func (p filePolicies) SetSetting(_ context.Context, groupCode int64, name, key string, value interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	policy := p.get(groupCode)
+	if value == nil {
+		delete(policy.Settings[name], key)
+		p.changed()
+		return nil
+	}
+	if policy.Settings == nil {
+		policy.Settings = make(map[string]map[string]interface{})
+	}
+	if policy.Settings[name] == nil {
+		policy.Settings[name] = make(map[string]interface{})
+	}
+	policy.Settings[name][key] = value
+	p.changed()
+	return nil
+}
+
+type fileCatalog struct {
+	*fileStore
+}
+
+func (c fileCatalog) List(_ context.Context) ([]model.CatalogItem, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var items []model.CatalogItem
+	for _, item := range c.data.Catalog {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, k int) bool { return items[i].ID < items[k].ID })
+	return items, nil
+}
+
+func (c fileCatalog) Get(_ context.Context, id string) (*model.CatalogItem, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, item := range c.data.Catalog {
+		if item.ID == id {
+			copied := *item
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (c fileCatalog) Put(_ context.Context, item model.CatalogItem) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, stored := range c.data.Catalog {
+		if stored.ID == item.ID {
+			c.data.Catalog[i] = &item
+			c.changed()
+			return nil
+		}
+	}
+	c.data.Catalog = append(c.data.Catalog, &item)
+	c.changed()
+	return nil
+}
+
+func (c fileCatalog) Delete(_ context.Context, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, stored := range c.data.Catalog {
+		if stored.ID == id {
+			c.data.Catalog = append(c.data.Catalog[:i], c.data.Catalog[i+1:]...)
+			c.changed()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+type fileOffences struct {
+	*fileStore
+}
+
+func (o fileOffences) List(_ context.Context, groupCode int64) ([]model.Offence, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	var offences []model.Offence
+	for _, offence := range o.data.Offences {
+		if offence.GroupCode == groupCode {
+			offences = append(offences, *offence)
+		}
+	}
+	sort.Slice(offences, func(i, k int) bool { return offences[i].Uin < offences[k].Uin })
+	return offences, nil
+}
+
+func (o fileOffences) Get(_ context.Context, groupCode, uin int64) (*model.Offence, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for _, offence := range o.data.Offences {
+		if offence.GroupCode == groupCode && offence.Uin == uin {
+			copied := *offence
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (o fileOffences) Put(_ context.Context, offence model.Offence) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, stored := range o.data.Offences {
+		if stored.GroupCode == offence.GroupCode && stored.Uin == offence.Uin {
+			o.data.Offences[i] = &offence
+			o.changed()
+			return nil
+		}
+	}
+	o.data.Offences = append(o.data.Offences, &offence)
+	o.changed()
+	return nil
+}
+
+func (o fileOffences) Record(_ context.Context, groupCode, uin int64, now time.Time, decay, grace time.Duration) (int, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	offence := o.find(groupCode, uin)
+	if offence == nil {
+		offence = &model.Offence{GroupCode: groupCode, Uin: uin}
+		o.data.Offences = append(o.data.Offences, offence)
+	}
+	if now.Before(offence.Until) {
+		return offence.Level - 1, false, nil
+	}
+	level := offence.DecayedLevel(decay, now)
+	offence.Level, offence.Last, offence.Until = level+1, now, now.Add(grace)
+	o.changed()
+	return level, true, nil
+}
+
+func (o fileOffences) Extend(_ context.Context, groupCode, uin int64, until time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	offence := o.find(groupCode, uin)
+	if offence == nil {
+		return ErrNotFound
+	}
+	if until.After(offence.Until) {
+		offence.Until = until
+		o.changed()
+	}
+	return nil
+}
+
+// find returns the stored offence of the member, the caller must hold the lock
+func (o fileOffences) find(groupCode, uin int64) *model.Offence {
+	for _, stored := range o.data.Offences {
+		if stored.GroupCode == groupCode && stored.Uin == uin {
+			return stored
+		}
+	}
+	return nil
+}
+
+type fileModLog struct {
+	*fileStore
+}
+
+func (l fileModLog) Insert(_ context.Context, a *model.ModAction) error {
+	if a.ID.IsZero() {
+		a.ID = primitive.NewObjectID()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.data.ModLog = append(l.data.ModLog, clone(a))
+	l.changed()
+	return nil
+}
+
+func (l fileModLog) List(_ context.Context, filter ModLogFilter) ([]model.ModAction, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var actions []model.ModAction
+	for i := len(l.data.ModLog) - 1; i >= 0; i-- {
+		if a := l.data.ModLog[i]; filter.match(a) {
+			actions = append(actions, *clone(a))
+		}
+	}
+	sort.SliceStable(actions, func(i, k int) bool { return actions[i].Time.After(actions[k].Time) })
+	if filter.Limit > 0 && len(actions) > filter.Limit {
+		actions = actions[:filter.Limit]
+	}
+	return actions, nil
+}
+
+func (l fileModLog) Prune(_ context.Context, groupCode int64, before time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.data.ModLog[:0]
+	for _, a := range l.data.ModLog {
+		if a.GroupCode != groupCode || !a.Time.Before(before) {
+			kept = append(kept, a)
+		}
+	}
+	n := len(l.data.ModLog) - len(kept)
+	for i := len(kept); i < len(l.data.ModLog); i++ {
+		l.data.ModLog[i] = nil
+	}
+	l.data.ModLog = kept
+	if n > 0 {
+		l.changed()
+	}
+	return n, nil
+}
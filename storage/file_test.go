@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/yangrq1018/botqq/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFileRolls(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "data", "botqq.json")
+	s, err := OpenFile(path)
+	assert.NoError(t, err)
+
+	drawTime := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	e := &model.MongoEvent{SkinName: "AK-47", GroupCode: 1, MsgID: 10, DrawTime: drawTime}
+	assert.NoError(t, s.Rolls().Insert(ctx, e))
+	assert.False(t, e.ObjectID.ObjectID.IsZero())
+	assert.NoError(t, s.Rolls().Insert(ctx, &model.MongoEvent{GroupCode: 1, MsgID: 11, DrawTime: drawTime.Add(-2 * time.Hour)}))
+	assert.NoError(t, s.Rolls().AddParticipant(ctx, e.ObjectID.ObjectID, message.Sender{Uin: 100, Nickname: "a"}, drawTime))
+	assert.NoError(t, s.Rolls().AddWinner(ctx, e.ObjectID.ObjectID, message.Sender{Uin: 100, Nickname: "a"}))
+
+	// the caller's copy is not changed by the store
+	assert.Empty(t, e.Participants)
+
+	// reopen the file
+	assert.NoError(t, s.Close(ctx))
+	s, err = OpenFile(path)
+	assert.NoError(t, err)
+	got, err := s.Rolls().FindByMessage(ctx, 1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "AK-47", got.SkinName)
+	assert.True(t, drawTime.Equal(got.DrawTime))
+	assert.Len(t, got.Participants, 1)
+	assert.True(t, drawTime.Equal(got.JoinedAt(100)))
+	assert.Len(t, got.Winners, 1)
+
+	assert.NoError(t, s.Rolls().Subscribe(ctx, e.ObjectID.ObjectID, 100, true))
+	assert.NoError(t, s.Rolls().RemoveParticipant(ctx, e.ObjectID.ObjectID, 100))
+	got, _ = s.Rolls().Get(ctx, e.ObjectID.ObjectID)
+	assert.Empty(t, got.Participants)
+	assert.Empty(t, got.Joins)
+	assert.Empty(t, got.Subscribers)
+	assert.Len(t, got.Winners, 1)
+
+	_, err = s.Rolls().FindByMessage(ctx, 1, 12)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, s.Rolls().SetMsgID(ctx, [12]byte{1}, 1))
+
+	pending, err := s.Rolls().List(ctx, RollFilter{GroupCode: 1, DrawAfter: time.Now()})
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, e.ObjectID, pending[0].ObjectID)
+
+	// events saved without status are pending
+	assert.NoError(t, s.Rolls().SetStatus(ctx, e.ObjectID.ObjectID, model.RollCancelled))
+	pending, _ = s.Rolls().List(ctx, RollFilter{Status: []model.RollStatus{model.RollPending}})
+	assert.Len(t, pending, 1)
+	assert.Equal(t, int32(11), pending[0].MsgID)
+
+	count := 3
+	assert.NoError(t, s.Rolls().Edit(ctx, e.ObjectID.ObjectID, RollChanges{WinnerCount: &count}))
+	got, _ = s.Rolls().Get(ctx, e.ObjectID.ObjectID)
+	assert.Equal(t, 3, got.WinnerCount)
+	assert.Equal(t, "AK-47", got.SkinName)
+}
+
+func TestMemoryRollQueue(t *testing.T) {
+	ctx := context.Background()
+	rolls := NewMemory().Rolls()
+	first := &model.MongoEvent{GroupCode: 1, Status: model.RollNew}
+	second := &model.MongoEvent{GroupCode: 1, Status: model.RollNew}
+	assert.NoError(t, rolls.Insert(ctx, first))
+	assert.NoError(t, rolls.Insert(ctx, &model.MongoEvent{GroupCode: 1}))
+	assert.NoError(t, rolls.Insert(ctx, second))
+
+	got, err := rolls.ClaimNew(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, first.ObjectID, got.ObjectID)
+	assert.Equal(t, model.RollAnnouncing, got.Status)
+	got, err = rolls.ClaimNew(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, second.ObjectID, got.ObjectID)
+	_, err = rolls.ClaimNew(ctx)
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, rolls.MarkAnnounced(ctx, first.ObjectID.ObjectID, 42))
+	got, _ = rolls.Get(ctx, first.ObjectID.ObjectID)
+	assert.Equal(t, model.RollPending, got.Status)
+	assert.Equal(t, int32(42), got.MsgID)
+
+	// the second one was claimed but not announced
+	n, err := rolls.ReleaseAnnouncing(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	got, err = rolls.ClaimNew(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, second.ObjectID, got.ObjectID)
+
+	// announced but not marked, it is not announced again
+	assert.NoError(t, rolls.SetMsgID(ctx, second.ObjectID.ObjectID, 43))
+	n, err = rolls.ReleaseAnnouncing(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	got, _ = rolls.Get(ctx, second.ObjectID.ObjectID)
+	assert.Equal(t, model.RollPending, got.Status)
+
+	// only one of the concurrent draw and cancel moves the event out of pending
+	winners := []message.Sender{{Uin: 100}}
+	ok, err := rolls.FinishDraw(ctx, second.ObjectID.ObjectID, &model.DrawRecord{Winners: []int64{100}}, winners)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = rolls.SwapStatus(ctx, second.ObjectID.ObjectID, model.RollPending, model.RollCancelled)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = rolls.FinishDraw(ctx, second.ObjectID.ObjectID, nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	got, _ = rolls.Get(ctx, second.ObjectID.ObjectID)
+	assert.Equal(t, model.RollDrawn, got.Status)
+	assert.Equal(t, winners, got.Winners)
+	assert.Equal(t, []int64{100}, got.Draw.Winners)
+	// saved without status is pending
+	legacy := &model.MongoEvent{GroupCode: 1}
+	assert.NoError(t, rolls.Insert(ctx, legacy))
+	assert.NoError(t, rolls.SetStatus(ctx, legacy.ObjectID.ObjectID, ""))
+	ok, err = rolls.SwapStatus(ctx, legacy.ObjectID.ObjectID, model.RollPending, model.RollCancelled)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestMemoryStats(t *testing.T) {
+	ctx := context.Background()
+	stats := NewMemory().Stats()
+	assert.NoError(t, stats.Add(ctx, 1, 100, "a", 1))
+	assert.NoError(t, stats.Add(ctx, 1, 200, "b", 1))
+	assert.NoError(t, stats.Add(ctx, 1, 200, "b2", 2))
+	assert.NoError(t, stats.Add(ctx, 2, 100, "a", 5))
+
+	top, err := stats.Top(ctx, 1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.MessageCount{{Uin: 200, GroupCode: 1, UserName: "b2", Count: 3}}, top)
+
+	c, err := stats.Get(ctx, 1, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), c.Count)
+	c, _ = stats.Get(ctx, 1, 300)
+	assert.Equal(t, int64(0), c.Count)
+
+	assert.NoError(t, stats.Clear(ctx, 1))
+	top, _ = stats.Top(ctx, 1, 10)
+	assert.Empty(t, top)
+	top, _ = stats.Top(ctx, 2, 10)
+	assert.Len(t, top, 1)
+}
+
+func TestMemoryPolicies(t *testing.T) {
+	ctx := context.Background()
+	policies := NewMemory().Policies()
+	assert.NoError(t, policies.SetModule(ctx, 1, "roll", false))
+	assert.NoError(t, policies.SetModule(ctx, 1, "spam", true))
+	list, err := policies.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.GroupPolicy{{GroupCode: 1, Modules: map[string]bool{"roll": false, "spam": true}}}, list)
+
+	assert.NoError(t, policies.SetSetting(ctx, 1, "spam", "allow", 20))
+	assert.NoError(t, policies.SetSetting(ctx, 1, "spam", "ladder", []string{"warn", "mute"}))
+	assert.NoError(t, policies.SetSetting(ctx, 1, "spam", "allow", nil))
+	list, _ = policies.List(ctx)
+	assert.Equal(t, map[string]map[string]interface{}{"spam": {"ladder": primitive.A{"warn", "mute"}}}, list[0].Settings)
+}
+
+func TestMemoryCatalog(t *testing.T) {
+	ctx := context.Background()
+	catalog := NewMemory().Catalog()
+	assert.NoError(t, catalog.Put(ctx, model.CatalogItem{ID: "m4", Name: "M4A4"}))
+	assert.NoError(t, catalog.Put(ctx, model.CatalogItem{ID: "ak", Name: "AK-47"}))
+	assert.NoError(t, catalog.Put(ctx, model.CatalogItem{ID: "ak", Name: "AK-47 | 红线", Value: 100}))
+
+	items, err := catalog.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.CatalogItem{{ID: "ak", Name: "AK-47 | 红线", Value: 100}, {ID: "m4", Name: "M4A4"}}, items)
+	item, err := catalog.Get(ctx, "ak")
+	assert.NoError(t, err)
+	assert.Equal(t, 100.0, item.Value)
+
+	assert.NoError(t, catalog.Delete(ctx, "ak"))
+	assert.Equal(t, ErrNotFound, catalog.Delete(ctx, "ak"))
+	_, err = catalog.Get(ctx, "ak")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryOffences(t *testing.T) {
+	ctx := context.Background()
+	offences := NewMemory().Offences()
+	_, err := offences.Get(ctx, 1, 2)
+	assert.Equal(t, ErrNotFound, err)
+
+	now := time.Now().Truncate(time.Millisecond)
+	assert.NoError(t, offences.Put(ctx, model.Offence{GroupCode: 1, Uin: 2, Level: 1, Last: now}))
+	assert.NoError(t, offences.Put(ctx, model.Offence{GroupCode: 3, Uin: 2, Level: 5, Last: now}))
+	assert.NoError(t, offences.Put(ctx, model.Offence{GroupCode: 1, Uin: 2, Level: 2, Last: now}))
+	o, err := offences.Get(ctx, 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, o.Level)
+	o, err = offences.Get(ctx, 3, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, o.Level)
+
+	assert.NoError(t, offences.Put(ctx, model.Offence{GroupCode: 1, Uin: 1, Trusted: true}))
+	list, err := offences.List(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Offence{{GroupCode: 1, Uin: 1, Trusted: true}, {GroupCode: 1, Uin: 2, Level: 2, Last: now}}, list)
+
+	// the level decays by one per day before the new offence
+	level, counted, err := offences.Record(ctx, 1, 2, now.Add(25*time.Hour), 24*time.Hour, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, counted)
+	assert.Equal(t, 1, level)
+	o, _ = offences.Get(ctx, 1, 2)
+	assert.Equal(t, 2, o.Level)
+	assert.True(t, now.Add(25*time.Hour).Equal(o.Last))
+	assert.True(t, now.Add(25*time.Hour+time.Minute).Equal(o.Until))
+	level, counted, err = offences.Record(ctx, 1, 5, now, 24*time.Hour, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, counted)
+	assert.Equal(t, 0, level)
+	o, _ = offences.Get(ctx, 1, 5)
+	assert.Equal(t, 1, o.Level)
+
+	// offences within the grace are not counted
+	level, counted, err = offences.Record(ctx, 1, 5, now.Add(30*time.Second), 24*time.Hour, time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, counted)
+	assert.Equal(t, 0, level)
+	assert.NoError(t, offences.Extend(ctx, 1, 5, now.Add(time.Hour)))
+	assert.NoError(t, offences.Extend(ctx, 1, 5, now.Add(time.Second)))
+	_, counted, _ = offences.Record(ctx, 1, 5, now.Add(30*time.Minute), 24*time.Hour, time.Minute)
+	assert.False(t, counted)
+	level, counted, _ = offences.Record(ctx, 1, 5, now.Add(time.Hour), 24*time.Hour, time.Minute)
+	assert.True(t, counted)
+	assert.Equal(t, 1, level)
+	assert.Equal(t, ErrNotFound, offences.Extend(ctx, 1, 6, now))
+
+	// the whitelist flag is kept
+	_, _, err = offences.Record(ctx, 1, 1, now, 0, 0)
+	assert.NoError(t, err)
+	o, _ = offences.Get(ctx, 1, 1)
+	assert.True(t, o.Trusted)
+}
+
+func TestMemoryModLog(t *testing.T) {
+	ctx := context.Background()
+	log := NewMemory().ModLog()
+	now := time.Now().Truncate(time.Millisecond)
+	for i, a := range []model.ModAction{
+		{GroupCode: 1, Uin: 2, Action: "warn", Time: now.Add(-time.Hour)},
+		{GroupCode: 1, Uin: 3, Action: "mute", Scores: map[string]float64{"flood": 1}, Time: now.Add(-time.Minute)},
+		{GroupCode: 4, Uin: 2, Action: "kick", Time: now},
+		{GroupCode: 1, Uin: 2, Action: "mute", Time: now},
+	} {
+		a := a
+		assert.NoError(t, log.Insert(ctx, &a), i)
+		assert.False(t, a.ID.IsZero())
+	}
+
+	actions, err := log.List(ctx, ModLogFilter{GroupCode: 1})
+	assert.NoError(t, err)
+	assert.Len(t, actions, 3)
+	assert.Equal(t, "mute", actions[0].Action)
+	assert.Equal(t, map[string]float64{"flood": 1}, actions[1].Scores)
+	assert.Equal(t, "warn", actions[2].Action)
+
+	actions, err = log.List(ctx, ModLogFilter{Uin: 2, Limit: 2})
+	assert.NoError(t, err)
+	assert.Len(t, actions, 2)
+	assert.Equal(t, []string{"mute", "kick"}, []string{actions[0].Action, actions[1].Action})
+
+	n, err := log.Prune(ctx, 1, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	actions, _ = log.List(ctx, ModLogFilter{})
+	assert.Len(t, actions, 2)
+	assert.Equal(t, []string{"mute", "kick"}, []string{actions[0].Action, actions[1].Action})
+}
+
+func TestFileFlush(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "botqq.json")
+	s, err := OpenFile(path)
+	assert.NoError(t, err)
+	s.(*fileStore).delay = 50 * time.Millisecond
+
+	// changes are written later in one go
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, s.Stats().Add(ctx, 1, 100, "a", 1))
+	}
+	assert.NoFileExists(t, path)
+	assert.Eventually(t, func() bool {
+		reopened, err := OpenFile(path)
+		if err != nil {
+			return false
+		}
+		c, _ := reopened.Stats().Get(ctx, 1, 100)
+		return c.Count == 100
+	}, time.Second, 10*time.Millisecond)
+
+	// Close writes the pending changes at once
+	s.(*fileStore).delay = time.Hour
+	assert.NoError(t, s.Stats().Add(ctx, 1, 100, "a", 1))
+	assert.NoError(t, s.Close(ctx))
+	reopened, err := OpenFile(path)
+	assert.NoError(t, err)
+	c, _ := reopened.Stats().Get(ctx, 1, 100)
+	assert.Equal(t, int64(101), c.Count)
+}
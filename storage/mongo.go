@@ -0,0 +1,578 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore keeps the collections in the database qq
+type mongoStore struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+// NewMongoStore stores the data in the database of a connected mongo client
+// and creates the indexes the repositories rely on
+func NewMongoStore(ctx context.Context, client *mongo.Client, database string) (Store, error) {
+	s := &mongoStore{client: client, db: client.Database(database)}
+	if err := s.createIndexes(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// createIndexes creates the missing indexes, existing ones are kept
+func (s *mongoStore) createIndexes(ctx context.Context) error {
+	indexes := map[string][]mongo.IndexModel{
+		// Offences().Put and Record upsert by member, duplicates would split the level
+		"offence": {{
+			Keys:    bson.D{{Key: "group_code", Value: 1}, {Key: "uin", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		}},
+		// ModLog().List filters by group and member and sorts by time, Prune by group and time
+		"modlog": {{
+			Keys: bson.D{{Key: "group_code", Value: 1}, {Key: "uin", Value: 1}, {Key: "time", Value: -1}},
+		}, {
+			Keys: bson.D{{Key: "group_code", Value: 1}, {Key: "time", Value: -1}},
+		}},
+	}
+	for collection, models := range indexes {
+		if _, err := s.db.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("failed to create indexes of %s: %v", collection, err)
+		}
+	}
+	return nil
+}
+
+func (s *mongoStore) Rolls() RollRepository {
+	return mongoRolls{s.db.Collection("csgo")}
+}
+
+func (s *mongoStore) Stats() StatRepository {
+	return mongoStats{s.db.Collection("stat")}
+}
+
+func (s *mongoStore) Accounts() AccountRepository {
+	return mongoAccounts{s.db.Collection("perfectworld")}
+}
+
+func (s *mongoStore) Policies() PolicyRepository {
+	return mongoPolicies{s.db.Collection("group_policy")}
+}
+
+func (s *mongoStore) Catalog() CatalogRepository {
+	return mongoCatalog{s.db.Collection("catalog")}
+}
+
+func (s *mongoStore) Offences() OffenceRepository {
+	return mongoOffences{s.db.Collection("offence")}
+}
+
+func (s *mongoStore) ModLog() ModLogRepository {
+	return mongoModLog{s.db.Collection("modlog")}
+}
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+type mongoRolls struct {
+	c *mongo.Collection
+}
+
+func (r mongoRolls) Insert(ctx context.Context, e *model.MongoEvent) error {
+	if e.ObjectID.ObjectID.IsZero() {
+		e.ObjectID.ObjectID = primitive.NewObjectID()
+	}
+	_, err := r.c.InsertOne(ctx, e)
+	return err
+}
+
+func (r mongoRolls) findOne(ctx context.Context, filter bson.M) (*model.MongoEvent, error) {
+	var e model.MongoEvent
+	err := r.c.FindOne(ctx, filter).Decode(&e)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (r mongoRolls) Get(ctx context.Context, id primitive.ObjectID) (*model.MongoEvent, error) {
+	return r.findOne(ctx, bson.M{"_id": id})
+}
+
+func (r mongoRolls) FindByMessage(ctx context.Context, groupCode int64, msgID int32) (*model.MongoEvent, error) {
+	return r.findOne(ctx, bson.M{"$or": bson.A{
+		bson.M{"group_code": groupCode, "msg_id": msgID},
+		bson.M{"groups": bson.M{"$elemMatch": bson.M{"group_code": groupCode, "msg_id": msgID}}},
+	}})
+}
+
+func (r mongoRolls) List(ctx context.Context, filter RollFilter) ([]*model.MongoEvent, error) {
+	query := bson.M{}
+	if filter.GroupCode != 0 {
+		query["$or"] = bson.A{
+			bson.M{"group_code": filter.GroupCode},
+			bson.M{"groups.group_code": filter.GroupCode},
+		}
+	}
+	if !filter.DrawAfter.IsZero() {
+		query["draw_time"] = bson.M{"$gt": filter.DrawAfter}
+	}
+	if filter.Claimant != 0 {
+		query["claims"] = bson.M{"$elemMatch": bson.M{"uin": filter.Claimant, "status": model.ClaimWaiting}}
+	}
+	if len(filter.Status) > 0 {
+		query["status"] = statusIn(filter.Status)
+	}
+	cursor, err := r.c.Find(ctx, query, options.Find().SetSort(bson.M{"draw_time": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var events []*model.MongoEvent
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// statusIn matches any of the statuses
+func statusIn(statuses []model.RollStatus) bson.M {
+	var in bson.A
+	for _, status := range statuses {
+		in = append(in, status)
+		if status == model.RollPending {
+			// saved without status, null also matches a missing field
+			in = append(in, "", nil)
+		}
+	}
+	return bson.M{"$in": in}
+}
+
+func (r mongoRolls) update(ctx context.Context, id primitive.ObjectID, update bson.M) error {
+	result, err := r.c.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r mongoRolls) SetMsgID(ctx context.Context, id primitive.ObjectID, msgID int32) error {
+	return r.update(ctx, id, bson.M{"$set": bson.M{"msg_id": msgID}})
+}
+
+func (r mongoRolls) AddParticipant(ctx context.Context, id primitive.ObjectID, p message.Sender, at time.Time) error {
+	return r.update(ctx, id, bson.M{"$push": bson.M{
+		"participants": p,
+		"joins":        model.Join{Uin: p.Uin, Time: at},
+	}})
+}
+
+func (r mongoRolls) RemoveParticipant(ctx context.Context, id primitive.ObjectID, uin int64) error {
+	return r.update(ctx, id, bson.M{"$pull": bson.M{
+		"participants": bson.M{"uin": uin},
+		"joins":        bson.M{"uin": uin},
+		"subscribers":  uin,
+	}})
+}
+
+func (r mongoRolls) AddWinner(ctx context.Context, id primitive.ObjectID, w message.Sender) error {
+	return r.update(ctx, id, bson.M{"$push": bson.M{"winner": w}})
+}
+
+func (r mongoRolls) SetStatus(ctx context.Context, id primitive.ObjectID, status model.RollStatus) error {
+	return r.update(ctx, id, bson.M{"$set": bson.M{"status": status}})
+}
+
+func (r mongoRolls) SwapStatus(ctx context.Context, id primitive.ObjectID, from, to model.RollStatus) (bool, error) {
+	result, err := r.c.UpdateOne(ctx,
+		bson.M{"_id": id, "status": statusIn([]model.RollStatus{from})},
+		bson.M{"$set": bson.M{"status": to}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (r mongoRolls) Edit(ctx context.Context, id primitive.ObjectID, changes RollChanges) error {
+	set := bson.M{}
+	if changes.DrawTime != nil {
+		set["draw_time"] = *changes.DrawTime
+	}
+	if changes.Prizes != nil {
+		set["prizes"] = changes.Prizes
+	}
+	if changes.SkinName != nil {
+		set["skin_name"] = *changes.SkinName
+	}
+	if changes.WinnerCount != nil {
+		set["winner_count"] = *changes.WinnerCount
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	return r.update(ctx, id, bson.M{"$set": set})
+}
+
+func (r mongoRolls) SetSeed(ctx context.Context, id primitive.ObjectID, seed, hash string) error {
+	return r.update(ctx, id, bson.M{"$set": bson.M{"seed": seed, "seed_hash": hash}})
+}
+
+func (r mongoRolls) RecordDraw(ctx context.Context, id primitive.ObjectID, record model.DrawRecord) error {
+	return r.update(ctx, id, bson.M{"$set": bson.M{"draw": record}})
+}
+
+func (r mongoRolls) FinishDraw(ctx context.Context, id primitive.ObjectID, record *model.DrawRecord, winners []message.Sender) (bool, error) {
+	if winners == nil {
+		winners = []message.Sender{}
+	}
+	set := bson.M{"status": model.RollDrawn, "winner": winners}
+	if record != nil {
+		set["draw"] = record
+	}
+	result, err := r.c.UpdateOne(ctx,
+		bson.M{"_id": id, "status": statusIn([]model.RollStatus{model.RollPending})},
+		bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (r mongoRolls) SetClaims(ctx context.Context, id primitive.ObjectID, claims []model.Claim) error {
+	return r.update(ctx, id, bson.M{"$set": bson.M{"claims": claims}})
+}
+
+func (r mongoRolls) SetGroups(ctx context.Context, id primitive.ObjectID, groups []model.RollGroup) error {
+	return r.update(ctx, id, bson.M{"$set": bson.M{"groups": groups}})
+}
+
+func (r mongoRolls) Subscribe(ctx context.Context, id primitive.ObjectID, uin int64, on bool) error {
+	if on {
+		return r.update(ctx, id, bson.M{"$addToSet": bson.M{"subscribers": uin}})
+	}
+	return r.update(ctx, id, bson.M{"$pull": bson.M{"subscribers": uin}})
+}
+
+func (r mongoRolls) ClaimNew(ctx context.Context) (*model.MongoEvent, error) {
+	var e model.MongoEvent
+	err := r.c.FindOneAndUpdate(ctx,
+		bson.M{"status": model.RollNew},
+		bson.M{"$set": bson.M{"status": model.RollAnnouncing}},
+		options.FindOneAndUpdate().SetSort(bson.M{"_id": 1}).SetReturnDocument(options.After),
+	).Decode(&e)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (r mongoRolls) MarkAnnounced(ctx context.Context, id primitive.ObjectID, msgID int32) error {
+	return r.update(ctx, id, bson.M{"$set": bson.M{"msg_id": msgID, "status": model.RollPending}})
+}
+
+func (r mongoRolls) ReleaseAnnouncing(ctx context.Context) (int, error) {
+	_, err := r.c.UpdateMany(ctx,
+		bson.M{"status": model.RollAnnouncing, "msg_id": bson.M{"$nin": bson.A{0, nil}}},
+		bson.M{"$set": bson.M{"status": model.RollPending}})
+	if err != nil {
+		return 0, err
+	}
+	result, err := r.c.UpdateMany(ctx,
+		bson.M{"status": model.RollAnnouncing},
+		bson.M{"$set": bson.M{"status": model.RollNew}})
+	if err != nil {
+		return 0, err
+	}
+	return int(result.ModifiedCount), nil
+}
+
+type mongoStats struct {
+	c *mongo.Collection
+}
+
+func (s mongoStats) Add(ctx context.Context, groupCode, uin int64, userName string, n int64) error {
+	_, err := s.c.UpdateOne(ctx,
+		bson.M{"uin": uin, "group_code": groupCode},
+		bson.M{
+			"$inc": bson.M{"count": n},
+			"$set": bson.M{"user_name": userName},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s mongoStats) Get(ctx context.Context, groupCode, uin int64) (model.MessageCount, error) {
+	c := model.MessageCount{Uin: uin, GroupCode: groupCode}
+	err := s.c.FindOne(ctx, bson.M{"uin": uin, "group_code": groupCode}).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return c, nil
+	}
+	return c, err
+}
+
+func (s mongoStats) Top(ctx context.Context, groupCode int64, n int) ([]model.MessageCount, error) {
+	cursor, err := s.c.Find(ctx,
+		bson.M{"group_code": groupCode},
+		options.Find().SetSort(bson.M{"count": -1}).SetLimit(int64(n)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var results []model.MessageCount
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s mongoStats) Clear(ctx context.Context, groupCode int64) error {
+	_, err := s.c.DeleteMany(ctx, bson.M{"group_code": groupCode})
+	return err
+}
+
+type mongoAccounts struct {
+	c *mongo.Collection
+}
+
+func (a mongoAccounts) List(ctx context.Context) ([]model.PerfectWorldAccount, error) {
+	cursor, err := a.c.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"friendCode": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var accounts []model.PerfectWorldAccount
+	if err = cursor.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+type mongoPolicies struct {
+	c *mongo.Collection
+}
+
+func (p mongoPolicies) List(ctx context.Context) ([]model.GroupPolicy, error) {
+	cursor, err := p.c.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var policies []model.GroupPolicy
+	if err = cursor.All(ctx, &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (p mongoPolicies) SetModule(ctx context.Context, groupCode int64, id string, on bool) error {
+	_, err := p.c.UpdateOne(ctx,
+		bson.M{"group_code": groupCode},
+		bson.M{"$set": bson.M{"modules." + id: on}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (p mongoPolicies) SetSetting(ctx context.Context, groupCode int64, name, key string, value interface{}) error {
+	field := "settings." + name + "." + key
+	update := bson.M{"$set": bson.M{field: value}}
+	if value == nil {
+		update = bson.M{"$unset": bson.M{field: ""}}
+	}
+	_, err := p.c.UpdateOne(ctx, bson.M{"group_code": groupCode}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+type mongoCatalog struct {
+	c *mongo.Collection
+}
+
+func (c mongoCatalog) List(ctx context.Context) ([]model.CatalogItem, error) {
+	cursor, err := c.c.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var items []model.CatalogItem
+	if err = cursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (c mongoCatalog) Get(ctx context.Context, id string) (*model.CatalogItem, error) {
+	var item model.CatalogItem
+	err := c.c.FindOne(ctx, bson.M{"_id": id}).Decode(&item)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (c mongoCatalog) Put(ctx context.Context, item model.CatalogItem) error {
+	_, err := c.c.ReplaceOne(ctx, bson.M{"_id": item.ID}, item, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (c mongoCatalog) Delete(ctx context.Context, id string) error {
+	res, err := c.c.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoOffences struct {
+	c *mongo.Collection
+}
+
+func (o mongoOffences) List(ctx context.Context, groupCode int64) ([]model.Offence, error) {
+	cursor, err := o.c.Find(ctx, bson.M{"group_code": groupCode}, options.Find().SetSort(bson.M{"uin": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var offences []model.Offence
+	if err = cursor.All(ctx, &offences); err != nil {
+		return nil, err
+	}
+	return offences, nil
+}
+
+func (o mongoOffences) Get(ctx context.Context, groupCode, uin int64) (*model.Offence, error) {
+	var offence model.Offence
+	err := o.c.FindOne(ctx, bson.M{"group_code": groupCode, "uin": uin}).Decode(&offence)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &offence, nil
+}
+
+func (o mongoOffences) Put(ctx context.Context, offence model.Offence) error {
+	_, err := o.c.ReplaceOne(ctx,
+		bson.M{"group_code": offence.GroupCode, "uin": offence.Uin},
+		offence,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// Record decays and increments the level in one update pipeline, so concurrent
+// offences of the member are all counted
+func (o mongoOffences) Record(ctx context.Context, groupCode, uin int64, now time.Time, decay, grace time.Duration) (int, bool, error) {
+	// dates are saved in milliseconds, compare the same way as the server
+	now = now.Truncate(time.Millisecond)
+	var level interface{} = bson.M{"$ifNull": bson.A{"$level", 0}}
+	if decay > 0 {
+		// truncated towards zero like DecayedLevel
+		periods := bson.M{"$trunc": bson.M{"$divide": bson.A{
+			bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$last", now}}}},
+			decay.Milliseconds(),
+		}}}
+		level = bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{level, periods}}}}
+	}
+	inGrace := bson.M{"$lt": bson.A{now, bson.M{"$ifNull": bson.A{"$until", time.Time{}}}}}
+	keep := func(field string, value interface{}) bson.M {
+		return bson.M{"$cond": bson.A{inGrace, "$" + field, value}}
+	}
+	var before model.Offence
+	err := o.c.FindOneAndUpdate(ctx,
+		bson.M{"group_code": groupCode, "uin": uin},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"level": keep("level", bson.M{"$add": bson.A{level, 1}}),
+			"last":  keep("last", now),
+			"until": keep("until", now.Add(grace)),
+		}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+	).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return 0, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if now.Before(before.Until) {
+		return before.Level - 1, false, nil
+	}
+	return before.DecayedLevel(decay, now), true, nil
+}
+
+func (o mongoOffences) Extend(ctx context.Context, groupCode, uin int64, until time.Time) error {
+	result, err := o.c.UpdateOne(ctx,
+		bson.M{"group_code": groupCode, "uin": uin},
+		bson.M{"$max": bson.M{"until": until}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoModLog struct {
+	c *mongo.Collection
+}
+
+func (l mongoModLog) Insert(ctx context.Context, a *model.ModAction) error {
+	if a.ID.IsZero() {
+		a.ID = primitive.NewObjectID()
+	}
+	_, err := l.c.InsertOne(ctx, a)
+	return err
+}
+
+func (l mongoModLog) List(ctx context.Context, filter ModLogFilter) ([]model.ModAction, error) {
+	query := bson.M{}
+	if filter.GroupCode != 0 {
+		query["group_code"] = filter.GroupCode
+	}
+	if filter.Uin != 0 {
+		query["uin"] = filter.Uin
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+	cursor, err := l.c.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	var actions []model.ModAction
+	if err = cursor.All(ctx, &actions); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+func (l mongoModLog) Prune(ctx context.Context, groupCode int64, before time.Time) (int, error) {
+	res, err := l.c.DeleteMany(ctx, bson.M{"group_code": groupCode, "time": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
@@ -0,0 +1,206 @@
+// Package storage persists the data of the bot, either in a mongo DB or in an
+// embedded file, so the bot can run on a small box or in tests without a mongo
+// server.
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Mrs4s/MiraiGo/message"
+	"github.com/yangrq1018/botqq/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned when the requested document does not exist
+var ErrNotFound = errors.New("not found")
+
+// Store groups the repositories of all data the bot persists
+type Store interface {
+	Rolls() RollRepository
+	Stats() StatRepository
+	Accounts() AccountRepository
+	Policies() PolicyRepository
+	Catalog() CatalogRepository
+	Offences() OffenceRepository
+	ModLog() ModLogRepository
+	Close(ctx context.Context) error
+}
+
+// RollFilter selects roll events, zero fields match everything
+type RollFilter struct {
+	GroupCode int64              // announced in the group, including the other groups of the roll
+	DrawAfter time.Time          // draw time strictly after
+	Status    []model.RollStatus // any of the status
+	Claimant  int64              // has a waiting claim of the uin
+}
+
+func (f RollFilter) match(e *model.MongoEvent) bool {
+	if f.GroupCode != 0 && !e.InGroup(f.GroupCode) {
+		return false
+	}
+	if f.Claimant != 0 {
+		found := false
+		for _, c := range e.Claims {
+			found = found || c.Uin == f.Claimant && c.Status == model.ClaimWaiting
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Status) > 0 {
+		found := false
+		for _, status := range f.Status {
+			found = found || e.State() == status
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.DrawAfter.IsZero() && !e.DrawTime.After(f.DrawAfter) {
+		return false
+	}
+	return true
+}
+
+// RollRepository stores roll events
+type RollRepository interface {
+	// Insert saves a new event, a new object ID is assigned if it has none
+	Insert(ctx context.Context, e *model.MongoEvent) error
+	Get(ctx context.Context, id primitive.ObjectID) (*model.MongoEvent, error)
+	// FindByMessage finds the event announced by the message msgID in the group,
+	// either its own group or one of the other groups
+	FindByMessage(ctx context.Context, groupCode int64, msgID int32) (*model.MongoEvent, error)
+	List(ctx context.Context, filter RollFilter) ([]*model.MongoEvent, error)
+	SetMsgID(ctx context.Context, id primitive.ObjectID, msgID int32) error
+	// AddParticipant appends the participant and records the join time
+	AddParticipant(ctx context.Context, id primitive.ObjectID, p message.Sender, at time.Time) error
+	// RemoveParticipant removes the participant with its join time and subscription
+	RemoveParticipant(ctx context.Context, id primitive.ObjectID, uin int64) error
+	AddWinner(ctx context.Context, id primitive.ObjectID, w message.Sender) error
+	SetStatus(ctx context.Context, id primitive.ObjectID, status model.RollStatus) error
+	// SwapStatus moves the event from status from to status to and reports
+	// whether it did, false if the event is in another status
+	SwapStatus(ctx context.Context, id primitive.ObjectID, from, to model.RollStatus) (bool, error)
+	// Edit changes the nil fields of changes
+	Edit(ctx context.Context, id primitive.ObjectID, changes RollChanges) error
+	// SetSeed saves the secret seed of the draw and its published hash
+	SetSeed(ctx context.Context, id primitive.ObjectID, seed, hash string) error
+	RecordDraw(ctx context.Context, id primitive.ObjectID, record model.DrawRecord) error
+	// FinishDraw moves a pending event to drawn together with the draw record,
+	// if not nil, and the winners, false if the event is no longer pending
+	FinishDraw(ctx context.Context, id primitive.ObjectID, record *model.DrawRecord, winners []message.Sender) (bool, error)
+	SetClaims(ctx context.Context, id primitive.ObjectID, claims []model.Claim) error
+	// SetGroups saves the other groups the event is announced in
+	SetGroups(ctx context.Context, id primitive.ObjectID, groups []model.RollGroup) error
+	// Subscribe adds or removes the uin from the subscribers of the event
+	Subscribe(ctx context.Context, id primitive.ObjectID, uin int64, on bool) error
+
+	// ClaimNew atomically moves the oldest new event to announcing and returns
+	// it, so that every event is announced once, ErrNotFound if there is none
+	ClaimNew(ctx context.Context) (*model.MongoEvent, error)
+	// MarkAnnounced saves the announcement message and moves the event to pending
+	MarkAnnounced(ctx context.Context, id primitive.ObjectID, msgID int32) error
+	// ReleaseAnnouncing moves the events left in announcing, e.g. by a crash,
+	// back to new and returns the number of them, the ones with a message ID
+	// were announced and are moved to pending instead
+	ReleaseAnnouncing(ctx context.Context) (int, error)
+}
+
+// RollChanges are the fields of a roll event edited after creation, nil fields
+// are not changed
+type RollChanges struct {
+	DrawTime    *time.Time
+	Prizes      []model.Prize // replaces the prizes if not nil
+	SkinName    *string
+	WinnerCount *int
+}
+
+func (c RollChanges) apply(e *model.MongoEvent) {
+	if c.DrawTime != nil {
+		e.DrawTime = *c.DrawTime
+	}
+	if c.Prizes != nil {
+		e.Prizes = append([]model.Prize(nil), c.Prizes...)
+	}
+	if c.SkinName != nil {
+		e.SkinName = *c.SkinName
+	}
+	if c.WinnerCount != nil {
+		e.WinnerCount = *c.WinnerCount
+	}
+}
+
+// StatRepository counts the messages of group members
+type StatRepository interface {
+	// Add adds n to the count of the member and updates the user name
+	Add(ctx context.Context, groupCode, uin int64, userName string, n int64) error
+	// Get returns the count of the member, zero if not counted
+	Get(ctx context.Context, groupCode, uin int64) (model.MessageCount, error)
+	// Top returns at most n members of the group with the highest counts
+	Top(ctx context.Context, groupCode int64, n int) ([]model.MessageCount, error)
+	Clear(ctx context.Context, groupCode int64) error
+}
+
+// AccountRepository stores the shared game accounts
+type AccountRepository interface {
+	// List returns all accounts ordered by friend code
+	List(ctx context.Context) ([]model.PerfectWorldAccount, error)
+}
+
+// PolicyRepository stores the module switches and settings changed by group commands
+type PolicyRepository interface {
+	List(ctx context.Context) ([]model.GroupPolicy, error)
+	SetModule(ctx context.Context, groupCode int64, id string, on bool) error
+	// SetSetting overrides the setting key of the module in the group, a nil
+	// value removes the override
+	SetSetting(ctx context.Context, groupCode int64, name, key string, value interface{}) error
+}
+
+// CatalogRepository stores the prize catalogue
+type CatalogRepository interface {
+	// List returns all items ordered by ID
+	List(ctx context.Context) ([]model.CatalogItem, error)
+	Get(ctx context.Context, id string) (*model.CatalogItem, error)
+	// Put inserts or replaces the item
+	Put(ctx context.Context, item model.CatalogItem) error
+	Delete(ctx context.Context, id string) error
+}
+
+// OffenceRepository stores the anti-spam offences of group members
+type OffenceRepository interface {
+	// List returns the records of the group ordered by uin
+	List(ctx context.Context, groupCode int64) ([]model.Offence, error)
+	Get(ctx context.Context, groupCode, uin int64) (*model.Offence, error)
+	// Put inserts or replaces the offence of the member
+	Put(ctx context.Context, o model.Offence) error
+	// Record atomically decays the level of the member, adds one offence at now
+	// with a grace until now+grace and returns the decayed level before it.
+	// Within the grace of the last offence nothing is changed, the level before
+	// the last offence and false are returned
+	Record(ctx context.Context, groupCode, uin int64, now time.Time, decay, grace time.Duration) (int, bool, error)
+	// Extend extends the grace of the last offence of the member to until
+	Extend(ctx context.Context, groupCode, uin int64, until time.Time) error
+}
+
+// ModLogFilter selects moderation actions, zero fields match everything
+type ModLogFilter struct {
+	GroupCode int64
+	Uin       int64 // the member acted on
+	Limit     int   // at most, 0 for no limit
+}
+
+func (f ModLogFilter) match(a *model.ModAction) bool {
+	return (f.GroupCode == 0 || a.GroupCode == f.GroupCode) && (f.Uin == 0 || a.Uin == f.Uin)
+}
+
+// ModLogRepository stores the moderation actions
+type ModLogRepository interface {
+	// Insert saves the action, a new object ID is assigned if it has none
+	Insert(ctx context.Context, a *model.ModAction) error
+	// List returns the matched actions, the latest first
+	List(ctx context.Context, filter ModLogFilter) ([]model.ModAction, error)
+	// Prune deletes the actions in the group before the time and returns the number of them
+	Prune(ctx context.Context, groupCode int64, before time.Time) (int, error)
+}